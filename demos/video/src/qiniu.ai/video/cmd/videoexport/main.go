@@ -0,0 +1,97 @@
+// videoexport renders the results of a video structuring task as WebVTT, SRT, EDL, CSV or a JSON timeline.
+//
+// The task is read from the video service (-host, -task) or from a task JSON file (-in):
+//
+//	videoexport -host http://127.0.0.1:9100 -task 5b0e... -format vtt -choice "scene|object" -min_confidence 0.8 -o out.vtt
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"qiniu.ai/video/export"
+	"qiniu.ai/video/models"
+	"strings"
+)
+
+func loadTask(host, taskId, in string) (task *models.TaskModel, err error) {
+	var r io.Reader
+	if in != "" {
+		f, errOpen := os.Open(in)
+		if errOpen != nil {
+			return nil, errOpen
+		}
+		defer f.Close()
+		r = f
+	} else {
+		resp, errGet := http.Get(strings.TrimRight(host, "/") + "/v1/video?task_id=" + url.QueryEscape(taskId))
+		if errGet != nil {
+			return nil, errGet
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("get task %s with status %d", taskId, resp.StatusCode)
+		}
+		r = resp.Body
+	}
+
+	task = &models.TaskModel{}
+	err = json.NewDecoder(r).Decode(task)
+	return
+}
+
+func main() {
+	host := flag.String("host", "http://127.0.0.1:9100", "video service address")
+	taskId := flag.String("task", "", "task id")
+	in := flag.String("in", "", "task JSON file, used instead of -host/-task")
+	format := flag.String("format", export.FormatJSON, "vtt, srt, edl, csv or json")
+	choice := flag.String("choice", "", "result types to export separated by |, empty for all")
+	minConfidence := flag.Float64("min_confidence", 0, "minimum confidence of exported intervals")
+	gap := flag.Int("gap", 0, "seconds between intervals of an attribute which are still merged")
+	out := flag.String("o", "", "output file, stdout by default")
+	flag.Parse()
+
+	if *taskId == "" && *in == "" {
+		fmt.Fprintln(os.Stderr, "either -task or -in is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, ok := export.ContentType(*format); !ok {
+		fmt.Fprintf(os.Stderr, "unknown format %s\n", *format)
+		os.Exit(2)
+	}
+
+	task, err := loadTask(*host, *taskId, *in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load task with error:%v\n", err)
+		os.Exit(1)
+	}
+
+	opts := export.Options{
+		MinConfidence: *minConfidence,
+		Gap:           *gap,
+	}
+	if *choice != "" {
+		opts.Choices = strings.Split(*choice, "|")
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, errCreate := os.Create(*out)
+		if errCreate != nil {
+			fmt.Fprintf(os.Stderr, "os.Create(%s) with error:%v\n", *out, errCreate)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err = export.Render(w, *format, task, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "export.Render(%s) with error:%v\n", *format, err)
+		os.Exit(1)
+	}
+}
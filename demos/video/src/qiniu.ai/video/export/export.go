@@ -0,0 +1,222 @@
+// Package export renders the merged results of a video task in formats used by players and editors
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"qiniu.ai/video/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatWebVTT = "vtt"
+	FormatSRT    = "srt"
+	FormatEDL    = "edl"
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown export format")
+
+	contentTypes = map[string]string{
+		FormatWebVTT: "text/vtt; charset=utf-8",
+		FormatSRT:    "application/x-subrip; charset=utf-8",
+		FormatEDL:    "text/plain; charset=utf-8",
+		FormatCSV:    "text/csv; charset=utf-8",
+		FormatJSON:   "application/json; charset=utf-8",
+	}
+)
+
+type Options struct {
+	// Choices keeps only the results of these types, empty keeps all
+	Choices       []string
+	MinConfidence float64
+	// Gap is the number of seconds between two intervals of an attribute which are still merged
+	Gap int
+}
+
+// Cue is one interval of one attribute, Start and End are in seconds and End is exclusive
+type Cue struct {
+	Type       string  `json:"type"`
+	Attribute  string  `json:"attribute"`
+	Start      int     `json:"start"`
+	End        int     `json:"end"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Timeline is the normalised JSON export
+type Timeline struct {
+	TaskId   string                 `json:"task_id"`
+	Name     string                 `json:"name"`
+	Duration int                    `json:"duration"`
+	Tracks   []models.TimelineEntry `json:"tracks"`
+	Cues     []Cue                  `json:"cues"`
+}
+
+func ContentType(format string) (contentType string, ok bool) {
+	contentType, ok = contentTypes[format]
+	return
+}
+
+func filterChoices(bodies []models.ResultBody, choices []string) []models.ResultBody {
+	if len(choices) == 0 {
+		return bodies
+	}
+
+	filtered := []models.ResultBody{}
+	for _, body := range bodies {
+		for _, choice := range choices {
+			if body.Type == choice {
+				filtered = append(filtered, body)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// Cues returns the intervals of the timeline ordered by start time
+func Cues(timeline []models.TimelineEntry) (cues []Cue) {
+	cues = []Cue{}
+	for _, entry := range timeline {
+		for _, interval := range entry.Intervals {
+			cues = append(cues, Cue{
+				Type:       entry.Type,
+				Attribute:  entry.Attribute,
+				Start:      interval.Start,
+				End:        interval.End + 1,
+				Confidence: interval.Confidence,
+			})
+		}
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool {
+		if cues[i].Start != cues[j].Start {
+			return cues[i].Start < cues[j].Start
+		}
+		return cues[i].End < cues[j].End
+	})
+	return
+}
+
+// Render writes the results of the task in the given format
+func Render(w io.Writer, format string, task *models.TaskModel, opts Options) error {
+	timeline := models.BuildTimeline(filterChoices(task.Results, opts.Choices), opts.Gap, opts.MinConfidence)
+	cues := Cues(timeline)
+
+	switch format {
+	case FormatWebVTT:
+		return writeWebVTT(w, cues)
+	case FormatSRT:
+		return writeSRT(w, cues)
+	case FormatEDL:
+		return writeEDL(w, task.Name, cues)
+	case FormatCSV:
+		return writeCSV(w, cues)
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(Timeline{
+			TaskId:   task.Id.Hex(),
+			Name:     task.Name,
+			Duration: task.TotalSecond,
+			Tracks:   timeline,
+			Cues:     cues,
+		})
+	}
+	return ErrUnknownFormat
+}
+
+func cueText(cue Cue) string {
+	return fmt.Sprintf("%s: %s (%.2f)", cue.Type, cue.Attribute, cue.Confidence)
+}
+
+func clock(seconds int, sep string) string {
+	return fmt.Sprintf("%02d:%02d:%02d%s000", seconds/3600, seconds/60%60, seconds%60, sep)
+}
+
+func writeWebVTT(w io.Writer, cues []Cue) (err error) {
+	if _, err = io.WriteString(w, "WEBVTT\n"); err != nil {
+		return
+	}
+	for i, cue := range cues {
+		_, err = fmt.Fprintf(w, "\n%d\n%s --> %s\n%s\n", i+1, clock(cue.Start, "."), clock(cue.End, "."), cueText(cue))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeSRT(w io.Writer, cues []Cue) (err error) {
+	for i, cue := range cues {
+		_, err = fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1, clock(cue.Start, ","), clock(cue.End, ","), cueText(cue))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// timecode formats HH:MM:SS:FF, the frame part is always 00 as results have a resolution of one second
+func timecode(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d:00", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// markerColors are the colors of the EDL markers by the type of the cues
+var markerColors = map[string]string{
+	"scene":  "GREEN",
+	"object": "BLUE",
+	"people": "RED",
+}
+
+func markerColor(cueType string) string {
+	if color, ok := markerColors[cueType]; ok {
+		return color
+	}
+	return "YELLOW"
+}
+
+// writeEDL writes a CMX3600 edit decision list with one marker event per cue,
+// the markers are `* LOC: <timecode> <color> <name>` as read by the editors
+func writeEDL(w io.Writer, title string, cues []Cue) (err error) {
+	if title == "" {
+		title = "video"
+	}
+	_, err = fmt.Fprintf(w, "TITLE: %s\nFCM: NON-DROP FRAME\n", strings.Replace(title, "\n", " ", -1))
+	if err != nil {
+		return
+	}
+	for i, cue := range cues {
+		in, out := timecode(cue.Start), timecode(cue.End)
+		_, err = fmt.Fprintf(w, "\n%03d  AX       V     C        %s %s %s %s\n* LOC: %s %s %s\n",
+			i+1, in, out, in, out, timecode(cue.Start), markerColor(cue.Type), cueText(cue))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeCSV(w io.Writer, cues []Cue) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"index", "type", "attribute", "start", "end", "start_timecode", "end_timecode", "confidence"})
+	for i, cue := range cues {
+		writer.Write([]string{
+			strconv.Itoa(i + 1),
+			cue.Type,
+			cue.Attribute,
+			strconv.Itoa(cue.Start),
+			strconv.Itoa(cue.End),
+			timecode(cue.Start),
+			timecode(cue.End),
+			strconv.FormatFloat(cue.Confidence, 'f', 4, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,98 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+	"qiniu.ai/video/models"
+)
+
+func testTask() *models.TaskModel {
+	return &models.TaskModel{
+		Id:          bson.NewObjectId(),
+		Name:        "demo",
+		TotalSecond: 3700,
+		Results: []models.ResultBody{
+			{
+				Type: "scene",
+				Result: []models.Result{
+					{Attribute: "beach", Confidence: 0.9, Type: "scene", Time: models.TimeDuration{Start: 3661, End: 3662}},
+					{Attribute: "forest", Confidence: 0.3, Type: "scene", Time: models.TimeDuration{Start: 0, End: 5}},
+				},
+			},
+			{
+				Type: "object",
+				Result: []models.Result{
+					{Attribute: "dog", Confidence: 0.85, Type: "object", Time: models.TimeDuration{Start: 10, End: 10}},
+				},
+			},
+		},
+	}
+}
+
+func TestRenderWebVTT(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Render(buf, FormatWebVTT, testTask(), Options{MinConfidence: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	expect := "WEBVTT\n\n1\n00:00:10.000 --> 00:00:11.000\nobject: dog (0.85)\n\n2\n01:01:01.000 --> 01:01:03.000\nscene: beach (0.90)\n"
+	if buf.String() != expect {
+		t.Errorf("unexpected vtt:\n%s", buf.String())
+	}
+}
+
+func TestRenderSRTChoices(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Render(buf, FormatSRT, testTask(), Options{Choices: []string{"scene"}}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "dog") || !strings.HasPrefix(out, "1\n00:00:00,000 --> 00:00:06,000\nscene: forest") {
+		t.Errorf("unexpected srt:\n%s", out)
+	}
+}
+
+func TestRenderEDLAndCSV(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Render(buf, FormatEDL, testTask(), Options{MinConfidence: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"002  AX       V     C        01:01:01:00 01:01:03:00 01:01:01:00 01:01:03:00",
+		"* LOC: 00:00:10:00 BLUE ",
+		"* LOC: 01:01:01:00 GREEN ",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expect %q in edl:\n%s", expected, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := Render(buf, FormatCSV, testTask(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 4 {
+		t.Errorf("unexpected csv:\n%s", buf.String())
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Render(buf, FormatJSON, testTask(), Options{MinConfidence: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	var timeline Timeline
+	if err := json.Unmarshal(buf.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	if timeline.Duration != 3700 || len(timeline.Tracks) != 2 || len(timeline.Cues) != 2 {
+		t.Errorf("unexpected timeline %+v", timeline)
+	}
+
+	if err := Render(buf, "mp4", testTask(), Options{}); err != ErrUnknownFormat {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -11,16 +11,15 @@ import (
 	"github.com/qiniu/api.v7/storage"
 	"github.com/qiniu/log.v1"
 	"gopkg.in/mgo.v2/bson"
-	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"qbox.us/cc/config"
 	"qiniu.ai/lib/model"
 	"qiniu.ai/video/models"
+	"qiniu.ai/video/source"
 	"qiniu.com/auth/qiniumac.v1"
 	"runtime"
 	"sort"
@@ -56,6 +55,7 @@ var (
 	VOICE_API       = "127.0.0.1:8009"
 	chunkSize       = 5
 	logger          *log.Logger
+	resolver        *source.Resolver
 
 	type2APIMap = map[string]string{
 		"scene":  "/v1/eval/scene",
@@ -67,15 +67,16 @@ var (
 
 type (
 	Config struct {
-		Mgo        model.Config `json:"mgo"`
-		BindHost   string       `json:"bind_host"`
-		AK         string       `json:"ak"`
-		SK         string       `json:"sk"`
-		AtlabHost  string       `json:"atlab_host"`
-		Bucket     string       `json:"bucket"`
-		BktHost    string       `json:"bucket_host"`
-		MaxProcs   int          `json:"max_procs"`
-		DebugLevel int          `json:"debug_level"`
+		Mgo        model.Config  `json:"mgo"`
+		BindHost   string        `json:"bind_host"`
+		AK         string        `json:"ak"`
+		SK         string        `json:"sk"`
+		AtlabHost  string        `json:"atlab_host"`
+		Bucket     string        `json:"bucket"`
+		BktHost    string        `json:"bucket_host"`
+		MaxProcs   int           `json:"max_procs"`
+		DebugLevel int           `json:"debug_level"`
+		Source     source.Config `json:"source"`
 	}
 
 	videoRequest struct {
@@ -123,7 +124,7 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 	if _, err = os.Stat(workerPath); os.IsNotExist(err) {
 		if errWorker := os.Mkdir(workerPath, os.ModePerm); errWorker != nil {
 			logger.Errorf("os.Mkdir(%s,os.ModePerm) with error:%v \n", workerPath, errWorker)
-			return
+			return errWorker
 		}
 
 	}
@@ -132,21 +133,41 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 		errMkdir := os.Mkdir(workerImagePath, os.ModePerm)
 		if errMkdir != nil {
 			logger.Errorf("os.Mkdir(%s,os.ModePerm) with error:%v \n", workerImagePath, errMkdir)
-			return
+			return errMkdir
 		}
 	}
 	defer os.RemoveAll(workerPath)
 	log.Printf("the msg in->%s\n", msg.name)
 
-	fileName, err := download(msg.fileURI, workerPath)
+	taskModel, err := models.Task.Find(msg.id.Hex())
 	if err != nil {
+		logger.Errorf("models.Task.Find(%s) with error:%v\n", msg.id.Hex(), err)
+		return
+	}
+
+	if processingTasks.canceled(msg.id.Hex()) {
+		return errTaskCanceled
+	}
+	if err = taskModel.EnterStage(models.TaskStageDownloading); err != nil {
+		return
+	}
+	fileName, err := resolver.Download(msg.fileURI, workerPath)
+	if err != nil {
+		logger.Errorf("resolver.Download(%s,%s) with error:%v\n", msg.fileURI, workerPath, err)
 		time.Sleep(time.Second * 10)
-		fileName, err = download(msg.fileURI, workerPath)
+		fileName, err = resolver.Download(msg.fileURI, workerPath)
 		if err != nil {
 
-			return err
+			return models.NewTaskError(models.TaskStageDownloading, models.TaskErrorDownload, err)
 		}
 	}
+
+	if processingTasks.canceled(msg.id.Hex()) {
+		return errTaskCanceled
+	}
+	if err = taskModel.EnterStage(models.TaskStageExtracting); err != nil {
+		return
+	}
 	//cmd := fmt.Sprintf("ffmpeg -i %s -r 1 -f image2 %s/%s-%%5d.jpg", fileName, workerImagePath, msg.id.Hex())
 
 	runPid := exec.Command("ffmpeg", "-i", fileName, "-r", "1", "-f", "image2", fmt.Sprintf("%s/%s-%%5d.jpg", workerImagePath, msg.id.Hex()))
@@ -156,13 +177,13 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 
 	if errCmd != nil {
 		logger.Errorf("execute ffmpeg false with error:%s\n", errCmd.Error())
-		return err
+		return models.NewTaskError(models.TaskStageExtracting, models.TaskErrorExtract, errCmd)
 	}
 
 	err = runPid.Wait()
 	if err != nil {
 		logger.Errorf("runPid,Wait() with error:%v\n", err)
-		return err
+		return models.NewTaskError(models.TaskStageExtracting, models.TaskErrorExtract, err)
 	}
 	totalSec := time.Now().Sub(start).Seconds()
 
@@ -171,8 +192,8 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 	dir, err := ioutil.ReadDir(workerImagePath)
 
 	if err != nil {
-		logger.Println("ioutil.ReadDir(%s) with error:%s", workerImagePath, err)
-		return err
+		logger.Printf("ioutil.ReadDir(%s) with error:%s\n", workerImagePath, err)
+		return models.NewTaskError(models.TaskStageExtracting, models.TaskErrorExtract, err)
 	}
 	formUploader := storage.NewFormUploader(&cfg)
 
@@ -190,6 +211,9 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 	imgNum := 0
 
 	for imgIndex, img := range dir {
+		if processingTasks.canceled(msg.id.Hex()) {
+			return errTaskCanceled
+		}
 
 		if img.IsDir() || !strings.HasPrefix(img.Name(), msg.id.Hex()) || !strings.HasSuffix(img.Name(), "jpg") {
 			continue
@@ -204,20 +228,47 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 		}
 
 		imgs = append(imgs, img.Name())
+		if err = taskModel.SetProgress(float64(imgIndex+1) / float64(len(dir))); err != nil {
+			logger.Errorf("taskModel(id=%s).SetProgress() with error:%v\n", msg.id.Hex(), err)
+		}
 
 	}
 
 	logger.Println("upload finished")
+	if imgNum > 0 && len(imgs) == 0 {
+		return models.NewTaskError(models.TaskStageExtracting, models.TaskErrorUpload, errors.New("no frame uploaded"))
+	}
 
 	sort.Strings(imgs)
 
+	if err = taskModel.EnterStage(models.TaskStageAnalysing); err != nil {
+		return
+	}
+
 	results := []models.ResultBody{}
 
+	// the progress is shared by the choices which are analysed, the unknown ones are skipped
+	analyses := []string{}
 	for _, choice := range msg.choices {
-		if choice != "scene" && choice != "object" && choice != "people" {
-			continue
+		if choice == "scene" || choice == "object" || choice == "people" {
+			analyses = append(analyses, choice)
+		}
+	}
+
+	for choiceIndex, choice := range analyses {
+		if processingTasks.canceled(msg.id.Hex()) {
+			return errTaskCanceled
 		}
 		result := models.ResultBody{Type: choice, Result: []models.Result{}}
+		// the images which failed are skipped, the task fails only if none of them is analysed
+		succeeded := 0
+		var lastErr error
+		analysed := func(n int) {
+			fraction := (float64(choiceIndex) + float64(n)/float64(len(imgs))) / float64(len(analyses))
+			if errProgress := taskModel.SetProgress(fraction); errProgress != nil {
+				logger.Errorf("taskModel(id=%s).SetProgress() with error:%v\n", msg.id.Hex(), errProgress)
+			}
+		}
 
 		if choice == "people" {
 			for i, img := range imgs {
@@ -225,11 +276,13 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 				jsVal, err := json.Marshal(param)
 				if err != nil {
 					logger.Errorf("json.Marshal(%+v) with error:%+v\n", param, err)
+					lastErr = err
 					continue
 				}
 				req, err := http.NewRequest("POST", type2APIMap[choice], strings.NewReader(string(jsVal)))
 				if err != nil {
 					logger.Errorf("http.NewRequest('POST',%s,%v) with error:%v\n", type2APIMap[choice], jsVal, err)
+					lastErr = err
 					continue
 				}
 				mac1 := &qiniumac.Mac{
@@ -244,6 +297,10 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 				//logger.Info(resp.Status)
 				if err != nil || resp == nil {
 					logger.Errorf("http.Client.Do() with error:%v\n", err)
+					lastErr = err
+					if lastErr == nil {
+						lastErr = errors.New("no response")
+					}
 					continue
 				}
 				defer resp.Body.Close()
@@ -251,6 +308,7 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 					body, _ := ioutil.ReadAll(resp.Body)
 					logger.Errorf("HTTP request:%s status:%d\n", type2APIMap[choice], resp.StatusCode)
 					logger.Error(string(body))
+					lastErr = fmt.Errorf("%s return status %d", type2APIMap[choice], resp.StatusCode)
 					continue
 				}
 
@@ -262,13 +320,20 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 				//logger.Infof("%v", string(body))
 				if err != nil {
 					logger.Errorf("ioutil.ReadAll() with error:%v\n", body)
+					lastErr = err
 					continue
 				}
 
 				err = json.Unmarshal(body, &resps)
 				resultItem := models.Result{}
+				if err != nil {
+					logger.Errorf("json.Unmarshal(%s) with error:%v\n", body, err)
+					lastErr = err
+					continue
+				}
 				apiResults, ok := resps.Result.(map[string]interface{})["detections"].([]interface{})
 				if !ok {
+					lastErr = fmt.Errorf("no detections in the result of %s", img)
 					continue
 				}
 				for _, apiRes := range apiResults {
@@ -287,6 +352,8 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 
 					result.Result = append(result.Result, resultItem)
 				}
+				succeeded++
+				analysed(i + 1)
 			}
 			//result.Result = models.MergeResult(result.Result)
 
@@ -313,12 +380,14 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 
 				if err != nil {
 					logger.Errorf("json.Marshal(%v) with error:%v\n", params, err)
+					lastErr = err
 					continue
 				}
 
 				req, err := http.NewRequest("POST", BATCH_API, strings.NewReader(string(jsonVal)))
 				if err != nil {
 					logger.Errorf("http.NewRequest('POST',%s,%v) with error:%v\n", BATCH_API, jsonVal, err)
+					lastErr = err
 					continue
 				}
 				mac2 := &qiniumac.Mac{
@@ -333,10 +402,15 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 				//logger.Info(resp.Status)
 				if err != nil || resp == nil {
 					logger.Errorf("http.Client.Do() with error:%v\n", err)
+					lastErr = err
+					if lastErr == nil {
+						lastErr = errors.New("no response")
+					}
 					continue
 				}
 				if resp != nil && resp.StatusCode != 200 {
 					logger.Errorf("HTTP status:%d\n", resp.StatusCode)
+					lastErr = fmt.Errorf("%s return status %d", BATCH_API, resp.StatusCode)
 					continue
 				}
 
@@ -349,10 +423,16 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 				//logger.Infof("%v", string(body))
 				if err != nil {
 					logger.Errorf("ioutil.ReadAll() with error:%v\n", body)
+					lastErr = err
 					continue
 				}
 
 				err = json.Unmarshal(body, &resps)
+				if err != nil {
+					logger.Errorf("json.Unmarshal(%s) with error:%v\n", body, err)
+					lastErr = err
+					continue
+				}
 				resultItem := models.Result{}
 
 				for j, resp := range resps {
@@ -381,98 +461,87 @@ func do(msg Job, workerPath string, conf *Config) (err error) {
 						result.Result = append(result.Result, resultItem)
 					}
 				}
+				succeeded += end - i
+				analysed(end)
 			}
 		}
 
-		result.Result = models.MergeResult(result.Result)
-		if choice == "scene" {
-			result.Result = models.FilterScene(result.Result)
+		if succeeded == 0 && lastErr != nil {
+			return models.NewTaskError(models.TaskStageAnalysing, models.TaskErrorAnalyse, lastErr)
 		}
+
 		results = append(results, result)
+		partial := models.ResultBody{Type: choice, Result: models.MergeResult(result.Result)}
+		if err = taskModel.SetPartialResult(partial); err != nil {
+			logger.Errorf("taskModel(id=%s).SetPartialResult(%s) with error:%v\n", msg.id.Hex(), choice, err)
+		}
 
 	}
-	logger.Info("task done,update now")
 
-	taskModel, err := models.Task.Find(msg.id.Hex())
-	if err != nil {
+	if processingTasks.canceled(msg.id.Hex()) {
+		return errTaskCanceled
+	}
+	if err = taskModel.EnterStage(models.TaskStageMerging); err != nil {
 		return
 	}
+
+	for i, result := range results {
+		results[i].Result = models.MergeResult(result.Result)
+		if result.Type == "scene" {
+			results[i].Result = models.FilterScene(results[i].Result)
+		}
+	}
+	logger.Info("task done,update now")
+
 	taskModel.TotalSecond = imgNum
 	taskModel.Results = results
-	taskModel.Status = models.TaskStatusDone
 	err = taskModel.Save()
 	if err != nil {
 		return
 	}
 
+	// the task is indexed again by models.Migrate() if it fails
+	if errIndex := models.ResultIndex.IndexTask(taskModel); errIndex != nil {
+		logger.Errorf("models.ResultIndex.IndexTask(%s) with error:%v\n", msg.id.Hex(), errIndex)
+	}
+
 	if msg.callBack != "" {
-		bs, err := json.Marshal(taskModel)
+		if err = taskModel.EnterStage(models.TaskStageCallback); err != nil {
+			return
+		}
+
+		done := *taskModel
+		done.Status = models.TaskStatusDone
+		done.Progress = 100
+		bs, err := json.Marshal(done)
 		if err != nil {
-			return err
+			return models.NewTaskError(models.TaskStageCallback, models.TaskErrorCallback, err)
 		}
 		body := bytes.NewBuffer([]byte(bs))
 
 		resp, err := http.Post(msg.callBack, "application/json;charset=utf-8", body)
-		if err != nil || resp == nil {
-			return err
+		if err != nil {
+			return models.NewTaskError(models.TaskStageCallback, models.TaskErrorCallback, err)
+		}
+		if resp == nil {
+			return models.NewTaskError(models.TaskStageCallback, models.TaskErrorCallback, errors.New("no response of the call back"))
 		}
+		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
-			err = errors.New("call back return status error")
 			logger.Errorf("call back id(%s) url:%s failed with response status %d\n", msg.id.Hex(), msg.callBack, resp.StatusCode)
-			return err
+			err = fmt.Errorf("call back return status %d", resp.StatusCode)
+			return models.NewTaskError(models.TaskStageCallback, models.TaskErrorCallback, err)
 		}
 	}
 
-	logger.Info("task update success!")
-
-	return
-}
-
-func download(URI string, dstPath string) (string, error) {
-	u, err := url.Parse(URI)
-	if err != nil {
-		logger.Errorf("url.Parse(%s)", URI)
-		return "", errors.New("uri not right")
-	}
-	var req *http.Request
-
-	switch u.Scheme {
-	case "qiniu":
-
-		req, err = http.NewRequest("GET", "http://iovip.qbox.me"+u.Path, nil)
-		req.Host = u.Host
-
-	case "http", "https":
-		req, err = http.NewRequest("GET", URI, nil)
-	}
-
-	if err != nil {
-		return "", err
-	}
-	log.Print("the uri:", URI, dstPath)
-	req.Header.Add("User-Agent", "video struct")
-
-	resp, err := http.DefaultClient.Do(req)
-
-	if err != nil {
-		logger.Errorf("http.DefaultClient.do(%v)", req)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	fileName := path.Join(dstPath, strings.TrimLeft(u.Path, "/"))
-	f, err := os.Create(fileName)
-
+	err = taskModel.Finish()
 	if err != nil {
-		logger.Errorf("os.Create(%s) with error:%v", fileName, err)
-		return "", err
+		return
 	}
-	defer f.Close()
 
-	io.Copy(f, resp.Body)
-
-	return fileName, err
+	logger.Info("task update success!")
 
+	return
 }
 
 func main() {
@@ -489,7 +558,7 @@ func main() {
 
 	mac = qbox.NewMac(AK, SK)
 
-	cfg := storage.Config{}
+	cfg = storage.Config{}
 
 	cfg.Zone = &storage.ZoneHuadong
 
@@ -501,6 +570,21 @@ func main() {
 	logger.SetOutputLevel(conf.DebugLevel)
 
 	models.SetupModel(model.NewModel(&conf.Mgo, *logger))
+	go func() {
+		if err := models.Migrate(); err != nil {
+			logger.Errorf("models.Migrate() with error:%v\n", err)
+		}
+	}()
+
+	if conf.Bucket != "" && conf.BktHost != "" {
+		if conf.Source.Buckets == nil {
+			conf.Source.Buckets = map[string]string{}
+		}
+		if _, ok := conf.Source.Buckets[conf.Bucket]; !ok {
+			conf.Source.Buckets[conf.Bucket] = conf.BktHost
+		}
+	}
+	resolver = source.NewResolver(conf.Source, qbox.NewMac(conf.AK, conf.SK))
 
 	srcPath, err := os.Getwd()
 	if err != nil {
@@ -541,19 +625,23 @@ func main() {
 
 			for msg := range msgsChan {
 
-				if result := do(msg, workerPath, conf); result != nil {
+				if result := do(msg, workerPath, conf); result != nil && result != errTaskCanceled {
 					taskModel, err := models.Task.Find(msg.id.Hex())
 					if err != nil {
 						logger.Errorf("models.Task.Find(%s) with error:%v\n", msg.id.Hex(), err)
 						continue
 					}
-					taskModel.Status = models.TaskStatusError
-					err = taskModel.Save()
+					logger.Errorf("task(id=%s) failed with error:%v\n", msg.id.Hex(), result)
+					err = taskModel.Fail(result)
 					if err != nil {
-						logger.Errorf("taskModel(id=%s).Save() failed with error:%v\n", taskModel.Id.Hex(), err)
+						logger.Errorf("taskModel(id=%s).Fail() failed with error:%v\n", taskModel.Id.Hex(), err)
 					}
 				}
 
+				if processingTasks.done(msg.id.Hex()) {
+					removeTask(msg.id.Hex())
+				}
+
 			}
 		}(workerIPath, &conf)
 	}
@@ -568,6 +656,14 @@ func main() {
 			})
 			return
 		}
+		if err = resolver.Validate(json.Src); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"task_id": "null",
+				"status":  "create failed",
+				"error":   err.Error(),
+			})
+			return
+		}
 		task := models.NewTaskModel(json.Src, json.Name, json.Choice)
 
 		job := Job{
@@ -578,8 +674,6 @@ func main() {
 			id:       task.Id,
 		}
 
-		msgsChan <- job
-
 		err = task.Save()
 		if err != nil {
 			c.JSON(http.StatusNotImplemented, map[string]interface{}{
@@ -589,6 +683,9 @@ func main() {
 			return
 		}
 
+		processingTasks.add(task.Id.Hex())
+		msgsChan <- job
+
 		c.JSON(http.StatusOK, map[string]interface{}{
 			"task_id": task.Id.Hex(),
 			"status":  "created",
@@ -608,6 +705,16 @@ func main() {
 
 	})
 
+	router.GET("/v1/videos", listTasks)
+
+	router.DELETE("/v1/video/:id", deleteTask)
+
+	router.GET("/v1/video/:id/timeline", taskTimeline)
+
+	router.GET("/v1/video/:id/export", exportResults)
+
+	router.GET("/v1/results/search", searchResults)
+
 	router.GET("/v1/video", func(c *gin.Context) {
 		taskId := c.Query("task_id")
 		if taskId == "" {
@@ -0,0 +1,10 @@
+package models
+
+// Migrate fills the fields added to the existing documents, it is safe to run again
+func Migrate() (err error) {
+	if _, err = Task.backfillChoices(); err != nil {
+		return
+	}
+	_, err = ResultIndex.backfill()
+	return
+}
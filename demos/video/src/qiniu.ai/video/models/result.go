@@ -1,5 +1,7 @@
 package models
 
+import "sort"
+
 type ResultBody struct {
 	Result []Result `bson:"result" json:"result"`
 	Type   string   `bson:"type" json:"type"`
@@ -78,9 +80,125 @@ func (tstatus TaskStatus) IsValid() bool {
 	return false
 }
 
+type TaskStage string
+
+const (
+	TaskStageQueued      TaskStage = "QUEUED"
+	TaskStageDownloading TaskStage = "DOWNLOADING"
+	TaskStageExtracting  TaskStage = "EXTRACTING"
+	TaskStageAnalysing   TaskStage = "ANALYSING"
+	TaskStageMerging     TaskStage = "MERGING"
+	TaskStageCallback    TaskStage = "CALLBACK"
+)
+
+// stageProgress is the progress (percent) a task has reached when it enters the stage
+var stageProgress = map[TaskStage]int{
+	TaskStageQueued:      0,
+	TaskStageDownloading: 5,
+	TaskStageExtracting:  15,
+	TaskStageAnalysing:   25,
+	TaskStageMerging:     90,
+	TaskStageCallback:    95,
+}
+
+func (stage TaskStage) IsValid() bool {
+	_, ok := stageProgress[stage]
+	return ok
+}
+
+// Progress returns the overall progress of a task which has finished the given fraction of this stage
+func (stage TaskStage) Progress(fraction float64) int {
+	start, ok := stageProgress[stage]
+	if !ok {
+		return 0
+	}
+	end := 100
+	for _, p := range stageProgress {
+		if p > start && p < end {
+			end = p
+		}
+	}
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return start + int(float64(end-start)*fraction)
+}
+
 func confidenceAbs(a float64, b float64) bool {
 	if a-b >= -0.15 && a-b <= 0.15 && a < 0.6 && b < 0.6 {
 		return true
 	}
 	return false
 }
+
+type Interval struct {
+	Start      int     `bson:"start" json:"start"`
+	End        int     `bson:"end" json:"end"`
+	Confidence float64 `bson:"confidence" json:"confidence"`
+}
+
+type TimelineEntry struct {
+	Attribute string     `json:"attribute"`
+	Type      string     `json:"type"`
+	Intervals []Interval `json:"intervals"`
+}
+
+// BuildTimeline groups the results by type and attribute, drops the ones under minConfidence and
+// merges intervals of the same attribute which are at most gap seconds apart
+func BuildTimeline(bodies []ResultBody, gap int, minConfidence float64) (timeline []TimelineEntry) {
+	timeline = []TimelineEntry{}
+	entries := map[string]int{}
+
+	for _, body := range bodies {
+		for _, res := range body.Result {
+			if res.Confidence < minConfidence {
+				continue
+			}
+			resType := res.Type
+			if resType == "" {
+				resType = body.Type
+			}
+			groupKey := resType + "\x00" + res.Attribute
+			index, ok := entries[groupKey]
+			if !ok {
+				index = len(timeline)
+				entries[groupKey] = index
+				timeline = append(timeline, TimelineEntry{Attribute: res.Attribute, Type: resType})
+			}
+			timeline[index].Intervals = append(timeline[index].Intervals, Interval{
+				Start:      res.Time.Start,
+				End:        res.Time.End,
+				Confidence: res.Confidence,
+			})
+		}
+	}
+
+	for i := range timeline {
+		timeline[i].Intervals = mergeIntervals(timeline[i].Intervals, gap)
+	}
+	return
+}
+
+func mergeIntervals(intervals []Interval, gap int) (merged []Interval) {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start < intervals[j].Start
+	})
+
+	for _, interval := range intervals {
+		n := len(merged)
+		if n == 0 || interval.Start > merged[n-1].End+1+gap {
+			merged = append(merged, interval)
+			continue
+		}
+		last := &merged[n-1]
+		lastLen := float64(last.End - last.Start + 1)
+		curLen := float64(interval.End - interval.Start + 1)
+		last.Confidence = (last.Confidence*lastLen + interval.Confidence*curLen) / (lastLen + curLen)
+		if interval.End > last.End {
+			last.End = interval.End
+		}
+	}
+	return
+}
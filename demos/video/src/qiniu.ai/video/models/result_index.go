@@ -0,0 +1,191 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+)
+
+var (
+	ResultIndex *_ResultIndex
+
+	resultIndexCollection = "result_index"
+	resultIndexIndexes    = []mgo.Index{
+		{
+			Key: []string{"attribute", "type", "confidence"},
+		},
+		{
+			Key: []string{"task_id"},
+		},
+	}
+)
+
+const (
+	ResultSearchDefaultLimit = 100
+	ResultSearchMaxLimit     = 1000
+)
+
+// ResultIndexModel is one merged interval of a task result, indexed for searching across tasks
+type ResultIndexModel struct {
+	Id         bson.ObjectId `bson:"_id" json:"id"`
+	TaskId     bson.ObjectId `bson:"task_id" json:"task_id"`
+	Type       string        `bson:"type" json:"type"`
+	Attribute  string        `bson:"attribute" json:"attribute"`
+	Confidence float64       `bson:"confidence" json:"confidence"`
+	Start      int           `bson:"start" json:"start"`
+	End        int           `bson:"end" json:"end"`
+}
+
+type ResultSearch struct {
+	Attribute string
+	// Prefix matches the attributes starting with Attribute instead of the same one
+	Prefix        bool
+	Type          string
+	MinConfidence float64
+	// Marker is the id of the last interval of the previous page
+	Marker string
+	Limit  int
+}
+
+// Replace drops the indexed intervals of the task and indexes the given results instead
+func (_ *_ResultIndex) Replace(taskId bson.ObjectId, bodies []ResultBody) (err error) {
+	docs := []interface{}{}
+	for _, body := range bodies {
+		for _, res := range body.Result {
+			resType := res.Type
+			if resType == "" {
+				resType = body.Type
+			}
+			docs = append(docs, &ResultIndexModel{
+				Id:         bson.NewObjectId(),
+				TaskId:     taskId,
+				Type:       resType,
+				Attribute:  res.Attribute,
+				Confidence: res.Confidence,
+				Start:      res.Time.Start,
+				End:        res.Time.End,
+			})
+		}
+	}
+
+	ResultIndex.Query(func(c *mgo.Collection) {
+		if _, err = c.RemoveAll(bson.M{"task_id": taskId}); err != nil {
+			return
+		}
+		if len(docs) > 0 {
+			err = c.Insert(docs...)
+		}
+	})
+	return
+}
+
+// IndexTask replaces the indexed intervals of the task by its results and marks the task indexed
+func (_ *_ResultIndex) IndexTask(task *TaskModel) (err error) {
+	if err = ResultIndex.Replace(task.Id, task.Results); err != nil {
+		return
+	}
+	if err = task.update(bson.M{"result_indexed": true}); err == nil {
+		task.ResultIndexed = true
+	}
+	return
+}
+
+// backfill indexes the done tasks which are not indexed, as they were finished before the result index
+// or their indexing failed
+func (_ *_ResultIndex) backfill() (n int, err error) {
+	ids := []bson.ObjectId{}
+	Task.Query(func(c *mgo.Collection) {
+		task := TaskModel{}
+		iter := c.Find(bson.M{"status": TaskStatusDone, "result_indexed": bson.M{"$ne": true}}).Select(bson.M{"_id": 1}).Iter()
+		for iter.Next(&task) {
+			ids = append(ids, task.Id)
+		}
+		err = iter.Close()
+	})
+	if err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		task, errFind := Task.Find(id.Hex())
+		if errFind == mgo.ErrNotFound {
+			// removed after listed
+			continue
+		}
+		if errFind != nil {
+			return n, errFind
+		}
+		if err = ResultIndex.IndexTask(task); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+func (_ *_ResultIndex) RemoveByTask(taskId bson.ObjectId) (err error) {
+	ResultIndex.Query(func(c *mgo.Collection) {
+		_, err = c.RemoveAll(bson.M{"task_id": taskId})
+	})
+	return
+}
+
+func (search *ResultSearch) query() (query bson.M, err error) {
+	query = bson.M{
+		"attribute": search.Attribute,
+	}
+	// the anchored regex is answered by the index of attribute
+	if search.Prefix {
+		query["attribute"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(search.Attribute)}
+	}
+	if search.Type != "" {
+		query["type"] = search.Type
+	}
+	if search.MinConfidence > 0 {
+		query["confidence"] = bson.M{"$gte": search.MinConfidence}
+	}
+	if search.Marker != "" {
+		if !bson.IsObjectIdHex(search.Marker) {
+			err = ErrInvalidId
+			return
+		}
+		query["_id"] = bson.M{"$gt": bson.ObjectIdHex(search.Marker)}
+	}
+	return
+}
+
+// Search returns one page of intervals matching the search and the marker of the next page
+func (_ *_ResultIndex) Search(search ResultSearch) (results []*ResultIndexModel, marker string, err error) {
+	query, err := search.query()
+	if err != nil {
+		return
+	}
+
+	limit := search.Limit
+	if limit <= 0 {
+		limit = ResultSearchDefaultLimit
+	} else if limit > ResultSearchMaxLimit {
+		limit = ResultSearchMaxLimit
+	}
+
+	results = []*ResultIndexModel{}
+	ResultIndex.Query(func(c *mgo.Collection) {
+		err = c.Find(query).Sort("_id").Limit(limit + 1).All(&results)
+	})
+	if err != nil {
+		return
+	}
+
+	if len(results) > limit {
+		results = results[:limit]
+		marker = results[limit-1].Id.Hex()
+	}
+	return
+}
+
+type _ResultIndex struct {
+}
+
+func (_ *_ResultIndex) Query(query func(c *mgo.Collection)) {
+	mongo.Query(resultIndexCollection, resultIndexIndexes, query)
+}
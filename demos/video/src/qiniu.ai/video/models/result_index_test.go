@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestResultSearchQuery(t *testing.T) {
+	search := ResultSearch{Attribute: "猫", Type: "object"}
+	query, err := search.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query["attribute"] != "猫" || query["type"] != "object" {
+		t.Errorf("exact query %v", query)
+	}
+
+	search = ResultSearch{Attribute: "cat.", Prefix: true, MinConfidence: 0.5}
+	if query, err = search.query(); err != nil {
+		t.Fatal(err)
+	}
+	if attribute := query["attribute"].(bson.RegEx); attribute.Pattern != `^cat\.` {
+		t.Errorf("prefix query %v", attribute)
+	}
+	if _, ok := query["confidence"].(bson.M)["$gte"]; !ok {
+		t.Errorf("confidence query %v", query["confidence"])
+	}
+
+	search = ResultSearch{Attribute: "cat", Marker: "invalid"}
+	if _, err = search.query(); err != ErrInvalidId {
+		t.Errorf("invalid marker error %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+import "testing"
+
+func TestBuildTimeline(t *testing.T) {
+	bodies := []ResultBody{
+		{
+			Type: "scene",
+			Result: []Result{
+				{Attribute: "beach", Confidence: 0.9, Time: TimeDuration{Start: 0, End: 3}},
+				{Attribute: "beach", Confidence: 0.7, Time: TimeDuration{Start: 6, End: 7}},
+				{Attribute: "beach", Confidence: 0.2, Time: TimeDuration{Start: 10, End: 12}},
+				{Attribute: "forest", Confidence: 0.8, Time: TimeDuration{Start: 4, End: 5}},
+			},
+		},
+	}
+
+	timeline := BuildTimeline(bodies, 0, 0.5)
+	if len(timeline) != 2 {
+		t.Fatalf("expect 2 attributes, got %+v", timeline)
+	}
+	if beach := timeline[0]; beach.Attribute != "beach" || beach.Type != "scene" || len(beach.Intervals) != 2 {
+		t.Errorf("unexpected beach timeline %+v", beach)
+	}
+
+	timeline = BuildTimeline(bodies, 2, 0.5)
+	beach := timeline[0].Intervals
+	if len(beach) != 1 || beach[0].Start != 0 || beach[0].End != 7 {
+		t.Fatalf("unexpected merged beach intervals %+v", beach)
+	}
+	if c := beach[0].Confidence; c < 0.83 || c > 0.84 {
+		t.Errorf("unexpected merged confidence %f", c)
+	}
+}
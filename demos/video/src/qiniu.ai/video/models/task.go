@@ -1,8 +1,13 @@
 package models
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -15,30 +20,105 @@ var (
 			Key:    []string{"_id"},
 			Unique: true,
 		},
+		{
+			Key: []string{"status", "_id"},
+		},
+		{
+			Key: []string{"name", "_id"},
+		},
+		{
+			Key: []string{"choices", "_id"},
+		},
+		{
+			Key: []string{"src"},
+		},
+		{
+			Key: []string{"create_time"},
+		},
+		{
+			Key: []string{"done_time", "_id"},
+		},
 	}
 )
 
+const (
+	TaskListDefaultLimit = 20
+	TaskListMaxLimit     = 1000
+)
+
+// the fields to sort the tasks by, the ids are created together with create_time so they are in the same order
+const (
+	TaskSortId       = "_id"
+	TaskSortName     = "name"
+	TaskSortDoneTime = "done_time"
+)
+
+const (
+	TaskErrorDownload = "DOWNLOAD_FAILED"
+	TaskErrorExtract  = "EXTRACT_FAILED"
+	TaskErrorUpload   = "UPLOAD_FAILED"
+	TaskErrorAnalyse  = "ANALYSE_FAILED"
+	TaskErrorCallback = "CALLBACK_FAILED"
+	TaskErrorInternal = "INTERNAL_ERROR"
+)
+
+// TaskError records the stage in which a task failed and why
+type TaskError struct {
+	Stage   TaskStage `bson:"stage" json:"stage"`
+	Code    string    `bson:"code" json:"code"`
+	Message string    `bson:"message" json:"message"`
+}
+
+func NewTaskError(stage TaskStage, code string, err error) *TaskError {
+	return &TaskError{
+		Stage:   stage,
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s in stage %s: %s", e.Code, e.Stage, e.Message)
+}
+
+type StageTime struct {
+	Stage     TaskStage `bson:"stage" json:"stage"`
+	StartTime time.Time `bson:"start_time" json:"start_time"`
+	EndTime   time.Time `bson:"end_time,omitempty" json:"end_time,omitempty"`
+}
+
 type TaskModel struct {
-	Id          bson.ObjectId `bson:"_id" json:"id"`
-	Src         string        `bson:"src" json:"src"`
-	Name        string        `bson:"name" json:"name"`
-	CreateTime  time.Time     `bson:"create_time" json:"create_time"`
-	DoneTime    time.Time     `bson:"done_time" json:"done_time"`
-	Choice      string        `bson:"choice" json:"choice"`
-	TotalSecond int           `bson:"total_second" json:"total_second"`
-	Results     []ResultBody  `bson:"results" json:"results"`
-	Status      TaskStatus    `bson:"status" json:"status"`
-	isNewRecord bool          `bson:"-" json:"-"`
+	Id            bson.ObjectId `bson:"_id" json:"id"`
+	Src           string        `bson:"src" json:"src"`
+	Name          string        `bson:"name" json:"name"`
+	CreateTime    time.Time     `bson:"create_time" json:"create_time"`
+	DoneTime      time.Time     `bson:"done_time" json:"done_time"`
+	Choice        string        `bson:"choice" json:"choice"`
+	Choices       []string      `bson:"choices" json:"-"`
+	TotalSecond   int           `bson:"total_second" json:"total_second"`
+	Results       []ResultBody  `bson:"results" json:"results"`
+	Status        TaskStatus    `bson:"status" json:"status"`
+	Stage         TaskStage     `bson:"stage" json:"stage"`
+	Progress      int           `bson:"progress" json:"progress"`
+	StageTimes    []StageTime   `bson:"stage_times" json:"stage_times"`
+	Error         *TaskError    `bson:"error,omitempty" json:"error,omitempty"`
+	ResultIndexed bool          `bson:"result_indexed" json:"-"`
+	isNewRecord   bool          `bson:"-" json:"-"`
 }
 
 func NewTaskModel(src string, name string, choice string) *TaskModel {
+	now := time.Now().UTC()
 	return &TaskModel{
 		Src:         src,
 		Id:          bson.NewObjectId(),
 		Name:        name,
 		Choice:      choice,
-		CreateTime:  time.Now().UTC(),
+		Choices:     strings.Split(choice, "|"),
+		CreateTime:  now,
 		Status:      TaskstatusPorcessing,
+		Stage:       TaskStageQueued,
+		Progress:    TaskStageQueued.Progress(0),
+		StageTimes:  []StageTime{{Stage: TaskStageQueued, StartTime: now}},
 		isNewRecord: true,
 	}
 }
@@ -66,6 +146,10 @@ func (task *TaskModel) Save() (err error) {
 				"total_second": task.TotalSecond,
 				"results":      task.Results,
 				"status":       task.Status,
+				"stage":        task.Stage,
+				"progress":     task.Progress,
+				"stage_times":  task.StageTimes,
+				"error":        task.Error,
 			}
 
 			err = c.UpdateId(task.Id, bson.M{
@@ -76,6 +160,115 @@ func (task *TaskModel) Save() (err error) {
 	return
 }
 
+// update persists the given fields of a task which has already been saved
+func (task *TaskModel) update(migrations bson.M) (err error) {
+	if task.IsNewRecord() {
+		err = ErrNotPersisted
+		return
+	}
+
+	Task.Query(func(c *mgo.Collection) {
+		err = c.UpdateId(task.Id, bson.M{
+			"$set": migrations,
+		})
+	})
+	return
+}
+
+func (task *TaskModel) closeStage(t time.Time) {
+	if n := len(task.StageTimes); n > 0 && task.StageTimes[n-1].EndTime.IsZero() {
+		task.StageTimes[n-1].EndTime = t
+	}
+}
+
+// EnterStage closes the timing of the current stage and moves the task into the next one
+func (task *TaskModel) EnterStage(stage TaskStage) error {
+	if !stage.IsValid() {
+		return fmt.Errorf("invalid task stage %s", stage)
+	}
+
+	t := time.Now().UTC()
+	task.closeStage(t)
+	task.Stage = stage
+	task.Progress = stage.Progress(0)
+	task.StageTimes = append(task.StageTimes, StageTime{Stage: stage, StartTime: t})
+
+	return task.update(bson.M{
+		"stage":       task.Stage,
+		"progress":    task.Progress,
+		"stage_times": task.StageTimes,
+	})
+}
+
+// SetProgress records that the given fraction of the current stage has been finished
+func (task *TaskModel) SetProgress(fraction float64) error {
+	progress := task.Stage.Progress(fraction)
+	if progress == task.Progress {
+		return nil
+	}
+	task.Progress = progress
+
+	return task.update(bson.M{
+		"progress": task.Progress,
+	})
+}
+
+// SetPartialResult stores the result of one choice as soon as it has been analysed
+func (task *TaskModel) SetPartialResult(result ResultBody) error {
+	replaced := false
+	for i := range task.Results {
+		if task.Results[i].Type == result.Type {
+			task.Results[i] = result
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		task.Results = append(task.Results, result)
+	}
+
+	return task.update(bson.M{
+		"results": task.Results,
+	})
+}
+
+// Finish marks the task as done
+func (task *TaskModel) Finish() error {
+	t := time.Now().UTC()
+	task.closeStage(t)
+	task.Status = TaskStatusDone
+	task.Progress = 100
+	task.DoneTime = t
+
+	return task.update(bson.M{
+		"status":      task.Status,
+		"progress":    task.Progress,
+		"stage_times": task.StageTimes,
+		"done_time":   task.DoneTime,
+	})
+}
+
+// Fail marks the task as failed, errors which are not *TaskError are attributed to the current stage
+func (task *TaskModel) Fail(cause error) error {
+	taskErr, ok := cause.(*TaskError)
+	if !ok {
+		taskErr = NewTaskError(task.Stage, TaskErrorInternal, cause)
+	}
+
+	t := time.Now().UTC()
+	task.closeStage(t)
+	task.Status = TaskStatusError
+	task.Error = taskErr
+	task.DoneTime = t
+
+	return task.update(bson.M{
+		"status":      task.Status,
+		"error":       task.Error,
+		"stage_times": task.StageTimes,
+		"done_time":   task.DoneTime,
+	})
+}
+
 func (_ *_Task) UpdateResultById(id string, results []ResultBody) (err error) {
 	t := time.Now().UTC()
 	migrations := bson.M{
@@ -102,6 +295,211 @@ func (_ *_Task) Find(id string) (model *TaskModel, err error) {
 	return
 }
 
+// TaskFilter selects tasks for listing, empty fields match everything
+type TaskFilter struct {
+	Status []TaskStatus
+	// Name matches the tasks whose name starts with it
+	Name string
+	// Choice matches the tasks which analysed it
+	Choice        string
+	Src           string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Marker is the position after the last task of the previous page
+	Marker string
+	Limit  int
+	// Sort is one of the TaskSort fields, _id by default
+	Sort string
+	Desc bool
+}
+
+// taskMarker is the position after a task in the order of a sort field other than _id
+type taskMarker struct {
+	Name     string    `json:"name,omitempty"`
+	DoneTime time.Time `json:"done_time,omitempty"`
+	Id       string    `json:"id"`
+}
+
+func (filter *TaskFilter) sortField() string {
+	if filter.Sort == "" {
+		return TaskSortId
+	}
+	return filter.Sort
+}
+
+// marker encodes the position after the task, which is the id of the task if sorted by _id
+func (filter *TaskFilter) marker(task *TaskModel) string {
+	if filter.sortField() == TaskSortId {
+		return task.Id.Hex()
+	}
+	m := taskMarker{Id: task.Id.Hex()}
+	if filter.sortField() == TaskSortName {
+		m.Name = task.Name
+	} else {
+		m.DoneTime = task.DoneTime
+	}
+	bs, _ := json.Marshal(m)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// after selects the tasks after the marker in the order of the sort field
+func (filter *TaskFilter) after(query bson.M) error {
+	op := "$gt"
+	if filter.Desc {
+		op = "$lt"
+	}
+
+	field := filter.sortField()
+	if field == TaskSortId {
+		if !bson.IsObjectIdHex(filter.Marker) {
+			return ErrInvalidId
+		}
+		query["_id"] = bson.M{op: bson.ObjectIdHex(filter.Marker)}
+		return nil
+	}
+
+	var m taskMarker
+	bs, err := base64.RawURLEncoding.DecodeString(filter.Marker)
+	if err == nil {
+		err = json.Unmarshal(bs, &m)
+	}
+	if err != nil || !bson.IsObjectIdHex(m.Id) {
+		return ErrInvalidId
+	}
+	var value interface{} = m.Name
+	if field == TaskSortDoneTime {
+		value = m.DoneTime.UTC()
+	}
+	query["$or"] = []bson.M{
+		{field: bson.M{op: value}},
+		{field: value, "_id": bson.M{op: bson.ObjectIdHex(m.Id)}},
+	}
+	return nil
+}
+
+func (filter *TaskFilter) query() (query bson.M, err error) {
+	switch filter.sortField() {
+	case TaskSortId, TaskSortName, TaskSortDoneTime:
+	default:
+		err = fmt.Errorf("invalid sort field %s", filter.Sort)
+		return
+	}
+
+	query = bson.M{}
+	if len(filter.Status) == 1 {
+		query["status"] = filter.Status[0]
+	} else if len(filter.Status) > 1 {
+		query["status"] = bson.M{"$in": filter.Status}
+	}
+	// the anchored regex is answered by the index of name
+	if filter.Name != "" {
+		query["name"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(filter.Name)}
+	}
+	if filter.Choice != "" {
+		query["choices"] = filter.Choice
+	}
+	if filter.Src != "" {
+		query["src"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(filter.Src)}
+	}
+
+	createTime := bson.M{}
+	if !filter.CreatedAfter.IsZero() {
+		createTime["$gte"] = filter.CreatedAfter.UTC()
+	}
+	if !filter.CreatedBefore.IsZero() {
+		createTime["$lt"] = filter.CreatedBefore.UTC()
+	}
+	if len(createTime) > 0 {
+		query["create_time"] = createTime
+	}
+
+	if filter.Marker != "" {
+		err = filter.after(query)
+	}
+	return
+}
+
+// List returns one page of tasks matching the filter and the marker of the next page,
+// the marker is empty when there are no more tasks
+func (_ *_Task) List(filter TaskFilter) (tasks []*TaskModel, marker string, err error) {
+	query, err := filter.query()
+	if err != nil {
+		return
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = TaskListDefaultLimit
+	} else if limit > TaskListMaxLimit {
+		limit = TaskListMaxLimit
+	}
+	// the ties of the sort field are ordered by _id
+	sort := []string{filter.sortField()}
+	if sort[0] != TaskSortId {
+		sort = append(sort, TaskSortId)
+	}
+	if filter.Desc {
+		for i := range sort {
+			sort[i] = "-" + sort[i]
+		}
+	}
+
+	tasks = []*TaskModel{}
+	Task.Query(func(c *mgo.Collection) {
+		err = c.Find(query).Sort(sort...).Limit(limit + 1).All(&tasks)
+	})
+	if err != nil {
+		return
+	}
+
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+		marker = filter.marker(tasks[limit-1])
+	}
+	return
+}
+
+// backfillChoices sets the choices of the tasks created before the field, so that they are found by choice
+func (_ *_Task) backfillChoices() (n int, err error) {
+	Task.Query(func(c *mgo.Collection) {
+		task := TaskModel{}
+		iter := c.Find(bson.M{"choices": bson.M{"$exists": false}}).Select(bson.M{"choice": 1}).Iter()
+		for iter.Next(&task) {
+			choices := strings.Split(task.Choice, "|")
+			if err = c.UpdateId(task.Id, bson.M{"$set": bson.M{"choices": choices}}); err != nil {
+				iter.Close()
+				return
+			}
+			n++
+		}
+		err = iter.Close()
+	})
+	return
+}
+
+func (_ *_Task) FindAll(ids []bson.ObjectId) (tasks []*TaskModel, err error) {
+	tasks = []*TaskModel{}
+	if len(ids) == 0 {
+		return
+	}
+
+	Task.Query(func(c *mgo.Collection) {
+		err = c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&tasks)
+	})
+	return
+}
+
+func (_ *_Task) Remove(id string) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidId
+	}
+
+	Task.Query(func(c *mgo.Collection) {
+		err = c.RemoveId(bson.ObjectIdHex(id))
+	})
+	return
+}
+
 type _Task struct {
 }
 
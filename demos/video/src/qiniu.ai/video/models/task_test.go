@@ -0,0 +1,91 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTaskStageProgress(t *testing.T) {
+	if p := TaskStageQueued.Progress(0); p != 0 {
+		t.Errorf("queued progress %d", p)
+	}
+	if p := TaskStageAnalysing.Progress(0.5); p <= TaskStageAnalysing.Progress(0) || p >= TaskStageMerging.Progress(0) {
+		t.Errorf("analysing progress %d out of range", p)
+	}
+	if p := TaskStageCallback.Progress(1); p != 100 {
+		t.Errorf("callback progress %d", p)
+	}
+	if p := TaskStage("UNKNOWN").Progress(1); p != 0 {
+		t.Errorf("unknown stage progress %d", p)
+	}
+}
+
+func TestTaskFilterQuery(t *testing.T) {
+	marker := bson.NewObjectId()
+	filter := TaskFilter{
+		Status:       []TaskStatus{TaskStatusDone, TaskStatusError},
+		Choice:       "scene",
+		CreatedAfter: time.Unix(100, 0),
+		Marker:       marker.Hex(),
+		Desc:         true,
+	}
+	query, err := filter.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := query["status"].(bson.M)["$in"]; !ok {
+		t.Errorf("status query %v", query["status"])
+	}
+	if _, ok := query["create_time"].(bson.M)["$gte"]; !ok {
+		t.Errorf("create_time query %v", query["create_time"])
+	}
+	if query["choices"] != "scene" {
+		t.Errorf("choice query %v", query["choices"])
+	}
+	if id := query["_id"].(bson.M)["$lt"]; id != marker {
+		t.Errorf("marker query %v", query["_id"])
+	}
+
+	filter = TaskFilter{Name: "a.b", Sort: TaskSortName}
+	if query, err = filter.query(); err != nil {
+		t.Fatal(err)
+	}
+	if name := query["name"].(bson.RegEx); name.Pattern != `^a\.b` || name.Options != "" {
+		t.Errorf("name query %v", name)
+	}
+
+	filter = TaskFilter{Marker: "invalid"}
+	if _, err = filter.query(); err != ErrInvalidId {
+		t.Errorf("invalid marker error %v", err)
+	}
+}
+
+func TestTaskFilterSortMarker(t *testing.T) {
+	task := &TaskModel{Id: bson.NewObjectId(), Name: "b", DoneTime: time.Unix(100, 0)}
+	for sort, value := range map[string]interface{}{TaskSortName: task.Name, TaskSortDoneTime: task.DoneTime.UTC()} {
+		filter := TaskFilter{Sort: sort}
+		filter.Marker = filter.marker(task)
+		query, err := filter.query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		or := query["$or"].([]bson.M)
+		if len(or) != 2 || or[1]["_id"].(bson.M)["$gt"] != task.Id {
+			t.Errorf("marker query of %s %v", sort, or)
+		}
+		if or[1][sort] != value {
+			t.Errorf("marker value of %s %v", sort, or[1][sort])
+		}
+	}
+
+	filter := TaskFilter{Sort: TaskSortName, Marker: bson.NewObjectId().Hex()}
+	if _, err := filter.query(); err != ErrInvalidId {
+		t.Errorf("invalid marker error %v", err)
+	}
+	filter = TaskFilter{Sort: "src"}
+	if _, err := filter.query(); err == nil {
+		t.Error("expect the invalid sort field")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"qiniu.ai/video/export"
+	"qiniu.ai/video/models"
+	"strconv"
+	"strings"
+)
+
+type (
+	videoIntervals struct {
+		TaskId    string          `json:"task_id"`
+		Name      string          `json:"name"`
+		Src       string          `json:"src"`
+		Intervals []typedInterval `json:"intervals"`
+	}
+
+	typedInterval struct {
+		models.Interval
+		Type string `json:"type"`
+	}
+)
+
+func queryInt(c *gin.Context, key string, def int) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func queryFloat(c *gin.Context, key string, def float64) (float64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// taskTimeline handles GET /v1/video/:id/timeline?gap=&min_confidence=
+func taskTimeline(c *gin.Context) {
+	taskId := c.Param("id")
+
+	gap, err := queryInt(c, "gap", 0)
+	if err != nil || gap < 0 {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid gap",
+		})
+		return
+	}
+	minConfidence, err := queryFloat(c, "min_confidence", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid min_confidence",
+		})
+		return
+	}
+
+	taskModel, err := models.Task.Find(taskId)
+	if err != nil {
+		logger.Errorf("models.Task.Find(%s) with error:%v\n", taskId, err)
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"task_id":  taskId,
+		"status":   taskModel.Status,
+		"timeline": models.BuildTimeline(taskModel.Results, gap, minConfidence),
+	})
+}
+
+// searchResults handles GET /v1/results/search?attribute=&match=&type=&min_confidence=&marker=&limit=,
+// the attribute is matched exactly, or as a prefix if match=prefix, and the matched intervals are grouped by video
+func searchResults(c *gin.Context) {
+	search := models.ResultSearch{
+		Attribute: c.Query("attribute"),
+		Type:      c.Query("type"),
+		Marker:    c.Query("marker"),
+	}
+	if search.Attribute == "" {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "attribute is required",
+		})
+		return
+	}
+	switch c.DefaultQuery("match", "exact") {
+	case "exact":
+	case "prefix":
+		search.Prefix = true
+	default:
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "match should be exact or prefix",
+		})
+		return
+	}
+
+	var err error
+	if search.MinConfidence, err = queryFloat(c, "min_confidence", 0); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid min_confidence",
+		})
+		return
+	}
+	if search.Limit, err = queryInt(c, "limit", 0); err != nil || search.Limit < 0 {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid limit",
+		})
+		return
+	}
+
+	matches, marker, err := models.ResultIndex.Search(search)
+	if err != nil {
+		logger.Errorf("models.ResultIndex.Search(%+v) with error:%v\n", search, err)
+		if err == models.ErrInvalidId {
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error": "invalid marker",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	videos := []*videoIntervals{}
+	byTask := map[bson.ObjectId]*videoIntervals{}
+	taskIds := []bson.ObjectId{}
+	for _, match := range matches {
+		video, ok := byTask[match.TaskId]
+		if !ok {
+			video = &videoIntervals{TaskId: match.TaskId.Hex()}
+			byTask[match.TaskId] = video
+			videos = append(videos, video)
+			taskIds = append(taskIds, match.TaskId)
+		}
+		video.Intervals = append(video.Intervals, typedInterval{
+			Interval: models.Interval{
+				Start:      match.Start,
+				End:        match.End,
+				Confidence: match.Confidence,
+			},
+			Type: match.Type,
+		})
+	}
+
+	tasks, err := models.Task.FindAll(taskIds)
+	if err != nil {
+		logger.Errorf("models.Task.FindAll(%v) with error:%v\n", taskIds, err)
+		c.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+	for _, task := range tasks {
+		if video, ok := byTask[task.Id]; ok {
+			video.Name = task.Name
+			video.Src = task.Src
+		}
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"videos": videos,
+		"marker": marker,
+	})
+}
+
+// exportResults handles GET /v1/video/:id/export?format=&choice=&min_confidence=&gap=
+func exportResults(c *gin.Context) {
+	taskId := c.Param("id")
+
+	format := c.DefaultQuery("format", export.FormatJSON)
+	contentType, ok := export.ContentType(format)
+	if !ok {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "format should be one of vtt, srt, edl, csv, json",
+		})
+		return
+	}
+
+	opts := export.Options{}
+	if choice := c.Query("choice"); choice != "" {
+		opts.Choices = strings.Split(choice, "|")
+	}
+	var err error
+	if opts.Gap, err = queryInt(c, "gap", 0); err != nil || opts.Gap < 0 {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid gap",
+		})
+		return
+	}
+	if opts.MinConfidence, err = queryFloat(c, "min_confidence", 0); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid min_confidence",
+		})
+		return
+	}
+
+	taskModel, err := models.Task.Find(taskId)
+	if err != nil {
+		logger.Errorf("models.Task.Find(%s) with error:%v\n", taskId, err)
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = export.Render(buf, format, taskModel, opts); err != nil {
+		logger.Errorf("export.Render(%s,%s) with error:%v\n", format, taskId, err)
+		c.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+strconv.Quote(taskId+"."+format))
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
@@ -0,0 +1,390 @@
+// Package source resolves the source URI of a video task and downloads it into a worker workspace
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/qiniu/api.v7/auth/qbox"
+	"github.com/qiniu/api.v7/storage"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxSize = 4 << 30
+	DefaultTimeout = 600
+	// privateURLExpires is the lifetime in seconds of the signed qiniu download urls
+	privateURLExpires = 3600
+)
+
+var (
+	ErrUnknownScheme    = errors.New("unknown source scheme")
+	ErrHostNotAllowed   = errors.New("source host is not allowed")
+	ErrPrivateAddress   = errors.New("source resolves to a private address")
+	ErrTooLarge         = errors.New("source exceeds the size limit")
+	ErrContentType      = errors.New("source content type is not allowed")
+	ErrUnknownBucket    = errors.New("no domain configured for the source bucket")
+	ErrOutsideLocalRoot = errors.New("local source is outside of the local root")
+
+	safeExt = regexp.MustCompile(`^\.[A-Za-z0-9]{1,8}$`)
+)
+
+type Config struct {
+	// AllowHosts are the hosts of the http(s) sources, an entry starting with "." matches all subdomains
+	// and "*" matches any host, no http(s) source is allowed if empty
+	AllowHosts []string `json:"allow_hosts"`
+	// AllowPrivate allows http(s) sources on loopback, private and link local addresses
+	AllowPrivate bool `json:"allow_private"`
+	// MaxSize is the maximum size in bytes of a source, DefaultMaxSize if zero
+	MaxSize int64 `json:"max_size"`
+	// ContentTypes are the allowed media type prefixes, like "video/", empty allows all
+	ContentTypes []string `json:"content_types"`
+	// Buckets maps the bucket of qiniu://<bucket>/<key> sources to its download domain
+	Buckets map[string]string `json:"buckets"`
+	// LocalRoot enables file://<path> sources under this directory, disabled if empty
+	LocalRoot string `json:"local_root"`
+	// Timeout of a whole download in seconds, DefaultTimeout if zero
+	Timeout int `json:"timeout"`
+}
+
+// Fetcher opens the content of a source URI of one scheme
+type Fetcher interface {
+	Validate(u *url.URL) error
+	Open(u *url.URL) (body io.ReadCloser, size int64, contentType string, err error)
+}
+
+type Resolver struct {
+	conf     Config
+	lk       sync.RWMutex
+	fetchers map[string]Fetcher
+}
+
+// NewResolver creates a resolver with the http, https, qiniu and (if LocalRoot is set) file schemes registered
+func NewResolver(conf Config, mac *qbox.Mac) *Resolver {
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = DefaultMaxSize
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
+	}
+
+	r := &Resolver{
+		conf:     conf,
+		fetchers: make(map[string]Fetcher),
+	}
+	httpFetcher := newHTTPFetcher(&r.conf)
+	r.Register("http", httpFetcher)
+	r.Register("https", httpFetcher)
+	r.Register("qiniu", &qiniuFetcher{http: httpFetcher, mac: mac, buckets: conf.Buckets})
+	if conf.LocalRoot != "" {
+		r.Register("file", &fileFetcher{root: conf.LocalRoot})
+	}
+	return r
+}
+
+func (r *Resolver) Register(scheme string, fetcher Fetcher) {
+	r.lk.Lock()
+	r.fetchers[strings.ToLower(scheme)] = fetcher
+	r.lk.Unlock()
+}
+
+func (r *Resolver) resolve(uri string) (u *url.URL, fetcher Fetcher, err error) {
+	u, err = url.Parse(uri)
+	if err != nil {
+		return
+	}
+
+	r.lk.RLock()
+	fetcher, ok := r.fetchers[strings.ToLower(u.Scheme)]
+	r.lk.RUnlock()
+	if !ok {
+		err = ErrUnknownScheme
+		return
+	}
+	err = fetcher.Validate(u)
+	return
+}
+
+// Validate checks that the URI could be downloaded without fetching it
+func (r *Resolver) Validate(uri string) error {
+	_, _, err := r.resolve(uri)
+	return err
+}
+
+// Download fetches the source into a new file under dstDir and returns its path,
+// nothing is left behind in dstDir on failure
+func (r *Resolver) Download(uri string, dstDir string) (fileName string, err error) {
+	u, fetcher, err := r.resolve(uri)
+	if err != nil {
+		return
+	}
+
+	body, size, contentType, err := fetcher.Open(u)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	if size > r.conf.MaxSize {
+		err = ErrTooLarge
+		return
+	}
+	if !r.allowContentType(contentType) {
+		err = fmt.Errorf("%v: %s", ErrContentType, contentType)
+		return
+	}
+
+	ext := path.Ext(u.Path)
+	if !safeExt.MatchString(ext) {
+		ext = ""
+	}
+	f, err := ioutil.TempFile(dstDir, "source-*"+ext)
+	if err != nil {
+		return
+	}
+	fileName = f.Name()
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			os.Remove(fileName)
+			fileName = ""
+		}
+	}()
+
+	n, err := io.Copy(f, io.LimitReader(body, r.conf.MaxSize+1))
+	if err != nil {
+		return
+	}
+	if n > r.conf.MaxSize {
+		err = ErrTooLarge
+		return
+	}
+	if size >= 0 && n != size {
+		err = fmt.Errorf("source truncated, %d of %d bytes received", n, size)
+	}
+	return
+}
+
+func (r *Resolver) allowContentType(contentType string) bool {
+	if len(r.conf.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range r.conf.ContentTypes {
+		if strings.HasPrefix(mediaType, strings.ToLower(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// --------------------------------------------------------------------
+
+type httpFetcher struct {
+	conf   *Config
+	client *http.Client
+}
+
+func newHTTPFetcher(conf *Config) *httpFetcher {
+	f := &httpFetcher{conf: conf}
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// check the address actually dialed so that DNS answers cannot bypass the private address check
+		Control: func(network, address string, c syscall.RawConn) error {
+			if conf.AllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return f.Validate(req.URL)
+		},
+	}
+	return f
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168) ||
+			(ip4[0] == 100 && ip4[1]&0xc0 == 64)
+	}
+	return ip[0]&0xfe == 0xfc
+}
+
+func (f *httpFetcher) Validate(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrUnknownScheme
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return ErrHostNotAllowed
+	}
+	for _, allowed := range f.conf.AllowHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return ErrHostNotAllowed
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (f *httpFetcher) Open(u *url.URL) (body io.ReadCloser, size int64, contentType string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(f.conf.Timeout)*time.Second)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		cancel()
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "video struct")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		err = fmt.Errorf("download %s%s with status %d", u.Host, u.Path, resp.StatusCode)
+		return
+	}
+	return &cancelBody{resp.Body, cancel}, resp.ContentLength, resp.Header.Get("Content-Type"), nil
+}
+
+// --------------------------------------------------------------------
+
+// qiniuFetcher downloads qiniu://<bucket>/<key> through a private url of the bucket domain
+type qiniuFetcher struct {
+	http    *httpFetcher
+	mac     *qbox.Mac
+	buckets map[string]string
+}
+
+func (f *qiniuFetcher) Validate(u *url.URL) error {
+	if _, ok := f.buckets[u.Host]; !ok {
+		return ErrUnknownBucket
+	}
+	if strings.TrimLeft(u.Path, "/") == "" {
+		return errors.New("empty source key")
+	}
+	return nil
+}
+
+func (f *qiniuFetcher) Open(u *url.URL) (body io.ReadCloser, size int64, contentType string, err error) {
+	if err = f.Validate(u); err != nil {
+		return
+	}
+	domain := strings.TrimRight(f.buckets[u.Host], "/")
+	if !strings.Contains(domain, "://") {
+		domain = "http://" + domain
+	}
+	deadline := time.Now().Add(privateURLExpires * time.Second).Unix()
+	privateURL := storage.MakePrivateURL(f.mac, domain, strings.TrimLeft(u.Path, "/"), deadline)
+
+	signed, err := url.Parse(privateURL)
+	if err != nil {
+		return
+	}
+	// the bucket domain is trusted configuration, only the address check of the dialer applies
+	return f.http.Open(signed)
+}
+
+// --------------------------------------------------------------------
+
+// fileFetcher reads file://<path> sources under root, it is meant for tests and local runs
+type fileFetcher struct {
+	root string
+}
+
+func (f *fileFetcher) localPath(u *url.URL) (string, error) {
+	root, err := filepath.Abs(f.root)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Clean(filepath.FromSlash(u.Host + u.Path))
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideLocalRoot
+	}
+	return name, nil
+}
+
+func (f *fileFetcher) Validate(u *url.URL) error {
+	_, err := f.localPath(u)
+	return err
+}
+
+func (f *fileFetcher) Open(u *url.URL) (body io.ReadCloser, size int64, contentType string, err error) {
+	name, err := f.localPath(u)
+	if err != nil {
+		return
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		if err == nil {
+			err = fmt.Errorf("%s is not a regular file", name)
+		}
+		return
+	}
+	return file, info.Size(), mime.TypeByExtension(filepath.Ext(name)), nil
+}
@@ -0,0 +1,126 @@
+package source
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadHTTP(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a/b/../movie.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write([]byte("movie"))
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer svr.Close()
+
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewResolver(Config{ContentTypes: []string{"video/"}}, nil)
+	if _, err = r.Download(svr.URL+"/movie.mp4", dir); err != ErrHostNotAllowed {
+		t.Fatalf("no host should be allowed by default, got %v", err)
+	}
+
+	r = NewResolver(Config{AllowHosts: []string{"*"}, ContentTypes: []string{"video/"}}, nil)
+	if _, err = r.Download(svr.URL+"/movie.mp4", dir); err == nil || !strings.Contains(err.Error(), ErrPrivateAddress.Error()) {
+		t.Fatalf("loopback source should be refused, got %v", err)
+	}
+
+	r = NewResolver(Config{AllowHosts: []string{"*"}, AllowPrivate: true, ContentTypes: []string{"video/"}, MaxSize: 10}, nil)
+	fileName, err := r.Download(svr.URL+"/a/b/%2E%2E/movie.mp4", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(fileName) != dir || filepath.Ext(fileName) != ".mp4" {
+		t.Errorf("unexpected file name %s", fileName)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "movie" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if _, err = r.Download(svr.URL+"/page.html", dir); err == nil {
+		t.Error("html source should be refused")
+	}
+	if _, err = r.Download(svr.URL+"/missing.mp4", dir); err == nil {
+		t.Error("missing source should fail")
+	}
+
+	r = NewResolver(Config{AllowHosts: []string{"*"}, AllowPrivate: true, MaxSize: 3}, nil)
+	if _, err = r.Download(svr.URL+"/a/b/%2E%2E/movie.mp4", dir); err != ErrTooLarge {
+		t.Errorf("expect ErrTooLarge, got %v", err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("failed downloads should not leave files, got %d files", len(files))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	r := NewResolver(Config{
+		AllowHosts: []string{"video.example.com", ".clouddn.com"},
+		Buckets:    map[string]string{"video": "video.example.com"},
+	}, nil)
+
+	cases := map[string]error{
+		"http://video.example.com/a.mp4":   nil,
+		"https://x.bkt.clouddn.com/a.mp4":  nil,
+		"http://evil.com/a.mp4":            ErrHostNotAllowed,
+		"http://clouddn.com.evil.com/a":    ErrHostNotAllowed,
+		"qiniu://video/dir/a.mp4":          nil,
+		"qiniu://other/a.mp4":              ErrUnknownBucket,
+		"ftp://video.example.com/a.mp4":    ErrUnknownScheme,
+		"file:///etc/passwd":               ErrUnknownScheme,
+		"gopher://video.example.com/a.mp4": ErrUnknownScheme,
+	}
+	for uri, expect := range cases {
+		if err := r.Validate(uri); err != expect {
+			t.Errorf("Validate(%s) = %v, expect %v", uri, err, expect)
+		}
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "source-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dst, err := ioutil.TempDir("", "source-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err = ioutil.WriteFile(filepath.Join(root, "clip.mp4"), []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewResolver(Config{LocalRoot: root}, nil)
+	fileName, err := r.Download("file://"+filepath.ToSlash(filepath.Join(root, "clip.mp4")), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "clip" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if err = r.Validate("file://" + filepath.ToSlash(filepath.Join(root, "..", "etc", "passwd"))); err != ErrOutsideLocalRoot {
+		t.Errorf("expect ErrOutsideLocalRoot, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/qiniu/api.v7/storage"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"qiniu.ai/video/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errTaskCanceled is returned by do() when the task is deleted while processing
+var errTaskCanceled = errors.New("task canceled")
+
+// taskRegistry holds the tasks queued or processed by the workers, a task deleted while processing is
+// marked canceled and removed by its worker when do() returns
+type taskRegistry struct {
+	sync.Mutex
+	canceledTasks map[string]bool
+}
+
+var processingTasks = &taskRegistry{canceledTasks: map[string]bool{}}
+
+func (r *taskRegistry) add(id string) {
+	r.Lock()
+	defer r.Unlock()
+	r.canceledTasks[id] = false
+}
+
+// cancel returns false if the task is not held by the workers
+func (r *taskRegistry) cancel(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.canceledTasks[id]; !ok {
+		return false
+	}
+	r.canceledTasks[id] = true
+	return true
+}
+
+func (r *taskRegistry) canceled(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.canceledTasks[id]
+}
+
+// done releases the task from the workers and returns whether it was canceled
+func (r *taskRegistry) done(id string) (canceled bool) {
+	r.Lock()
+	defer r.Unlock()
+	canceled = r.canceledTasks[id]
+	delete(r.canceledTasks, id)
+	return
+}
+
+// removeTask removes the frames of the task, which are listed by the prefix of their keys, and then the task
+func removeTask(taskId string) (err error) {
+	bucketManager := storage.NewBucketManager(mac, &cfg)
+	marker := ""
+	for {
+		entries, _, nextMarker, hasNext, errList := bucketManager.ListFiles(bucket, taskId+"-", "", marker, 1000)
+		if errList != nil {
+			logger.Errorf("bucketManager.ListFiles(%s,%s-) with error:%v\n", bucket, taskId, errList)
+			return errList
+		}
+
+		ops := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			ops = append(ops, storage.URIDelete(bucket, entry.Key))
+		}
+		if len(ops) > 0 {
+			rets, errBatch := bucketManager.Batch(ops)
+			if errBatch != nil {
+				logger.Errorf("bucketManager.Batch(delete %d frames of %s) with error:%v\n", len(ops), taskId, errBatch)
+				return errBatch
+			}
+			for i, ret := range rets {
+				// 612 is the frame deleted already
+				if ret.Code != http.StatusOK && ret.Code != 612 {
+					logger.Warnf("delete frame %s of task %s with code:%d\n", entries[i].Key, taskId, ret.Code)
+				}
+			}
+		}
+
+		if !hasNext {
+			break
+		}
+		marker = nextMarker
+	}
+
+	if err = models.ResultIndex.RemoveByTask(bson.ObjectIdHex(taskId)); err != nil {
+		logger.Errorf("models.ResultIndex.RemoveByTask(%s) with error:%v\n", taskId, err)
+		return
+	}
+
+	if err = models.Task.Remove(taskId); err != nil {
+		logger.Errorf("models.Task.Remove(%s) with error:%v\n", taskId, err)
+	}
+	return
+}
+
+func parseTime(value string) (t time.Time, err error) {
+	if value == "" {
+		return
+	}
+	if sec, errParse := strconv.ParseInt(value, 10, 64); errParse == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// listTasks handles GET /v1/videos?status=&name=&choice=&src=&start=&end=&marker=&limit=&sort=
+func listTasks(c *gin.Context) {
+	filter := models.TaskFilter{
+		Name:   c.Query("name"),
+		Choice: c.Query("choice"),
+		Src:    c.Query("src"),
+		Marker: c.Query("marker"),
+	}
+
+	if status := c.Query("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			taskStatus := models.TaskStatus(strings.ToUpper(s))
+			if !taskStatus.IsValid() {
+				c.JSON(http.StatusBadRequest, map[string]interface{}{
+					"error": "invalid status " + s,
+				})
+				return
+			}
+			filter.Status = append(filter.Status, taskStatus)
+		}
+	}
+
+	var err error
+	if filter.CreatedAfter, err = parseTime(c.Query("start")); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid start time",
+		})
+		return
+	}
+	if filter.CreatedBefore, err = parseTime(c.Query("end")); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid end time",
+		})
+		return
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error": "invalid limit",
+			})
+			return
+		}
+	}
+
+	sort := c.DefaultQuery("sort", "create_time")
+	if strings.HasPrefix(sort, "-") {
+		sort = sort[1:]
+		filter.Desc = true
+	}
+	switch sort {
+	case "create_time", "id":
+		// the ids are in the order of create_time
+		filter.Sort = models.TaskSortId
+	case "name":
+		filter.Sort = models.TaskSortName
+	case "done_time":
+		filter.Sort = models.TaskSortDoneTime
+	default:
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error": "sort should be one of create_time, id, name, done_time, or one of them after -",
+		})
+		return
+	}
+
+	tasks, marker, err := models.Task.List(filter)
+	if err != nil {
+		logger.Errorf("models.Task.List(%+v) with error:%v\n", filter, err)
+		if err == models.ErrInvalidId {
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error": "invalid marker",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"tasks":  tasks,
+		"marker": marker,
+	})
+}
+
+// deleteTask handles DELETE /v1/video/:id, it removes the frames of the task from the bucket and then the task itself,
+// a processing task is canceled and removed by its worker later
+func deleteTask(c *gin.Context) {
+	taskId := c.Param("id")
+
+	taskModel, err := models.Task.Find(taskId)
+	if err != nil {
+		logger.Errorf("models.Task.Find(%s) with error:%v\n", taskId, err)
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+
+	// the processing tasks left by a restart are not held by any worker, so they are removed at once
+	if taskModel.Status == models.TaskstatusPorcessing && processingTasks.cancel(taskId) {
+		c.JSON(http.StatusAccepted, map[string]interface{}{
+			"task_id": taskId,
+			"status":  "deleting",
+		})
+		return
+	}
+
+	if err = removeTask(taskId); err != nil {
+		c.JSON(http.StatusInternalServerError, nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"task_id": taskId,
+		"status":  "deleted",
+	})
+}
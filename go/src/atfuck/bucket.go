@@ -12,9 +12,11 @@ type BucketInfo struct {
 	Region string `json:"region"`
 }
 
-const (
+//hosts to query the bucket info before the zone of the bucket is known
+var (
 	BUCKET_RS_HOST  = "http://rs.qiniu.com"
 	BUCKET_API_HOST = "http://api.qiniu.com"
+	BUCKET_UC_HOST  = "http://uc.qbox.me"
 )
 
 /*
@@ -0,0 +1,354 @@
+package atfuck
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"qiniu/rpc"
+	"strings"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+)
+
+//the file served for the missing files of the bucket
+const NOT_FOUND_PAGE_KEY = "errno-404"
+
+//referer anti-leech mode
+const (
+	ANTI_LEECH_OFF       = "off"
+	ANTI_LEECH_WHITELIST = "whitelist"
+	ANTI_LEECH_BLACKLIST = "blacklist"
+)
+
+var antiLeechModes = []string{ANTI_LEECH_OFF, ANTI_LEECH_WHITELIST, ANTI_LEECH_BLACKLIST}
+
+type AntiLeech struct {
+	Mode              string   `json:"mode"`
+	Patterns          []string `json:"patterns,omitempty"`
+	AllowEmptyReferer bool     `json:"allow_empty_referer"`
+}
+
+//LifecycleRule deletes the files with the prefix, or transits them to the low frequency storage,
+//some days after they are uploaded
+type LifecycleRule struct {
+	Name            string `json:"name"`
+	Prefix          string `json:"prefix"`
+	DeleteAfterDays int    `json:"delete_after_days,omitempty"`
+	ToLineAfterDays int    `json:"to_line_after_days,omitempty"`
+}
+
+//BucketConfig is the exported config of a bucket, the domains are for reference and not imported.
+//NotFoundPage is the bucket:key of the 404 page, it is copied to errno-404 of the bucket imported.
+type BucketConfig struct {
+	Bucket       string          `json:"bucket"`
+	Region       string          `json:"region"`
+	Private      bool            `json:"private"`
+	NoIndexPage  bool            `json:"no_index_page"`
+	NotFoundPage string          `json:"not_found_page,omitempty"`
+	AntiLeech    AntiLeech       `json:"anti_leech"`
+	Lifecycle    []LifecycleRule `json:"lifecycle"`
+	Domains      []string        `json:"domains,omitempty"`
+}
+
+type ucBucketInfo struct {
+	Region        string   `json:"region"`
+	Private       int      `json:"private"`
+	NoIndexPage   int      `json:"no_index_page"`
+	AntiLeechMode int      `json:"anti_leech_mode"`
+	ReferWl       []string `json:"refer_wl"`
+	ReferBl       []string `json:"refer_bl"`
+	NoRefer       bool     `json:"no_refer"`
+}
+
+func bucketError(callErr error) error {
+	if v, ok := callErr.(*rpc.ErrorInfo); ok {
+		return fmt.Errorf("code: %d, %s, xreqid: %s", v.Code, v.Err, v.Reqid)
+	}
+	return callErr
+}
+
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func ucCall(mac *digest.Mac, ret interface{}, path string, params url.Values) (err error) {
+	client := rs.NewMac(mac)
+	callErr := client.Conn.CallWithForm(nil, ret, BUCKET_UC_HOST+path, params)
+	if callErr != nil {
+		err = bucketError(callErr)
+	}
+	return
+}
+
+//CreateBucket creates the bucket in the region, like z0, z1, z2 or na0
+func CreateBucket(mac *digest.Mac, bucket, region string) (err error) {
+	if !IsValidZone(region) {
+		err = fmt.Errorf("Invalid region `%s`", region)
+		return
+	}
+	client := rs.NewMac(mac)
+	mkbucketUri := fmt.Sprintf("%s/mkbucketv2/%s/region/%s", BUCKET_RS_HOST,
+		base64.URLEncoding.EncodeToString([]byte(bucket)), region)
+	if callErr := client.Conn.Call(nil, nil, mkbucketUri); callErr != nil {
+		err = bucketError(callErr)
+	}
+	return
+}
+
+//DropBucket deletes the bucket, it fails if the bucket has any files
+func DropBucket(mac *digest.Mac, bucket string) (err error) {
+	client := rs.NewMac(mac)
+	if callErr := client.Conn.Call(nil, nil, fmt.Sprintf("%s/drop/%s", BUCKET_RS_HOST, url.PathEscape(bucket))); callErr != nil {
+		err = bucketError(callErr)
+	}
+	return
+}
+
+//IsBucketEmpty lists one file of the bucket, the zone of the bucket should be set
+func IsBucketEmpty(mac *digest.Mac, bucket string) (empty bool, err error) {
+	client := rsf.New(mac)
+	items, _, lErr := client.ListPrefix(nil, bucket, "", "", 1)
+	if lErr != nil && lErr != io.EOF {
+		err = bucketError(lErr)
+		return
+	}
+	empty = len(items) == 0
+	return
+}
+
+func SetBucketPrivate(mac *digest.Mac, bucket string, private bool) error {
+	return ucCall(mac, nil, "/private", url.Values{
+		"bucket":  {bucket},
+		"private": {boolParam(private)},
+	})
+}
+
+//SetIndexPage sets whether index.html is served for the dirs of the bucket
+func SetIndexPage(mac *digest.Mac, bucket string, enabled bool) error {
+	return ucCall(mac, nil, "/noIndexPage", url.Values{
+		"bucket":      {bucket},
+		"noIndexPage": {boolParam(!enabled)},
+	})
+}
+
+//SetNotFoundPage copies the file to errno-404 of the same bucket, the zone of the bucket should be set
+func SetNotFoundPage(mac *digest.Mac, bucket, key string) error {
+	return copyNotFoundPage(mac, bucket, key, bucket)
+}
+
+func copyNotFoundPage(mac *digest.Mac, srcBucket, srcKey, bucket string) (err error) {
+	client := rs.NewMac(mac)
+	if callErr := client.Copy(nil, srcBucket, srcKey, bucket, NOT_FOUND_PAGE_KEY, true); callErr != nil {
+		err = bucketError(callErr)
+	}
+	return
+}
+
+//getNotFoundPage returns the bucket:key of the 404 page, empty if not set, the zone of the bucket should be set
+func getNotFoundPage(mac *digest.Mac, bucket string) (page string, err error) {
+	client := rs.NewMac(mac)
+	if _, callErr := client.Stat(nil, bucket, NOT_FOUND_PAGE_KEY); callErr != nil {
+		if v, ok := callErr.(*rpc.ErrorInfo); ok && v.Code == 612 {
+			return
+		}
+		err = bucketError(callErr)
+		return
+	}
+	page = bucket + ":" + NOT_FOUND_PAGE_KEY
+	return
+}
+
+func SetAntiLeech(mac *digest.Mac, bucket string, antiLeech AntiLeech) (err error) {
+	mode := -1
+	for i, m := range antiLeechModes {
+		if antiLeech.Mode == m || (antiLeech.Mode == "" && m == ANTI_LEECH_OFF) {
+			mode = i
+		}
+	}
+	if mode < 0 {
+		err = fmt.Errorf("Invalid anti leech mode `%s`", antiLeech.Mode)
+		return
+	}
+	if mode != 0 && len(antiLeech.Patterns) == 0 {
+		err = errors.New("No referer patterns for the anti leech")
+		return
+	}
+	return ucCall(mac, nil, "/referAntiLeech", url.Values{
+		"bucket":         {bucket},
+		"mode":           {fmt.Sprintf("%d", mode)},
+		"norefer":        {boolParam(antiLeech.AllowEmptyReferer)},
+		"pattern":        {strings.Join(antiLeech.Patterns, ";")},
+		"source_enabled": {"1"},
+	})
+}
+
+// ----------------------------------------------------------
+
+func GetLifecycleRules(mac *digest.Mac, bucket string) (rules []LifecycleRule, err error) {
+	rules = make([]LifecycleRule, 0)
+	err = ucCall(mac, &rules, "/rules/get", url.Values{"bucket": {bucket}})
+	return
+}
+
+func lifecycleRuleParams(bucket string, rule LifecycleRule) url.Values {
+	return url.Values{
+		"bucket":             {bucket},
+		"name":               {rule.Name},
+		"prefix":             {rule.Prefix},
+		"delete_after_days":  {fmt.Sprintf("%d", rule.DeleteAfterDays)},
+		"to_line_after_days": {fmt.Sprintf("%d", rule.ToLineAfterDays)},
+	}
+}
+
+func checkLifecycleRule(rule LifecycleRule) error {
+	if rule.Name == "" {
+		return errors.New("No name for the lifecycle rule")
+	}
+	if rule.DeleteAfterDays < 0 || rule.ToLineAfterDays < 0 || rule.DeleteAfterDays == 0 && rule.ToLineAfterDays == 0 {
+		return fmt.Errorf("Invalid days of the lifecycle rule `%s`", rule.Name)
+	}
+	if rule.DeleteAfterDays > 0 && rule.ToLineAfterDays >= rule.DeleteAfterDays {
+		return fmt.Errorf("The files of lifecycle rule `%s` are deleted before transited", rule.Name)
+	}
+	return nil
+}
+
+func AddLifecycleRule(mac *digest.Mac, bucket string, rule LifecycleRule) error {
+	if err := checkLifecycleRule(rule); err != nil {
+		return err
+	}
+	return ucCall(mac, nil, "/rules/add", lifecycleRuleParams(bucket, rule))
+}
+
+func UpdateLifecycleRule(mac *digest.Mac, bucket string, rule LifecycleRule) error {
+	if err := checkLifecycleRule(rule); err != nil {
+		return err
+	}
+	return ucCall(mac, nil, "/rules/update", lifecycleRuleParams(bucket, rule))
+}
+
+func DeleteLifecycleRule(mac *digest.Mac, bucket, name string) error {
+	return ucCall(mac, nil, "/rules/delete", url.Values{
+		"bucket": {bucket},
+		"name":   {name},
+	})
+}
+
+// ----------------------------------------------------------
+
+//GetBucketConfig gets the settings of the bucket, the zone is set to the region of the bucket
+func GetBucketConfig(mac *digest.Mac, bucket string) (config BucketConfig, err error) {
+	var info ucBucketInfo
+	if err = ucCall(mac, &info, "/v2/bucketInfo", url.Values{"bucket": {bucket}}); err != nil {
+		return
+	}
+	SetZone(info.Region)
+	config = BucketConfig{
+		Bucket:      bucket,
+		Region:      info.Region,
+		Private:     info.Private == 1,
+		NoIndexPage: info.NoIndexPage == 1,
+		AntiLeech: AntiLeech{
+			Mode:              ANTI_LEECH_OFF,
+			AllowEmptyReferer: info.NoRefer,
+		},
+	}
+	switch info.AntiLeechMode {
+	case 1:
+		config.AntiLeech.Mode = ANTI_LEECH_WHITELIST
+		config.AntiLeech.Patterns = info.ReferWl
+	case 2:
+		config.AntiLeech.Mode = ANTI_LEECH_BLACKLIST
+		config.AntiLeech.Patterns = info.ReferBl
+	}
+
+	if config.NotFoundPage, err = getNotFoundPage(mac, bucket); err != nil {
+		return
+	}
+	if config.Lifecycle, err = GetLifecycleRules(mac, bucket); err != nil {
+		return
+	}
+	config.Domains, err = GetDomainsOfBucket(mac, bucket)
+	return
+}
+
+//ApplyBucketConfig creates the bucket if it does not exist, and makes its settings the same as the config.
+//The lifecycle rules not in the config are deleted, the 404 page is kept if not in the config.
+func ApplyBucketConfig(mac *digest.Mac, bucket string, config BucketConfig) (err error) {
+	buckets, err := GetBuckets(mac)
+	if err != nil {
+		return
+	}
+	exists := false
+	for _, name := range buckets {
+		if name == bucket {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		if err = CreateBucket(mac, bucket, config.Region); err != nil {
+			return
+		}
+	}
+
+	if err = SetBucketPrivate(mac, bucket, config.Private); err != nil {
+		return
+	}
+	if err = SetIndexPage(mac, bucket, !config.NoIndexPage); err != nil {
+		return
+	}
+	if err = SetAntiLeech(mac, bucket, config.AntiLeech); err != nil {
+		return
+	}
+	if config.NotFoundPage != "" && config.NotFoundPage != bucket+":"+NOT_FOUND_PAGE_KEY {
+		entry := strings.SplitN(config.NotFoundPage, ":", 2)
+		if len(entry) != 2 || entry[0] == "" || entry[1] == "" {
+			return fmt.Errorf("Invalid 404 page `%s`, expect <Bucket>:<Key>", config.NotFoundPage)
+		}
+		bucketInfo, gErr := GetBucketInfo(mac, bucket)
+		if gErr != nil {
+			return gErr
+		}
+		SetZone(bucketInfo.Region)
+		if err = copyNotFoundPage(mac, entry[0], entry[1], bucket); err != nil {
+			return
+		}
+	}
+
+	oldRules, err := GetLifecycleRules(mac, bucket)
+	if err != nil {
+		return
+	}
+	oldRuleNames := make(map[string]bool)
+	for _, rule := range oldRules {
+		oldRuleNames[rule.Name] = true
+	}
+	newRuleNames := make(map[string]bool)
+	for _, rule := range config.Lifecycle {
+		newRuleNames[rule.Name] = true
+		if oldRuleNames[rule.Name] {
+			err = UpdateLifecycleRule(mac, bucket, rule)
+		} else {
+			err = AddLifecycleRule(mac, bucket, rule)
+		}
+		if err != nil {
+			return
+		}
+	}
+	for _, rule := range oldRules {
+		if !newRuleNames[rule.Name] {
+			if err = DeleteLifecycleRule(mac, bucket, rule.Name); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package atfuck
+
+import (
+	"reflect"
+	"testing"
+
+	"qiniu/api.v6/fakeserver"
+)
+
+func TestBucketAdmin(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	SetZone(fakeserver.Region)
+
+	if err := CreateBucket(mac, "admin", "unknown"); err == nil {
+		t.Fatal("expect creating a bucket in an unknown region to fail")
+	}
+	if err := CreateBucket(mac, "admin", fakeserver.Region); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateBucket(mac, "admin", fakeserver.Region); err == nil {
+		t.Fatal("expect creating an existing bucket to fail")
+	}
+
+	if err := SetBucketPrivate(mac, "admin", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetIndexPage(mac, "admin", false); err != nil {
+		t.Fatal(err)
+	}
+	antiLeech := AntiLeech{Mode: ANTI_LEECH_WHITELIST, Patterns: []string{"*.example.com"}, AllowEmptyReferer: true}
+	if err := SetAntiLeech(mac, "admin", antiLeech); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAntiLeech(mac, "admin", AntiLeech{Mode: ANTI_LEECH_BLACKLIST}); err == nil {
+		t.Fatal("expect a blacklist without patterns to fail")
+	}
+
+	rules := []LifecycleRule{
+		{Name: "logs", Prefix: "logs/", DeleteAfterDays: 30},
+		{Name: "tmp", Prefix: "tmp/", DeleteAfterDays: 7},
+	}
+	for _, rule := range rules {
+		if err := AddLifecycleRule(mac, "admin", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddLifecycleRule(mac, "admin", LifecycleRule{Name: "bad", DeleteAfterDays: 3, ToLineAfterDays: 5}); err == nil {
+		t.Fatal("expect a rule deleting the files before transiting to fail")
+	}
+	rules[0].ToLineAfterDays = 10
+	if err := UpdateLifecycleRule(mac, "admin", rules[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := GetBucketConfig(mac, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Region != fakeserver.Region || !config.Private || !config.NoIndexPage ||
+		!reflect.DeepEqual(config.AntiLeech, antiLeech) || !reflect.DeepEqual(config.Lifecycle, rules) {
+		t.Fatalf("unexpected config %+v", config)
+	}
+
+	//apply to a new bucket, then drop a rule from an existing one
+	if err = ApplyBucketConfig(mac, "admin2", config); err != nil {
+		t.Fatal(err)
+	}
+	config2, err := GetBucketConfig(mac, "admin2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config2.Bucket, config2.Domains = config.Bucket, config.Domains
+	if !reflect.DeepEqual(config2, config) {
+		t.Fatalf("expect config %+v, got %+v", config, config2)
+	}
+	config.Lifecycle = config.Lifecycle[:1]
+	config.AntiLeech = AntiLeech{Mode: ANTI_LEECH_OFF}
+	if err = ApplyBucketConfig(mac, "admin2", config); err != nil {
+		t.Fatal(err)
+	}
+	if config2, err = GetBucketConfig(mac, "admin2"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config2.Lifecycle, config.Lifecycle) || config2.AntiLeech.Mode != ANTI_LEECH_OFF {
+		t.Fatalf("unexpected config after apply %+v", config2)
+	}
+
+	srv.PutObject("admin", "index.html", []byte("<html></html>"), "")
+	if empty, err := IsBucketEmpty(mac, "admin"); err != nil || empty {
+		t.Fatalf("expect bucket not empty, got %v, %v", empty, err)
+	}
+	if err = SetNotFoundPage(mac, "admin", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.GetObject("admin", NOT_FOUND_PAGE_KEY); !ok {
+		t.Fatal("expect the 404 page to be copied")
+	}
+	if config, err = GetBucketConfig(mac, "admin"); err != nil || config.NotFoundPage != "admin:"+NOT_FOUND_PAGE_KEY {
+		t.Fatalf("expect the 404 page in the config, got %+v, %v", config, err)
+	}
+	if err = ApplyBucketConfig(mac, "admin3", config); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.GetObject("admin3", NOT_FOUND_PAGE_KEY); !ok {
+		t.Fatal("expect the 404 page to be imported")
+	}
+
+	if empty, err := IsBucketEmpty(mac, "admin2"); err != nil || !empty {
+		t.Fatalf("expect bucket empty, got %v, %v", empty, err)
+	}
+	if err = DropBucket(mac, "admin2"); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := GetBuckets(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range buckets {
+		if bucket == "admin2" {
+			t.Fatal("expect bucket admin2 dropped")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package atfuck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"qiniu/rpc"
+	"strings"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/conf"
+	fio "qiniu/api.v6/io"
+	rio "qiniu/api.v6/resumable/io"
+	"qiniu/api.v6/rs"
+)
+
+var errIncompleteBody = errors.New("incomplete body")
+
+//bucketProxy downloads and uploads the files of a bucket for the servers in front of it
+type bucketProxy struct {
+	bucket  string
+	domain  string
+	ioHost  string
+	tempDir string
+	mac     *digest.Mac
+	client  rs.Client
+}
+
+//newBucketProxy sets the zone of the bucket, the first domain of the bucket and the io host of the zone are used by default
+func newBucketProxy(mac *digest.Mac, bucket, domain, ioHost, tempDir string) (proxy *bucketProxy, err error) {
+	bucketInfo, err := GetBucketInfo(mac, bucket)
+	if err != nil {
+		return
+	}
+	SetZone(bucketInfo.Region)
+
+	if domain == "" {
+		domains, gErr := GetDomainsOfBucket(mac, bucket)
+		if gErr != nil {
+			err = gErr
+			return
+		}
+		if len(domains) == 0 {
+			err = fmt.Errorf("No domains of bucket `%s`", bucket)
+			return
+		}
+		domain = domains[0]
+	}
+	if ioHost == "" {
+		ioHost = conf.IO_HOST
+	}
+	proxy = &bucketProxy{
+		bucket:  bucket,
+		domain:  domain,
+		ioHost:  strings.TrimPrefix(strings.TrimPrefix(ioHost, "http://"), "https://"),
+		tempDir: tempDir,
+		mac:     mac,
+		client:  rs.NewMac(mac),
+	}
+	return
+}
+
+//upToken is a token which may overwrite the key
+func (p *bucketProxy) upToken(key string) string {
+	policy := rs.PutPolicy{Scope: p.bucket + ":" + key}
+	policy.Expires = 3600 * 24
+	return policy.Token(p.mac)
+}
+
+//download gets the file by the private link through the io host, the headers like Range are passed on
+func (p *bucketProxy) download(ctx context.Context, key string, header http.Header) (resp *http.Response, err error) {
+	escapedKey := (&url.URL{Path: key}).EscapedPath()
+	fileUrl := makePrivateDownloadLink(p.mac, p.domain, p.ioHost, escapedKey)
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Host = p.domain
+	for _, name := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	return http.DefaultClient.Do(req)
+}
+
+//spool saves the body to a temp file, the caller removes it,
+//the size is checked unless it is negative
+func (p *bucketProxy) spool(body io.Reader, size int64) (tmpFile string, n int64, err error) {
+	fh, err := ioutil.TempFile(p.tempDir, "atfuck-proxy-")
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	tmpFile = fh.Name()
+
+	n, err = io.Copy(fh, body)
+	if err == nil && size >= 0 && n != size {
+		err = errIncompleteBody
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		tmpFile = ""
+	}
+	return
+}
+
+//upload puts the local file by form upload or by multipart upload if it is larger than a part
+func (p *bucketProxy) upload(ctx context.Context, key, localFile string, size int64, mimeType string) (putRet fio.PutRet, err error) {
+	upToken := p.upToken(key)
+	if size <= rio.DefaultPartSize {
+		err = fio.PutFileCtx(ctx, rpc.NewClient(""), nil, &putRet, upToken, key, localFile, &fio.PutExtra{MimeType: mimeType})
+	} else {
+		err = rio.PutFileV2(ctx, rio.NewClient(upToken, ""), nil, &putRet, p.bucket, key, localFile,
+			&rio.PutExtraV2{MimeType: mimeType})
+	}
+	return
+}
@@ -0,0 +1,220 @@
+package atfuck
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rsf"
+)
+
+//the time unit of the put time stats
+const (
+	STATS_BY_DAY   = "day"
+	STATS_BY_MONTH = "month"
+)
+
+//the key of the files not in a dir of the stats depth
+const STATS_ROOT_DIR = "<root>"
+
+type BucketStatsOptions struct {
+	Depth      int    //the depth of the dirs, 0 means no dir stats
+	Delimiter  string //the delimiter of the dirs, default is "/"
+	TimeUnit   string //day or month, default is month
+	Duplicates bool   //find the files with the same hash, keeps the hash of each file in memory
+}
+
+type StatsItem struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+type DuplicateFiles struct {
+	Hash  string   `json:"hash"`
+	Fsize int64    `json:"fsize"`
+	Keys  []string `json:"keys"`
+}
+
+//Wasted is the bytes taken by the copies besides the first one
+func (d *DuplicateFiles) Wasted() int64 {
+	return d.Fsize * int64(len(d.Keys)-1)
+}
+
+type BucketStats struct {
+	Bucket     string           `json:"bucket"`
+	Prefix     string           `json:"prefix"`
+	Total      StatsItem        `json:"total"`
+	ByDir      []StatsItem      `json:"by_dir,omitempty"`
+	ByMime     []StatsItem      `json:"by_mime"`
+	ByFileType []StatsItem      `json:"by_file_type"`
+	ByPutTime  []StatsItem      `json:"by_put_time"`
+	Duplicates []DuplicateFiles `json:"duplicates,omitempty"`
+}
+
+//FileTypeName is the storage class of the FileType of a listed file
+func FileTypeName(fileType int) string {
+	switch fileType {
+	case 0:
+		return "standard"
+	case 1:
+		return "line"
+	}
+	return fmt.Sprintf("type%d", fileType)
+}
+
+//statsDir returns the first depth dirs of the key after the prefix
+func statsDir(key, prefix, delimiter string, depth int) string {
+	parts := strings.Split(strings.TrimPrefix(key, prefix), delimiter)
+	if len(parts) <= 1 {
+		return STATS_ROOT_DIR
+	}
+	if len(parts)-1 > depth {
+		parts = parts[:depth]
+	} else {
+		parts = parts[:len(parts)-1]
+	}
+	return prefix + strings.Join(parts, delimiter) + delimiter
+}
+
+//bucketStatsCollector aggregates the listed files, it is not safe for concurrent use
+type bucketStatsCollector struct {
+	opts       BucketStatsOptions
+	prefix     string
+	total      StatsItem
+	byDir      map[string]*StatsItem
+	byMime     map[string]*StatsItem
+	byFileType map[string]*StatsItem
+	byPutTime  map[string]*StatsItem
+	firstKeys  map[string]string
+	duplicates map[string]*DuplicateFiles
+}
+
+func newBucketStatsCollector(prefix string, opts BucketStatsOptions) *bucketStatsCollector {
+	if opts.Delimiter == "" {
+		opts.Delimiter = "/"
+	}
+	if opts.TimeUnit == "" {
+		opts.TimeUnit = STATS_BY_MONTH
+	}
+	return &bucketStatsCollector{
+		opts:       opts,
+		prefix:     prefix,
+		byDir:      make(map[string]*StatsItem),
+		byMime:     make(map[string]*StatsItem),
+		byFileType: make(map[string]*StatsItem),
+		byPutTime:  make(map[string]*StatsItem),
+		firstKeys:  make(map[string]string),
+		duplicates: make(map[string]*DuplicateFiles),
+	}
+}
+
+func addStats(stats map[string]*StatsItem, name string, fsize int64) {
+	item, ok := stats[name]
+	if !ok {
+		item = &StatsItem{Name: name}
+		stats[name] = item
+	}
+	item.Count += 1
+	item.Bytes += fsize
+}
+
+func (c *bucketStatsCollector) add(entry rsf.ListItem) {
+	c.total.Count += 1
+	c.total.Bytes += entry.Fsize
+
+	if c.opts.Depth > 0 {
+		addStats(c.byDir, statsDir(entry.Key, c.prefix, c.opts.Delimiter, c.opts.Depth), entry.Fsize)
+	}
+	mimeType := entry.MimeType
+	if mimeType == "" {
+		mimeType = "unknown"
+	}
+	addStats(c.byMime, mimeType, entry.Fsize)
+	addStats(c.byFileType, FileTypeName(entry.FileType), entry.Fsize)
+
+	//the put time is in 100ns
+	putTime := time.Unix(0, entry.PutTime*100)
+	layout := "2006-01"
+	if c.opts.TimeUnit == STATS_BY_DAY {
+		layout = "2006-01-02"
+	}
+	addStats(c.byPutTime, putTime.Format(layout), entry.Fsize)
+
+	if c.opts.Duplicates && entry.Hash != "" {
+		if dup, ok := c.duplicates[entry.Hash]; ok {
+			dup.Keys = append(dup.Keys, entry.Key)
+		} else if firstKey, ok := c.firstKeys[entry.Hash]; ok {
+			c.duplicates[entry.Hash] = &DuplicateFiles{
+				Hash:  entry.Hash,
+				Fsize: entry.Fsize,
+				Keys:  []string{firstKey, entry.Key},
+			}
+		} else {
+			c.firstKeys[entry.Hash] = entry.Key
+		}
+	}
+}
+
+//sortedStats sorts by bytes desc, or by name if byName
+func sortedStats(stats map[string]*StatsItem, byName bool) []StatsItem {
+	items := make([]StatsItem, 0, len(stats))
+	for _, item := range stats {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if byName || items[i].Bytes == items[j].Bytes {
+			return items[i].Name < items[j].Name
+		}
+		return items[i].Bytes > items[j].Bytes
+	})
+	return items
+}
+
+func (c *bucketStatsCollector) stats(bucket string) BucketStats {
+	stats := BucketStats{
+		Bucket:     bucket,
+		Prefix:     c.prefix,
+		Total:      c.total,
+		ByMime:     sortedStats(c.byMime, false),
+		ByFileType: sortedStats(c.byFileType, false),
+		ByPutTime:  sortedStats(c.byPutTime, true),
+	}
+	stats.Total.Name = "total"
+	if c.opts.Depth > 0 {
+		stats.ByDir = sortedStats(c.byDir, false)
+	}
+	if c.opts.Duplicates {
+		stats.Duplicates = make([]DuplicateFiles, 0, len(c.duplicates))
+		for _, dup := range c.duplicates {
+			stats.Duplicates = append(stats.Duplicates, *dup)
+		}
+		sort.Slice(stats.Duplicates, func(i, j int) bool {
+			wi, wj := stats.Duplicates[i].Wasted(), stats.Duplicates[j].Wasted()
+			if wi == wj {
+				return stats.Duplicates[i].Hash < stats.Duplicates[j].Hash
+			}
+			return wi > wj
+		})
+	}
+	return stats
+}
+
+//GetBucketStats aggregates the files with the prefix while listing, without a list result file
+func GetBucketStats(ctx context.Context, mac *digest.Mac, bucket, prefix string,
+	opts BucketStatsOptions) (stats BucketStats, err error) {
+	collector := newBucketStatsCollector(prefix, opts)
+	err = ListBucketFuncCtx(ctx, mac, bucket, prefix, "", func(entries []rsf.ListItem, _ string) {
+		for _, entry := range entries {
+			collector.add(entry)
+		}
+	})
+	if err != nil {
+		return
+	}
+	stats = collector.stats(bucket)
+	return
+}
@@ -0,0 +1,72 @@
+package atfuck
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetBucketStats(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	files := map[string]string{
+		"data/a/1.txt":   "hello",
+		"data/a/2.txt":   "hello",
+		"data/b/c/3.txt": "world!",
+		"data/4.json":    "{}",
+		"other.txt":      "other",
+	}
+	for key, data := range files {
+		srv.PutObject(fakeBucket, key, []byte(data), "")
+	}
+
+	stats, err := GetBucketStats(context.Background(), mac, fakeBucket, "data/",
+		BucketStatsOptions{Depth: 1, TimeUnit: STATS_BY_DAY, Duplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total.Count != 4 || stats.Total.Bytes != 18 {
+		t.Fatalf("unexpected total %+v", stats.Total)
+	}
+	expectDirs := []StatsItem{
+		{"data/a/", 2, 10},
+		{"data/b/", 1, 6},
+		{STATS_ROOT_DIR, 1, 2},
+	}
+	if len(stats.ByDir) != len(expectDirs) {
+		t.Fatalf("unexpected dirs %+v", stats.ByDir)
+	}
+	for i, dir := range expectDirs {
+		if stats.ByDir[i] != dir {
+			t.Fatalf("expect dir %+v, got %+v", dir, stats.ByDir[i])
+		}
+	}
+	if len(stats.ByMime) != 2 || stats.ByMime[0].Name != "text/plain; charset=utf-8" || stats.ByMime[0].Count != 3 {
+		t.Fatalf("unexpected mime stats %+v", stats.ByMime)
+	}
+	if len(stats.ByFileType) != 1 || stats.ByFileType[0].Name != "standard" {
+		t.Fatalf("unexpected file type stats %+v", stats.ByFileType)
+	}
+	if len(stats.ByPutTime) != 1 || len(stats.ByPutTime[0].Name) != len("2006-01-02") {
+		t.Fatalf("unexpected put time stats %+v", stats.ByPutTime)
+	}
+	if len(stats.Duplicates) != 1 || len(stats.Duplicates[0].Keys) != 2 || stats.Duplicates[0].Wasted() != 5 {
+		t.Fatalf("unexpected duplicates %+v", stats.Duplicates)
+	}
+}
+
+func TestStatsDir(t *testing.T) {
+	cases := []struct {
+		key    string
+		depth  int
+		expect string
+	}{
+		{"a/b/c.txt", 1, "p/a/"},
+		{"a/b/c.txt", 2, "p/a/b/"},
+		{"a/b/c.txt", 3, "p/a/b/"},
+		{"c.txt", 1, STATS_ROOT_DIR},
+	}
+	for _, c := range cases {
+		if dir := statsDir("p/"+c.key, "p/", "/", c.depth); dir != c.expect {
+			t.Fatalf("expect dir of `%s` at depth %d to be `%s`, got `%s`", c.key, c.depth, c.expect, dir)
+		}
+	}
+}
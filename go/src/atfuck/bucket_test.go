@@ -1,20 +1,45 @@
 package atfuck
 
 import (
-	"os"
 	"testing"
 
-	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/fakeserver"
 )
 
 func TestGetBucketInfo(t *testing.T) {
-	ak := os.Getenv("AccessKey")
-	sk := os.Getenv("SecretKey")
-	bucket := os.Getenv("Bucket")
-	mac := digest.Mac{ak, []byte(sk)}
-	bucketInfo, gErr := GetBucketInfo(&mac, bucket)
+	_, mac := startFakeServer(t)
+	bucketInfo, gErr := GetBucketInfo(mac, fakeBucket)
 	if gErr != nil {
 		t.Fatal(gErr)
 	}
-	t.Log(bucketInfo.Region)
+	if bucketInfo.Region != fakeserver.Region {
+		t.Fatalf("unexpected region `%s`", bucketInfo.Region)
+	}
+
+	if _, gErr = GetBucketInfo(mac, "nosuchbucket"); gErr == nil {
+		t.Fatal("expect an error for unknown bucket")
+	}
+}
+
+func TestGetBuckets(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srv.CreateBucket("other", false)
+	buckets, gErr := GetBuckets(mac)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+	if len(buckets) != 2 || buckets[0] != "other" || buckets[1] != fakeBucket {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
+
+func TestGetDomainsOfBucket(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	domains, gErr := GetDomainsOfBucket(mac, fakeBucket)
+	if gErr != nil {
+		t.Fatal(gErr)
+	}
+	if len(domains) != 1 || domains[0] != srv.Domain(fakeBucket) {
+		t.Fatalf("unexpected domains %v", domains)
+	}
 }
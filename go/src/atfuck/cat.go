@@ -0,0 +1,156 @@
+package atfuck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"qiniu/rpc"
+	"time"
+
+	"qiniu/api.v6/auth/digest"
+)
+
+//a broken download of cat is resumed from the bytes written, with the interval doubled for each retry
+var catRetryPolicy = &rpc.Backoff{
+	MaxRetries:  5,
+	Interval:    time.Second,
+	MaxInterval: time.Second * 10,
+}
+
+var errFileChanged = errors.New("file changed during the download")
+
+//CatFile writes the file in bucket to w, the packed file is read from its pack
+func CatFile(ctx context.Context, mac *digest.Mac, bucket, key string, w io.Writer) (err error) {
+	return CatFileRange(ctx, mac, bucket, key, 0, -1, w)
+}
+
+//CatFileRange writes length bytes of the file in bucket from offset to w, or to the end of the file if length
+//is negative. The file is downloaded by the private link, a broken download is resumed from the bytes written
+//if the file is not changed, and the packed file is read from its pack.
+func CatFileRange(ctx context.Context, mac *digest.Mac, bucket, key string, offset, length int64, w io.Writer) (err error) {
+	if offset < 0 {
+		return fmt.Errorf("invalid offset %d", offset)
+	}
+	if length == 0 {
+		return
+	}
+	proxy, err := newBucketProxy(mac, bucket, "", "", "")
+	if err != nil {
+		return
+	}
+
+	//the write error stops the retries by canceling ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source := key
+	var base int64
+	var validator string
+	var written int64
+	err = rpc.WithRetry(ctx, catRetryPolicy, func() (rErr error) {
+		header := http.Header{}
+		if validator != "" {
+			header.Set("If-Range", validator)
+		}
+		resp, rErr := catRequest(ctx, proxy, source, base+offset+written, length-written, header)
+		if rErr != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		//the file not found may be packed, which is read from the range of its entry in pack
+		if resp.StatusCode == http.StatusNotFound && source == key {
+			entry, found, fErr := FindPackEntry(ctx, mac, bucket, key)
+			if fErr != nil {
+				return fErr
+			}
+			if !found {
+				cancel()
+				return fmt.Errorf("no such file `%s`", key)
+			}
+			if offset > entry.Size || offset == entry.Size && entry.Size > 0 {
+				cancel()
+				return fmt.Errorf("offset %d out of the file size %d", offset, entry.Size)
+			}
+			if length < 0 || offset+length > entry.Size {
+				length = entry.Size - offset
+			}
+			if length == 0 {
+				return
+			}
+			source, base = entry.Pack, entry.Offset
+			resp.Body.Close()
+			if resp, rErr = catRequest(ctx, proxy, source, base+offset, length, header); rErr != nil {
+				return
+			}
+			defer resp.Body.Close()
+		}
+		skip := int64(0)
+		if resp.Request.Header.Get("Range") != "" && resp.StatusCode == http.StatusOK {
+			//the whole file is returned for the resumed download only if it is changed,
+			//otherwise the server ignores the range, and the bytes before it are skipped
+			if resp.Request.Header.Get("If-Range") != "" {
+				cancel()
+				return errFileChanged
+			}
+			skip = base + offset + written
+		}
+		if resp.StatusCode/100 != 2 {
+			return &rpc.ErrorInfo{Code: resp.StatusCode, Err: fmt.Sprintf("get `%s` error, %s", source, resp.Status)}
+		}
+		if validator == "" {
+			if validator = resp.Header.Get("ETag"); validator == "" {
+				validator = resp.Header.Get("Last-Modified")
+			}
+		}
+
+		if skip > 0 {
+			if _, sErr := io.CopyN(ioutil.Discard, resp.Body, skip); sErr != nil {
+				return sErr
+			}
+		}
+		var body io.Reader = resp.Body
+		if length > 0 {
+			body = io.LimitReader(resp.Body, length-written)
+		}
+
+		cw := &catWriter{w: w}
+		n, cErr := io.Copy(cw, body)
+		written += n
+		if cw.err != nil {
+			cancel()
+			return cw.err
+		}
+		if cErr == nil && length > 0 && written < length {
+			cErr = io.ErrUnexpectedEOF
+		}
+		return cErr
+	})
+	return
+}
+
+//catRequest gets length bytes of the file from the offset, or to the end if length is negative
+func catRequest(ctx context.Context, proxy *bucketProxy, key string, offset, length int64,
+	header http.Header) (resp *http.Response, err error) {
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return proxy.download(ctx, key, header)
+}
+
+//catWriter keeps the error of w apart from the errors of the download
+type catWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *catWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.err = err
+	return
+}
@@ -0,0 +1,156 @@
+package atfuck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+//breakingTransport breaks the body of the first download from the host after the limit, and records the ranges requested
+type breakingTransport struct {
+	transport http.RoundTripper
+	host      string
+	limit     int64
+
+	lock   sync.Mutex
+	ranges []string
+	broken bool
+}
+
+func (t *breakingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	resp, err = t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode/100 != 2 || req.URL.Host != t.host {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ranges = append(t.ranges, req.Header.Get("Range"))
+	if !t.broken {
+		t.broken = true
+		resp.Body = &breakingBody{ReadCloser: resp.Body, left: t.limit}
+	}
+	return
+}
+
+type breakingBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *breakingBody) Read(p []byte) (n int, err error) {
+	if b.left <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err = b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return
+}
+
+//rangeIgnoringTransport drops the range of the downloads from the host, like a server not supporting the ranges
+type rangeIgnoringTransport struct {
+	transport http.RoundTripper
+	host      string
+}
+
+func (t *rangeIgnoringTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if req.URL.Host != t.host {
+		return t.transport.RoundTrip(req)
+	}
+	ignored := req.Clone(req.Context())
+	ignored.Header.Del("Range")
+	if resp, err = t.transport.RoundTrip(ignored); err == nil {
+		resp.Request = req
+	}
+	return
+}
+
+func TestCatFileRange(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	data := make([]byte, 100000)
+	rand.Read(data)
+	srv.PutObject(fakeBucket, "a.bin", data, "")
+	ioHost, _ := url.Parse(srv.IoHost)
+
+	interval := catRetryPolicy.Interval
+	catRetryPolicy.Interval = time.Millisecond
+	transport := http.DefaultTransport
+	t.Cleanup(func() {
+		catRetryPolicy.Interval = interval
+		http.DefaultTransport = transport
+	})
+
+	cases := []struct {
+		offset, length int64
+		ranges         []string
+	}{
+		{0, -1, []string{"", "bytes=1000-"}},
+		{500, 5000, []string{"bytes=500-5499", "bytes=1500-5499"}},
+		{90000, -1, []string{"bytes=90000-", "bytes=91000-"}},
+	}
+	for _, c := range cases {
+		breaking := &breakingTransport{transport: transport, host: ioHost.Host, limit: 1000}
+		http.DefaultTransport = breaking
+		var buf bytes.Buffer
+		if err := CatFileRange(context.Background(), mac, fakeBucket, "a.bin", c.offset, c.length, &buf); err != nil {
+			t.Fatal(err)
+		}
+		end := int64(len(data))
+		if c.length >= 0 {
+			end = c.offset + c.length
+		}
+		if !bytes.Equal(buf.Bytes(), data[c.offset:end]) {
+			t.Fatalf("content of range %d+%d mismatched", c.offset, c.length)
+		}
+		if len(breaking.ranges) != 2 || breaking.ranges[0] != c.ranges[0] || breaking.ranges[1] != c.ranges[1] {
+			t.Fatalf("expect the download resumed by %v, got %v", c.ranges, breaking.ranges)
+		}
+	}
+
+	//the bytes out of the range are skipped if the server ignores the range
+	http.DefaultTransport = &rangeIgnoringTransport{transport: transport, host: ioHost.Host}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := CatFileRange(context.Background(), mac, fakeBucket, "a.bin", c.offset, c.length, &buf); err != nil {
+			t.Fatal(err)
+		}
+		end := int64(len(data))
+		if c.length >= 0 {
+			end = c.offset + c.length
+		}
+		if !bytes.Equal(buf.Bytes(), data[c.offset:end]) {
+			t.Fatalf("content of range %d+%d mismatched when the range is ignored", c.offset, c.length)
+		}
+	}
+
+	//the write error is not retried
+	http.DefaultTransport = transport
+	err := CatFileRange(context.Background(), mac, fakeBucket, "a.bin", 0, -1, &failingWriter{})
+	if err == nil || err.Error() != "broken pipe" {
+		t.Fatalf("expect the write error, got %v", err)
+	}
+	if err := CatFileRange(context.Background(), mac, fakeBucket, "missing.bin", 0, -1, io.Discard); err == nil {
+		t.Fatal("expect the missing file")
+	}
+}
+
+type failingWriter struct {
+	count int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.count += 1
+	if w.count > 1 {
+		panic("write after the error")
+	}
+	return 0, errors.New("broken pipe")
+}
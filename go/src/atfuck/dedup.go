@@ -0,0 +1,187 @@
+package atfuck
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"qiniu/api.v6/auth/digest"
+)
+
+/*
+Dedup mode of qupload keeps a local index of the qetag to a key of each file in bucket, built from
+the bucket list and updated after each upload, so the file of a known hash is copied in bucket
+instead of uploaded again.
+
+With the hash layout the files are stored as <dedup_hash_prefix><qetag>, and the manifest object
+
+	<key_prefix>.atfuck-manifests/<run id>.jsonl
+
+has a json line of ManifestEntry for each local file uploaded under the key prefix by now.
+*/
+
+const (
+	DEFAULT_DEDUP_HASH_PREFIX = "hash/"
+	DEDUP_MANIFEST_DIR        = ".atfuck-manifests/"
+
+	dedupBuiltKey       = "!built"
+	dedupHashPrefix     = "h:"
+	dedupKeyPrefix      = "k:"
+	dedupManifestPrefix = "m:"
+)
+
+//ManifestEntry maps the key of a local file to its hash in the hash layout
+type ManifestEntry struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type dedupIndex struct {
+	db *leveldb.DB
+	//empty if not the hash layout
+	hashPrefix string
+}
+
+//openDedupIndex opens the index of the bucket, and builds it from the bucket list if not built or rebuild
+func openDedupIndex(mac *digest.Mac, bucket, indexPath string, rebuild bool) (index *dedupIndex, err error) {
+	db, err := leveldb.OpenFile(indexPath, nil)
+	if err != nil {
+		return
+	}
+	index = &dedupIndex{db: db}
+	if _, gErr := db.Get([]byte(dedupBuiltKey), nil); gErr == nil && !rebuild {
+		return
+	}
+	if err = index.build(mac, bucket, indexPath+".list"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return
+}
+
+func (d *dedupIndex) build(mac *digest.Mac, bucket, listFile string) (err error) {
+	if err = ListBucket(mac, bucket, "", "", listFile); err != nil {
+		return
+	}
+	defer os.Remove(listFile)
+	listFp, err := os.Open(listFile)
+	if err != nil {
+		return
+	}
+	defer listFp.Close()
+
+	//the hashes of the files deleted from bucket are dropped
+	for _, prefix := range []string{dedupHashPrefix, dedupKeyPrefix} {
+		iter := d.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			d.db.Delete(iter.Key(), nil)
+		}
+		iter.Release()
+	}
+
+	batch := new(leveldb.Batch)
+	listScanner := bufio.NewScanner(listFp)
+	for listScanner.Scan() {
+		items := strings.Split(listScanner.Text(), "\t")
+		if len(items) < 3 || items[2] == "" || IsPackKey(items[0]) {
+			continue
+		}
+		batch.Put([]byte(dedupHashPrefix+items[2]), []byte(items[0]))
+		batch.Put([]byte(dedupKeyPrefix+items[0]), []byte(items[2]))
+		if batch.Len() >= 1000 {
+			if err = d.db.Write(batch, nil); err != nil {
+				return
+			}
+			batch.Reset()
+		}
+	}
+	if err = listScanner.Err(); err != nil {
+		return
+	}
+	batch.Put([]byte(dedupBuiltKey), []byte(bucket))
+	return d.db.Write(batch, nil)
+}
+
+func (d *dedupIndex) close() {
+	d.db.Close()
+}
+
+//get finds a key of the file of the hash in bucket
+func (d *dedupIndex) get(hash string) (key string, ok bool) {
+	value, err := d.db.Get([]byte(dedupHashPrefix+hash), nil)
+	if err != nil {
+		return
+	}
+	return string(value), true
+}
+
+//put maps the hash to the key, the previous hash of the key is dropped if it maps to the overwritten key
+func (d *dedupIndex) put(hash, key string) error {
+	batch := new(leveldb.Batch)
+	if oldHash, err := d.db.Get([]byte(dedupKeyPrefix+key), nil); err == nil && string(oldHash) != hash {
+		if oldKey, gErr := d.db.Get([]byte(dedupHashPrefix+string(oldHash)), nil); gErr == nil && string(oldKey) == key {
+			batch.Delete([]byte(dedupHashPrefix + string(oldHash)))
+		}
+	}
+	batch.Put([]byte(dedupHashPrefix+hash), []byte(key))
+	batch.Put([]byte(dedupKeyPrefix+key), []byte(hash))
+	return d.db.Write(batch, nil)
+}
+
+//forget drops the hash of the file deleted from bucket
+func (d *dedupIndex) forget(hash string) error {
+	return d.db.Delete([]byte(dedupHashPrefix+hash), nil)
+}
+
+//targetKey is the key to store the file of the hash
+func (d *dedupIndex) targetKey(key, hash string) string {
+	if d.hashPrefix != "" {
+		return d.hashPrefix + hash
+	}
+	return key
+}
+
+//record adds the local file to the manifest of the hash layout
+func (d *dedupIndex) record(key, hash string, size int64) error {
+	if d.hashPrefix == "" {
+		return nil
+	}
+	return d.db.Put([]byte(dedupManifestPrefix+key), []byte(fmt.Sprintf("%s\t%d", hash, size)), nil)
+}
+
+//writeManifest writes the manifest of the files under the key prefix, and returns the count
+func (d *dedupIndex) writeManifest(keyPrefix, manifestFile string) (count int64, err error) {
+	fp, err := os.Create(manifestFile)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	bWriter := bufio.NewWriter(fp)
+	encoder := json.NewEncoder(bWriter)
+
+	iter := d.db.NewIterator(util.BytesPrefix([]byte(dedupManifestPrefix+keyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		items := strings.SplitN(string(iter.Value()), "\t", 2)
+		if len(items) != 2 {
+			continue
+		}
+		entry := ManifestEntry{Key: strings.TrimPrefix(string(iter.Key()), dedupManifestPrefix), Hash: items[0]}
+		entry.Size, _ = strconv.ParseInt(items[1], 10, 64)
+		if err = encoder.Encode(&entry); err != nil {
+			return
+		}
+		count += 1
+	}
+	if err = iter.Error(); err != nil {
+		return
+	}
+	err = bWriter.Flush()
+	return
+}
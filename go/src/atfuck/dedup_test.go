@@ -0,0 +1,158 @@
+package atfuck
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func runTestUpload(t *testing.T, uploadConfig UploadConfig) (log string) {
+	configData, _ := json.Marshal(uploadConfig)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestQiniuUploadHelper$")
+	cmd.Env = append(os.Environ(), "ATFUCK_TEST_ROOT="+QShellRootPath, "ATFUCK_TEST_UPLOAD_CONFIG="+string(configData))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("qupload failed, %s\n%s", err, out)
+	}
+	data, _ := ioutil.ReadFile(uploadConfig.LogFile)
+	return string(data)
+}
+
+func TestQiniuUploadDedup(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	existing := []byte("the content in bucket")
+	existingHash, _ := srv.PutObject(fakeBucket, "old/x.bin", existing, "")
+
+	srcDir := t.TempDir()
+	files := map[string][]byte{
+		"a.bin":     existing,
+		"b.bin":     []byte("the new content"),
+		"dir/c.bin": existing,
+	}
+	for name, data := range files {
+		localPath := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		ioutil.WriteFile(localPath, data, 0644)
+	}
+	hostsData, _ := json.Marshal(fakeHostsConfig(srv))
+	ioutil.WriteFile(filepath.Join(QShellRootPath, ".atfuck", "hosts.json"), hostsData, 0644)
+
+	//the files of the known hash are copied in bucket
+	log := runTestUpload(t, UploadConfig{
+		SrcDir:      srcDir,
+		Bucket:      fakeBucket,
+		KeyPrefix:   "up/",
+		LogFile:     filepath.Join(t.TempDir(), "upload.log"),
+		Dedup:       true,
+		DedupRescan: true,
+	})
+	for name, data := range files {
+		if remote, ok := srv.GetObject(fakeBucket, "up/"+name); !ok || !bytes.Equal(remote, data) {
+			t.Fatalf("content of `%s` mismatched", name)
+		}
+	}
+	for _, key := range []string{"up/a.bin", "up/dir/c.bin"} {
+		if !strings.Contains(log, "=> `"+key+"` of the same hash") {
+			t.Fatalf("expect `%s` copied in bucket, log:\n%s", key, log)
+		}
+	}
+	if strings.Contains(log, "=> `up/b.bin` of the same hash") {
+		t.Fatal("expect the new file uploaded")
+	}
+
+	//the hash layout stores the files by the hashes with the manifest
+	log = runTestUpload(t, UploadConfig{
+		SrcDir:          srcDir,
+		Bucket:          fakeBucket,
+		KeyPrefix:       "logical/",
+		LogFile:         filepath.Join(t.TempDir(), "upload.log"),
+		Dedup:           true,
+		DedupRescan:     true,
+		DedupHashLayout: true,
+	})
+	if _, ok := srv.GetObject(fakeBucket, "logical/a.bin"); ok {
+		t.Fatal("expect the file stored by the hash only")
+	}
+	if remote, ok := srv.GetObject(fakeBucket, DEFAULT_DEDUP_HASH_PREFIX+existingHash); !ok || !bytes.Equal(remote, existing) {
+		t.Fatal("expect the file stored by the hash")
+	}
+
+	listFile := filepath.Join(t.TempDir(), "list.txt")
+	if err := ListBucket(mac, fakeBucket, "logical/"+DEDUP_MANIFEST_DIR, "", listFile); err != nil {
+		t.Fatal(err)
+	}
+	listData, _ := ioutil.ReadFile(listFile)
+	manifestKey := strings.Split(string(listData), "\t")[0]
+	manifestData, ok := srv.GetObject(fakeBucket, manifestKey)
+	if !ok {
+		t.Fatalf("expect the manifest, list `%s`", listData)
+	}
+	hashes := make(map[string]string)
+	decoder := json.NewDecoder(bytes.NewReader(manifestData))
+	for decoder.More() {
+		var entry ManifestEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		hashes[entry.Key] = entry.Hash
+	}
+	if len(hashes) != len(files) {
+		t.Fatalf("expect %d files in manifest, got `%s`", len(files), manifestData)
+	}
+	for name, data := range files {
+		remote, _ := srv.GetObject(fakeBucket, DEFAULT_DEDUP_HASH_PREFIX+hashes["logical/"+name])
+		if !bytes.Equal(remote, data) {
+			t.Fatalf("content of `%s` by the manifest mismatched", name)
+		}
+	}
+
+	//the files overwritten in bucket since indexed are not copied
+	for _, key := range []string{"old/x.bin", "up/a.bin", "up/dir/c.bin", DEFAULT_DEDUP_HASH_PREFIX + existingHash} {
+		srv.PutObject(fakeBucket, key, []byte("overwritten"), "")
+	}
+	log = runTestUpload(t, UploadConfig{
+		SrcDir:    srcDir,
+		Bucket:    fakeBucket,
+		KeyPrefix: "again/",
+		LogFile:   filepath.Join(t.TempDir(), "upload.log"),
+		Dedup:     true,
+	})
+	for name, data := range files {
+		if remote, ok := srv.GetObject(fakeBucket, "again/"+name); !ok || !bytes.Equal(remote, data) {
+			t.Fatalf("content of `%s` mismatched, log:\n%s", name, log)
+		}
+	}
+}
+
+func TestDedupIndexPut(t *testing.T) {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "dedup"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &dedupIndex{db: db}
+	defer index.close()
+
+	index.put("hash1", "a")
+	index.put("hash1", "b")
+	//the key overwritten by another hash
+	index.put("hash2", "b")
+	if _, ok := index.get("hash1"); ok {
+		t.Fatal("expect the hash of the overwritten key dropped")
+	}
+	if key, ok := index.get("hash2"); !ok || key != "b" {
+		t.Fatalf("expect hash2 of `b`, got `%s`", key)
+	}
+	//the hash of another key is kept
+	index.put("hash3", "c")
+	index.put("hash3", "d")
+	index.put("hash4", "c")
+	if key, ok := index.get("hash3"); !ok || key != "d" {
+		t.Fatalf("expect hash3 of `d`, got `%s`", key)
+	}
+}
@@ -0,0 +1,296 @@
+package atfuck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rsf"
+)
+
+//DiffLocation is one side of the diff, a bucket prefix, a local dir or a list file
+type DiffLocation struct {
+	Bucket   string
+	Prefix   string
+	LocalDir string
+	ListFile string
+}
+
+//ParseDiffLocation parses `qiniu://<Bucket>[/<Prefix>]`, `list://<ListFile>` or a local dir
+func ParseDiffLocation(location string) (loc DiffLocation, err error) {
+	switch {
+	case strings.HasPrefix(location, "qiniu://"):
+		path := strings.TrimPrefix(location, "qiniu://")
+		if idx := strings.Index(path, "/"); idx >= 0 {
+			loc.Bucket, loc.Prefix = path[:idx], path[idx+1:]
+		} else {
+			loc.Bucket = path
+		}
+		if loc.Bucket == "" {
+			err = fmt.Errorf("No bucket in `%s`", location)
+		}
+	case strings.HasPrefix(location, "list://"):
+		loc.ListFile = strings.TrimPrefix(location, "list://")
+		if loc.ListFile == "" {
+			err = fmt.Errorf("No list file in `%s`", location)
+		}
+	default:
+		loc.LocalDir = strings.TrimPrefix(location, "file://")
+		fi, sErr := os.Stat(loc.LocalDir)
+		if sErr != nil {
+			err = sErr
+		} else if !fi.IsDir() {
+			err = fmt.Errorf("`%s` is not a directory", loc.LocalDir)
+		}
+	}
+	return
+}
+
+func (loc DiffLocation) String() string {
+	switch {
+	case loc.Bucket != "":
+		return fmt.Sprintf("qiniu://%s/%s", loc.Bucket, loc.Prefix)
+	case loc.ListFile != "":
+		return "list://" + loc.ListFile
+	}
+	return loc.LocalDir
+}
+
+//diffEntry is a file of a location, the hash of a local file is computed only when compared
+type diffEntry struct {
+	key   string
+	fsize int64
+	hash  string
+	local string
+}
+
+func (e *diffEntry) etag() (hash string, err error) {
+	if e.hash == "" && e.local != "" {
+		e.hash, err = GetEtag(e.local)
+	}
+	return e.hash, err
+}
+
+//walkDiffLocation passes each file of the location to fn
+func walkDiffLocation(ctx context.Context, mac *digest.Mac, loc DiffLocation, fn func(entry *diffEntry)) (err error) {
+	if loc.Bucket != "" {
+		return ListBucketFuncCtx(ctx, mac, loc.Bucket, loc.Prefix, "", func(entries []rsf.ListItem, _ string) {
+			for _, entry := range entries {
+				fn(&diffEntry{key: entry.Key, fsize: entry.Fsize, hash: entry.Hash})
+			}
+		})
+	}
+
+	listFile := loc.ListFile
+	if loc.LocalDir != "" {
+		cacheFh, tErr := ioutil.TempFile("", "atfuck-diff-")
+		if tErr != nil {
+			return tErr
+		}
+		cacheFh.Close()
+		listFile = cacheFh.Name()
+		defer os.Remove(listFile)
+		if _, err = DirCache(loc.LocalDir, listFile); err != nil {
+			return
+		}
+	}
+
+	fh, err := os.Open(listFile)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		//the lines of listbucket are `key fsize hash ...`, the lines of dircache are `key fsize modtime`
+		items := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+		if len(items) < 2 || items[0] == "" {
+			continue
+		}
+		fsize, pErr := strconv.ParseInt(items[1], 10, 64)
+		if pErr != nil {
+			logs.Error("Invalid fsize of line `%s` in list file `%s`", scanner.Text(), listFile)
+			continue
+		}
+		entry := diffEntry{key: items[0], fsize: fsize}
+		if loc.LocalDir != "" {
+			entry.local = filepath.Join(loc.LocalDir, entry.key)
+			entry.key = filepath.ToSlash(entry.key)
+		} else if len(items) >= 3 {
+			if _, pErr := strconv.ParseInt(items[2], 10, 64); pErr != nil {
+				entry.hash = items[2]
+			}
+		}
+		fn(&entry)
+	}
+	return scanner.Err()
+}
+
+// ----------------------------------------------------------
+
+type DiffOptions struct {
+	//the src key is mapped to the dest key by replacing the prefix StripPrefix with AddPrefix,
+	//if both are empty, the prefix of the src bucket is replaced with the prefix of the dest bucket
+	StripPrefix string
+	AddPrefix   string
+
+	//compare the size only, the qetag of the local files are not computed
+	SizeOnly bool
+
+	//the result files, `<SrcKey>\t<DestKey>` for missing and changed, `<DestKey>` for extra,
+	//they can be used by batchcopy and batchdelete, empty to skip
+	MissingFile string
+	ExtraFile   string
+	ChangedFile string
+}
+
+type DiffResult struct {
+	Compared int64
+	Same     int64
+	Missing  int64
+	Extra    int64
+	Changed  int64
+}
+
+//Equal returns whether the two locations hold the same files
+func (r DiffResult) Equal() bool {
+	return r.Missing == 0 && r.Extra == 0 && r.Changed == 0
+}
+
+type diffWriter struct {
+	fh *os.File
+	bw *bufio.Writer
+}
+
+func newDiffWriter(path string) (w *diffWriter, err error) {
+	w = &diffWriter{}
+	if path == "" {
+		return
+	}
+	if w.fh, err = os.Create(path); err != nil {
+		return
+	}
+	w.bw = bufio.NewWriter(w.fh)
+	return
+}
+
+func (w *diffWriter) writeLine(items ...string) {
+	if w.bw != nil {
+		w.bw.WriteString(strings.Join(items, "\t") + "\n")
+	}
+}
+
+func (w *diffWriter) close() (err error) {
+	if w.fh == nil {
+		return
+	}
+	err = w.bw.Flush()
+	if cErr := w.fh.Close(); err == nil {
+		err = cErr
+	}
+	return
+}
+
+//sameFile compares the size, then the qetag if both sides have it or are local files
+func sameFile(src, dest *diffEntry, sizeOnly bool) (same bool, err error) {
+	if src.fsize != dest.fsize {
+		return
+	}
+	if sizeOnly || (src.hash == "" && src.local == "") || (dest.hash == "" && dest.local == "") {
+		same = true
+		return
+	}
+	srcHash, err := src.etag()
+	if err != nil {
+		return
+	}
+	destHash, err := dest.etag()
+	if err != nil {
+		return
+	}
+	same = srcHash == destHash
+	return
+}
+
+//Diff loads the dest files into memory, then compares each src file with the dest file of the mapped key
+func Diff(ctx context.Context, mac *digest.Mac, src, dest DiffLocation, opts DiffOptions) (result DiffResult, err error) {
+	if opts.StripPrefix == "" && opts.AddPrefix == "" {
+		opts.StripPrefix, opts.AddPrefix = src.Prefix, dest.Prefix
+	}
+
+	destEntries := make(map[string]*diffEntry)
+	err = walkDiffLocation(ctx, mac, dest, func(entry *diffEntry) {
+		destEntries[entry.key] = entry
+	})
+	if err != nil {
+		return
+	}
+
+	var writers [3]*diffWriter
+	for i, path := range []string{opts.MissingFile, opts.ExtraFile, opts.ChangedFile} {
+		if writers[i], err = newDiffWriter(path); err != nil {
+			return
+		}
+		defer func(w *diffWriter) {
+			if cErr := w.close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}(writers[i])
+	}
+	missingW, extraW, changedW := writers[0], writers[1], writers[2]
+
+	err = walkDiffLocation(ctx, mac, src, func(entry *diffEntry) {
+		if !strings.HasPrefix(entry.key, opts.StripPrefix) {
+			return
+		}
+		result.Compared += 1
+		destKey := opts.AddPrefix + strings.TrimPrefix(entry.key, opts.StripPrefix)
+		destEntry, ok := destEntries[destKey]
+		if !ok {
+			result.Missing += 1
+			missingW.writeLine(entry.key, destKey)
+			return
+		}
+		delete(destEntries, destKey)
+
+		same, sErr := sameFile(entry, destEntry, opts.SizeOnly)
+		if sErr != nil {
+			logs.Error("Failed to compare `%s` with `%s`, %s", entry.key, destKey, sErr)
+		}
+		if same {
+			result.Same += 1
+		} else {
+			result.Changed += 1
+			changedW.writeLine(entry.key, destKey)
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	//the dest files not matched are extra, only those under the mapped prefix
+	extraKeys := make([]string, 0)
+	for key := range destEntries {
+		if strings.HasPrefix(key, opts.AddPrefix) {
+			extraKeys = append(extraKeys, key)
+		}
+	}
+	sort.Strings(extraKeys)
+	for _, key := range extraKeys {
+		extraW.writeLine(key)
+	}
+	result.Extra = int64(len(extraKeys))
+	return
+}
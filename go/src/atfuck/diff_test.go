@@ -0,0 +1,105 @@
+package atfuck
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srv.CreateBucket("backup", false)
+	for key, data := range map[string]string{"src/a.txt": "a", "src/b.txt": "b", "src/c.txt": "c"} {
+		srv.PutObject(fakeBucket, key, []byte(data), "")
+	}
+	for key, data := range map[string]string{"dst/a.txt": "a", "dst/b.txt": "B", "dst/d.txt": "d"} {
+		srv.PutObject("backup", key, []byte(data), "")
+	}
+
+	tmpDir := t.TempDir()
+	opts := DiffOptions{
+		MissingFile: filepath.Join(tmpDir, "missing.txt"),
+		ExtraFile:   filepath.Join(tmpDir, "extra.txt"),
+		ChangedFile: filepath.Join(tmpDir, "changed.txt"),
+	}
+	src := DiffLocation{Bucket: fakeBucket, Prefix: "src/"}
+	dest := DiffLocation{Bucket: "backup", Prefix: "dst/"}
+	result, err := Diff(context.Background(), mac, src, dest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (DiffResult{Compared: 3, Same: 1, Missing: 1, Extra: 1, Changed: 1}) || result.Equal() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for path, expect := range map[string]string{
+		opts.MissingFile: "src/c.txt\tdst/c.txt\n",
+		opts.ExtraFile:   "dst/d.txt\n",
+		opts.ChangedFile: "src/b.txt\tdst/b.txt\n",
+	} {
+		data, rErr := ioutil.ReadFile(path)
+		if rErr != nil {
+			t.Fatal(rErr)
+		}
+		if string(data) != expect {
+			t.Fatalf("expect `%s` in %s, got `%s`", expect, path, data)
+		}
+	}
+
+	//a local dir compared with the dest prefix, the qetag of local files is compared
+	localDir := filepath.Join(tmpDir, "local")
+	os.MkdirAll(localDir, 0755)
+	for key, data := range map[string]string{"a.txt": "a", "b.txt": "b", "d.txt": "d"} {
+		ioutil.WriteFile(filepath.Join(localDir, key), []byte(data), 0644)
+	}
+	local, err := ParseDiffLocation(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Diff(context.Background(), mac, local, dest, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Compared != 3 || result.Same != 2 || result.Changed != 1 {
+		t.Fatalf("unexpected result of local dir %+v", result)
+	}
+	result, err = Diff(context.Background(), mac, local, dest, DiffOptions{SizeOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Equal() {
+		t.Fatalf("expect equal by size, got %+v", result)
+	}
+
+	//a list file of listbucket
+	listFile := filepath.Join(tmpDir, "list.txt")
+	if err = ListBucket(mac, "backup", "dst/", "", listFile); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ParseDiffLocation("list://" + listFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Diff(context.Background(), mac, list, dest, DiffOptions{StripPrefix: "dst/", AddPrefix: "dst/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Equal() || result.Same != 3 {
+		t.Fatalf("expect list file equal to the bucket, got %+v", result)
+	}
+}
+
+func TestParseDiffLocation(t *testing.T) {
+	loc, err := ParseDiffLocation("qiniu://bucket/some/prefix")
+	if err != nil || loc.Bucket != "bucket" || loc.Prefix != "some/prefix" {
+		t.Fatalf("unexpected location %+v, %v", loc, err)
+	}
+	if _, err = ParseDiffLocation("qiniu://"); err == nil {
+		t.Fatal("expect a location without bucket to fail")
+	}
+	if _, err = ParseDiffLocation(filepath.Join(t.TempDir(), "missing")); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expect a missing dir to fail, got %v", err)
+	}
+}
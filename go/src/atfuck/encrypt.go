@@ -0,0 +1,482 @@
+package atfuck
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+)
+
+/*
+An encrypted file is stored as the envelope header followed by the chunks.
+
+The header of ENCRYPT_HEADER_SIZE bytes:
+
+	magic "ATFKENC1" | chunk size uint32 | plain size uint64 | master key id [8] | nonce prefix [8] |
+	wrap nonce [12] | data key wrapped by the master key with AES-GCM [48]
+
+Each chunk of ENCRYPT_CHUNK_SIZE plain bytes, the last one may be shorter, is sealed by AES-GCM with
+the data key, the nonce of the chunk is the nonce prefix and the chunk index, and the additional data
+marks the last chunk, so the chunks can not be reordered or truncated. An empty file has one empty chunk.
+
+The chunks are sealed independently and the same envelope always produces the same ciphertext,
+so the ciphertext can be read at any offset for the resumable upload.
+*/
+
+const (
+	ENCRYPT_CHUNK_SIZE  = 64 * 1024
+	ENCRYPT_HEADER_SIZE = 96
+
+	encryptMagic     = "ATFKENC1"
+	encryptKeySize   = 32
+	encryptTagSize   = 16
+	encryptNonceSize = 12
+)
+
+var (
+	ErrNotEncrypted       = errors.New("not an encrypted file")
+	ErrWrongMasterKey     = errors.New("file encrypted by another master key")
+	ErrCorruptedEncrypted = errors.New("encrypted file corrupted")
+)
+
+//MasterKey wraps the data keys of the files
+type MasterKey struct {
+	key []byte
+	id  [8]byte
+}
+
+//LoadMasterKey reads the master key file, which holds the base64 or hex of 32 random bytes,
+//like the output of `openssl rand -base64 32`
+func LoadMasterKey(keyFile string) (master *MasterKey, err error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return
+	}
+	text := strings.TrimSpace(string(data))
+	key, dErr := base64.StdEncoding.DecodeString(text)
+	if dErr != nil || len(key) != encryptKeySize {
+		key, dErr = hex.DecodeString(text)
+	}
+	if dErr != nil || len(key) != encryptKeySize {
+		err = fmt.Errorf("Invalid master key file `%s`, should be the base64 or hex of %d bytes", keyFile, encryptKeySize)
+		return
+	}
+	return NewMasterKey(key), nil
+}
+
+func NewMasterKey(key []byte) *MasterKey {
+	master := &MasterKey{key: key}
+	sum := sha256.Sum256(key)
+	copy(master.id[:], sum[:])
+	return master
+}
+
+//Id is the fingerprint of the master key
+func (m *MasterKey) Id() string {
+	return hex.EncodeToString(m.id[:])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Envelope is the header of an encrypted file
+type Envelope struct {
+	ChunkSize int64
+	Size      int64
+	KeyId     [8]byte
+	Nonce     [8]byte
+
+	aead    cipher.AEAD
+	dataKey []byte
+}
+
+//NewEnvelope makes an envelope with a random data key for a file of the size
+func NewEnvelope(master *MasterKey, size int64) (env *Envelope, err error) {
+	env = &Envelope{ChunkSize: ENCRYPT_CHUNK_SIZE, Size: size, KeyId: master.id, dataKey: make([]byte, encryptKeySize)}
+	if _, err = rand.Read(env.dataKey); err != nil {
+		return
+	}
+	if _, err = rand.Read(env.Nonce[:]); err != nil {
+		return
+	}
+	env.aead, err = newGCM(env.dataKey)
+	return
+}
+
+//Marshal wraps the data key by the master key
+func (env *Envelope) Marshal(master *MasterKey) (header []byte, err error) {
+	header = make([]byte, 36, ENCRYPT_HEADER_SIZE)
+	copy(header, encryptMagic)
+	binary.BigEndian.PutUint32(header[8:], uint32(env.ChunkSize))
+	binary.BigEndian.PutUint64(header[12:], uint64(env.Size))
+	copy(header[20:], env.KeyId[:])
+	copy(header[28:], env.Nonce[:])
+
+	aead, err := newGCM(master.key)
+	if err != nil {
+		return
+	}
+	wrapNonce := make([]byte, encryptNonceSize)
+	if _, err = rand.Read(wrapNonce); err != nil {
+		return
+	}
+	header = append(header, wrapNonce...)
+	header = aead.Seal(header, wrapNonce, env.dataKey, header[:36])
+	return
+}
+
+//IsEncrypted checks the magic of the header
+func IsEncrypted(header []byte) bool {
+	return len(header) >= len(encryptMagic) && string(header[:len(encryptMagic)]) == encryptMagic
+}
+
+//OpenEnvelope unwraps the data key of the header by the master key
+func OpenEnvelope(master *MasterKey, header []byte) (env *Envelope, err error) {
+	if len(header) < ENCRYPT_HEADER_SIZE || !IsEncrypted(header) {
+		return nil, ErrNotEncrypted
+	}
+	env = &Envelope{
+		ChunkSize: int64(binary.BigEndian.Uint32(header[8:])),
+		Size:      int64(binary.BigEndian.Uint64(header[12:])),
+	}
+	copy(env.KeyId[:], header[20:])
+	copy(env.Nonce[:], header[28:])
+	if env.KeyId != master.id {
+		return nil, ErrWrongMasterKey
+	}
+	if env.ChunkSize <= 0 || env.Size < 0 {
+		return nil, ErrCorruptedEncrypted
+	}
+	aead, err := newGCM(master.key)
+	if err != nil {
+		return
+	}
+	wrapNonce := header[36 : 36+encryptNonceSize]
+	if env.dataKey, err = aead.Open(nil, wrapNonce, header[36+encryptNonceSize:ENCRYPT_HEADER_SIZE], header[:36]); err != nil {
+		return nil, ErrCorruptedEncrypted
+	}
+	env.aead, err = newGCM(env.dataKey)
+	return
+}
+
+func (env *Envelope) chunkCount() int64 {
+	if env.Size == 0 {
+		return 1
+	}
+	return (env.Size + env.ChunkSize - 1) / env.ChunkSize
+}
+
+//EncryptedSize is the size of the encrypted file
+func (env *Envelope) EncryptedSize() int64 {
+	return ENCRYPT_HEADER_SIZE + env.Size + env.chunkCount()*encryptTagSize
+}
+
+func (env *Envelope) chunkNonce(idx int64) []byte {
+	nonce := make([]byte, encryptNonceSize)
+	copy(nonce, env.Nonce[:])
+	binary.BigEndian.PutUint32(nonce[8:], uint32(idx))
+	return nonce
+}
+
+func (env *Envelope) chunkAad(idx int64) []byte {
+	if idx == env.chunkCount()-1 {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+//EncryptedSize is the size of the plain file of the size after encrypted
+func EncryptedSize(size int64) int64 {
+	return (&Envelope{ChunkSize: ENCRYPT_CHUNK_SIZE, Size: size}).EncryptedSize()
+}
+
+//DecryptedSize is the size of the plain file of an encrypted file of the size, -1 if the size is invalid
+func DecryptedSize(encryptedSize int64) int64 {
+	size := encryptedSize - ENCRYPT_HEADER_SIZE
+	chunks := (size + ENCRYPT_CHUNK_SIZE + encryptTagSize - 1) / (ENCRYPT_CHUNK_SIZE + encryptTagSize)
+	size -= chunks * encryptTagSize
+	if size < 0 || EncryptedSize(size) != encryptedSize {
+		return -1
+	}
+	return size
+}
+
+// ----------------------------------------------------------
+
+//encryptReaderAt reads the encrypted file at any offset
+type encryptReaderAt struct {
+	env    *Envelope
+	header []byte
+	src    io.ReaderAt
+}
+
+//NewEncryptReaderAt encrypts the plain file of the envelope after the marshaled header,
+//the size is the encrypted size
+func NewEncryptReaderAt(env *Envelope, header []byte, src io.ReaderAt) (r io.ReaderAt, size int64) {
+	return &encryptReaderAt{env: env, header: header[:ENCRYPT_HEADER_SIZE], src: src}, env.EncryptedSize()
+}
+
+func (e *encryptReaderAt) sealChunk(idx int64) ([]byte, error) {
+	offset := idx * e.env.ChunkSize
+	size := e.env.Size - offset
+	if size > e.env.ChunkSize {
+		size = e.env.ChunkSize
+	}
+	plain := make([]byte, size, size+encryptTagSize)
+	if n, err := e.src.ReadAt(plain, offset); int64(n) != size {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return e.env.aead.Seal(plain[:0], e.env.chunkNonce(idx), plain, e.env.chunkAad(idx)), nil
+}
+
+func (e *encryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	total := e.env.EncryptedSize()
+	for len(p) > 0 && off < total {
+		var nn int
+		if off < ENCRYPT_HEADER_SIZE {
+			nn = copy(p, e.header[off:])
+		} else {
+			sealedSize := e.env.ChunkSize + encryptTagSize
+			idx := (off - ENCRYPT_HEADER_SIZE) / sealedSize
+			sealed, sErr := e.sealChunk(idx)
+			if sErr != nil {
+				return n, sErr
+			}
+			nn = copy(p, sealed[off-ENCRYPT_HEADER_SIZE-idx*sealedSize:])
+		}
+		n += nn
+		off += int64(nn)
+		p = p[nn:]
+	}
+	if len(p) > 0 {
+		err = io.EOF
+	}
+	return
+}
+
+//decryptReader decrypts the chunks one by one
+type decryptReader struct {
+	env   *Envelope
+	src   io.Reader
+	idx   int64
+	plain []byte
+	buf   []byte
+}
+
+//NewDecryptReader reads the header and returns the reader of the plain file, which fails on the corrupted chunks
+func NewDecryptReader(master *MasterKey, src io.Reader) (r io.Reader, env *Envelope, err error) {
+	header := make([]byte, ENCRYPT_HEADER_SIZE)
+	if _, err = io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrNotEncrypted
+		}
+		return
+	}
+	if env, err = OpenEnvelope(master, header); err != nil {
+		return
+	}
+	return &decryptReader{env: env, src: src, buf: make([]byte, env.ChunkSize+encryptTagSize)}, env, nil
+}
+
+func (d *decryptReader) Read(p []byte) (n int, err error) {
+	for len(d.plain) == 0 {
+		if d.idx == d.env.chunkCount() {
+			//nothing is allowed after the last chunk
+			if n, _ := d.src.Read(d.buf[:1]); n > 0 {
+				return 0, ErrCorruptedEncrypted
+			}
+			return 0, io.EOF
+		}
+		size := d.env.Size - d.idx*d.env.ChunkSize
+		if size > d.env.ChunkSize {
+			size = d.env.ChunkSize
+		}
+		sealed := d.buf[:size+encryptTagSize]
+		if _, err = io.ReadFull(d.src, sealed); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrCorruptedEncrypted
+			}
+			return
+		}
+		if d.plain, err = d.env.aead.Open(sealed[:0], d.env.chunkNonce(d.idx), sealed, d.env.chunkAad(d.idx)); err != nil {
+			return 0, ErrCorruptedEncrypted
+		}
+		d.idx += 1
+	}
+	n = copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return
+}
+
+// ----------------------------------------------------------
+
+//IsEncryptedFile checks the magic of the local file
+func IsEncryptedFile(localFile string) (bool, error) {
+	fp, err := os.Open(localFile)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+	header := make([]byte, len(encryptMagic))
+	if _, err = io.ReadFull(fp, header); err != nil {
+		return false, nil
+	}
+	return IsEncrypted(header), nil
+}
+
+//DecryptFile decrypts the local file to the dest file, the dest file is removed if failed
+func DecryptFile(master *MasterKey, srcFile, destFile string) (err error) {
+	srcFp, err := os.Open(srcFile)
+	if err != nil {
+		return
+	}
+	defer srcFp.Close()
+	r, _, err := NewDecryptReader(master, srcFp)
+	if err != nil {
+		return
+	}
+	destFp, err := os.Create(destFile)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(destFp, r)
+	if cErr := destFp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(destFile)
+	}
+	return
+}
+
+//EncryptedEtag is the etag of the local file encrypted with the envelope of the header,
+//so the local file can be compared with the encrypted file in bucket
+func EncryptedEtag(master *MasterKey, header []byte, localFile string) (etag string, err error) {
+	env, err := OpenEnvelope(master, header)
+	if err != nil {
+		return
+	}
+	fp, err := os.Open(localFile)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() != env.Size {
+		//the encrypted file is of another size, the etag never matches
+		return
+	}
+	r, size := NewEncryptReaderAt(env, header, fp)
+	return GetEtagOfReader(io.NewSectionReader(r, 0, size), size)
+}
+
+//loadEnvelopeFile reads the envelope saved for the resumable upload of the local file, or saves a new one.
+//The saved envelope is reused only while the progress file of the upload exists, the progress is of the same
+//version of the file, so the data key and the nonce never encrypt another content
+func loadEnvelopeFile(master *MasterKey, envelopeFile, progressFile string, size int64) (env *Envelope, header []byte, err error) {
+	if _, sErr := os.Stat(progressFile); sErr == nil {
+		if header, err = ioutil.ReadFile(envelopeFile); err == nil {
+			if env, err = OpenEnvelope(master, header); err == nil && env.Size == size {
+				return
+			}
+		}
+	}
+	if env, err = NewEnvelope(master, size); err != nil {
+		return
+	}
+	if header, err = env.Marshal(master); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(envelopeFile, header, 0600)
+	return
+}
+
+//openEncrypted opens the local file to upload as the ciphertext, the envelope is saved to the envelope file
+//if not empty, so the upload resumed from the progress file goes on with the same ciphertext
+func openEncrypted(master *MasterKey, localFile, envelopeFile, progressFile string) (fp *os.File, r io.ReaderAt,
+	size int64, err error) {
+	if fp, err = os.Open(localFile); err != nil {
+		return
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return
+	}
+	var env *Envelope
+	var header []byte
+	if envelopeFile != "" {
+		env, header, err = loadEnvelopeFile(master, envelopeFile, progressFile, fi.Size())
+	} else if env, err = NewEnvelope(master, fi.Size()); err == nil {
+		header, err = env.Marshal(master)
+	}
+	if err != nil {
+		fp.Close()
+		return
+	}
+	r, size = NewEncryptReaderAt(env, header, fp)
+	return
+}
+
+//encryptedChecker compares the local files with the encrypted files in bucket
+type encryptedChecker struct {
+	master *MasterKey
+	mac    *digest.Mac
+	bucket string
+	proxy  *bucketProxy
+}
+
+//etag is the etag of the local file encrypted like the file in bucket,
+//empty if the file in bucket is not encrypted by the master key
+func (c *encryptedChecker) etag(key, localFile string) (etag string, err error) {
+	if c.proxy == nil {
+		if c.proxy, err = newBucketProxy(c.mac, c.bucket, "", "", ""); err != nil {
+			return
+		}
+	}
+	resp, err := c.proxy.download(context.Background(), key,
+		http.Header{"Range": {fmt.Sprintf("bytes=0-%d", ENCRYPT_HEADER_SIZE-1)}})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("get the header of `%s` error, %s", key, resp.Status)
+		return
+	}
+	header := make([]byte, ENCRYPT_HEADER_SIZE)
+	if _, rErr := io.ReadFull(resp.Body, header); rErr != nil || !IsEncrypted(header) {
+		logs.Warning("File `%s` in bucket is not encrypted", key)
+		return
+	}
+	if etag, err = EncryptedEtag(c.master, header, localFile); err == ErrWrongMasterKey {
+		logs.Warning("File `%s` in bucket is encrypted by another master key", key)
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,261 @@
+package atfuck
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testMasterKey(seed byte) *MasterKey {
+	return NewMasterKey(bytes.Repeat([]byte{seed}, 32))
+}
+
+func testEncrypt(t *testing.T, master *MasterKey, plain []byte) []byte {
+	env, err := NewEnvelope(master, int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := env.Marshal(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, size := NewEncryptReaderAt(env, header, bytes.NewReader(plain))
+	if size != EncryptedSize(int64(len(plain))) {
+		t.Fatalf("unexpected encrypted size %d of %d bytes", size, len(plain))
+	}
+	encrypted, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func testDecrypt(master *MasterKey, encrypted []byte) ([]byte, error) {
+	r, _, err := NewDecryptReader(master, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	master := testMasterKey(1)
+	for _, size := range []int{0, 1, ENCRYPT_CHUNK_SIZE, ENCRYPT_CHUNK_SIZE + 1, 3*ENCRYPT_CHUNK_SIZE - 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		encrypted := testEncrypt(t, master, plain)
+		if !IsEncrypted(encrypted) {
+			t.Fatal("expect the magic")
+		}
+		if DecryptedSize(int64(len(encrypted))) != int64(size) {
+			t.Fatalf("unexpected decrypted size of %d bytes", size)
+		}
+		decrypted, err := testDecrypt(master, encrypted)
+		if err != nil {
+			t.Fatalf("decrypt %d bytes error, %s", size, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Fatalf("round trip of %d bytes mismatched", size)
+		}
+	}
+	if DecryptedSize(ENCRYPT_HEADER_SIZE) != -1 {
+		t.Fatal("expect the invalid size without the chunk")
+	}
+}
+
+func TestEncryptReadAt(t *testing.T) {
+	master := testMasterKey(1)
+	plain := make([]byte, 3*ENCRYPT_CHUNK_SIZE+7)
+	rand.Read(plain)
+	env, _ := NewEnvelope(master, int64(len(plain)))
+	header, _ := env.Marshal(master)
+	r, size := NewEncryptReaderAt(env, header, bytes.NewReader(plain))
+	whole, _ := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+
+	//the resumable upload reads the blocks at any offset, maybe twice
+	for i := 0; i < 50; i++ {
+		off := rand.Int63n(size)
+		p := make([]byte, rand.Intn(2*ENCRYPT_CHUNK_SIZE)+1)
+		n, err := r.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], whole[off:off+int64(n)]) {
+			t.Fatalf("read at %d mismatched", off)
+		}
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	master := testMasterKey(1)
+	plain := make([]byte, 2*ENCRYPT_CHUNK_SIZE+3)
+	rand.Read(plain)
+	encrypted := testEncrypt(t, master, plain)
+
+	if _, err := testDecrypt(testMasterKey(2), encrypted); err != ErrWrongMasterKey {
+		t.Fatalf("expect the wrong master key, got %v", err)
+	}
+	if _, err := testDecrypt(master, plain); err != ErrNotEncrypted {
+		t.Fatalf("expect not encrypted, got %v", err)
+	}
+	tampered := append([]byte(nil), encrypted...)
+	tampered[ENCRYPT_HEADER_SIZE+ENCRYPT_CHUNK_SIZE+100] ^= 1
+	if _, err := testDecrypt(master, tampered); err == nil {
+		t.Fatal("expect the tampered chunk rejected")
+	}
+	//drop the last chunk, the previous one is not marked as the last
+	truncated := encrypted[:len(encrypted)-3-16]
+	if _, err := testDecrypt(master, truncated); err == nil {
+		t.Fatal("expect the truncated file rejected")
+	}
+	if _, err := testDecrypt(master, append(encrypted, 0)); err == nil {
+		t.Fatal("expect the trailing data rejected")
+	}
+}
+
+func TestEncryptedEtag(t *testing.T) {
+	master := testMasterKey(1)
+	plain := make([]byte, BLOCK_SIZE+1024)
+	rand.Read(plain)
+	localFile := filepath.Join(t.TempDir(), "plain.bin")
+	ioutil.WriteFile(localFile, plain, 0644)
+	encrypted := testEncrypt(t, master, plain)
+	encryptedFile := filepath.Join(t.TempDir(), "encrypted.bin")
+	ioutil.WriteFile(encryptedFile, encrypted, 0644)
+
+	expect, _ := GetEtag(encryptedFile)
+	etag, err := EncryptedEtag(master, encrypted[:ENCRYPT_HEADER_SIZE], localFile)
+	if err != nil || etag != expect {
+		t.Fatalf("expect etag %s, got %s %v", expect, etag, err)
+	}
+
+	destFile := filepath.Join(t.TempDir(), "decrypted.bin")
+	if err = DecryptFile(master, encryptedFile, destFile); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, _ := ioutil.ReadFile(destFile); !bytes.Equal(decrypted, plain) {
+		t.Fatal("decrypted file mismatched")
+	}
+}
+
+func TestLoadEnvelopeFile(t *testing.T) {
+	master := testMasterKey(2)
+	dir := t.TempDir()
+	envelopeFile := filepath.Join(dir, "a.progress.envelope")
+	progressFile := filepath.Join(dir, "a.progress")
+
+	//a new envelope without the progress
+	_, header1, err := loadEnvelopeFile(master, envelopeFile, progressFile, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, header2, _ := loadEnvelopeFile(master, envelopeFile, progressFile, 100)
+	if bytes.Equal(header1, header2) {
+		t.Fatal("expect a new envelope without the progress file")
+	}
+	//the same envelope to resume the progress
+	ioutil.WriteFile(progressFile, []byte("{}"), 0644)
+	if _, header3, _ := loadEnvelopeFile(master, envelopeFile, progressFile, 100); !bytes.Equal(header2, header3) {
+		t.Fatal("expect the saved envelope with the progress file")
+	}
+	if _, header4, _ := loadEnvelopeFile(master, envelopeFile, progressFile, 101); bytes.Equal(header2, header4) {
+		t.Fatal("expect a new envelope of another size")
+	}
+}
+
+func TestQiniuUploadEncrypted(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	master := testMasterKey(3)
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(master.key)+"\n"), 0600)
+
+	srcDir := t.TempDir()
+	files := map[string][]byte{
+		"a.txt":     []byte("secret"),
+		"dir/b.bin": make([]byte, BLOCK_SIZE+1024),
+	}
+	rand.Read(files["dir/b.bin"])
+	for name, data := range files {
+		localPath := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		ioutil.WriteFile(localPath, data, 0644)
+	}
+	hostsData, _ := json.Marshal(fakeHostsConfig(srv))
+	ioutil.WriteFile(filepath.Join(QShellRootPath, ".atfuck", "hosts.json"), hostsData, 0644)
+
+	//form upload for the small file, mkblk/mkfile and multipart upload (v2) for the big one
+	for _, v2 := range []bool{false, true} {
+		keyPrefix := "enc/"
+		if v2 {
+			keyPrefix = "enc2/"
+		}
+		uploadConfig := UploadConfig{
+			SrcDir:         srcDir,
+			Bucket:         fakeBucket,
+			KeyPrefix:      keyPrefix,
+			PutThreshold:   1024 * 1024,
+			LogFile:        filepath.Join(t.TempDir(), "upload.log"),
+			EncryptKeyFile: keyFile,
+
+			ResumableApiV2:         v2,
+			ResumableApiV2PartSize: 1024 * 1024,
+		}
+		configData, _ := json.Marshal(uploadConfig)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestQiniuUploadHelper$")
+		cmd.Env = append(os.Environ(), "ATFUCK_TEST_ROOT="+QShellRootPath, "ATFUCK_TEST_UPLOAD_CONFIG="+string(configData))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("qupload failed, %s\n%s", err, out)
+		}
+
+		for name, data := range files {
+			remote, ok := srv.GetObject(fakeBucket, keyPrefix+name)
+			if !ok || !IsEncrypted(remote) {
+				t.Fatalf("expect `%s` encrypted in bucket", keyPrefix+name)
+			}
+			if decrypted, err := testDecrypt(master, remote); err != nil || !bytes.Equal(decrypted, data) {
+				t.Fatalf("content of `%s` mismatched, %v", keyPrefix+name, err)
+			}
+		}
+	}
+
+	//the hash check compares the local file with the ciphertext in bucket
+	checker := &encryptedChecker{master: master, mac: mac, bucket: fakeBucket}
+	remote, _ := srv.GetObject(fakeBucket, "enc/dir/b.bin")
+	remoteFile := filepath.Join(t.TempDir(), "remote.bin")
+	ioutil.WriteFile(remoteFile, remote, 0644)
+	expect, _ := GetEtag(remoteFile)
+	if etag, err := checker.etag("enc/dir/b.bin", filepath.Join(srcDir, "dir/b.bin")); err != nil || etag != expect {
+		t.Fatalf("expect etag %s, got %s %v", expect, etag, err)
+	}
+	srv.PutObject(fakeBucket, "plain.txt", []byte("plain"), "")
+	if etag, err := (&encryptedChecker{master: master, mac: mac, bucket: fakeBucket}).etag("plain.txt",
+		filepath.Join(srcDir, "a.txt")); err != nil || etag != "" {
+		t.Fatalf("expect no etag of the plain file, got %s %v", etag, err)
+	}
+
+	//qdownload decrypts the encrypted files and keeps the plain ones
+	destDir := t.TempDir()
+	QiniuDownload(2, &DownloadConfig{
+		DestDir:        destDir,
+		Bucket:         fakeBucket,
+		AK:             fakeAccessKey,
+		SK:             fakeSecretKey,
+		Prefix:         "enc",
+		LogFile:        filepath.Join(t.TempDir(), "download.log"),
+		EncryptKeyFile: keyFile,
+	})
+	for name, data := range files {
+		for _, keyPrefix := range []string{"enc/", "enc2/"} {
+			if local, err := ioutil.ReadFile(filepath.Join(destDir, keyPrefix+name)); err != nil || !bytes.Equal(local, data) {
+				t.Fatalf("content of `%s` mismatched, %v", keyPrefix+name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package atfuck
+
+import (
+	"testing"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/conf"
+	"qiniu/api.v6/fakeserver"
+)
+
+const (
+	fakeAccessKey = "fake-ak"
+	fakeSecretKey = "fake-sk"
+	fakeBucket    = "test"
+)
+
+func fakeHostsConfig(srv *fakeserver.Server) HostsConfig {
+	return HostsConfig{
+		BucketRsHost:  srv.RsHost,
+		BucketApiHost: srv.ApiHost,
+		BucketUcHost:  srv.UcHost,
+		Zones: map[string]ZoneConfig{
+			fakeserver.Region: {
+				UpHost:    srv.UpHost,
+				RsHost:    srv.RsHost,
+				RsfHost:   srv.RsfHost,
+				IovipHost: srv.IoHost,
+				ApiHost:   srv.ApiHost,
+			},
+		},
+	}
+}
+
+//startFakeServer points atfuck at a local fake server with the bucket `test`,
+//and saves its account under a temp QShellRootPath
+func startFakeServer(t *testing.T) (*fakeserver.Server, *digest.Mac) {
+	srv := fakeserver.New(fakeAccessKey, fakeSecretKey)
+	srv.CreateBucket(fakeBucket, false)
+
+	rootPath := QShellRootPath
+	bucketRsHost, bucketApiHost, bucketUcHost := BUCKET_RS_HOST, BUCKET_API_HOST, BUCKET_UC_HOST
+	up, rs, rsf, io, api := conf.UP_HOST, conf.RS_HOST, conf.RSF_HOST, conf.IO_HOST, conf.API_HOST
+	t.Cleanup(func() {
+		srv.Close()
+		QShellRootPath = rootPath
+		BUCKET_RS_HOST, BUCKET_API_HOST, BUCKET_UC_HOST = bucketRsHost, bucketApiHost, bucketUcHost
+		conf.UP_HOST, conf.RS_HOST, conf.RSF_HOST, conf.IO_HOST, conf.API_HOST = up, rs, rsf, io, api
+		delete(customZoneConfigs, fakeserver.Region)
+	})
+
+	SetHostsConfig(fakeHostsConfig(srv))
+	QShellRootPath = t.TempDir()
+	if err := SetAccount(fakeAccessKey, fakeSecretKey); err != nil {
+		t.Fatal(err)
+	}
+	return srv, srv.Mac()
+}
@@ -0,0 +1,358 @@
+package atfuck
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+)
+
+//the default prices of the storage classes, per GB per month
+const (
+	DEFAULT_STANDARD_PRICE = 0.148
+	DEFAULT_LINE_PRICE     = 0.1
+)
+
+//the actions of the lifecycle rules
+const (
+	LIFECYCLE_TO_LINE = "toline"
+	LIFECYCLE_DELETE  = "delete"
+)
+
+type StoragePrices struct {
+	Standard float64 `json:"standard"`
+	Line     float64 `json:"line"`
+}
+
+func (p StoragePrices) price(fileType int) float64 {
+	if fileType == 1 {
+		return p.Line
+	}
+	return p.Standard
+}
+
+//LifecyclePolicy is the json file of the lifecycle command,
+//a file is applied with the first rule whose prefix matches its key
+type LifecyclePolicy struct {
+	Rules  []LifecycleRule `json:"rules"`
+	Prices StoragePrices   `json:"prices"`
+}
+
+func LoadLifecyclePolicy(policyFile string) (policy LifecyclePolicy, err error) {
+	data, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &policy); err != nil {
+		err = fmt.Errorf("Parse lifecycle policy `%s` error, %s", policyFile, err)
+		return
+	}
+	if len(policy.Rules) == 0 {
+		err = errors.New("No rules in the lifecycle policy")
+		return
+	}
+	for _, rule := range policy.Rules {
+		if err = checkLifecycleRule(rule); err != nil {
+			return
+		}
+	}
+	if policy.Prices.Standard == 0 {
+		policy.Prices.Standard = DEFAULT_STANDARD_PRICE
+	}
+	if policy.Prices.Line == 0 {
+		policy.Prices.Line = DEFAULT_LINE_PRICE
+	}
+	return
+}
+
+func (p *LifecyclePolicy) match(key string) int {
+	for i, rule := range p.Rules {
+		if strings.HasPrefix(key, rule.Prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+//lifecycleAction returns the action of the rule for the file at now, empty for nothing to do
+func lifecycleAction(rule LifecycleRule, entry rsf.ListItem, now time.Time) string {
+	//the put time is in 100ns
+	age := now.Sub(time.Unix(0, entry.PutTime*100))
+	day := 24 * time.Hour
+	if rule.DeleteAfterDays > 0 && age >= time.Duration(rule.DeleteAfterDays)*day {
+		return LIFECYCLE_DELETE
+	}
+	if rule.ToLineAfterDays > 0 && age >= time.Duration(rule.ToLineAfterDays)*day && entry.FileType == 0 {
+		return LIFECYCLE_TO_LINE
+	}
+	return ""
+}
+
+// ----------------------------------------------------------
+
+type LifecycleRuleReport struct {
+	Name    string    `json:"name"`
+	ToLine  StatsItem `json:"toline"`
+	Deleted StatsItem `json:"deleted"`
+	Saving  float64   `json:"monthly_saving"`
+}
+
+//LifecycleReport counts the files transited and deleted, or to be in dry run,
+//the saving is the storage cost saved per month by the prices of the policy
+type LifecycleReport struct {
+	Bucket  string                `json:"bucket"`
+	Prefix  string                `json:"prefix"`
+	DryRun  bool                  `json:"dry_run"`
+	Scanned int64                 `json:"scanned"`
+	Failed  int64                 `json:"failed"`
+	Rules   []LifecycleRuleReport `json:"rules"`
+	Saving  float64               `json:"monthly_saving"`
+}
+
+type LifecycleOptions struct {
+	DryRun bool
+
+	//the checkpoint saves the list marker and the report after each batch,
+	//a run with the same checkpoint continues from it, empty for no checkpoint
+	CheckpointFile string
+
+	//the actions are written as `<Action>\t<Key>\t<Fsize>\t<PutTime>`, empty to skip
+	ActionFile string
+
+	//the time to compute the age of the files, time.Now() if zero
+	Now time.Time
+}
+
+type lifecycleCheckpoint struct {
+	Marker string          `json:"marker"`
+	Report LifecycleReport `json:"report"`
+}
+
+//DefaultLifecycleCheckpoint is the checkpoint file of the bucket prefix under QShellRootPath
+func DefaultLifecycleCheckpoint(bucket, prefix string) string {
+	sum := md5.Sum([]byte(bucket + ":" + prefix))
+	return filepath.Join(QShellRootPath, ".atfuck", "lifecycle", hex.EncodeToString(sum[:])+".json")
+}
+
+func loadLifecycleCheckpoint(checkpointFile string, report *LifecycleReport) (marker string, err error) {
+	data, rErr := ioutil.ReadFile(checkpointFile)
+	if rErr != nil {
+		if !os.IsNotExist(rErr) {
+			err = rErr
+		}
+		return
+	}
+	var checkpoint lifecycleCheckpoint
+	if err = json.Unmarshal(data, &checkpoint); err != nil {
+		err = fmt.Errorf("Parse lifecycle checkpoint `%s` error, %s", checkpointFile, err)
+		return
+	}
+	cReport := checkpoint.Report
+	if cReport.Bucket != report.Bucket || cReport.Prefix != report.Prefix || len(cReport.Rules) != len(report.Rules) {
+		err = fmt.Errorf("The lifecycle checkpoint `%s` is not of the bucket `%s` and the policy", checkpointFile, report.Bucket)
+		return
+	}
+	*report = cReport
+	marker = checkpoint.Marker
+	return
+}
+
+func saveLifecycleCheckpoint(checkpointFile, marker string, report LifecycleReport) (err error) {
+	if err = os.MkdirAll(filepath.Dir(checkpointFile), 0775); err != nil {
+		return
+	}
+	data, _ := json.Marshal(lifecycleCheckpoint{marker, report})
+	//write to a temp file first, the checkpoint is never left half written
+	tmpFile := checkpointFile + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmpFile, checkpointFile)
+}
+
+type lifecycleOp struct {
+	rule   int
+	action string
+	entry  rsf.ListItem
+}
+
+func (op *lifecycleOp) uri(bucket string) string {
+	if op.action == LIFECYCLE_DELETE {
+		return rs.URIDelete(bucket, op.entry.Key)
+	}
+	return rs.URIChangeType(bucket, op.entry.Key, 1)
+}
+
+//count adds the op to the report, the transited files are charged by the line price,
+//the deleted files are not charged any more
+func (op *lifecycleOp) count(report *LifecycleReport, prices StoragePrices) {
+	ruleReport := &report.Rules[op.rule]
+	gb := float64(op.entry.Fsize) / float64(1<<30)
+	var saving float64
+	if op.action == LIFECYCLE_DELETE {
+		ruleReport.Deleted.Count += 1
+		ruleReport.Deleted.Bytes += op.entry.Fsize
+		saving = gb * prices.price(op.entry.FileType)
+	} else {
+		ruleReport.ToLine.Count += 1
+		ruleReport.ToLine.Bytes += op.entry.Fsize
+		saving = gb * (prices.Standard - prices.Line)
+	}
+	ruleReport.Saving += saving
+	report.Saving += saving
+}
+
+//runLifecycleBatch applies the ops by the batch api, the failed ops are logged and counted
+func runLifecycleBatch(ctx context.Context, client rs.Client, bucket string, ops []lifecycleOp,
+	report *LifecycleReport, prices StoragePrices) (err error) {
+	uris := make([]string, 0, len(ops))
+	for i := range ops {
+		uris = append(uris, ops[i].uri(bucket))
+	}
+	var rets []BatchItemRet
+	bErr := client.BatchCtx(ctx, nil, &rets, uris)
+	if len(rets) != len(ops) {
+		//the whole batch failed, none of the ops are counted and the batch is retried from the checkpoint
+		if bErr == nil {
+			bErr = errors.New("unexpected batch result")
+		}
+		err = bucketError(bErr)
+		return
+	}
+	for i, ret := range rets {
+		op := &ops[i]
+		if ret.Code != 200 || ret.Data.Error != "" {
+			logs.Error("Lifecycle %s '%s' => '%s' failed, Code: %d, Error: %s",
+				op.action, bucket, op.entry.Key, ret.Code, ret.Data.Error)
+			report.Failed += 1
+			continue
+		}
+		logs.Debug("Lifecycle %s '%s' => '%s' success", op.action, bucket, op.entry.Key)
+		op.count(report, prices)
+	}
+	return
+}
+
+//ApplyLifecycle scans the files with the prefix, transits the files to the low frequency storage
+//or deletes them by the rules of the policy, a batch for each page of the listing.
+func ApplyLifecycle(ctx context.Context, mac *digest.Mac, bucket, prefix string, policy LifecyclePolicy,
+	opts LifecycleOptions) (report LifecycleReport, err error) {
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	report = LifecycleReport{
+		Bucket: bucket,
+		Prefix: prefix,
+		DryRun: opts.DryRun,
+		Rules:  make([]LifecycleRuleReport, len(policy.Rules)),
+	}
+	for i, rule := range policy.Rules {
+		report.Rules[i].Name = rule.Name
+	}
+
+	//the dry run does not change anything, so it is not checkpointed
+	checkpointFile := opts.CheckpointFile
+	if opts.DryRun {
+		checkpointFile = ""
+	}
+	marker := ""
+	if checkpointFile != "" {
+		if marker, err = loadLifecycleCheckpoint(checkpointFile, &report); err != nil {
+			return
+		}
+		if marker != "" {
+			logs.Informational("Continue the lifecycle of `%s` from the checkpoint `%s`", bucket, checkpointFile)
+		}
+	}
+
+	var actionW *bufio.Writer
+	if opts.ActionFile != "" {
+		//the actions of the pages before the checkpoint are kept
+		flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if marker != "" {
+			flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		actionFh, cErr := os.OpenFile(opts.ActionFile, flag, 0644)
+		if cErr != nil {
+			err = cErr
+			return
+		}
+		defer actionFh.Close()
+		actionW = bufio.NewWriter(actionFh)
+		defer actionW.Flush()
+	}
+
+	//the listing stops on a failed batch by the cancel
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client := rs.NewMac(mac)
+	var batchErr error
+	listErr := ListBucketFuncCtx(listCtx, mac, bucket, prefix, marker, func(entries []rsf.ListItem, markerOut string) {
+		if batchErr != nil {
+			return
+		}
+		ops := make([]lifecycleOp, 0, len(entries))
+		for _, entry := range entries {
+			rule := policy.match(entry.Key)
+			if rule < 0 {
+				continue
+			}
+			action := lifecycleAction(policy.Rules[rule], entry, now)
+			if action == "" {
+				continue
+			}
+			ops = append(ops, lifecycleOp{rule, action, entry})
+			if actionW != nil {
+				actionW.WriteString(fmt.Sprintf("%s\t%s\t%d\t%d\n", action, entry.Key, entry.Fsize, entry.PutTime))
+			}
+		}
+
+		if opts.DryRun {
+			for i := range ops {
+				ops[i].count(&report, policy.Prices)
+			}
+		} else if len(ops) > 0 {
+			//a page is at most 1000 files, the same as the max ops of a batch
+			if batchErr = runLifecycleBatch(listCtx, client, bucket, ops, &report, policy.Prices); batchErr != nil {
+				cancel()
+				return
+			}
+		}
+		report.Scanned += int64(len(entries))
+
+		if checkpointFile != "" && markerOut != "" {
+			if actionW != nil {
+				actionW.Flush()
+			}
+			if cErr := saveLifecycleCheckpoint(checkpointFile, markerOut, report); cErr != nil {
+				logs.Error("Save lifecycle checkpoint `%s` error, %s", checkpointFile, cErr)
+			}
+		}
+	})
+	if batchErr != nil {
+		err = batchErr
+		return
+	}
+	if listErr != nil {
+		err = listErr
+		return
+	}
+	if checkpointFile != "" {
+		os.Remove(checkpointFile)
+	}
+	return
+}
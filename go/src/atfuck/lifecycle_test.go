@@ -0,0 +1,143 @@
+package atfuck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"qiniu/api.v6/fakeserver"
+	"qiniu/api.v6/rs"
+)
+
+func TestApplyLifecycle(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	now := time.Now()
+	files := map[string]int{
+		"logs/old.log":   400,
+		"logs/month.log": 40,
+		"logs/new.log":   1,
+		"tmp/a":          10,
+		"keep/a":         1000,
+	}
+	for key, days := range files {
+		srv.PutObject(fakeBucket, key, []byte(key), "")
+		srv.SetPutTime(fakeBucket, key, now.Add(-time.Duration(days)*24*time.Hour))
+	}
+
+	tmpDir := t.TempDir()
+	policyFile := filepath.Join(tmpDir, "policy.json")
+	data, _ := json.Marshal(map[string]interface{}{
+		"rules": []LifecycleRule{
+			{Name: "logs", Prefix: "logs/", ToLineAfterDays: 30, DeleteAfterDays: 365},
+			{Name: "tmp", Prefix: "tmp/", DeleteAfterDays: 7},
+		},
+	})
+	ioutil.WriteFile(policyFile, data, 0644)
+	policy, err := LoadLifecyclePolicy(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Prices.Standard != DEFAULT_STANDARD_PRICE || policy.Prices.Line != DEFAULT_LINE_PRICE {
+		t.Fatalf("expect the default prices, got %+v", policy.Prices)
+	}
+
+	//dry run changes nothing
+	actionFile := filepath.Join(tmpDir, "actions.txt")
+	report, err := ApplyLifecycle(context.Background(), mac, fakeBucket, "", policy,
+		LifecycleOptions{DryRun: true, ActionFile: actionFile, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 5 || report.Rules[0].ToLine.Count != 1 || report.Rules[0].Deleted.Count != 1 ||
+		report.Rules[1].Deleted.Count != 1 || report.Saving <= 0 {
+		t.Fatalf("unexpected dry run report %+v", report)
+	}
+	actions, _ := ioutil.ReadFile(actionFile)
+	if lines := strings.Split(strings.TrimSpace(string(actions)), "\n"); len(lines) != 3 {
+		t.Fatalf("expect 3 actions, got `%s`", actions)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "tmp/a"); !ok {
+		t.Fatal("expect dry run not to delete")
+	}
+
+	checkpointFile := filepath.Join(tmpDir, "checkpoint.json")
+	report, err = ApplyLifecycle(context.Background(), mac, fakeBucket, "", policy,
+		LifecycleOptions{CheckpointFile: checkpointFile, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 0 || report.Rules[0].ToLine.Count != 1 || report.Rules[1].Deleted.Count != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for key, expect := range map[string]bool{"logs/old.log": false, "tmp/a": false, "keep/a": true, "logs/new.log": true} {
+		if _, ok := srv.GetObject(fakeBucket, key); ok != expect {
+			t.Fatalf("expect `%s` exists to be %v", key, expect)
+		}
+	}
+	client := rs.NewMac(mac)
+	SetZone(fakeserver.Region)
+	entry, err := client.Stat(nil, fakeBucket, "logs/month.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.FileType != 1 {
+		t.Fatalf("expect logs/month.log transited to line, got type %d", entry.FileType)
+	}
+	if _, err = os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Fatal("expect the checkpoint removed after the lifecycle finished")
+	}
+}
+
+func TestApplyLifecycleCheckpoint(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	now := time.Now()
+	for i := 0; i < 1500; i++ {
+		key := fmt.Sprintf("tmp/%04d", i)
+		srv.PutObject(fakeBucket, key, []byte(key), "")
+		srv.SetPutTime(fakeBucket, key, now.Add(-10*24*time.Hour))
+	}
+	policy := LifecyclePolicy{
+		Rules:  []LifecycleRule{{Name: "tmp", Prefix: "tmp/", DeleteAfterDays: 7}},
+		Prices: StoragePrices{1, 1},
+	}
+
+	//a checkpoint after the first page, as if the last run was stopped there
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	done := LifecycleReport{
+		Bucket:  fakeBucket,
+		Scanned: 1000,
+		Rules:   []LifecycleRuleReport{{Name: "tmp", Deleted: StatsItem{Count: 1000, Bytes: 8000}}},
+	}
+	marker := "dG1wLzA5OTk=" //base64 of tmp/0999
+	if err := saveLifecycleCheckpoint(checkpointFile, marker, done); err != nil {
+		t.Fatal(err)
+	}
+	actionFile := filepath.Join(t.TempDir(), "actions.txt")
+	if err := ioutil.WriteFile(actionFile, []byte("delete\ttmp/0999\t8\t0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := ApplyLifecycle(context.Background(), mac, fakeBucket, "", policy,
+		LifecycleOptions{CheckpointFile: checkpointFile, ActionFile: actionFile, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := ioutil.ReadFile(actionFile); err != nil || !strings.HasPrefix(string(actions), "delete\ttmp/0999\t") ||
+		strings.Count(string(actions), "\n") != 501 {
+		t.Fatalf("expect the actions appended after the checkpointed ones, got %d lines, %v", strings.Count(string(actions), "\n"), err)
+	}
+	if report.Scanned != 1500 || report.Rules[0].Deleted.Count != 1500 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "tmp/0999"); !ok {
+		t.Fatal("expect the files before the checkpoint untouched")
+	}
+	if _, ok := srv.GetObject(fakeBucket, "tmp/1000"); ok {
+		t.Fatal("expect the files after the checkpoint deleted")
+	}
+}
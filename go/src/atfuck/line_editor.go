@@ -0,0 +1,146 @@
+package atfuck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+//lineEditor reads a line from the terminal with the completion by tab and the history by the up and down keys,
+//the terminal is set to the raw mode by stty only while reading the line. The completion gets the candidates
+//to replace the line from the start offset
+type lineEditor struct {
+	tty      *os.File
+	in       *bufio.Reader
+	out      io.Writer
+	complete func(line string) (start int, candidates []string)
+}
+
+func newLineEditor(tty *os.File, in *bufio.Reader, out io.Writer,
+	complete func(line string) (start int, candidates []string)) *lineEditor {
+	return &lineEditor{tty: tty, in: in, out: out, complete: complete}
+}
+
+//stty runs stty on the terminal, it is not supported on windows
+func (e *lineEditor) stty(args ...string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("stty not supported on %s", runtime.GOOS)
+	}
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = e.tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+//readLine reads a line in the raw mode, or as is if the mode can not be set. The signals are off in the raw mode,
+//so ctrl-c drops the line instead of killing the shell
+func (e *lineEditor) readLine(prompt string, history []string) (line string, err error) {
+	fmt.Fprint(e.out, prompt)
+	state, err := e.stty("-g")
+	if err == nil {
+		_, err = e.stty("-icanon", "-echo", "-isig", "min", "1")
+	}
+	if err != nil {
+		line, err = e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return
+	}
+	defer e.stty(state)
+
+	var buf []rune
+	histIdx := len(history)
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r\033[K%s%s", prompt, string(buf))
+	}
+	for {
+		r, _, rErr := e.in.ReadRune()
+		if rErr != nil {
+			return "", rErr
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprintln(e.out)
+			return string(buf), nil
+		case 127, '\b':
+			if len(buf) > 0 {
+				buf = buf[:len(buf)-1]
+				redraw()
+			}
+		case 3: //ctrl-c drops the line
+			fmt.Fprintln(e.out, "^C")
+			buf = buf[:0]
+			histIdx = len(history)
+			fmt.Fprint(e.out, prompt)
+		case 4: //ctrl-d ends the input on an empty line
+			if len(buf) == 0 {
+				fmt.Fprintln(e.out)
+				return "", io.EOF
+			}
+		case 21: //ctrl-u
+			buf = buf[:0]
+			redraw()
+		case '\t':
+			buf = e.completeLine(prompt, buf)
+		case 27: //the arrow keys are ESC [ A/B/C/D
+			if next, _, _ := e.in.ReadRune(); next != '[' {
+				continue
+			}
+			key, _, _ := e.in.ReadRune()
+			switch key {
+			case 'A':
+				if histIdx > 0 {
+					histIdx -= 1
+					buf = []rune(history[histIdx])
+					redraw()
+				}
+			case 'B':
+				if histIdx < len(history) {
+					histIdx += 1
+					buf = buf[:0]
+					if histIdx < len(history) {
+						buf = []rune(history[histIdx])
+					}
+					redraw()
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf, r)
+				fmt.Fprint(e.out, string(r))
+			}
+		}
+	}
+}
+
+//completeLine replaces the last word by the only candidate or the common prefix of the candidates,
+//all the candidates are shown if the word can not be longer
+func (e *lineEditor) completeLine(prompt string, buf []rune) []rune {
+	line := string(buf)
+	start, candidates := e.complete(line)
+	if len(candidates) == 0 {
+		return buf
+	}
+	word := line[start:]
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = string([]rune(common)[:len([]rune(common))-1])
+		}
+	}
+	if len(common) > len(word) {
+		buf = []rune(line[:start] + common)
+	} else if len(candidates) > 1 {
+		fmt.Fprintln(e.out)
+		for _, candidate := range candidates {
+			fmt.Fprintln(e.out, strings.TrimSpace(candidate))
+		}
+	}
+	fmt.Fprintf(e.out, "\r\033[K%s%s", prompt, string(buf))
+	return buf
+}
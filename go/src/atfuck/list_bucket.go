@@ -2,10 +2,12 @@ package atfuck
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"qiniu/rpc"
+	"time"
 
 	"github.com/astaxie/beego/logs"
 	"qiniu/api.v6/auth/digest"
@@ -20,6 +22,18 @@ import (
 *@return listError
  */
 func ListBucket(mac *digest.Mac, bucket, prefix, marker, listResultFile string) (retErr error) {
+	return ListBucketCtx(context.Background(), mac, bucket, prefix, marker, listResultFile)
+}
+
+//the list of a marker is retried on network errors and 5xx
+var listRetryPolicy = &rpc.Backoff{
+	MaxRetries:  5,
+	Interval:    time.Second,
+	MaxInterval: time.Second * 10,
+}
+
+//ListBucketCtx stops listing when ctx is done, the entries listed are kept in the result file
+func ListBucketCtx(ctx context.Context, mac *digest.Mac, bucket, prefix, marker, listResultFile string) (retErr error) {
 	var listResultFh *os.File
 	if listResultFile == "stdout" {
 		listResultFh = os.Stdout
@@ -45,6 +59,31 @@ func ListBucket(mac *digest.Mac, bucket, prefix, marker, listResultFile string)
 	defer listResultFh.Close()
 	bWriter := bufio.NewWriter(listResultFh)
 
+	retErr = ListBucketFuncCtx(ctx, mac, bucket, prefix, marker, func(entries []rsf.ListItem, _ string) {
+		//append entries
+		for _, entry := range entries {
+			lineData := fmt.Sprintf("%s\t%d\t%s\t%d\t%s\t%d\t%s\r\n",
+				entry.Key, entry.Fsize, entry.Hash, entry.PutTime, entry.MimeType, entry.FileType, entry.EndUser)
+			_, wErr := bWriter.WriteString(lineData)
+			if wErr != nil {
+				logs.Error("Write line data `%s` to list result file failed.", lineData)
+			}
+		}
+
+		//flush
+		fErr := bWriter.Flush()
+		if fErr != nil {
+			logs.Error("Flush data to list result file error", fErr)
+		}
+	})
+	return
+}
+
+//ListBucketFuncCtx lists the bucket from the marker and passes each page of entries to fn,
+//with the marker to continue after the page, empty for the last page.
+//The zone is set to the region of the bucket
+func ListBucketFuncCtx(ctx context.Context, mac *digest.Mac, bucket, prefix, marker string,
+	fn func(entries []rsf.ListItem, marker string)) (retErr error) {
 	//get zone info
 	bucketInfo, gErr := GetBucketInfo(mac, bucket)
 	if gErr != nil {
@@ -58,14 +97,13 @@ func ListBucket(mac *digest.Mac, bucket, prefix, marker, listResultFile string)
 
 	//init
 	client := rsf.New(mac)
+	client.Conn.Retry = listRetryPolicy
 	limit := 1000
 	run := true
-	maxRetryTimes := 5
-	retryTimes := 1
 
 	//start to list
 	for run {
-		entries, markerOut, listErr := client.ListPrefix(nil, bucket, prefix, marker, limit)
+		entries, markerOut, listErr := client.ListPrefixCtx(ctx, nil, bucket, prefix, marker, limit)
 		if listErr != nil {
 			if listErr == io.EOF {
 				run = false
@@ -75,17 +113,10 @@ func ListBucket(mac *digest.Mac, bucket, prefix, marker, listResultFile string)
 				} else {
 					logs.Error("List error for marker `%s`, %s", marker, listErr)
 				}
-				if retryTimes <= maxRetryTimes {
-					logs.Warning("Retry list for marker `%s` for %d times", marker, retryTimes)
-					retryTimes += 1
-					continue
-				} else {
-					logs.Error("List failed too many times for marker `%s`", marker)
-					break
-				}
+				retErr = listErr
+				break
 			}
 		} else {
-			retryTimes = 1
 			if markerOut == "" {
 				run = false
 			} else {
@@ -93,22 +124,30 @@ func ListBucket(mac *digest.Mac, bucket, prefix, marker, listResultFile string)
 			}
 		}
 
-		//append entries
-		for _, entry := range entries {
-			lineData := fmt.Sprintf("%s\t%d\t%s\t%d\t%s\t%d\t%s\r\n",
-				entry.Key, entry.Fsize, entry.Hash, entry.PutTime, entry.MimeType, entry.FileType, entry.EndUser)
-			_, wErr := bWriter.WriteString(lineData)
-			if wErr != nil {
-				logs.Error("Write line data `%s` to list result file failed.", lineData)
-			}
-		}
-
-		//flush
-		fErr := bWriter.Flush()
-		if fErr != nil {
-			logs.Error("Flush data to list result file error", listErr)
+		if len(entries) > 0 {
+			fn(entries, markerOut)
 		}
 	}
 
 	return
 }
+
+//ListDirCtx lists the files right under the prefix and its sub dirs by the `/` delimiter, the sub dirs
+//are the prefixes ending with `/` and their files are not listed
+func ListDirCtx(ctx context.Context, mac *digest.Mac, bucket, prefix string, limit int,
+	fn func(entries []rsf.ListItem, dirs []string)) error {
+	client := rsf.New(mac)
+	client.Conn.Retry = listRetryPolicy
+	marker := ""
+	for {
+		entries, dirs, markerOut, err := client.ListDelimiterCtx(ctx, nil, bucket, prefix, "/", marker, limit)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		fn(entries, dirs)
+		if err == io.EOF || markerOut == "" {
+			return nil
+		}
+		marker = markerOut
+	}
+}
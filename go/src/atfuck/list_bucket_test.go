@@ -0,0 +1,35 @@
+package atfuck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListBucket(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	for i := 0; i < 5; i++ {
+		srv.PutObject(fakeBucket, fmt.Sprintf("dir/%d.txt", i), []byte(fmt.Sprintf("file %d", i)), "")
+	}
+	srv.PutObject(fakeBucket, "other.txt", []byte("other"), "")
+
+	listResultFile := filepath.Join(t.TempDir(), "list.txt")
+	if err := ListBucket(mac, fakeBucket, "dir/", "", listResultFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(listResultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\r\n")
+	if len(lines) != 5 {
+		t.Fatalf("expect 5 lines, got %d", len(lines))
+	}
+	//key, fsize, hash, putTime, mime, type, endUser
+	items := strings.Split(lines[0], "\t")
+	if len(items) != 7 || items[0] != "dir/0.txt" || items[1] != "6" || items[4] != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected line `%s`", lines[0])
+	}
+}
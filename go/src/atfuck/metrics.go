@@ -0,0 +1,381 @@
+package atfuck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/rpc"
+)
+
+/*
+The metrics server of the long running jobs like qupload and qdownload, started by the global
+option -metrics-addr, serves
+
+	/metrics	the counters and gauges in the prometheus text format
+	/status		the json of the jobs with their config, and the recent errors in log
+
+The http requests are counted by the transport wrapping http.DefaultTransport.
+*/
+
+const (
+	METRICS_RECENT_ERRORS = 100
+	METRICS_LOG_ADAPTER   = "recenterrors"
+
+	metricsNetworkError = "network"
+)
+
+//RecentError is an error message in log
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+//MetricsJobStatus is a job in the status of the metrics server
+type MetricsJobStatus struct {
+	ProgressStatus
+	QueueDepth int         `json:"queue_depth"`
+	Config     interface{} `json:"config"`
+}
+
+//MetricsStatus is the json of /status
+type MetricsStatus struct {
+	Jobs         []MetricsJobStatus `json:"jobs"`
+	Retries      int64              `json:"retries"`
+	Inflight     int64              `json:"inflight_requests"`
+	RecentErrors []RecentError      `json:"recent_errors"`
+}
+
+type metricsJob struct {
+	progress *Progress
+	queue    func() int
+	config   interface{}
+}
+
+type hostCode struct {
+	host string
+	code string
+}
+
+type metricsRegistry struct {
+	lock       sync.Mutex
+	jobs       []*metricsJob
+	requests   map[string]int64
+	hostErrors map[hostCode]int64
+	inflight   int64
+}
+
+var metrics = &metricsRegistry{
+	requests:   make(map[string]int64),
+	hostErrors: make(map[hostCode]int64),
+}
+
+var recentErrors = &recentErrorLog{}
+
+func init() {
+	logs.Register(METRICS_LOG_ADAPTER, func() logs.Logger {
+		return recentErrors
+	})
+}
+
+//RegisterMetricsJob adds the job to the metrics, the job of the same name registered before is replaced,
+//queue returns the tasks waiting for the workers, and config is shown in status without the secrets
+func RegisterMetricsJob(progress *Progress, queue func() int, config interface{}) {
+	job := &metricsJob{progress: progress, queue: queue, config: redactConfig(config)}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	for i, old := range metrics.jobs {
+		if old.progress.name == progress.name {
+			metrics.jobs[i] = job
+			return
+		}
+	}
+	metrics.jobs = append(metrics.jobs, job)
+}
+
+//redactConfig converts the config to a json map, with the values of the secret keys hidden
+func redactConfig(config interface{}) interface{} {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(data, &fields) != nil {
+		return config
+	}
+	for name := range fields {
+		lower := strings.ToLower(name)
+		if lower == "sk" || strings.Contains(lower, "secret") || strings.Contains(lower, "password") {
+			fields[name] = "******"
+		}
+	}
+	return fields
+}
+
+//StartMetricsServer listens on the addr and serves the metrics in background, it returns the address
+//listened on, the requests sent by http.DefaultTransport are counted from now on
+func StartMetricsServer(addr string) (listenAddr string, err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	listenAddr = listener.Addr().String()
+	http.DefaultTransport = NewMetricsTransport(http.DefaultTransport)
+	if err = logs.SetLogger(METRICS_LOG_ADAPTER); err != nil {
+		listener.Close()
+		return "", err
+	}
+	go func() {
+		if sErr := http.Serve(listener, MetricsHandler()); sErr != nil {
+			logs.Error("Metrics server on `%s` stopped, %s", addr, sErr)
+		}
+	}()
+	logs.Informational("Metrics server listening on `%s`", listenAddr)
+	return
+}
+
+func MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/status", serveStatus)
+	return mux
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	status := MetricsStatus{
+		Jobs:         []MetricsJobStatus{},
+		Retries:      rpc.RetryCount(),
+		Inflight:     atomic.LoadInt64(&metrics.inflight),
+		RecentErrors: recentErrors.list(),
+	}
+	for _, job := range metrics.snapshot() {
+		status.Jobs = append(status.Jobs, MetricsJobStatus{
+			ProgressStatus: job.progress.Status(),
+			QueueDepth:     job.queue(),
+			Config:         job.config,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(&status)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	jobs := metrics.snapshot()
+	statuses := make([]ProgressStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = job.progress.Status()
+	}
+
+	writeMetric(&buf, "atfuck_files_total", "counter", "Files finished by the job, by the status.", func(add func(float64, ...string)) {
+		for _, s := range statuses {
+			add(float64(s.DoneFiles), "job", s.Name, "status", PROGRESS_SUCCEEDED)
+			add(float64(s.FailedFiles), "job", s.Name, "status", PROGRESS_FAILED)
+			add(float64(s.SkippedFiles), "job", s.Name, "status", PROGRESS_SKIPPED)
+		}
+	})
+	writeMetric(&buf, "atfuck_job_files", "gauge", "Files to transfer by the job.", func(add func(float64, ...string)) {
+		for _, s := range statuses {
+			add(float64(s.TotalFiles), "job", s.Name)
+		}
+	})
+	writeMetric(&buf, "atfuck_transferred_bytes_total", "counter",
+		"Bytes sent or received for the files finished by the job, by the status, the resumed bytes are skipped.",
+		func(add func(float64, ...string)) {
+			for _, s := range statuses {
+				for _, status := range []string{PROGRESS_SUCCEEDED, PROGRESS_FAILED, PROGRESS_SKIPPED} {
+					add(float64(s.StatusBytes[status]), "job", s.Name, "status", status)
+				}
+			}
+		})
+	writeMetric(&buf, "atfuck_job_bytes", "gauge", "Bytes of the files to transfer by the job.", func(add func(float64, ...string)) {
+		for _, s := range statuses {
+			add(float64(s.TotalBytes), "job", s.Name)
+		}
+	})
+	writeMetric(&buf, "atfuck_active_workers", "gauge", "Workers transferring a file.", func(add func(float64, ...string)) {
+		for _, s := range statuses {
+			add(float64(s.Active), "job", s.Name)
+		}
+	})
+	writeMetric(&buf, "atfuck_queue_depth", "gauge", "Tasks waiting for a worker.", func(add func(float64, ...string)) {
+		for _, job := range jobs {
+			add(float64(job.queue()), "job", job.progress.name)
+		}
+	})
+	writeMetric(&buf, "atfuck_eta_seconds", "gauge", "Estimated seconds to finish the job, -1 if unknown.", func(add func(float64, ...string)) {
+		for _, s := range statuses {
+			add(s.Eta, "job", s.Name)
+		}
+	})
+
+	requests, hostErrors := metrics.httpSnapshot()
+	writeMetric(&buf, "atfuck_http_inflight_requests", "gauge", "Http requests waiting for the response or reading the body.", func(add func(float64, ...string)) {
+		add(float64(atomic.LoadInt64(&metrics.inflight)))
+	})
+	writeMetric(&buf, "atfuck_http_requests_total", "counter", "Http requests sent, by the host.", func(add func(float64, ...string)) {
+		for _, host := range sortedKeys(requests) {
+			add(float64(requests[host]), "host", host)
+		}
+	})
+	writeMetric(&buf, "atfuck_http_errors_total", "counter", "Http requests failed, by the host and the status code, network for the network errors.", func(add func(float64, ...string)) {
+		keys := make([]hostCode, 0, len(hostErrors))
+		for key := range hostErrors {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].host != keys[j].host {
+				return keys[i].host < keys[j].host
+			}
+			return keys[i].code < keys[j].code
+		})
+		for _, key := range keys {
+			add(float64(hostErrors[key]), "host", key.host, "code", key.code)
+		}
+	})
+	writeMetric(&buf, "atfuck_retries_total", "counter", "Requests sent again after a failure.", func(add func(float64, ...string)) {
+		add(float64(rpc.RetryCount()))
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+//writeMetric writes a metric family, the labels are given as name and value pairs
+func writeMetric(w io.Writer, name, kind, help string, samples func(add func(value float64, labels ...string))) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	samples(func(value float64, labels ...string) {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		if len(pairs) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", name, value)
+		}
+	})
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *metricsRegistry) snapshot() []*metricsJob {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*metricsJob(nil), m.jobs...)
+}
+
+func (m *metricsRegistry) httpSnapshot() (requests map[string]int64, hostErrors map[hostCode]int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	requests = make(map[string]int64, len(m.requests))
+	for host, count := range m.requests {
+		requests[host] = count
+	}
+	hostErrors = make(map[hostCode]int64, len(m.hostErrors))
+	for key, count := range m.hostErrors {
+		hostErrors[key] = count
+	}
+	return
+}
+
+func (m *metricsRegistry) countRequest(host string, code string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[host] += 1
+	if code != "" {
+		m.hostErrors[hostCode{host, code}] += 1
+	}
+}
+
+//metricsTransport counts the requests in flight until the body of the response is closed,
+//and the errors by the host
+type metricsTransport struct {
+	transport http.RoundTripper
+}
+
+func NewMetricsTransport(transport http.RoundTripper) http.RoundTripper {
+	return &metricsTransport{transport: transport}
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	atomic.AddInt64(&metrics.inflight, 1)
+	resp, err = t.transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&metrics.inflight, -1)
+		metrics.countRequest(req.URL.Host, metricsNetworkError)
+		return
+	}
+	var code string
+	if resp.StatusCode >= 400 {
+		code = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	metrics.countRequest(req.URL.Host, code)
+	resp.Body = &metricsBody{ReadCloser: resp.Body}
+	return
+}
+
+type metricsBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (b *metricsBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&metrics.inflight, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+//recentErrorLog is the log adapter keeping the recent error messages
+type recentErrorLog struct {
+	lock     sync.Mutex
+	messages []RecentError
+}
+
+func (l *recentErrorLog) Init(config string) error {
+	return nil
+}
+
+func (l *recentErrorLog) WriteMsg(when time.Time, msg string, level int) error {
+	if level > logs.LevelError {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, RecentError{Time: when, Message: msg})
+	if len(l.messages) > METRICS_RECENT_ERRORS {
+		l.messages = l.messages[len(l.messages)-METRICS_RECENT_ERRORS:]
+	}
+	return nil
+}
+
+func (l *recentErrorLog) list() []RecentError {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]RecentError{}, l.messages...)
+}
+
+func (l *recentErrorLog) Destroy() {
+}
+
+func (l *recentErrorLog) Flush() {
+}
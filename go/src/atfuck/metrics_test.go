@@ -0,0 +1,117 @@
+package atfuck
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/conf"
+	"qiniu/api.v6/rs"
+	"qiniu/rpc"
+)
+
+func TestMetricsServer(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srv.PutObject(fakeBucket, "a.txt", []byte("a"), "")
+
+	transport := http.DefaultTransport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		logs.GetBeeLogger().DelLogger(METRICS_LOG_ADAPTER)
+	})
+	addr, err := StartMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := NewProgress("metricstest", 3, 300, func() ProgressCounts {
+		return ProgressCounts{Done: 1, Failed: 1, Skipped: 1}
+	})
+	file := progress.File()
+	file.Resumed(20)
+	file.Transferred(100)
+	file.Finish(nil)
+	RegisterMetricsJob(progress, func() int {
+		return 2
+	}, &DownloadConfig{Bucket: fakeBucket, AK: fakeAccessKey, SK: fakeSecretKey})
+
+	//the requests after the start are counted
+	conf.RS_HOST = srv.RsHost
+	client := rs.NewMac(mac)
+	if _, sErr := client.Stat(nil, fakeBucket, "a.txt"); sErr != nil {
+		t.Fatal(sErr)
+	}
+	if _, sErr := client.Stat(nil, fakeBucket, "missing.txt"); sErr == nil {
+		t.Fatal("expect the missing file")
+	}
+	rpc.WithRetry(context.Background(), &rpc.Backoff{MaxRetries: 1, Interval: time.Millisecond}, func() error {
+		return &rpc.ErrorInfo{Code: 503}
+	})
+	logs.Error("the error for the metrics test")
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	exposition := string(data)
+	rsHost, _ := url.Parse(srv.RsHost)
+	for _, line := range []string{
+		`atfuck_files_total{job="metricstest",status="failed"} 1`,
+		`atfuck_files_total{job="metricstest",status="skipped"} 1`,
+		`atfuck_transferred_bytes_total{job="metricstest",status="succeeded"} 100`,
+		`atfuck_transferred_bytes_total{job="metricstest",status="skipped"} 20`,
+		`atfuck_queue_depth{job="metricstest"} 2`,
+		`atfuck_http_errors_total{host="` + rsHost.Host + `",code="612"} 1`,
+		`# TYPE atfuck_http_inflight_requests gauge`,
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Fatalf("expect `%s` in metrics:\n%s", line, exposition)
+		}
+	}
+	var retries float64 = -1
+	for _, line := range strings.Split(exposition, "\n") {
+		if strings.HasPrefix(line, "atfuck_retries_total ") {
+			retries, _ = strconv.ParseFloat(strings.TrimPrefix(line, "atfuck_retries_total "), 64)
+		}
+	}
+	if retries < 1 {
+		t.Fatalf("expect the retry counted, metrics:\n%s", exposition)
+	}
+
+	resp, err = http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status MetricsStatus
+	dErr := json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if dErr != nil {
+		t.Fatal(dErr)
+	}
+	var job *MetricsJobStatus
+	for i := range status.Jobs {
+		if status.Jobs[i].Name == "metricstest" {
+			job = &status.Jobs[i]
+		}
+	}
+	if job == nil || job.TotalFiles != 3 || job.QueueDepth != 2 {
+		t.Fatalf("unexpected jobs %+v", status.Jobs)
+	}
+	config, _ := job.Config.(map[string]interface{})
+	if config["bucket"] != fakeBucket || config["sk"] == fakeSecretKey {
+		t.Fatalf("unexpected config %v", job.Config)
+	}
+	if len(status.RecentErrors) == 0 ||
+		!strings.Contains(status.RecentErrors[len(status.RecentErrors)-1].Message, "the error for the metrics test") {
+		t.Fatalf("expect the recent error, got %+v", status.RecentErrors)
+	}
+}
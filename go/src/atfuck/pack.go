@@ -0,0 +1,400 @@
+package atfuck
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rsf"
+)
+
+/*
+Pack mode of qupload bundles the small files into tar objects under the pack dir of the key prefix,
+
+	<key_prefix>.atfuck-packs/<run id>-<seq>.tar
+	<key_prefix>.atfuck-packs/<run id>-<seq>.index
+
+the index object of a pack has a json line of PackEntry for each file in the pack, so a file is read
+from the pack with a Range request, and the pack is still a plain tar to extract all at once.
+*/
+
+const (
+	PACK_DIR                = ".atfuck-packs/"
+	PACK_SUFFIX             = ".tar"
+	PACK_INDEX_SUFFIX       = ".index"
+	DEFAULT_PACK_SIZE int64 = 64 * 1024 * 1024
+)
+
+//PackEntry locates a packed file in the pack object
+type PackEntry struct {
+	Key    string `json:"key"`
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+//IsPackKey checks whether the key is a pack or an index in the pack dir
+func IsPackKey(key string) bool {
+	return strings.Contains(key, "/"+PACK_DIR) || strings.HasPrefix(key, PACK_DIR)
+}
+
+func isPackIndexKey(key string) bool {
+	return IsPackKey(key) && strings.HasSuffix(key, PACK_INDEX_SUFFIX)
+}
+
+//ReadPackIndex reads the json lines of the index object
+func ReadPackIndex(r io.Reader) (entries []PackEntry, err error) {
+	decoder := json.NewDecoder(r)
+	for {
+		var entry PackEntry
+		if err = decoder.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+//packedFile is a local file in the pack with its upload log
+type packedFile struct {
+	PackEntry
+	localFile    string
+	ldbKey       string
+	lastModified int64
+}
+
+//filePack is a sealed pack to upload with its index
+type filePack struct {
+	key       string
+	indexKey  string
+	tarFile   string
+	indexFile string
+	size      int64
+	files     []packedFile
+}
+
+//remove removes the local pack files after upload
+func (p *filePack) remove() {
+	os.Remove(p.tarFile)
+	os.Remove(p.indexFile)
+}
+
+//filePacker writes the small files into the local packs of the pack size
+type filePacker struct {
+	dir      string
+	runId    string
+	packSize int64
+	tempDir  string
+
+	seq   int
+	fp    *os.File
+	cw    *countWriter
+	tw    *tar.Writer
+	files []packedFile
+}
+
+func newFilePacker(keyPrefix string, packSize int64, tempDir string) *filePacker {
+	if packSize <= 0 {
+		packSize = DEFAULT_PACK_SIZE
+	}
+	return &filePacker{
+		dir:      keyPrefix + PACK_DIR,
+		runId:    time.Now().Format("20060102150405"),
+		packSize: packSize,
+		tempDir:  tempDir,
+	}
+}
+
+func (p *filePacker) packKey() string {
+	return fmt.Sprintf("%s%s-%d", p.dir, p.runId, p.seq)
+}
+
+//add writes the local file into the pack, and returns the pack if it is full
+func (p *filePacker) add(localFile, key, ldbKey string, lastModified int64) (pack *filePack, err error) {
+	//the small file is read at once, so the size in the tar header can not change
+	data, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return
+	}
+	if p.tw == nil {
+		if p.fp, err = ioutil.TempFile(p.tempDir, "pack-"); err != nil {
+			return
+		}
+		p.cw = &countWriter{w: bufio.NewWriter(p.fp)}
+		p.tw = tar.NewWriter(p.cw)
+	}
+	header := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     key,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  time.Now(),
+	}
+	if fi, sErr := os.Stat(localFile); sErr == nil {
+		header.ModTime = fi.ModTime()
+	}
+	if err = p.tw.WriteHeader(&header); err != nil {
+		return
+	}
+	entry := PackEntry{Key: key, Pack: p.packKey() + PACK_SUFFIX, Offset: p.cw.n, Size: int64(len(data))}
+	if _, err = p.tw.Write(data); err != nil {
+		return
+	}
+	p.files = append(p.files, packedFile{PackEntry: entry, localFile: localFile, ldbKey: ldbKey, lastModified: lastModified})
+	if p.cw.n >= p.packSize {
+		pack, err = p.seal()
+	}
+	return
+}
+
+//flush seals the last pack, nil if empty
+func (p *filePacker) flush() (pack *filePack, err error) {
+	if p.tw == nil {
+		return
+	}
+	return p.seal()
+}
+
+func (p *filePacker) seal() (pack *filePack, err error) {
+	pack = &filePack{
+		key:      p.packKey() + PACK_SUFFIX,
+		indexKey: p.packKey() + PACK_INDEX_SUFFIX,
+		tarFile:  p.fp.Name(),
+		files:    p.files,
+	}
+	err = p.tw.Close()
+	if err == nil {
+		err = p.cw.w.(*bufio.Writer).Flush()
+	}
+	if cErr := p.fp.Close(); err == nil {
+		err = cErr
+	}
+	pack.size = p.cw.n
+	p.seq += 1
+	p.fp, p.cw, p.tw, p.files = nil, nil, nil, nil
+	if err == nil {
+		pack.indexFile = pack.tarFile + PACK_INDEX_SUFFIX
+		err = writePackIndex(pack.indexFile, pack.files)
+	}
+	if err != nil {
+		pack.remove()
+		return nil, err
+	}
+	return
+}
+
+func writePackIndex(indexFile string, files []packedFile) (err error) {
+	fp, err := os.Create(indexFile)
+	if err != nil {
+		return
+	}
+	bWriter := bufio.NewWriter(fp)
+	encoder := json.NewEncoder(bWriter)
+	for _, file := range files {
+		if err = encoder.Encode(&file.PackEntry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bWriter.Flush()
+	}
+	if cErr := fp.Close(); err == nil {
+		err = cErr
+	}
+	return
+}
+
+//expandPackIndexes replaces the index objects in the bucket list file with the lines of the packed files,
+//which have the pack key and the offset appended, and drops the packs
+func expandPackIndexes(mac *digest.Mac, domainOfBucket, ioProxyAddress, listFile string) (packedCount int64, err error) {
+	listFp, err := os.Open(listFile)
+	if err != nil {
+		return
+	}
+	defer listFp.Close()
+	expandFile := listFile + ".expand"
+	expandFp, err := os.Create(expandFile)
+	if err != nil {
+		return
+	}
+	defer os.Remove(expandFile)
+	bWriter := bufio.NewWriter(expandFp)
+
+	var hasPack bool
+	listScanner := bufio.NewScanner(listFp)
+	for listScanner.Scan() {
+		line := strings.TrimSpace(listScanner.Text())
+		items := strings.Split(line, "\t")
+		if len(items) < 4 || !IsPackKey(items[0]) {
+			fmt.Fprintf(bWriter, "%s\r\n", line)
+			continue
+		}
+		hasPack = true
+		if !isPackIndexKey(items[0]) {
+			continue
+		}
+		var entries []PackEntry
+		if entries, err = fetchPackIndex(mac, domainOfBucket, ioProxyAddress, items[0]); err != nil {
+			expandFp.Close()
+			return
+		}
+		//the packed files change with the index
+		for _, entry := range entries {
+			fmt.Fprintf(bWriter, "%s\t%d\t\t%s\t\t\t\t%s\t%d\r\n", entry.Key, entry.Size, items[3], entry.Pack, entry.Offset)
+		}
+		packedCount += int64(len(entries))
+	}
+	if err = listScanner.Err(); err == nil {
+		err = bWriter.Flush()
+	}
+	if cErr := expandFp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && hasPack {
+		err = os.Rename(expandFile, listFile)
+	}
+	return
+}
+
+func fetchPackIndex(mac *digest.Mac, domainOfBucket, ioProxyAddress, indexKey string) (entries []PackEntry, err error) {
+	req, err := http.NewRequest("GET", makePrivateDownloadLink(mac, domainOfBucket, ioProxyAddress, indexKey), nil)
+	if err != nil {
+		return
+	}
+	req.Host = domainOfBucket
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("get pack index `%s` error, %s", indexKey, resp.Status)
+		return
+	}
+	return ReadPackIndex(resp.Body)
+}
+
+//parsePackedLine gets the pack key and the offset of the expanded list line, empty if not packed
+func parsePackedLine(items []string) (pack string, offset int64) {
+	if len(items) < 9 || items[7] == "" {
+		return
+	}
+	offset, err := strconv.ParseInt(items[8], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return items[7], offset
+}
+
+//packIndexes caches the pack indexes fetched by FindPackEntry in the process, by the bucket, the key and the hash
+//of the index objects, so the lookups of the files in the same packs download each index once
+var packIndexes = struct {
+	sync.Mutex
+	entries map[string][]PackEntry
+}{entries: make(map[string][]PackEntry)}
+
+func cachedPackIndex(mac *digest.Mac, proxy *bucketProxy, bucket string, item rsf.ListItem) (entries []PackEntry, err error) {
+	cacheKey := bucket + ":" + item.Key + ":" + item.Hash
+	packIndexes.Lock()
+	entries, ok := packIndexes.entries[cacheKey]
+	packIndexes.Unlock()
+	if ok {
+		return
+	}
+	if entries, err = fetchPackIndex(mac, proxy.domain, proxy.ioHost, item.Key); err != nil {
+		return
+	}
+	packIndexes.Lock()
+	packIndexes.entries[cacheKey] = entries
+	packIndexes.Unlock()
+	return
+}
+
+//FindPackEntry looks up the packed file in the pack dirs of the parent dirs of the key,
+//the latest index wins if the key is packed more than once
+func FindPackEntry(ctx context.Context, mac *digest.Mac, bucket, key string) (entry PackEntry, found bool, err error) {
+	proxy, err := newBucketProxy(mac, bucket, "", "", "")
+	if err != nil {
+		return
+	}
+	client := rsf.New(mac)
+	client.Conn.Retry = listRetryPolicy
+	dir := key
+	for {
+		dir = strings.TrimSuffix(dir, "/")
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			dir = dir[:i+1]
+		} else {
+			dir = ""
+		}
+
+		var indexes []rsf.ListItem
+		marker := ""
+		for {
+			items, markerOut, lErr := client.ListPrefixCtx(ctx, nil, bucket, dir+PACK_DIR, marker, 1000)
+			if lErr != nil && lErr != io.EOF {
+				err = lErr
+				return
+			}
+			for _, item := range items {
+				if strings.HasSuffix(item.Key, PACK_INDEX_SUFFIX) {
+					indexes = append(indexes, item)
+				}
+			}
+			if lErr == io.EOF || markerOut == "" {
+				break
+			}
+			marker = markerOut
+		}
+
+		//from the latest index, the older ones are not fetched once the key is found
+		sort.SliceStable(indexes, func(i, j int) bool { return indexes[i].PutTime > indexes[j].PutTime })
+		for _, item := range indexes {
+			entries, fErr := cachedPackIndex(mac, proxy, bucket, item)
+			if fErr != nil {
+				err = fErr
+				return
+			}
+			for _, e := range entries {
+				if e.Key == key {
+					return e, true, nil
+				}
+			}
+		}
+		if dir == "" {
+			return
+		}
+	}
+}
+
+//packTempDir is the dir of the local packs of the upload job
+func packTempDir(storePath string) (dir string, err error) {
+	dir = filepath.Join(storePath, "packs")
+	err = os.MkdirAll(dir, 0775)
+	return
+}
@@ -0,0 +1,178 @@
+package atfuck
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilePacker(t *testing.T) {
+	srcDir := t.TempDir()
+	files := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		data := make([]byte, 500*i)
+		rand.Read(data)
+		name := fmt.Sprintf("f%d.bin", i)
+		files[name] = data
+		ioutil.WriteFile(filepath.Join(srcDir, name), data, 0644)
+	}
+
+	packer := newFilePacker("p/", 8*1024, t.TempDir())
+	var packs []*filePack
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("f%d.bin", i)
+		pack, err := packer.add(filepath.Join(srcDir, name), "p/"+name, name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pack != nil {
+			packs = append(packs, pack)
+		}
+	}
+	if pack, err := packer.flush(); err != nil || pack == nil {
+		t.Fatalf("expect the last pack, %v", err)
+	} else {
+		packs = append(packs, pack)
+	}
+	if len(packs) < 2 {
+		t.Fatalf("expect the files split into packs, got %d", len(packs))
+	}
+
+	var count int
+	for _, pack := range packs {
+		if !strings.HasPrefix(pack.key, "p/"+PACK_DIR) || !strings.HasSuffix(pack.key, PACK_SUFFIX) {
+			t.Fatalf("unexpected pack key `%s`", pack.key)
+		}
+		packData, _ := ioutil.ReadFile(pack.tarFile)
+		if int64(len(packData)) != pack.size {
+			t.Fatalf("expect pack size %d, got %d", pack.size, len(packData))
+		}
+		//read by the index
+		indexFp, _ := os.Open(pack.indexFile)
+		entries, err := ReadPackIndex(indexFp)
+		indexFp.Close()
+		if err != nil || len(entries) != len(pack.files) {
+			t.Fatalf("unexpected index, %d entries %v", len(entries), err)
+		}
+		for _, entry := range entries {
+			name := strings.TrimPrefix(entry.Key, "p/")
+			if entry.Pack != pack.key || !bytes.Equal(packData[entry.Offset:entry.Offset+entry.Size], files[name]) {
+				t.Fatalf("entry of `%s` mismatched", entry.Key)
+			}
+			count += 1
+		}
+		//the pack is a plain tar
+		tr := tar.NewReader(bytes.NewReader(packData))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(tr)
+			if !bytes.Equal(data, files[strings.TrimPrefix(header.Name, "p/")]) {
+				t.Fatalf("tar member `%s` mismatched", header.Name)
+			}
+		}
+		pack.remove()
+	}
+	if count != len(files) {
+		t.Fatalf("expect %d packed files, got %d", len(files), count)
+	}
+}
+
+func TestQiniuUploadPacked(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srcDir := t.TempDir()
+	files := map[string][]byte{
+		"thumbs/a.jpg": []byte("a"),
+		"thumbs/b.jpg": make([]byte, 2000),
+		"thumbs/c.jpg": {},
+		"big.bin":      make([]byte, 8000),
+	}
+	rand.Read(files["thumbs/b.jpg"])
+	rand.Read(files["big.bin"])
+	for name, data := range files {
+		localPath := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		ioutil.WriteFile(localPath, data, 0644)
+	}
+	hostsData, _ := json.Marshal(fakeHostsConfig(srv))
+	ioutil.WriteFile(filepath.Join(QShellRootPath, ".atfuck", "hosts.json"), hostsData, 0644)
+
+	uploadConfig := UploadConfig{
+		SrcDir:        srcDir,
+		Bucket:        fakeBucket,
+		KeyPrefix:     "up/",
+		LogFile:       filepath.Join(t.TempDir(), "upload.log"),
+		PackThreshold: 4096,
+		PackSize:      1024,
+	}
+	configData, _ := json.Marshal(uploadConfig)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestQiniuUploadHelper$")
+	cmd.Env = append(os.Environ(), "ATFUCK_TEST_ROOT="+QShellRootPath, "ATFUCK_TEST_UPLOAD_CONFIG="+string(configData))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("qupload failed, %s\n%s", err, out)
+	}
+
+	//only the big file is uploaded by its key
+	if _, ok := srv.GetObject(fakeBucket, "up/big.bin"); !ok {
+		t.Fatal("expect the big file not packed")
+	}
+	if _, ok := srv.GetObject(fakeBucket, "up/thumbs/a.jpg"); ok {
+		t.Fatal("expect the small file packed")
+	}
+
+	for name, data := range files {
+		var buf bytes.Buffer
+		if err := CatFile(context.Background(), mac, fakeBucket, "up/"+name, &buf); err != nil {
+			t.Fatalf("cat `%s` error, %s", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("cat `%s` mismatched", name)
+		}
+	}
+	//a range of the packed file
+	var buf bytes.Buffer
+	if err := CatFileRange(context.Background(), mac, fakeBucket, "up/thumbs/b.jpg", 100, 50, &buf); err != nil ||
+		!bytes.Equal(buf.Bytes(), files["thumbs/b.jpg"][100:150]) {
+		t.Fatalf("cat range of the packed file mismatched, %v", err)
+	}
+	buf.Reset()
+	if err := CatFileRange(context.Background(), mac, fakeBucket, "up/thumbs/b.jpg", 1990, -1, &buf); err != nil ||
+		!bytes.Equal(buf.Bytes(), files["thumbs/b.jpg"][1990:]) {
+		t.Fatalf("cat the tail of the packed file mismatched, %v", err)
+	}
+	if err := CatFile(context.Background(), mac, fakeBucket, "up/thumbs/missing.jpg", ioutil.Discard); err == nil {
+		t.Fatal("expect the missing file")
+	}
+
+	destDir := t.TempDir()
+	QiniuDownload(2, &DownloadConfig{
+		DestDir: destDir,
+		Bucket:  fakeBucket,
+		AK:      fakeAccessKey,
+		SK:      fakeSecretKey,
+		Prefix:  "up/",
+		LogFile: filepath.Join(t.TempDir(), "download.log"),
+	})
+	for name, data := range files {
+		if local, err := ioutil.ReadFile(filepath.Join(destDir, "up", name)); err != nil || !bytes.Equal(local, data) {
+			t.Fatalf("content of `%s` mismatched, %v", name, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(destDir, "up", PACK_DIR, "*")); len(matches) != 0 {
+		t.Fatalf("expect the packs not downloaded, got %v", matches)
+	}
+}
@@ -0,0 +1,289 @@
+package atfuck
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rio "qiniu/api.v6/resumable/io"
+)
+
+const (
+	PROGRESS_TTY_INTERVAL = time.Second / 2
+	PROGRESS_LOG_INTERVAL = time.Second * 10
+
+	PROGRESS_SUCCEEDED = "succeeded"
+	PROGRESS_FAILED    = "failed"
+	PROGRESS_SKIPPED   = "skipped"
+)
+
+//ProgressCounts are the files finished by the job
+type ProgressCounts struct {
+	Done    int64
+	Failed  int64
+	Skipped int64
+}
+
+//ProgressStatus is a snapshot of the progress
+type ProgressStatus struct {
+	Name         string  `json:"name"`
+	TotalFiles   int64   `json:"total_files"`
+	TotalBytes   int64   `json:"total_bytes"`
+	DoneFiles    int64   `json:"done_files"`
+	FailedFiles  int64   `json:"failed_files"`
+	SkippedFiles int64   `json:"skipped_files"`
+	Bytes        int64   `json:"bytes"`
+	Active       int64   `json:"active_workers"`
+	Elapsed      float64 `json:"elapsed_seconds"`
+	Speed        float64 `json:"bytes_per_second"`
+	//negative if unknown
+	Eta float64 `json:"eta_seconds"`
+	//the bytes of the finished files by the status, the bytes resumed from the earlier runs are skipped
+	StatusBytes map[string]int64 `json:"status_bytes"`
+}
+
+//Progress renders the status line of a long job, fed by the byte counters and the file counts of the workers,
+//the status line is redrawn on a terminal, or printed as a log line periodically if not
+type Progress struct {
+	name       string
+	totalFiles int64
+	totalBytes int64
+	counts     func() ProgressCounts
+	start      time.Time
+
+	bytes  int64
+	active int64
+
+	statusLock  sync.Mutex
+	statusBytes map[string]int64
+
+	w     io.Writer
+	tty   bool
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	width int
+}
+
+func NewProgress(name string, totalFiles, totalBytes int64, counts func() ProgressCounts) *Progress {
+	return &Progress{
+		name:       name,
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		counts:     counts,
+		start:      time.Now(),
+		w:          os.Stdout,
+		tty:        isTerminal(os.Stdout),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+//Transferred counts the bytes sent or received
+func (p *Progress) Transferred(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, n)
+	}
+}
+
+func (p *Progress) WorkerStart() {
+	if p != nil {
+		atomic.AddInt64(&p.active, 1)
+	}
+}
+
+func (p *Progress) WorkerEnd() {
+	if p != nil {
+		atomic.AddInt64(&p.active, -1)
+	}
+}
+
+//File counts the bytes of a file, which are added to the status of the file when finished
+func (p *Progress) File() *ProgressFile {
+	return &ProgressFile{p: p}
+}
+
+//ProgressFile is the transfer of a file of the job
+type ProgressFile struct {
+	p       *Progress
+	bytes   int64
+	resumed int64
+}
+
+func (f *ProgressFile) Transferred(n int64) {
+	atomic.AddInt64(&f.bytes, n)
+	f.p.Transferred(n)
+}
+
+//Resumed counts the bytes not transferred again as resumed from the earlier runs
+func (f *ProgressFile) Resumed(n int64) {
+	atomic.StoreInt64(&f.resumed, n)
+}
+
+//OnBlockProgress counts the bytes of the blocks of a resumable upload, the progress of the blocks
+//uploaded at the same time may come out of order. The bytes resumed from the progress file are not
+//transferred by this upload, so they are not counted
+func (f *ProgressFile) OnBlockProgress() func(rio.BlockProgress) {
+	var reported int64
+	return func(bp rio.BlockProgress) {
+		f.Resumed(bp.Resumed)
+		uploaded := bp.Uploaded - bp.Resumed
+		for {
+			last := atomic.LoadInt64(&reported)
+			if uploaded <= last {
+				return
+			}
+			if atomic.CompareAndSwapInt64(&reported, last, uploaded) {
+				f.Transferred(uploaded - last)
+				return
+			}
+		}
+	}
+}
+
+//Reader counts the bytes read from r
+func (f *ProgressFile) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, f: f}
+}
+
+//Finish adds the bytes of the file to its status by the error of the transfer
+func (f *ProgressFile) Finish(err error) {
+	if f.p == nil {
+		return
+	}
+	status := PROGRESS_SUCCEEDED
+	if err != nil {
+		status = PROGRESS_FAILED
+	}
+	f.p.statusLock.Lock()
+	defer f.p.statusLock.Unlock()
+	if f.p.statusBytes == nil {
+		f.p.statusBytes = make(map[string]int64)
+	}
+	f.p.statusBytes[status] += atomic.LoadInt64(&f.bytes)
+	f.p.statusBytes[PROGRESS_SKIPPED] += atomic.LoadInt64(&f.resumed)
+}
+
+type progressReader struct {
+	r io.Reader
+	f *ProgressFile
+}
+
+func (r *progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	r.f.Transferred(int64(n))
+	return
+}
+
+func (p *Progress) Status() (status ProgressStatus) {
+	counts := p.counts()
+	status = ProgressStatus{
+		Name:         p.name,
+		TotalFiles:   p.totalFiles,
+		TotalBytes:   p.totalBytes,
+		DoneFiles:    counts.Done,
+		FailedFiles:  counts.Failed,
+		SkippedFiles: counts.Skipped,
+		Bytes:        atomic.LoadInt64(&p.bytes),
+		Active:       atomic.LoadInt64(&p.active),
+		Elapsed:      time.Since(p.start).Seconds(),
+		Eta:          -1,
+		StatusBytes:  map[string]int64{PROGRESS_SUCCEEDED: 0, PROGRESS_FAILED: 0, PROGRESS_SKIPPED: 0},
+	}
+	p.statusLock.Lock()
+	for name, n := range p.statusBytes {
+		status.StatusBytes[name] = n
+	}
+	p.statusLock.Unlock()
+	if status.Elapsed > 0 {
+		status.Speed = float64(status.Bytes) / status.Elapsed
+	}
+	//the files left are taken to be of the average size, as the skipped files are not transferred
+	finished := counts.Done + counts.Failed + counts.Skipped
+	if status.Speed > 0 && p.totalFiles > 0 && finished <= p.totalFiles {
+		leftBytes := float64(p.totalBytes) * float64(p.totalFiles-finished) / float64(p.totalFiles)
+		status.Eta = leftBytes / status.Speed
+	}
+	return
+}
+
+func (s ProgressStatus) String() string {
+	eta := "-"
+	if s.Eta >= 0 {
+		eta = (time.Duration(s.Eta) * time.Second).String()
+	}
+	return fmt.Sprintf("[%s] %d/%d files, %d failed, %d skipped | %s/%s | %s/s | ETA %s | %d active",
+		s.Name, s.DoneFiles+s.FailedFiles+s.SkippedFiles, s.TotalFiles, s.FailedFiles, s.SkippedFiles,
+		progressSize(s.Bytes), progressSize(s.TotalBytes), progressSize(int64(s.Speed)), eta, s.Active)
+}
+
+func progressSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i += 1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.2f %s", value, units[i])
+}
+
+//Start renders the status until stopped
+func (p *Progress) Start() {
+	p.stop = make(chan struct{})
+	interval := PROGRESS_LOG_INTERVAL
+	if p.tty {
+		interval = PROGRESS_TTY_INTERVAL
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+//Stop renders the final status
+func (p *Progress) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+	p.render()
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *Progress) render() {
+	line := p.Status().String()
+	//not to the log too, or the line is printed twice when the log is on the console
+	if !p.tty {
+		fmt.Fprintf(p.w, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), line)
+		return
+	}
+	//pad to clear the longer line before
+	padding := p.width - len(line)
+	if padding < 0 {
+		padding = 0
+	}
+	p.width = len(line)
+	fmt.Fprintf(p.w, "\r%s%*s", line, padding, "")
+}
@@ -0,0 +1,54 @@
+package atfuck
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	rio "qiniu/api.v6/resumable/io"
+)
+
+func TestProgress(t *testing.T) {
+	counts := ProgressCounts{Done: 2, Failed: 1, Skipped: 1}
+	p := NewProgress("upload", 8, 8000, func() ProgressCounts { return counts })
+	var out bytes.Buffer
+	p.w, p.tty = &out, false
+
+	//the blocks uploaded at the same time report out of order
+	file := p.File()
+	onProgress := file.OnBlockProgress()
+	for _, uploaded := range []int64{100, 300, 200, 400} {
+		onProgress(rio.BlockProgress{Uploaded: uploaded})
+	}
+	//the bytes resumed from the progress file are not counted
+	resumedFile := p.File()
+	onResumed := resumedFile.OnBlockProgress()
+	for _, uploaded := range []int64{500, 600} {
+		onResumed(rio.BlockProgress{Uploaded: uploaded, Resumed: 400})
+	}
+	p.Transferred(400)
+	p.WorkerStart()
+	file.Finish(nil)
+	resumedFile.Finish(errors.New("failed"))
+
+	status := p.Status()
+	if status.Bytes != 1000 || status.Active != 1 || status.SkippedFiles != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	//the bytes of the finished files by the status
+	if status.StatusBytes[PROGRESS_SUCCEEDED] != 400 || status.StatusBytes[PROGRESS_FAILED] != 200 ||
+		status.StatusBytes[PROGRESS_SKIPPED] != 400 {
+		t.Fatalf("unexpected status bytes %v", status.StatusBytes)
+	}
+	//half of the files are left, so half of the bytes
+	if status.Speed <= 0 || status.Eta < 0 || status.Eta > 4000/status.Speed*1.01 || status.Eta < 4000/status.Speed*0.99 {
+		t.Fatalf("unexpected eta %+v", status)
+	}
+
+	p.Stop()
+	line := out.String()
+	if !strings.Contains(line, "[upload] 4/8 files, 1 failed, 1 skipped") || !strings.Contains(line, "1000 B/7.81 KB") {
+		t.Fatalf("unexpected line `%s`", line)
+	}
+}
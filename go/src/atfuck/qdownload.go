@@ -28,6 +28,7 @@ import (
 	"bucket"		:	"test-bucket",
 	"prefix"		:	"demo/",
 	"suffixes"		: 	".png,.jpg",
+	"encrypt_key_file"	:	""
 }
 */
 
@@ -49,6 +50,8 @@ type DownloadConfig struct {
 	//down from cdn
 	Referer   string `json:"referer,omitempty"`
 	CdnDomain string `json:"cdn_domain,omitempty"`
+	//client-side encryption, the master key file to decrypt the encrypted files
+	EncryptKeyFile string `json:"encrypt_key_file,omitempty"`
 	//log settings
 	LogLevel  string `json:"log_level,omitempty"`
 	LogFile   string `json:"log_file,omitempty"`
@@ -57,6 +60,9 @@ type DownloadConfig struct {
 }
 
 var downloadTasks chan func()
+
+//the status line of the download
+var downloadProgress *Progress
 var initDownOnce sync.Once
 var ZIP_LIST = []string{
 	".zip",
@@ -161,6 +167,16 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	SetZone(bucketInfo.Region)
 	ioProxyAddress := conf.IO_HOST
 
+	//decrypt the encrypted files after download
+	var masterKey *MasterKey
+	if downConfig.EncryptKeyFile != "" {
+		var kErr error
+		if masterKey, kErr = LoadMasterKey(downConfig.EncryptKeyFile); kErr != nil {
+			logs.Error("Load master key error,", kErr)
+			os.Exit(STATUS_HALT)
+		}
+	}
+
 	//check whether cdn domain is set
 	if downConfig.CdnDomain != "" {
 		ioProxyAddress = downConfig.CdnDomain
@@ -195,6 +211,14 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 		os.Exit(STATUS_ERROR)
 	}
 
+	//the packed files are downloaded from the packs by the index objects
+	if packedCount, expandErr := expandPackIndexes(&mac, domainOfBucket, ioProxyAddress, jobListFileName); expandErr != nil {
+		logs.Error("Expand pack index error", expandErr)
+		os.Exit(STATUS_ERROR)
+	} else if packedCount > 0 {
+		logs.Info("Found %d packed files in the packs", packedCount)
+	}
+
 	//init wait group
 	downWaitGroup := sync.WaitGroup{}
 
@@ -215,6 +239,17 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	var skipBySuffixes int64
 
 	totalFileCount = GetFileLineCount(jobListFileName)
+	downloadProgress = NewProgress("download", totalFileCount, GetFileBytes(jobListFileName, 1), func() ProgressCounts {
+		return ProgressCounts{
+			Done:    atomic.LoadInt64(&successFileCount),
+			Failed:  atomic.LoadInt64(&failureFileCount),
+			Skipped: atomic.LoadInt64(&existsFileCount) + atomic.LoadInt64(&skipBySuffixes),
+		}
+	})
+	downloadProgress.Start()
+	RegisterMetricsJob(downloadProgress, func() int {
+		return len(downloadTasks)
+	}, downConfig)
 
 	//open prepared file list to download files
 	listFp, openErr := os.Open(jobListFileName)
@@ -238,7 +273,7 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 	}
 
 	for listScanner.Scan() {
-		currentFileCount += 1
+		atomic.AddInt64(&currentFileCount, 1)
 		line := strings.TrimSpace(listScanner.Text())
 		items := strings.Split(line, "\t")
 		if len(items) >= 4 {
@@ -255,7 +290,7 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 				}
 
 				if !goAhead {
-					skipBySuffixes += 1
+					atomic.AddInt64(&skipBySuffixes, 1)
 					logs.Info("Skip download `%s`, suffix filter not match", fileKey)
 					continue
 				}
@@ -274,14 +309,13 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 			}
 
 			fileUrl := makePrivateDownloadLink(&mac, domainOfBucket, ioProxyAddress, fileKey)
-
-			//progress
-			if totalFileCount != 0 {
-				fmt.Printf("Downloading %s [%d/%d, %.1f%%] ...\n", fileKey, currentFileCount, totalFileCount,
-					float32(currentFileCount)*100/float32(totalFileCount))
-			} else {
-				fmt.Printf("Downloading %s ...\n", fileKey)
+			packKey, packOffset := parsePackedLine(items)
+			if packKey != "" {
+				fileUrl = makePrivateDownloadLink(&mac, domainOfBucket, ioProxyAddress, packKey)
 			}
+
+			logs.Debug("Queue %s [%d/%d]", fileKey, currentFileCount, totalFileCount)
+
 			//check whether log file exists
 			localFilePath := filepath.Join(downConfig.DestDir, fileKey)
 			localAbsFilePath, _ := filepath.Abs(localFilePath)
@@ -299,10 +333,10 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 					oldFileInfoItems := strings.Split(string(oldFileInfo), "|")
 					oldFileLmd, _ := strconv.ParseInt(oldFileInfoItems[0], 10, 64)
 					//oldFileSize, _ := strconv.ParseInt(oldFileInfoItems[1], 10, 64)
-					if oldFileLmd == fileMtime && localFileInfo.Size() == fileSize {
+					if oldFileLmd == fileMtime && sameDownloadSize(masterKey, localFileInfo.Size(), fileSize) {
 						//nothing change, ignore
 						logs.Info("Local file `%s` exists, same as in bucket, download skip", localAbsFilePath)
-						existsFileCount += 1
+						atomic.AddInt64(&existsFileCount, 1)
 						continue
 					} else {
 						//somthing changed, must download a new file
@@ -310,7 +344,7 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 						downNewFile = true
 					}
 				} else {
-					if localFileInfo.Size() != fileSize {
+					if !sameDownloadSize(masterKey, localFileInfo.Size(), fileSize) {
 						logs.Info("Local file `%s` exists, size not the same as in bucket, go to download", localAbsFilePath)
 						downNewFile = true
 					} else {
@@ -338,7 +372,7 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 								fromBytes = localTmpFileInfo.Size()
 							} else {
 								//rename it
-								renameErr := os.Rename(localFilePathTmp, localFilePath)
+								renameErr := finishDownload(masterKey, fileKey, localFilePathTmp, localFilePath)
 								if renameErr != nil {
 									logs.Error("Rename temp file `%s` to final file `%s` error", localFilePathTmp, localFilePath, renameErr)
 								}
@@ -368,8 +402,10 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 			downWaitGroup.Add(1)
 			downloadTasks <- func() {
 				defer downWaitGroup.Done()
+				downloadProgress.WorkerStart()
+				defer downloadProgress.WorkerEnd()
 
-				downErr := downloadFile(downConfig, fileKey, fileUrl, domainOfBucket, fileSize, fromBytes)
+				downErr := downloadFile(downConfig, masterKey, fileKey, fileUrl, domainOfBucket, packOffset, fileSize, fromBytes)
 				if downErr != nil {
 					atomic.AddInt64(&failureFileCount, 1)
 					logs.Info("put into the queue again")
@@ -386,6 +422,7 @@ func QiniuDownload(threadCount int, downConfig *DownloadConfig) {
 
 	//wait for all tasks done
 	downWaitGroup.Wait()
+	downloadProgress.Stop()
 
 	logs.Info("-------Download Result-------")
 	logs.Info("%10s%10d", "Total:", totalFileCount)
@@ -416,13 +453,45 @@ func makePrivateDownloadLink(mac *digest.Mac, domainOfBucket, ioProxyAddress, fi
 	return
 }
 
+//sameDownloadSize checks the local file size against the file in bucket, which is larger if encrypted
+func sameDownloadSize(masterKey *MasterKey, localFileSize, fileSize int64) bool {
+	return localFileSize == fileSize || masterKey != nil && localFileSize == DecryptedSize(fileSize)
+}
+
+//finishDownload moves the temp file to the local file, the encrypted file is decrypted if the master key is set
+func finishDownload(masterKey *MasterKey, fileName, localFilePathTmp, localFilePath string) (err error) {
+	if encrypted, _ := IsEncryptedFile(localFilePathTmp); !encrypted {
+		return os.Rename(localFilePathTmp, localFilePath)
+	}
+	if masterKey == nil {
+		logs.Warning("File `%s` is encrypted, keep the ciphertext without `encrypt_key_file`", fileName)
+		return os.Rename(localFilePathTmp, localFilePath)
+	}
+	err = DecryptFile(masterKey, localFilePathTmp, localFilePath)
+	//the broken ciphertext is downloaded again next time
+	os.Remove(localFilePathTmp)
+	if err != nil {
+		logs.Error("Decrypt `%s` error, %s", fileName, err)
+		return
+	}
+	logs.Info("Decrypt", fileName, "by the master key", masterKey.Id())
+	return
+}
+
 //file key -> mtime
-func downloadFile(downConfig *DownloadConfig, fileName, fileUrl, domainOfBucket string, fileSize int64, fromBytes int64) (err error) {
+//the packed file is the range of the size at the pack offset
+func downloadFile(downConfig *DownloadConfig, masterKey *MasterKey, fileName, fileUrl, domainOfBucket string,
+	packOffset, fileSize, fromBytes int64) (err error) {
 	startDown := time.Now().Unix()
 	destDir := downConfig.DestDir
 	localFilePath := filepath.Join(destDir, fileName)
 	localFileDir := filepath.Dir(localFilePath)
 	localFilePathTmp := fmt.Sprintf("%s.tmp", localFilePath)
+	file := downloadProgress.File()
+	file.Resumed(fromBytes)
+	defer func() {
+		file.Finish(err)
+	}()
 
 	mkdirErr := os.MkdirAll(localFileDir, 0775)
 	if mkdirErr != nil {
@@ -445,7 +514,14 @@ func downloadFile(downConfig *DownloadConfig, fileName, fileUrl, domainOfBucket
 		req.Header.Add("Referer", downConfig.Referer)
 	}
 
-	if fromBytes != 0 {
+	if packOffset != 0 {
+		//an empty packed file still reads a byte of the pack
+		rangeEnd := packOffset + fileSize - 1
+		if fileSize == 0 {
+			rangeEnd = packOffset
+		}
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", packOffset+fromBytes, rangeEnd))
+	} else if fromBytes != 0 {
 		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", fromBytes))
 	}
 
@@ -456,7 +532,16 @@ func downloadFile(downConfig *DownloadConfig, fileName, fileUrl, domainOfBucket
 		return
 	}
 	defer resp.Body.Close()
+	if packOffset != 0 && resp.StatusCode != http.StatusPartialContent {
+		err = fmt.Errorf("range not supported, %s", resp.Status)
+		logs.Error("Download", fileName, "from the pack failed,", err)
+		return
+	}
 	if resp.StatusCode/100 == 2 {
+		var body io.Reader = file.Reader(resp.Body)
+		if packOffset != 0 {
+			body = io.LimitReader(body, fileSize-fromBytes)
+		}
 		var localFp *os.File
 		var openErr error
 		if fromBytes != 0 {
@@ -471,7 +556,7 @@ func downloadFile(downConfig *DownloadConfig, fileName, fileUrl, domainOfBucket
 			return
 		}
 
-		cpCnt, cpErr := io.Copy(localFp, resp.Body)
+		cpCnt, cpErr := io.Copy(localFp, body)
 		if cpErr != nil {
 			err = cpErr
 			localFp.Close()
@@ -486,7 +571,7 @@ func downloadFile(downConfig *DownloadConfig, fileName, fileUrl, domainOfBucket
 		avgSpeed := fmt.Sprintf("%.2fKB/s", float64(cpCnt)/float64(endDown-startDown)/1024)
 
 		//move temp file to log file
-		renameErr := os.Rename(localFilePathTmp, localFilePath)
+		renameErr := finishDownload(masterKey, fileName, localFilePathTmp, localFilePath)
 		if renameErr != nil {
 			err = renameErr
 			logs.Error("Rename temp file to final log file error", renameErr)
@@ -0,0 +1,49 @@
+package atfuck
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestQiniuDownload(t *testing.T) {
+	srv, _ := startFakeServer(t)
+	files := map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.bin": make([]byte, BLOCK_SIZE+1024),
+		"dir/c.png": []byte("png"),
+	}
+	rand.Read(files["dir/b.bin"])
+	for key, data := range files {
+		srv.PutObject(fakeBucket, key, data, "")
+	}
+
+	destDir := t.TempDir()
+	downConfig := DownloadConfig{
+		DestDir:  destDir,
+		Bucket:   fakeBucket,
+		AK:       fakeAccessKey,
+		SK:       fakeSecretKey,
+		Suffixes: ".txt,.bin",
+		LogFile:  filepath.Join(t.TempDir(), "download.log"),
+	}
+	QiniuDownload(2, &downConfig)
+
+	for key, data := range files {
+		local, err := ioutil.ReadFile(filepath.Join(destDir, key))
+		if key == "dir/c.png" {
+			if err == nil {
+				t.Fatalf("`%s` should be skipped by suffixes", key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(local, data) {
+			t.Fatalf("content of `%s` mismatched", key)
+		}
+	}
+}
@@ -32,8 +32,11 @@ func GetEtag(filename string) (etag string, err error) {
 	if err != nil {
 		return
 	}
+	return GetEtagOfReader(f, fi.Size())
+}
 
-	fsize := fi.Size()
+//GetEtagOfReader calculates the etag of the fsize bytes read from f
+func GetEtagOfReader(f io.Reader, fsize int64) (etag string, err error) {
 	blockCnt := BlockCount(fsize)
 	sha1Buf := make([]byte, 0, 21)
 
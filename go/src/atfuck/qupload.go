@@ -2,8 +2,10 @@ package atfuck
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -46,7 +48,14 @@ Config file like:
 	"bind_up_ip"		:	"",
 	"bind_rs_ip"		:	"",
 	"bind_nic_ip"		:	"",
-	"rescan_local"		:	false
+	"rescan_local"		:	false,
+	"encrypt_key_file"	:	"",
+	"pack_threshold"	:	0,
+	"pack_size"		:	67108864,
+	"dedup"			:	false,
+	"dedup_rescan"		:	false,
+	"dedup_hash_layout"	:	false,
+	"dedup_hash_prefix"	:	"hash/"
 }
 
 or the simplest one
@@ -92,6 +101,25 @@ type UploadConfig struct {
 	//advanced config
 	UpHost string `json:"up_host,omitempty"`
 
+	//multipart upload (v2) instead of mkblk/mkfile for the big files
+	ResumableApiV2         bool  `json:"resumable_api_v2,omitempty"`
+	ResumableApiV2PartSize int64 `json:"resumable_api_v2_part_size,omitempty"`
+
+	//client-side encryption, the master key file to wrap the data keys of the files
+	EncryptKeyFile string `json:"encrypt_key_file,omitempty"`
+
+	//pack the files smaller than the threshold into the tar objects of the pack size,
+	//the index objects locate the packed files for qdownload and cat
+	PackThreshold int64 `json:"pack_threshold,omitempty"`
+	PackSize      int64 `json:"pack_size,omitempty"`
+
+	//copy in bucket instead of upload if the file of the same hash is in bucket, by the local index of the
+	//bucket list, the hash layout stores the files by the hashes and writes the manifest of the keys
+	Dedup           bool   `json:"dedup,omitempty"`
+	DedupRescan     bool   `json:"dedup_rescan,omitempty"`
+	DedupHashLayout bool   `json:"dedup_hash_layout,omitempty"`
+	DedupHashPrefix string `json:"dedup_hash_prefix,omitempty"`
+
 	BindUpIp string `json:"bind_up_ip,omitempty"`
 	BindRsIp string `json:"bind_rs_ip,omitempty"`
 	//local network interface card config
@@ -127,6 +155,10 @@ var successFileCount int64
 var notOverwriteCount int64
 var failureFileCount int64
 var skippedFileCount int64
+var dedupFileCount int64
+
+//the status line of the upload
+var uploadProgress *Progress
 
 func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 	timeStart := time.Now()
@@ -200,18 +232,88 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 	//set up host
 	SetZone(bucketInfo.Region)
 
+	//encrypt the files before upload
+	var masterKey *MasterKey
+	var encryptChecker *encryptedChecker
+	if uploadConfig.EncryptKeyFile != "" {
+		masterKey, gErr = LoadMasterKey(uploadConfig.EncryptKeyFile)
+		if gErr != nil {
+			logs.Error("Load master key error,", gErr)
+			os.Exit(STATUS_HALT)
+		}
+		encryptChecker = &encryptedChecker{master: masterKey, mac: &mac, bucket: uploadConfig.Bucket}
+		logs.Info("Encrypt the files by the master key %s", masterKey.Id())
+	}
+
+	//pack the small files
+	var packer *filePacker
+	if uploadConfig.PackThreshold > 0 {
+		if masterKey != nil {
+			logs.Error("Upload config `pack_threshold` does not work with `encrypt_key_file`")
+			os.Exit(STATUS_HALT)
+		}
+		packDir, mkdirErr := packTempDir(storePath)
+		if mkdirErr != nil {
+			logs.Error("Failed to mkdir `%s` due to `%s`", packDir, mkdirErr)
+			os.Exit(STATUS_HALT)
+		}
+		packer = newFilePacker(uploadConfig.KeyPrefix, uploadConfig.PackSize, packDir)
+	}
+
+	//dedup by the index of the bucket
+	var dedup *dedupIndex
+	if uploadConfig.Dedup {
+		if masterKey != nil || packer != nil {
+			logs.Error("Upload config `dedup` does not work with `encrypt_key_file` or `pack_threshold`")
+			os.Exit(STATUS_HALT)
+		}
+		dedupDir := filepath.Join(QShellRootPath, ".atfuck", "qupload", "dedup")
+		if mkdirErr := os.MkdirAll(dedupDir, 0775); mkdirErr != nil {
+			logs.Error("Failed to mkdir `%s` due to `%s`", dedupDir, mkdirErr)
+			os.Exit(STATUS_HALT)
+		}
+		logs.Info("Loading the dedup index of bucket `%s`, the bucket is listed at the first time", uploadConfig.Bucket)
+		var dErr error
+		dedup, dErr = openDedupIndex(&mac, uploadConfig.Bucket, filepath.Join(dedupDir, Md5Hex(uploadConfig.Bucket)+".ldb"),
+			uploadConfig.DedupRescan)
+		if dErr != nil {
+			logs.Error("Open dedup index error,", dErr)
+			os.Exit(STATUS_HALT)
+		}
+		defer dedup.close()
+		if uploadConfig.DedupHashLayout {
+			dedup.hashPrefix = uploadConfig.DedupHashPrefix
+			if dedup.hashPrefix == "" {
+				dedup.hashPrefix = DEFAULT_DEDUP_HASH_PREFIX
+			}
+		}
+	}
+
 	//chunk upload threshold
 	putThreshold := DEFAULT_PUT_THRESHOLD
 	if uploadConfig.PutThreshold > 0 {
 		putThreshold = uploadConfig.PutThreshold
 	}
 
+	//multipart upload part size
+	if partSize := uploadConfig.ResumableApiV2PartSize; uploadConfig.ResumableApiV2 && partSize != 0 &&
+		(partSize < rio.MinPartSize || partSize > rio.MaxPartSize) {
+		logs.Error("Upload config `resumable_api_v2_part_size` error,", rio.ErrInvalidPartSize)
+		os.Exit(STATUS_HALT)
+	}
+
 	//use host if not empty, overwrite the default config
 	if uploadConfig.UpHost != "" {
 		conf.UP_HOST = uploadConfig.UpHost
 	}
-	//set resume upload settings
-	rio.SetSettings(&upSettings)
+	//resume upload workers of this job, shared by the files uploading at the same time
+	uploader := rio.NewUploader(&upSettings)
+	defer uploader.Close()
+	//each file can take its share of the workers
+	blockConcurrency := 1
+	if threadCount > 0 && upSettings.Workers/threadCount > 1 {
+		blockConcurrency = upSettings.Workers / threadCount
+	}
 
 	//make SrcDir the full path
 	uploadConfig.SrcDir, _ = filepath.Abs(uploadConfig.SrcDir)
@@ -259,6 +361,15 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 		Sync: true,
 	}
 
+	uploadProgress = NewProgress("upload", totalFileCount, GetFileBytes(cacheResultName, 1), func() ProgressCounts {
+		return ProgressCounts{
+			Done:    atomic.LoadInt64(&successFileCount) + atomic.LoadInt64(&dedupFileCount),
+			Failed:  atomic.LoadInt64(&failureFileCount),
+			Skipped: atomic.LoadInt64(&skippedFileCount) + atomic.LoadInt64(&notOverwriteCount),
+		}
+	})
+	uploadProgress.Start()
+
 	//init wait group
 	upWaitGroup := sync.WaitGroup{}
 
@@ -268,18 +379,21 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 			go doUpload(uploadTasks)
 		}
 	})
+	RegisterMetricsJob(uploadProgress, func() int {
+		return len(uploadTasks)
+	}, uploadConfig)
 
-	//check bind net interface card
-	var transport *http.Transport
+	//check bind net interface card, the requests are counted by the metrics like the default transport
+	var transport http.RoundTripper
 	var rsClient rs.Client
 	if uploadConfig.BindNicIp != "" {
-		transport = &http.Transport{
+		transport = NewMetricsTransport(&http.Transport{
 			Dial: (&net.Dialer{
 				LocalAddr: &net.TCPAddr{
 					IP: net.ParseIP(uploadConfig.BindNicIp),
 				},
 			}).Dial,
-		}
+		})
 	}
 
 	if transport != nil {
@@ -303,30 +417,30 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 		}
 
 		localFileRelativePath := items[0]
-		currentFileCount += 1
+		atomic.AddInt64(&currentFileCount, 1)
 
 		//check skip local file or folder
 		if skip, prefix := hitByPathPrefixes(uploadConfig.SkipPathPrefixes, localFileRelativePath); skip {
 			logs.Informational("Skip by path prefix `%s` for local file path `%s`", prefix, localFileRelativePath)
-			skippedFileCount += 1
+			atomic.AddInt64(&skippedFileCount, 1)
 			continue
 		}
 
 		if skip, prefix := hitByFilePrefixes(uploadConfig.SkipFilePrefixes, localFileRelativePath); skip {
 			logs.Informational("Skip by file prefix `%s` for local file path `%s`", prefix, localFileRelativePath)
-			skippedFileCount += 1
+			atomic.AddInt64(&skippedFileCount, 1)
 			continue
 		}
 
 		if skip, fixedStr := hitByFixesString(uploadConfig.SkipFixedStrings, localFileRelativePath); skip {
 			logs.Informational("Skip by fixed string `%s` for local file path `%s`", fixedStr, localFileRelativePath)
-			skippedFileCount += 1
+			atomic.AddInt64(&skippedFileCount, 1)
 			continue
 		}
 
 		if skip, suffix := hitBySuffixes(uploadConfig.SkipSuffixes, localFileRelativePath); skip {
 			logs.Informational("Skip by suffix `%s` for local file `%s`", suffix, localFileRelativePath)
-			skippedFileCount += 1
+			atomic.AddInt64(&skippedFileCount, 1)
 			continue
 		}
 
@@ -351,7 +465,7 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 		localFilePath := filepath.Join(uploadConfig.SrcDir, localFileRelativePath)
 		localFileStat, statErr := os.Stat(localFilePath)
 		if statErr != nil {
-			failureFileCount += 1
+			atomic.AddInt64(&failureFileCount, 1)
 			logs.Error("Error stat local file `%s` due to `%s`", localFilePath, statErr)
 			continue
 		}
@@ -359,30 +473,64 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 		localFileSize := localFileStat.Size()
 		ldbKey := fmt.Sprintf("%s => %s", localFilePath, uploadFileKey)
 
-		if totalFileCount != 0 {
-			fmt.Printf("Uploading %s [%d/%d, %.1f%%] ...\n", ldbKey, currentFileCount, totalFileCount,
-				float32(currentFileCount)*100/float32(totalFileCount))
-		} else {
-			fmt.Printf("Uploading %s ...\n", ldbKey)
+		logs.Debug("Queue %s [%d/%d]", ldbKey, currentFileCount, totalFileCount)
+
+		//the packed files and the files of the hash layout are not in bucket by their keys,
+		//only the leveldb log is checked
+		packIt := packer != nil && localFileSize < uploadConfig.PackThreshold
+		checkConfig := uploadConfig
+		if packIt || dedup != nil && dedup.hashPrefix != "" {
+			packCheckConfig := *uploadConfig
+			packCheckConfig.CheckExists = false
+			checkConfig = &packCheckConfig
 		}
 
 		//check exists
-		if !checkFileNeedToUpload(uploadConfig, &rsClient, ldb, &ldbWOpt, ldbKey, localFilePath,
+		if !checkFileNeedToUpload(checkConfig, &rsClient, encryptChecker, ldb, &ldbWOpt, ldbKey, localFilePath,
 			uploadFileKey, localFileLastModified, localFileSize) {
 			continue
 		}
 
+		if packIt {
+			pack, packErr := packer.add(localFilePath, uploadFileKey, ldbKey, localFileLastModified)
+			if packErr != nil {
+				atomic.AddInt64(&failureFileCount, 1)
+				logs.Error("Pack file `%s` => `%s` failed due to `%s`", localFilePath, uploadFileKey, packErr)
+			} else if pack != nil {
+				upWaitGroup.Add(1)
+				uploadTasks <- func() {
+					defer upWaitGroup.Done()
+					uploadFilePack(uploader, blockConcurrency, uploadConfig, transport, &mac, putThreshold, ldb, &ldbWOpt,
+						storePath, pack)
+				}
+			}
+			continue
+		}
+
 		logs.Informational("Uploading file %s => %s : %s", localFilePath, uploadConfig.Bucket, uploadFileKey)
 
 		//start to upload
 		upWaitGroup.Add(1)
 		uploadTasks <- func() {
 			defer upWaitGroup.Done()
+			uploadProgress.WorkerStart()
+			defer uploadProgress.WorkerEnd()
+
+			//copy the file of the same hash in bucket
+			targetKey := uploadFileKey
+			var fileHash string
+			if dedup != nil {
+				var done bool
+				if targetKey, fileHash, done = dedupUploadFile(dedup, &rsClient, uploadConfig, ldb, &ldbWOpt, ldbKey,
+					localFilePath, uploadFileKey, localFileLastModified, localFileSize); done {
+					return
+				}
+			}
 
 			policy := rs.PutPolicy{}
 			policy.Scope = uploadConfig.Bucket
-			if uploadConfig.Overwrite {
-				policy.Scope = fmt.Sprintf("%s:%s", uploadConfig.Bucket, uploadFileKey)
+			if uploadConfig.Overwrite || targetKey != uploadFileKey {
+				policy.Scope = fmt.Sprintf("%s:%s", uploadConfig.Bucket, targetKey)
 				policy.InsertOnly = 0
 			}
 
@@ -391,24 +539,65 @@ func QiniuUpload(threadCount int, uploadConfig *UploadConfig, watchDir bool) {
 			policy.Expires = 7 * 24 * 3600
 			upToken := policy.Token(&mac)
 
+			var upErr error
 			if localFileSize > putThreshold {
-				resumableUploadFile(uploadConfig, transport, ldb, &ldbWOpt, ldbKey, upToken, storePath,
-					localFilePath, uploadFileKey, localFileLastModified)
+				upErr = resumableUploadFile(uploader, blockConcurrency, uploadConfig, transport, masterKey, ldb, &ldbWOpt, ldbKey,
+					upToken, storePath, localFilePath, targetKey, localFileLastModified)
 			} else {
-				formUploadFile(uploadConfig, transport, ldb, &ldbWOpt, ldbKey, upToken,
-					localFilePath, uploadFileKey, localFileLastModified)
+				upErr = formUploadFile(uploadConfig, transport, masterKey, ldb, &ldbWOpt, ldbKey, upToken,
+					localFilePath, targetKey, localFileLastModified)
+				//the form upload is counted when done
+				file := uploadProgress.File()
+				if upErr == nil {
+					file.Transferred(localFileSize)
+				}
+				file.Finish(upErr)
+			}
+			if dedup != nil && upErr == nil {
+				if iErr := dedup.put(fileHash, targetKey); iErr != nil {
+					logs.Error("Put hash of `%s` into dedup index error due to `%s`", targetKey, iErr)
+				}
+				if iErr := dedup.record(uploadFileKey, fileHash, localFileSize); iErr != nil {
+					logs.Error("Put `%s` into manifest error due to `%s`", uploadFileKey, iErr)
+				}
+			}
+		}
+	}
+
+	if packer != nil {
+		pack, packErr := packer.flush()
+		if packErr != nil {
+			logs.Error("Pack the last files failed due to `%s`", packErr)
+			atomic.AddInt64(&failureFileCount, 1)
+		} else if pack != nil {
+			upWaitGroup.Add(1)
+			uploadTasks <- func() {
+				defer upWaitGroup.Done()
+				uploadFilePack(uploader, blockConcurrency, uploadConfig, transport, &mac, putThreshold, ldb, &ldbWOpt,
+					storePath, pack)
 			}
 		}
 	}
 
 	upWaitGroup.Wait()
 
+	//the manifest of all the files of the hash layout under the key prefix
+	if dedup != nil && dedup.hashPrefix != "" {
+		uploadManifest(uploader, blockConcurrency, uploadConfig, transport, &mac, putThreshold, storePath, dedup)
+	}
+	//the workers are stopped here as os.Exit skips the deferred calls
+	uploader.Close()
+	uploadProgress.Stop()
+
 	logs.Informational("-------------Upload Result--------------")
 	logs.Informational("%20s%10d", "Total:", totalFileCount)
 	logs.Informational("%20s%10d", "Success:", successFileCount)
 	logs.Informational("%20s%10d", "Failure:", failureFileCount)
 	logs.Informational("%20s%10d", "NotOverwrite:", notOverwriteCount)
 	logs.Informational("%20s%10d", "Skipped:", skippedFileCount)
+	if dedup != nil {
+		logs.Informational("%20s%10d", "Dedup:", dedupFileCount)
+	}
 	logs.Informational("%20s%15s", "Duration:", time.Since(timeStart))
 	logs.Info("----------------------------------------")
 	fmt.Println("\nSee upload log at path", uploadConfig.LogFile)
@@ -561,7 +750,8 @@ func hitBySuffixes(suffixesStr, localFileRelativePath string) (hit bool, hitSuff
 	return
 }
 
-func checkFileNeedToUpload(uploadConfig *UploadConfig, rsClient *rs.Client, ldb *leveldb.DB, ldbWOpt *opt.WriteOptions,
+func checkFileNeedToUpload(uploadConfig *UploadConfig, rsClient *rs.Client, encryptChecker *encryptedChecker,
+	ldb *leveldb.DB, ldbWOpt *opt.WriteOptions,
 	ldbKey, localFilePath, uploadFileKey string, localFileLastModified, localFileSize int64) (needToUpload bool) {
 	//default to upload
 	needToUpload = true
@@ -572,8 +762,14 @@ func checkFileNeedToUpload(uploadConfig *UploadConfig, rsClient *rs.Client, ldb
 		if checkErr == nil {
 			ldbValue := fmt.Sprintf("%d", localFileLastModified)
 			if uploadConfig.CheckHash {
-				//compare hash
-				localEtag, cErr := GetEtag(localFilePath)
+				//compare hash, the file in bucket is the ciphertext if encrypted
+				var localEtag string
+				var cErr error
+				if encryptChecker != nil {
+					localEtag, cErr = encryptChecker.etag(uploadFileKey, localFilePath)
+				} else {
+					localEtag, cErr = GetEtag(localFilePath)
+				}
 				if cErr != nil {
 					logs.Error("File `%s` calc local hash failed, %s", uploadFileKey, cErr)
 					atomic.AddInt64(&failureFileCount, 1)
@@ -598,7 +794,11 @@ func checkFileNeedToUpload(uploadConfig *UploadConfig, rsClient *rs.Client, ldb
 				}
 			} else {
 				if uploadConfig.CheckSize {
-					if rsEntry.Fsize == localFileSize {
+					remoteFileSize := localFileSize
+					if encryptChecker != nil {
+						remoteFileSize = EncryptedSize(localFileSize)
+					}
+					if rsEntry.Fsize == remoteFileSize {
 						logs.Info("File `%s` exists in bucket, size match, ignore this upload", uploadFileKey)
 						atomic.AddInt64(&skippedFileCount, 1)
 						putErr := ldb.Put([]byte(ldbKey), []byte(ldbValue), ldbWOpt)
@@ -659,9 +859,9 @@ func checkFileNeedToUpload(uploadConfig *UploadConfig, rsClient *rs.Client, ldb
 	return
 }
 
-func formUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
+func formUploadFile(uploadConfig *UploadConfig, transport http.RoundTripper, masterKey *MasterKey,
 	ldb *leveldb.DB, ldbWOpt *opt.WriteOptions, ldbKey string, upToken string,
-	localFilePath, uploadFileKey string, localFileLastModified int64) {
+	localFilePath, uploadFileKey string, localFileLastModified int64) (err error) {
 	var putClient rpc.Client
 	if transport != nil {
 		putClient = rpc.NewClientEx(transport, uploadConfig.BindUpIp)
@@ -670,7 +870,17 @@ func formUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
 	}
 
 	putRet := fio.PutRet{}
-	err := fio.PutFile(putClient, nil, &putRet, upToken, uploadFileKey, localFilePath, nil)
+	if masterKey != nil {
+		var fp *os.File
+		var encrypted io.ReaderAt
+		var size int64
+		if fp, encrypted, size, err = openEncrypted(masterKey, localFilePath, "", ""); err == nil {
+			err = fio.Put2(putClient, nil, &putRet, upToken, uploadFileKey, io.NewSectionReader(encrypted, 0, size), size, nil)
+			fp.Close()
+		}
+	} else {
+		err = fio.PutFile(putClient, nil, &putRet, upToken, uploadFileKey, localFilePath, nil)
+	}
 	if err != nil {
 		atomic.AddInt64(&failureFileCount, 1)
 		if pErr, ok := err.(*rpc.ErrorInfo); ok {
@@ -686,11 +896,12 @@ func formUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
 			logs.Error("Put key `%s` into leveldb error due to `%s`", ldbKey, putErr)
 		}
 	}
+	return
 }
 
-func resumableUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
-	ldb *leveldb.DB, ldbWOpt *opt.WriteOptions, ldbKey string, upToken string, storePath,
-	localFilePath, uploadFileKey string, localFileLastModified int64) {
+func resumableUploadFile(uploader *rio.Uploader, blockConcurrency int, uploadConfig *UploadConfig, transport http.RoundTripper,
+	masterKey *MasterKey, ldb *leveldb.DB, ldbWOpt *opt.WriteOptions, ldbKey string, upToken string, storePath,
+	localFilePath, uploadFileKey string, localFileLastModified int64) (err error) {
 	var putClient rpc.Client
 	if transport != nil {
 		putClient = rio.NewClientEx(upToken, transport, uploadConfig.BindUpIp)
@@ -700,18 +911,64 @@ func resumableUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
 
 	//params
 	putRet := rio.PutRet{}
-	putExtra := rio.PutExtra{}
 
-	//progress file
-	progressFileKey := Md5Hex(fmt.Sprintf("%s:%s|%s:%s", uploadConfig.SrcDir,
-		uploadConfig.Bucket, localFilePath, uploadFileKey))
+	//progress file, of the version of the local file so that a changed file is uploaded from the start
+	progressFileKey := Md5Hex(fmt.Sprintf("%s:%s|%s:%s|%d", uploadConfig.SrcDir,
+		uploadConfig.Bucket, localFilePath, uploadFileKey, localFileLastModified))
 	progressFilePath := filepath.Join(storePath, fmt.Sprintf("%s.progress", progressFileKey))
-	putExtra.ProgressFile = progressFilePath
+	if uploadConfig.ResumableApiV2 {
+		progressFilePath += ".v2"
+	}
+
+	//the envelope is kept with the progress file, so the resumed upload encrypts the same ciphertext
+	var encrypted io.ReaderAt
+	var encryptedSize int64
+	envelopeFilePath := progressFilePath + ".envelope"
+	if masterKey != nil {
+		var fp *os.File
+		if fp, encrypted, encryptedSize, err = openEncrypted(masterKey, localFilePath, envelopeFilePath,
+			progressFilePath); err == nil {
+			defer fp.Close()
+		}
+	}
 
 	//resumable upload
-	err := rio.PutFile(putClient, nil, &putRet, uploadFileKey, localFilePath, &putExtra)
+	file := uploadProgress.File()
 	if err != nil {
-		os.Remove(progressFilePath)
+		//failed to open the encrypted file
+	} else if uploadConfig.ResumableApiV2 {
+		putExtra := rio.PutExtraV2{
+			PartSize:     uploadConfig.ResumableApiV2PartSize,
+			ProgressFile: progressFilePath,
+			Concurrency:  blockConcurrency,
+			OnProgress:   file.OnBlockProgress(),
+		}
+		if encrypted != nil {
+			err = uploader.PutV2(context.Background(), putClient, nil, &putRet, uploadConfig.Bucket,
+				uploadFileKey, encrypted, encryptedSize, &putExtra)
+		} else {
+			err = uploader.PutFileV2(context.Background(), putClient, nil, &putRet, uploadConfig.Bucket,
+				uploadFileKey, localFilePath, &putExtra)
+		}
+	} else {
+		putExtra := rio.PutExtra{
+			Concurrency:  blockConcurrency,
+			ProgressFile: progressFilePath,
+			OnProgress:   file.OnBlockProgress(),
+		}
+		if encrypted != nil {
+			err = uploader.Put(context.Background(), putClient, nil, &putRet, uploadFileKey, encrypted, encryptedSize, &putExtra)
+		} else {
+			err = uploader.PutFile(context.Background(), putClient, nil, &putRet, uploadFileKey, localFilePath, &putExtra)
+		}
+	}
+	file.Finish(err)
+	if err != nil {
+		//the progress is kept for the next run to resume, unless it does not fit the file
+		if err == rio.ErrInvalidPutProgress {
+			os.Remove(progressFilePath)
+			os.Remove(envelopeFilePath)
+		}
 		atomic.AddInt64(&failureFileCount, 1)
 		if pErr, ok := err.(*rpc.ErrorInfo); ok {
 			logs.Error("Resumable upload file `%s` => `%s` failed due to rerror `%s`", localFilePath, uploadFileKey, pErr.Err)
@@ -720,6 +977,7 @@ func resumableUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
 		}
 	} else {
 		os.Remove(progressFilePath)
+		os.Remove(envelopeFilePath)
 		atomic.AddInt64(&successFileCount, 1)
 		logs.Informational("Upload file `%s` => `%s` success", localFilePath, uploadFileKey)
 		putErr := ldb.Put([]byte(ldbKey), []byte(fmt.Sprintf("%d", localFileLastModified)), ldbWOpt)
@@ -727,4 +985,195 @@ func resumableUploadFile(uploadConfig *UploadConfig, transport *http.Transport,
 			logs.Error("Put key `%s` into leveldb error due to `%s`", ldbKey, putErr)
 		}
 	}
+	return
+}
+
+//uploadFilePack uploads the pack and then its index, the packed files are logged after the index is uploaded
+func uploadFilePack(uploader *rio.Uploader, blockConcurrency int, uploadConfig *UploadConfig, transport http.RoundTripper,
+	mac *digest.Mac, putThreshold int64, ldb *leveldb.DB, ldbWOpt *opt.WriteOptions, storePath string, pack *filePack) {
+	defer pack.remove()
+	uploadProgress.WorkerStart()
+	defer uploadProgress.WorkerEnd()
+
+	err := uploadLocalObject(uploader, blockConcurrency, uploadConfig, transport, mac, putThreshold, storePath,
+		pack.tarFile, pack.key, pack.size)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(pack.indexFile); err == nil {
+			err = uploadLocalObject(uploader, blockConcurrency, uploadConfig, transport, mac, putThreshold, storePath,
+				pack.indexFile, pack.indexKey, fi.Size())
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&failureFileCount, int64(len(pack.files)))
+		logs.Error("Upload pack `%s` of %d files failed due to `%s`", pack.key, len(pack.files), err)
+		return
+	}
+
+	atomic.AddInt64(&successFileCount, int64(len(pack.files)))
+	logs.Informational("Upload pack `%s` of %d files success", pack.key, len(pack.files))
+	for _, file := range pack.files {
+		logs.Informational("Upload file `%s` => `%s` in pack `%s` success", file.localFile, file.Key, pack.key)
+		putErr := ldb.Put([]byte(file.ldbKey), []byte(fmt.Sprintf("%d", file.lastModified)), ldbWOpt)
+		if putErr != nil {
+			logs.Error("Put key `%s` into leveldb error due to `%s`", file.ldbKey, putErr)
+		}
+	}
+}
+
+func uploadLocalObject(uploader *rio.Uploader, blockConcurrency int, uploadConfig *UploadConfig, transport http.RoundTripper,
+	mac *digest.Mac, putThreshold int64, storePath, localFilePath, uploadFileKey string, localFileSize int64) (err error) {
+	policy := rs.PutPolicy{
+		Scope:    fmt.Sprintf("%s:%s", uploadConfig.Bucket, uploadFileKey),
+		FileType: uploadConfig.FileType,
+		Expires:  7 * 24 * 3600,
+	}
+	upToken := policy.Token(mac)
+	file := uploadProgress.File()
+	defer func() {
+		file.Finish(err)
+	}()
+
+	if localFileSize <= putThreshold {
+		var putClient rpc.Client
+		if transport != nil {
+			putClient = rpc.NewClientEx(transport, uploadConfig.BindUpIp)
+		} else {
+			putClient = rpc.NewClient(uploadConfig.BindUpIp)
+		}
+		putRet := fio.PutRet{}
+		if err = fio.PutFile(putClient, nil, &putRet, upToken, uploadFileKey, localFilePath, nil); err == nil {
+			file.Transferred(localFileSize)
+		}
+		return
+	}
+
+	var putClient rpc.Client
+	if transport != nil {
+		putClient = rio.NewClientEx(upToken, transport, uploadConfig.BindUpIp)
+	} else {
+		putClient = rio.NewClient(upToken, uploadConfig.BindUpIp)
+	}
+	putRet := rio.PutRet{}
+	progressFilePath := filepath.Join(storePath, fmt.Sprintf("%s.progress", Md5Hex(uploadFileKey)))
+	if uploadConfig.ResumableApiV2 {
+		putExtra := rio.PutExtraV2{
+			PartSize:     uploadConfig.ResumableApiV2PartSize,
+			ProgressFile: progressFilePath + ".v2",
+			Concurrency:  blockConcurrency,
+			OnProgress:   file.OnBlockProgress(),
+		}
+		return uploader.PutFileV2(context.Background(), putClient, nil, &putRet, uploadConfig.Bucket,
+			uploadFileKey, localFilePath, &putExtra)
+	}
+	putExtra := rio.PutExtra{
+		Concurrency:  blockConcurrency,
+		ProgressFile: progressFilePath,
+		OnProgress:   file.OnBlockProgress(),
+	}
+	if err = uploader.PutFile(context.Background(), putClient, nil, &putRet, uploadFileKey, localFilePath,
+		&putExtra); err == nil || err == rio.ErrInvalidPutProgress {
+		os.Remove(progressFilePath)
+	}
+	return
+}
+
+//dedupUploadFile copies the file of the same hash in bucket, and returns the key and the hash to upload if not done
+func dedupUploadFile(dedup *dedupIndex, rsClient *rs.Client, uploadConfig *UploadConfig, ldb *leveldb.DB,
+	ldbWOpt *opt.WriteOptions, ldbKey, localFilePath, uploadFileKey string, localFileLastModified, localFileSize int64) (
+	targetKey, fileHash string, done bool) {
+	fileHash, err := GetEtag(localFilePath)
+	if err != nil {
+		atomic.AddInt64(&failureFileCount, 1)
+		logs.Error("File `%s` calc local hash failed, %s", localFilePath, err)
+		return "", "", true
+	}
+	targetKey = dedup.targetKey(uploadFileKey, fileHash)
+
+	logDone := func() {
+		if iErr := dedup.record(uploadFileKey, fileHash, localFileSize); iErr != nil {
+			logs.Error("Put `%s` into manifest error due to `%s`", uploadFileKey, iErr)
+		}
+		putErr := ldb.Put([]byte(ldbKey), []byte(fmt.Sprintf("%d", localFileLastModified)), ldbWOpt)
+		if putErr != nil {
+			logs.Error("Put key `%s` into leveldb error due to `%s`", ldbKey, putErr)
+		}
+	}
+
+	srcKey, found := dedup.get(fileHash)
+	if !found {
+		return
+	}
+	//the file may be deleted or overwritten since indexed
+	entry, err := rsClient.Stat(nil, uploadConfig.Bucket, srcKey)
+	if err == nil && entry.Hash != fileHash {
+		logs.Warning("File `%s` is not of hash `%s` any more, go to upload", srcKey, fileHash)
+		dedup.forget(fileHash)
+		return
+	}
+	if v, ok := err.(*rpc.ErrorInfo); ok && v.Code == 612 {
+		logs.Warning("File `%s` of hash `%s` is not in bucket, go to upload", srcKey, fileHash)
+		dedup.forget(fileHash)
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&failureFileCount, 1)
+		logs.Error("Stat `%s` failed due to `%s`", srcKey, err)
+		return targetKey, fileHash, true
+	}
+	if srcKey == targetKey {
+		logs.Informational("File `%s` exists in bucket as `%s` by hash, ignore this upload", localFilePath, targetKey)
+		atomic.AddInt64(&skippedFileCount, 1)
+		logDone()
+		return targetKey, fileHash, true
+	}
+
+	force := uploadConfig.Overwrite || dedup.hashPrefix != ""
+	err = rsClient.Copy(nil, uploadConfig.Bucket, srcKey, uploadConfig.Bucket, targetKey, force)
+	if err == nil {
+		logs.Informational("Copy `%s` => `%s` of the same hash instead of upload `%s`", srcKey, targetKey, localFilePath)
+		atomic.AddInt64(&dedupFileCount, 1)
+		if iErr := dedup.put(fileHash, targetKey); iErr != nil {
+			logs.Error("Put hash of `%s` into dedup index error due to `%s`", targetKey, iErr)
+		}
+		logDone()
+		return targetKey, fileHash, true
+	}
+	if v, ok := err.(*rpc.ErrorInfo); ok {
+		switch v.Code {
+		case 612:
+			//the file is deleted from bucket, upload it
+			logs.Warning("File `%s` of hash `%s` is not in bucket, go to upload", srcKey, fileHash)
+			dedup.forget(fileHash)
+			return
+		case 614:
+			logs.Warning("Skip copy to the existing file `%s` because `overwrite` is false", targetKey)
+			atomic.AddInt64(&notOverwriteCount, 1)
+			return targetKey, fileHash, true
+		}
+	}
+	atomic.AddInt64(&failureFileCount, 1)
+	logs.Error("Copy `%s` => `%s` failed due to `%s`", srcKey, targetKey, err)
+	return targetKey, fileHash, true
+}
+
+func uploadManifest(uploader *rio.Uploader, blockConcurrency int, uploadConfig *UploadConfig, transport http.RoundTripper,
+	mac *digest.Mac, putThreshold int64, storePath string, dedup *dedupIndex) {
+	manifestFile := filepath.Join(storePath, "manifest.jsonl")
+	defer os.Remove(manifestFile)
+	count, err := dedup.writeManifest(uploadConfig.KeyPrefix, manifestFile)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(manifestFile); err == nil {
+			manifestKey := fmt.Sprintf("%s%s%s.jsonl", uploadConfig.KeyPrefix, DEDUP_MANIFEST_DIR, time.Now().Format("20060102150405"))
+			if err = uploadLocalObject(uploader, blockConcurrency, uploadConfig, transport, mac, putThreshold, storePath,
+				manifestFile, manifestKey, fi.Size()); err == nil {
+				logs.Informational("Upload manifest `%s` of %d files success", manifestKey, count)
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&failureFileCount, 1)
+		logs.Error("Upload manifest failed due to `%s`", err)
+	}
 }
@@ -1,12 +1,28 @@
 package atfuck
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 )
 
+//the upload tests below run against the real cloud with the account in QShellRootPath
+func requireCloudBucket(t *testing.T) {
+	if os.Getenv("SrcDir") == "" || os.Getenv("Bucket") == "" {
+		t.Skip("SrcDir and Bucket are not set")
+	}
+}
+
 func TestGetFileTotalCount(t *testing.T) {
-	fpath := "/Users/jemy/Worklab/atfucktest/qiniu.txt"
+	fpath := filepath.Join(t.TempDir(), "qiniu.txt")
+	if err := ioutil.WriteFile(fpath, []byte("1\n2\n3\n4\n5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
 	totalCount := GetFileLineCount(fpath)
 	if totalCount != 5 {
 		t.Fail()
@@ -14,25 +30,28 @@ func TestGetFileTotalCount(t *testing.T) {
 }
 
 func TestSimpleUpload(t *testing.T) {
+	requireCloudBucket(t)
 	uploadConfig := UploadConfig{
 		SrcDir: os.Getenv("SrcDir"),
 		Bucket: os.Getenv("Bucket"),
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
 }
 
 func TestSimpleUploadWithKeyPrefix(t *testing.T) {
+	requireCloudBucket(t)
 	uploadConfig := UploadConfig{
 		SrcDir:    os.Getenv("SrcDir"),
 		Bucket:    os.Getenv("Bucket"),
 		KeyPrefix: os.Getenv("Prefix"),
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
 }
 
 func TestSimpleUploadIgnoreDir(t *testing.T) {
+	requireCloudBucket(t)
 	uploadConfig := UploadConfig{
 		SrcDir:    os.Getenv("SrcDir"),
 		Bucket:    os.Getenv("Bucket"),
@@ -40,10 +59,11 @@ func TestSimpleUploadIgnoreDir(t *testing.T) {
 		IgnoreDir: true,
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
 }
 
 func TestOverwriteUpload(t *testing.T) {
+	requireCloudBucket(t)
 	uploadConfig := UploadConfig{
 		SrcDir:      os.Getenv("SrcDir"),
 		Bucket:      os.Getenv("Bucket"),
@@ -51,11 +71,12 @@ func TestOverwriteUpload(t *testing.T) {
 		RescanLocal: true,
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
 }
 
 //use when files are delete from the buckets
 func TestCheckExistsUpload(t *testing.T) {
+	requireCloudBucket(t)
 	uploadConfig := UploadConfig{
 		SrcDir:      os.Getenv("SrcDir"),
 		Bucket:      os.Getenv("Bucket"),
@@ -64,10 +85,11 @@ func TestCheckExistsUpload(t *testing.T) {
 		CheckExists: true,
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
 }
 
 func TestUploadWithFileList(t *testing.T) {
+	requireCloudBucket(t)
 	flist := os.Getenv("SrcFileList")
 	uploadConfig := UploadConfig{
 		SrcDir:   os.Getenv("SrcDir"),
@@ -75,5 +97,128 @@ func TestUploadWithFileList(t *testing.T) {
 		FileList: flist,
 	}
 
-	QiniuUpload(1, &uploadConfig)
+	QiniuUpload(1, &uploadConfig, false)
+}
+
+//QiniuUpload exits the process, so it is run in a child test process against the fake server
+func TestQiniuUploadToFakeServer(t *testing.T) {
+	srv, _ := startFakeServer(t)
+
+	srcDir := t.TempDir()
+	files := map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.bin": make([]byte, BLOCK_SIZE+1024),
+	}
+	rand.Read(files["dir/b.bin"])
+	for name, data := range files {
+		localPath := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err := ioutil.WriteFile(localPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostsData, _ := json.Marshal(fakeHostsConfig(srv))
+	if err := ioutil.WriteFile(filepath.Join(QShellRootPath, ".atfuck", "hosts.json"), hostsData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	//mkblk/mkfile and multipart upload (v2) for the big file
+	for _, v2 := range []bool{false, true} {
+		keyPrefix := "up/"
+		if v2 {
+			keyPrefix = "v2/"
+		}
+		uploadConfig := UploadConfig{
+			SrcDir:       srcDir,
+			Bucket:       fakeBucket,
+			KeyPrefix:    keyPrefix,
+			PutThreshold: 1024 * 1024,
+			LogFile:      filepath.Join(t.TempDir(), "upload.log"),
+
+			ResumableApiV2:         v2,
+			ResumableApiV2PartSize: 1024 * 1024,
+		}
+		configData, _ := json.Marshal(uploadConfig)
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestQiniuUploadHelper$")
+		cmd.Env = append(os.Environ(), "ATFUCK_TEST_ROOT="+QShellRootPath, "ATFUCK_TEST_UPLOAD_CONFIG="+string(configData))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("qupload failed, %s\n%s", err, out)
+		}
+
+		for name, data := range files {
+			remote, ok := srv.GetObject(fakeBucket, keyPrefix+name)
+			if !ok || !bytes.Equal(remote, data) {
+				t.Fatalf("content of `%s` mismatched", keyPrefix+name)
+			}
+		}
+	}
+}
+
+//the parts uploaded before the upload is interrupted are not uploaded again by the next run
+func TestQiniuUploadResume(t *testing.T) {
+	srv, _ := startFakeServer(t)
+
+	srcDir := t.TempDir()
+	data := make([]byte, 3*1024*1024)
+	rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "big.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hostsData, _ := json.Marshal(fakeHostsConfig(srv))
+	if err := ioutil.WriteFile(filepath.Join(QShellRootPath, ".atfuck", "hosts.json"), hostsData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadConfig := UploadConfig{
+		SrcDir:       srcDir,
+		Bucket:       fakeBucket,
+		PutThreshold: 1024 * 1024,
+		LogFile:      filepath.Join(t.TempDir(), "upload.log"),
+
+		ResumableApiV2:         true,
+		ResumableApiV2PartSize: 1024 * 1024,
+	}
+	configData, _ := json.Marshal(uploadConfig)
+	upload := func() ([]byte, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestQiniuUploadHelper$")
+		cmd.Env = append(os.Environ(), "ATFUCK_TEST_ROOT="+QShellRootPath, "ATFUCK_TEST_UPLOAD_CONFIG="+string(configData))
+		return cmd.CombinedOutput()
+	}
+
+	srv.FailParts(1)
+	if out, err := upload(); err == nil {
+		t.Fatalf("expect the upload interrupted\n%s", out)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "big.bin"); ok {
+		t.Fatal("expect big.bin not uploaded")
+	}
+
+	srv.FailParts(-1)
+	uploaded := srv.PartsUploaded()
+	if out, err := upload(); err != nil {
+		t.Fatalf("qupload failed, %s\n%s", err, out)
+	}
+	if remote, ok := srv.GetObject(fakeBucket, "big.bin"); !ok || !bytes.Equal(remote, data) {
+		t.Fatal("content of `big.bin` mismatched")
+	}
+	if n := srv.PartsUploaded() - uploaded; n != 2 {
+		t.Fatalf("expect the 2 parts left uploaded, got %d", n)
+	}
+}
+
+func TestQiniuUploadHelper(t *testing.T) {
+	configData := os.Getenv("ATFUCK_TEST_UPLOAD_CONFIG")
+	if configData == "" {
+		t.Skip("run by TestQiniuUploadToFakeServer")
+	}
+	QShellRootPath = os.Getenv("ATFUCK_TEST_ROOT")
+	if err := LoadHostsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var uploadConfig UploadConfig
+	if err := json.Unmarshal([]byte(configData), &uploadConfig); err != nil {
+		t.Fatal(err)
+	}
+	QiniuUpload(1, &uploadConfig, false)
 }
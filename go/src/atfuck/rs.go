@@ -103,7 +103,11 @@ func Saveas(mac *digest.Mac, publicUrl string, saveBucket string, saveKey string
 		return "", parseErr
 	}
 	baseUrl := uri.Host + uri.RequestURI()
-	saveEntry := saveBucket + ":" + saveKey
+	//the key is generated by the server if empty
+	saveEntry := saveBucket
+	if saveKey != "" {
+		saveEntry += ":" + saveKey
+	}
 	encodedSaveEntry := base64.URLEncoding.EncodeToString([]byte(saveEntry))
 	baseUrl += "|saveas/" + encodedSaveEntry
 	h := hmac.New(sha1.New, mac.SecretKey)
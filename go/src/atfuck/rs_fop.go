@@ -1,11 +1,36 @@
 package atfuck
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"qiniu/rpc"
+	"strings"
+	"time"
 
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
 	"qiniu/api.v6/conf"
+	"qiniu/api.v6/rs"
+)
+
+//status code of the persistent fop
+const (
+	FOP_SUCCESS         = 0
+	FOP_WAITING         = 1
+	FOP_PROCESSING      = 2
+	FOP_FAILED          = 3
+	FOP_CALLBACK_FAILED = 4
+)
+
+//interval of polling the pfop status, doubled for each round until the max
+const (
+	PFOP_WAIT_INTERVAL     = time.Second * 1
+	PFOP_WAIT_MAX_INTERVAL = time.Second * 30
 )
 
 type FopRet struct {
@@ -93,3 +118,212 @@ func Prefop(persistentId string, fopRet *FopRet) (err error) {
 	}
 	return rpc.ResponseError(resp)
 }
+
+//Finished reports whether the fop is no longer waiting or processing
+func (this *FopRet) Finished() bool {
+	return this.Code != FOP_WAITING && this.Code != FOP_PROCESSING
+}
+
+type PfopRet struct {
+	PersistentId string `json:"persistentId"`
+}
+
+//Pfop submits the fops separated by `;` for the file in bucket, and returns the persistent id to query the status
+func Pfop(mac *digest.Mac, bucket, key, fops, pipeline, notifyUrl string, force bool) (persistentId string, err error) {
+	params := map[string][]string{
+		"bucket": {bucket},
+		"key":    {key},
+		"fops":   {fops},
+	}
+	if pipeline != "" {
+		params["pipeline"] = []string{pipeline}
+	}
+	if notifyUrl != "" {
+		params["notifyURL"] = []string{notifyUrl}
+	}
+	if force {
+		params["force"] = []string{"1"}
+	}
+
+	var pfopRet PfopRet
+	client := rs.NewMac(mac)
+	err = client.Conn.CallWithForm(nil, &pfopRet, conf.API_HOST+"/pfop/", params)
+	if err != nil {
+		return
+	}
+	persistentId = pfopRet.PersistentId
+	return
+}
+
+//the final status of the pfop jobs in the job file
+const (
+	PFOP_JOB_SUCCEEDED = "succeeded"
+	PFOP_JOB_FAILED    = "failed"
+)
+
+//PfopJob is a submitted pfop, which is saved as a line in the job file:
+//<PersistentId>\t<Bucket>\t<Key>\t<Fops>[\t<Status>]
+//the status is recorded once the pfop is finished
+type PfopJob struct {
+	PersistentId string
+	Bucket       string
+	Key          string
+	Fops         string
+	Status       string
+}
+
+func (job *PfopJob) Finished() bool {
+	return job.Status != ""
+}
+
+func (job *PfopJob) line() string {
+	line := fmt.Sprintf("%s\t%s\t%s\t%s", job.PersistentId, job.Bucket, job.Key, job.Fops)
+	if job.Status != "" {
+		line += "\t" + job.Status
+	}
+	return line + "\n"
+}
+
+func DefaultPfopJobFile() string {
+	return filepath.Join(QShellRootPath, ".atfuck", "pfop", "jobs.txt")
+}
+
+func AppendPfopJobs(jobFile string, jobs ...PfopJob) (err error) {
+	if mkdirErr := os.MkdirAll(filepath.Dir(jobFile), 0775); mkdirErr != nil {
+		err = fmt.Errorf("Mkdir for job file error, %s", mkdirErr)
+		return
+	}
+	fh, openErr := os.OpenFile(jobFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if openErr != nil {
+		err = fmt.Errorf("Open job file %s error, %s", jobFile, openErr)
+		return
+	}
+	defer fh.Close()
+
+	bWriter := bufio.NewWriter(fh)
+	for _, job := range jobs {
+		bWriter.WriteString(job.line())
+	}
+	if fErr := bWriter.Flush(); fErr != nil {
+		err = fmt.Errorf("Write job file %s error, %s", jobFile, fErr)
+	}
+	return
+}
+
+//FinishPfopJobs records the final status of the jobs by their persistent ids, so that they are not waited for again.
+//The job file is replaced by a new one, the jobs appended while it is rewritten may be lost.
+func FinishPfopJobs(jobFile string, statuses map[string]string) (err error) {
+	jobs, err := LoadPfopJobs(jobFile)
+	if err != nil {
+		return
+	}
+	tmpFile := jobFile + ".tmp"
+	fh, openErr := os.Create(tmpFile)
+	if openErr != nil {
+		err = fmt.Errorf("Open job file %s error, %s", tmpFile, openErr)
+		return
+	}
+	bWriter := bufio.NewWriter(fh)
+	for _, job := range jobs {
+		if status, ok := statuses[job.PersistentId]; ok && !job.Finished() {
+			job.Status = status
+		}
+		bWriter.WriteString(job.line())
+	}
+	fErr := bWriter.Flush()
+	if cErr := fh.Close(); fErr == nil {
+		fErr = cErr
+	}
+	if fErr == nil {
+		fErr = os.Rename(tmpFile, jobFile)
+	}
+	if fErr != nil {
+		os.Remove(tmpFile)
+		err = fmt.Errorf("Write job file %s error, %s", jobFile, fErr)
+	}
+	return
+}
+
+func LoadPfopJobs(jobFile string) (jobs []PfopJob, err error) {
+	fh, openErr := os.Open(jobFile)
+	if openErr != nil {
+		err = fmt.Errorf("Open job file %s error, %s", jobFile, openErr)
+		return
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		items := strings.Split(scanner.Text(), "\t")
+		if len(items) != 4 && len(items) != 5 || items[0] == "" {
+			continue
+		}
+		job := PfopJob{
+			PersistentId: items[0],
+			Bucket:       items[1],
+			Key:          items[2],
+			Fops:         items[3],
+		}
+		if len(items) == 5 {
+			job.Status = items[4]
+		}
+		jobs = append(jobs, job)
+	}
+	err = scanner.Err()
+	return
+}
+
+//WaitPfop polls the status of the pfops until all of them finish or ctx is done,
+//onDone is called once for each of them with the final status, or the error of querying the status.
+//It returns the persistent ids which failed or are not finished.
+func WaitPfop(ctx context.Context, persistentIds []string, interval, maxInterval time.Duration,
+	onDone func(persistentId string, fopRet *FopRet, err error)) (failed []string, err error) {
+	pending := persistentIds
+	for len(pending) > 0 {
+		stillPending := make([]string, 0, len(pending))
+		for _, persistentId := range pending {
+			fopRet := FopRet{}
+			pErr := Prefop(persistentId, &fopRet)
+			if pErr != nil {
+				var ei *rpc.ErrorInfo
+				if !errors.As(pErr, &ei) || rpc.IsRetryableCode(ei.Code) {
+					//query it again in the next round
+					logs.Warning("Query pfop `%s` status error, %s", persistentId, pErr)
+					stillPending = append(stillPending, persistentId)
+					continue
+				}
+				failed = append(failed, persistentId)
+				onDone(persistentId, nil, pErr)
+				continue
+			}
+			if !fopRet.Finished() {
+				stillPending = append(stillPending, persistentId)
+				continue
+			}
+			if fopRet.Code != FOP_SUCCESS {
+				failed = append(failed, persistentId)
+			}
+			onDone(persistentId, &fopRet, nil)
+		}
+		pending = stillPending
+		if len(pending) == 0 {
+			break
+		}
+
+		//wait for the next round
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			failed = append(failed, pending...)
+			err = ctx.Err()
+			return
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+	return
+}
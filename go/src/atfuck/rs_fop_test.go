@@ -0,0 +1,89 @@
+package atfuck
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"qiniu/api.v6/fakeserver"
+)
+
+func TestPfopAndWait(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	SetZone(fakeserver.Region)
+	srv.PutObject(fakeBucket, "a.mp4", []byte("video"), "")
+
+	saveas := base64.URLEncoding.EncodeToString([]byte(fakeBucket + ":a.m3u8"))
+	fops := []string{"avthumb/m3u8|saveas/" + saveas, fakeserver.FailFop}
+	jobFile := filepath.Join(t.TempDir(), "jobs.txt")
+	for _, fop := range fops {
+		persistentId, err := Pfop(mac, fakeBucket, "a.mp4", fop, "pipe", "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = AppendPfopJobs(jobFile, PfopJob{PersistentId: persistentId, Bucket: fakeBucket, Key: "a.mp4", Fops: fop}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Pfop(mac, fakeBucket, "missing.mp4", fops[0], "", "", false); err == nil {
+		t.Fatal("expect pfop of a missing file to fail")
+	}
+
+	jobs, err := LoadPfopJobs(jobFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Fops != fops[0] || jobs[1].Key != "a.mp4" {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+
+	rets := make(map[string]*FopRet)
+	failed, err := WaitPfop(context.Background(), []string{jobs[0].PersistentId, jobs[1].PersistentId},
+		time.Millisecond, time.Millisecond, func(persistentId string, fopRet *FopRet, err error) {
+			if err != nil {
+				t.Errorf("query %s error, %s", persistentId, err)
+				return
+			}
+			rets[persistentId] = fopRet
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != jobs[1].PersistentId {
+		t.Fatalf("unexpected failed jobs %v", failed)
+	}
+	ok := rets[jobs[0].PersistentId]
+	if ok == nil || ok.Code != FOP_SUCCESS || ok.Pipeline != "pipe" || len(ok.Items) != 1 || ok.Items[0].Key != "a.m3u8" {
+		t.Fatalf("unexpected fop ret %+v", ok)
+	}
+	if _, saved := srv.GetObject(fakeBucket, "a.m3u8"); !saved {
+		t.Fatal("expect the fop result saved")
+	}
+	if ret := rets[jobs[1].PersistentId]; ret == nil || ret.Code != FOP_FAILED {
+		t.Fatalf("unexpected fop ret %+v", ret)
+	}
+
+	// the finished jobs are recorded in the job file
+	if err = FinishPfopJobs(jobFile, map[string]string{jobs[1].PersistentId: PFOP_JOB_FAILED}); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err = LoadPfopJobs(jobFile); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Finished() || jobs[1].Status != PFOP_JOB_FAILED || jobs[1].Fops != fops[1] {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+
+	// an unknown id fails without waiting
+	failed, err = WaitPfop(context.Background(), []string{"unknown"}, time.Hour, time.Hour,
+		func(persistentId string, fopRet *FopRet, err error) {
+			if err == nil {
+				t.Errorf("expect query error for %s", persistentId)
+			}
+		})
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("unexpected wait result %v %v", failed, err)
+	}
+}
@@ -0,0 +1,792 @@
+package atfuck
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"qiniu/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+	fio "qiniu/api.v6/io"
+	rio "qiniu/api.v6/resumable/io"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+)
+
+const (
+	S3_DEFAULT_REGION = "us-east-1"
+
+	s3Xmlns          = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeLayout     = "2006-01-02T15:04:05.000Z"
+	s3DefaultMaxKeys = 1000
+	s3MaxDeleteKeys  = 1000
+)
+
+var (
+	errS3NoSuchBucket   = &s3Error{404, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey      = &s3Error{404, "NoSuchKey", "The specified key does not exist."}
+	errS3NoSuchUpload   = &s3Error{404, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errS3InvalidArgs    = &s3Error{400, "InvalidArgument", "Invalid Argument"}
+	errS3MalformedXML   = &s3Error{400, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	errS3InvalidPart    = &s3Error{400, "InvalidPart", "One or more of the specified parts could not be found."}
+	errS3NotImplemented = &s3Error{501, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	errS3BadMethod      = &s3Error{405, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+)
+
+//S3GatewayConfig is the config of the S3 gateway in front of a bucket
+type S3GatewayConfig struct {
+	Bucket  string            //the bucket served as the S3 bucket of the same name
+	Region  string            //the region of the bucket reported to the S3 clients, us-east-1 by default
+	Keys    map[string]string //the S3 access keys and their secret keys
+	Domain  string            //the domain to download the files, the first domain of the bucket by default
+	IoHost  string            //the io host to download the files, the io host of the zone by default
+	TempDir string            //the dir to keep the uploading bodies until they are verified
+}
+
+//S3Gateway serves a subset of the S3 REST API, path style or virtual hosted style, for a bucket
+type S3Gateway struct {
+	*bucketProxy
+	config S3GatewayConfig
+}
+
+//NewS3Gateway sets the zone of the bucket and finds its domain
+func NewS3Gateway(mac *digest.Mac, config S3GatewayConfig) (gw *S3Gateway, err error) {
+	if len(config.Keys) == 0 {
+		err = errors.New("No access keys for the S3 gateway")
+		return
+	}
+	if config.Region == "" {
+		config.Region = S3_DEFAULT_REGION
+	}
+	proxy, err := newBucketProxy(mac, config.Bucket, config.Domain, config.IoHost, config.TempDir)
+	if err != nil {
+		return
+	}
+	gw = &S3Gateway{bucketProxy: proxy, config: config}
+	return
+}
+
+// ----------------------------------------------------------
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3LocationResult struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3CopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+// ----------------------------------------------------------
+
+func s3ETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+//s3Time formats the put time in 100ns
+func s3Time(putTime int64) time.Time {
+	return time.Unix(0, putTime*100).UTC()
+}
+
+func s3StorageClass(fileType int) string {
+	if fileType == 1 {
+		return "STANDARD_IA"
+	}
+	return "STANDARD"
+}
+
+//s3ErrorOf maps the errors of the storage to the S3 errors
+func s3ErrorOf(err error) *s3Error {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err
+	}
+	var info *rpc.ErrorInfo
+	if errors.As(err, &info) {
+		switch info.Code {
+		case 612:
+			return errS3NoSuchKey
+		case 631:
+			return errS3NoSuchBucket
+		case 401, 403:
+			return errS3AccessDenied
+		case 400:
+			return &s3Error{400, "InvalidArgument", info.Err}
+		case 413:
+			return &s3Error{400, "EntityTooLarge", info.Err}
+		}
+		return &s3Error{500, "InternalError", info.Err}
+	}
+	return &s3Error{500, "InternalError", err.Error()}
+}
+
+func newS3RequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(data)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(data)
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, err error) {
+	s3Err := s3ErrorOf(err)
+	if s3Err.status >= 500 {
+		logs.Error("S3 %s %s error, %s", req.Method, req.URL.Path, err)
+	}
+	if req.Method == "HEAD" {
+		w.WriteHeader(s3Err.status)
+		return
+	}
+	writeS3XML(w, s3Err.status, s3ErrorResponse{
+		Code:      s3Err.code,
+		Message:   s3Err.msg,
+		Resource:  req.URL.Path,
+		RequestId: w.Header().Get("X-Amz-Request-Id"),
+	})
+}
+
+//bucketAndKey splits the request into the bucket and the key, by the host for the virtual hosted style
+func (gw *S3Gateway) bucketAndKey(req *http.Request) (bucket, key string) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if strings.HasPrefix(host, gw.config.Bucket+".") {
+		return gw.config.Bucket, path
+	}
+	items := strings.SplitN(path, "/", 2)
+	bucket = items[0]
+	if len(items) == 2 {
+		key = items[1]
+	}
+	return
+}
+
+func (gw *S3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", newS3RequestId())
+	w.Header().Set("Server", "atfuck-s3-gateway")
+
+	sig, err := verifyS3Signature(req, gw.config.Keys, time.Now())
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	bucket, key := gw.bucketAndKey(req)
+	if bucket == "" {
+		if req.Method != "GET" {
+			writeS3Error(w, req, errS3BadMethod)
+			return
+		}
+		writeS3XML(w, 200, s3ListBucketsResult{
+			Xmlns:   s3Xmlns,
+			Buckets: []s3Bucket{{Name: gw.config.Bucket, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeLayout)}},
+		})
+		return
+	}
+	if bucket != gw.config.Bucket {
+		writeS3Error(w, req, errS3NoSuchBucket)
+		return
+	}
+
+	ctx := req.Context()
+	query := req.URL.Query()
+	if key == "" {
+		err = gw.serveBucket(ctx, w, req, query)
+	} else {
+		err = gw.serveObject(ctx, w, req, query, sig, key)
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+	}
+}
+
+func (gw *S3Gateway) serveBucket(ctx context.Context, w http.ResponseWriter, req *http.Request, query url.Values) error {
+	switch req.Method {
+	case "HEAD":
+		w.Header().Set("X-Amz-Bucket-Region", gw.config.Region)
+		w.WriteHeader(200)
+		return nil
+	case "GET":
+		if _, ok := query["location"]; ok {
+			writeS3XML(w, 200, s3LocationResult{Xmlns: s3Xmlns, Region: gw.config.Region})
+			return nil
+		}
+		if query.Get("list-type") != "2" || len(query["uploads"]) > 0 || len(query["versions"]) > 0 {
+			return errS3NotImplemented
+		}
+		return gw.listObjectsV2(ctx, w, query)
+	case "POST":
+		if _, ok := query["delete"]; ok {
+			return gw.deleteObjects(ctx, w, req)
+		}
+		return errS3NotImplemented
+	}
+	return errS3BadMethod
+}
+
+func (gw *S3Gateway) serveObject(ctx context.Context, w http.ResponseWriter, req *http.Request,
+	query url.Values, sig *s3Signature, key string) error {
+	uploadId := query.Get("uploadId")
+	switch req.Method {
+	case "HEAD":
+		return gw.headObject(w, key)
+	case "GET":
+		if uploadId != "" {
+			//ListParts
+			return errS3NotImplemented
+		}
+		return gw.getObject(ctx, w, req, key)
+	case "PUT":
+		if uploadId != "" {
+			return gw.uploadPart(ctx, w, req, sig, key, uploadId, query.Get("partNumber"))
+		}
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return gw.copyObject(w, req, key)
+		}
+		return gw.putObject(ctx, w, req, sig, key)
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			return gw.initiateUpload(ctx, w, req, key)
+		}
+		if uploadId != "" {
+			return gw.completeUpload(ctx, w, req, key, uploadId)
+		}
+		return errS3NotImplemented
+	case "DELETE":
+		if uploadId != "" {
+			return gw.abortUpload(ctx, w, key, uploadId)
+		}
+		if err := gw.client.Delete(nil, gw.config.Bucket, key); err != nil && s3ErrorOf(err) != errS3NoSuchKey {
+			return err
+		}
+		w.WriteHeader(204)
+		return nil
+	}
+	return errS3BadMethod
+}
+
+// ----------------------------------------------------------
+
+//s3ListToken is the continuation token, the listing continues from the page of the marker after the name
+type s3ListToken struct {
+	Marker string `json:"m"`
+	After  string `json:"a"`
+}
+
+func (gw *S3Gateway) listObjectsV2(ctx context.Context, w http.ResponseWriter, query url.Values) (err error) {
+	result := s3ListResult{
+		Xmlns:             s3Xmlns,
+		Name:              gw.config.Bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           s3DefaultMaxKeys,
+		EncodingType:      query.Get("encoding-type"),
+	}
+	if v := query.Get("max-keys"); v != "" {
+		if result.MaxKeys, err = strconv.Atoi(v); err != nil || result.MaxKeys < 0 {
+			return errS3InvalidArgs
+		}
+		if result.MaxKeys > s3DefaultMaxKeys {
+			result.MaxKeys = s3DefaultMaxKeys
+		}
+	}
+	if result.EncodingType != "" && result.EncodingType != "url" {
+		return errS3InvalidArgs
+	}
+
+	token := s3ListToken{After: result.StartAfter}
+	if result.ContinuationToken != "" {
+		data, dErr := base64.URLEncoding.DecodeString(result.ContinuationToken)
+		if dErr != nil || json.Unmarshal(data, &token) != nil {
+			return &s3Error{400, "InvalidArgument", "The continuation token provided is incorrect"}
+		}
+	}
+
+	client := rsf.New(gw.mac)
+	client.Conn.Retry = listRetryPolicy
+	prefix, delimiter := result.Prefix, result.Delimiter
+	pageMarker := token.Marker
+	lastName := token.After
+	for result.MaxKeys > 0 {
+		entries, prefixes, markerOut, lErr := client.ListDelimiterCtx(ctx, nil, gw.config.Bucket, prefix, delimiter,
+			pageMarker, s3DefaultMaxKeys)
+		if lErr != nil && lErr != io.EOF {
+			return lErr
+		}
+		//the files and the common prefixes of the page are merged in order
+		commonPrefixes := make(map[string]bool, len(prefixes))
+		for _, commonPrefix := range prefixes {
+			commonPrefixes[commonPrefix] = true
+			entries = append(entries, rsf.ListItem{Key: commonPrefix})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		for _, entry := range entries {
+			name, isPrefix := entry.Key, commonPrefixes[entry.Key]
+			//the names after the continuation token
+			if name <= lastName {
+				continue
+			}
+			if result.KeyCount == result.MaxKeys {
+				result.IsTruncated = true
+				data, _ := json.Marshal(s3ListToken{pageMarker, lastName})
+				result.NextContinuationToken = base64.URLEncoding.EncodeToString(data)
+				break
+			}
+			if isPrefix {
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{name})
+			} else {
+				result.Contents = append(result.Contents, s3Object{
+					Key:          entry.Key,
+					LastModified: s3Time(entry.PutTime).Format(s3TimeLayout),
+					ETag:         s3ETag(entry.Hash),
+					Size:         entry.Fsize,
+					StorageClass: s3StorageClass(entry.FileType),
+				})
+			}
+			result.KeyCount += 1
+			lastName = name
+		}
+		if result.IsTruncated || lErr == io.EOF || markerOut == "" {
+			break
+		}
+		pageMarker = markerOut
+	}
+
+	if result.EncodingType == "url" {
+		result.Prefix = url.QueryEscape(result.Prefix)
+		result.Delimiter = url.QueryEscape(result.Delimiter)
+		result.StartAfter = url.QueryEscape(result.StartAfter)
+		for i := range result.Contents {
+			result.Contents[i].Key = url.QueryEscape(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = url.QueryEscape(result.CommonPrefixes[i].Prefix)
+		}
+	}
+	writeS3XML(w, 200, result)
+	return nil
+}
+
+func (gw *S3Gateway) headObject(w http.ResponseWriter, key string) error {
+	entry, err := gw.client.Stat(nil, gw.config.Bucket, key)
+	if err != nil {
+		return err
+	}
+	header := w.Header()
+	header.Set("Content-Length", strconv.FormatInt(entry.Fsize, 10))
+	header.Set("Content-Type", entry.MimeType)
+	header.Set("ETag", s3ETag(entry.Hash))
+	header.Set("Last-Modified", s3Time(entry.PutTime).Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if entry.FileType == 1 {
+		header.Set("X-Amz-Storage-Class", s3StorageClass(entry.FileType))
+	}
+	w.WriteHeader(200)
+	return nil
+}
+
+func (gw *S3Gateway) getObject(ctx context.Context, w http.ResponseWriter, req *http.Request, key string) error {
+	resp, err := gw.download(ctx, key, req.Header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 404:
+		return errS3NoSuchKey
+	case resp.StatusCode == 416:
+		return &s3Error{416, "InvalidRange", "The requested range is not satisfiable"}
+	case resp.StatusCode == 412:
+		return &s3Error{412, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	case resp.StatusCode >= 400:
+		return &s3Error{500, "InternalError", fmt.Sprintf("download error, status %d", resp.StatusCode)}
+	}
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "ETag", "Last-Modified", "Accept-Ranges"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	if v := req.URL.Query().Get("response-content-type"); v != "" {
+		w.Header().Set("Content-Type", v)
+	}
+	if v := req.URL.Query().Get("response-content-disposition"); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, cErr := io.Copy(w, resp.Body); cErr != nil {
+		logs.Error("S3 get `%s` error, %s", key, cErr)
+	}
+	return nil
+}
+
+//spoolBody saves the verified body to a temp file, the caller removes it
+func (gw *S3Gateway) spoolBody(req *http.Request, sig *s3Signature) (tmpFile string, size int64, err error) {
+	body, size, err := newS3BodyReader(req, sig, gw.config.Keys[sig.accessKey])
+	if err != nil {
+		return
+	}
+	tmpFile, _, err = gw.spool(body, size)
+	if err == errIncompleteBody {
+		err = errS3IncompleteBody
+	}
+	return
+}
+
+func (gw *S3Gateway) putObject(ctx context.Context, w http.ResponseWriter, req *http.Request, sig *s3Signature, key string) error {
+	tmpFile, size, err := gw.spoolBody(req, sig)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	putRet, err := gw.upload(ctx, key, tmpFile, size, req.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3ETag(putRet.Hash))
+	w.WriteHeader(200)
+	return nil
+}
+
+//copyObject copies in the bucket served, the mime type is replaced by the REPLACE metadata directive
+func (gw *S3Gateway) copyObject(w http.ResponseWriter, req *http.Request, key string) error {
+	source := strings.SplitN(req.Header.Get("X-Amz-Copy-Source"), "?", 2)[0]
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return errS3InvalidArgs
+	}
+	items := strings.SplitN(source, "/", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return errS3InvalidArgs
+	}
+	srcBucket, srcKey := items[0], items[1]
+	//the access keys of the gateway are limited to the bucket served
+	if srcBucket != gw.config.Bucket {
+		return errS3AccessDenied
+	}
+	replace := req.Header.Get("X-Amz-Metadata-Directive") == "REPLACE"
+
+	if srcKey != key {
+		if err = gw.client.Copy(nil, srcBucket, srcKey, gw.config.Bucket, key, true); err != nil {
+			return err
+		}
+	} else if !replace {
+		return &s3Error{400, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the metadata"}
+	}
+	if mimeType := req.Header.Get("Content-Type"); replace && mimeType != "" {
+		if err = gw.client.ChangeMime(nil, gw.config.Bucket, key, mimeType); err != nil {
+			return err
+		}
+	}
+
+	entry, err := gw.client.Stat(nil, gw.config.Bucket, key)
+	if err != nil {
+		return err
+	}
+	writeS3XML(w, 200, s3CopyResult{
+		LastModified: s3Time(entry.PutTime).Format(s3TimeLayout),
+		ETag:         s3ETag(entry.Hash),
+	})
+	return nil
+}
+
+func (gw *S3Gateway) deleteObjects(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	var deleteReq s3DeleteRequest
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 2<<20)).Decode(&deleteReq); err != nil {
+		return errS3MalformedXML
+	}
+	if len(deleteReq.Objects) == 0 || len(deleteReq.Objects) > s3MaxDeleteKeys {
+		return errS3MalformedXML
+	}
+	entries := make([]rs.EntryPath, 0, len(deleteReq.Objects))
+	for _, object := range deleteReq.Objects {
+		entries = append(entries, rs.EntryPath{Bucket: gw.config.Bucket, Key: object.Key})
+	}
+	rets, err := BatchDelete(gw.client, entries)
+	if len(rets) != len(entries) {
+		if err == nil {
+			err = errors.New("unexpected batch result")
+		}
+		return err
+	}
+
+	result := s3DeleteResult{Xmlns: s3Xmlns}
+	for i, ret := range rets {
+		key := entries[i].Key
+		//like S3, deleting a missing key succeeds
+		if ret.Code == 200 || ret.Code == 612 {
+			if !deleteReq.Quiet {
+				result.Deleted = append(result.Deleted, s3Deleted{key})
+			}
+			continue
+		}
+		s3Err := s3ErrorOf(&rpc.ErrorInfo{Code: ret.Code, Err: ret.Data.Error})
+		result.Errors = append(result.Errors, s3DeleteError{key, s3Err.code, s3Err.msg})
+	}
+	writeS3XML(w, 200, result)
+	return nil
+}
+
+// ----------------------------------------------------------
+
+//s3UploadId is the upload id of the storage with the content type of the initiate request,
+//which is only passed to the storage when the upload is completed
+type s3UploadId struct {
+	UploadId string `json:"id"`
+	MimeType string `json:"mime,omitempty"`
+}
+
+func (id s3UploadId) encode() string {
+	data, _ := json.Marshal(id)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeS3UploadId(encoded string) (id s3UploadId, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(data, &id)
+	}
+	if err != nil || id.UploadId == "" {
+		err = errS3NoSuchUpload
+	}
+	return
+}
+
+func multipartError(err error) error {
+	var info *rpc.ErrorInfo
+	if errors.As(err, &info) && info.Code == rio.NoSuchUpload {
+		return errS3NoSuchUpload
+	}
+	return err
+}
+
+func (gw *S3Gateway) initiateUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, key string) error {
+	putClient := rio.NewClient(gw.upToken(key), "")
+	initRet, err := rio.InitParts(ctx, putClient, nil, gw.config.Bucket, key, true)
+	if err != nil {
+		return err
+	}
+	uploadId := s3UploadId{UploadId: initRet.UploadId, MimeType: req.Header.Get("Content-Type")}
+	writeS3XML(w, 200, s3InitiateResult{
+		Xmlns:    s3Xmlns,
+		Bucket:   gw.config.Bucket,
+		Key:      key,
+		UploadId: uploadId.encode(),
+	})
+	return nil
+}
+
+func (gw *S3Gateway) uploadPart(ctx context.Context, w http.ResponseWriter, req *http.Request, sig *s3Signature,
+	key, encodedUploadId, partNumberParam string) error {
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		//UploadPartCopy
+		return errS3NotImplemented
+	}
+	uploadId, err := decodeS3UploadId(encodedUploadId)
+	if err != nil {
+		return err
+	}
+	partNumber, err := strconv.Atoi(partNumberParam)
+	if err != nil || partNumber < 1 || partNumber > rio.MaxParts {
+		return errS3InvalidArgs
+	}
+	tmpFile, size, err := gw.spoolBody(req, sig)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	fh, err := os.Open(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	putClient := rio.NewClient(gw.upToken(key), "")
+	partRet, err := rio.UploadPart(ctx, putClient, nil, gw.config.Bucket, key, true, uploadId.UploadId,
+		partNumber, "", fh, size)
+	if err != nil {
+		return multipartError(err)
+	}
+	w.Header().Set("ETag", s3ETag(partRet.Etag))
+	w.WriteHeader(200)
+	return nil
+}
+
+func (gw *S3Gateway) completeUpload(ctx context.Context, w http.ResponseWriter, req *http.Request,
+	key, encodedUploadId string) error {
+	uploadId, err := decodeS3UploadId(encodedUploadId)
+	if err != nil {
+		return err
+	}
+	var completeReq s3CompleteRequest
+	if err = xml.NewDecoder(io.LimitReader(req.Body, 4<<20)).Decode(&completeReq); err != nil || len(completeReq.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	parts := make([]rio.UploadPartInfo, 0, len(completeReq.Parts))
+	for i, part := range completeReq.Parts {
+		if i > 0 && part.PartNumber <= completeReq.Parts[i-1].PartNumber {
+			return &s3Error{400, "InvalidPartOrder", "The list of parts was not in ascending order."}
+		}
+		parts = append(parts, rio.UploadPartInfo{Etag: strings.Trim(part.ETag, `"`), PartNumber: part.PartNumber})
+	}
+
+	putClient := rio.NewClient(gw.upToken(key), "")
+	putRet := fio.PutRet{}
+	err = rio.CompleteParts(ctx, putClient, nil, &putRet, gw.config.Bucket, key, true, uploadId.UploadId, parts,
+		&rio.PutExtraV2{MimeType: uploadId.MimeType})
+	if err != nil {
+		var info *rpc.ErrorInfo
+		if errors.As(err, &info) && info.Code == 400 {
+			return errS3InvalidPart
+		}
+		return multipartError(err)
+	}
+	writeS3XML(w, 200, s3CompleteResult{
+		Xmlns:    s3Xmlns,
+		Location: "/" + gw.config.Bucket + "/" + key,
+		Bucket:   gw.config.Bucket,
+		Key:      key,
+		ETag:     s3ETag(putRet.Hash),
+	})
+	return nil
+}
+
+func (gw *S3Gateway) abortUpload(ctx context.Context, w http.ResponseWriter, key, encodedUploadId string) error {
+	uploadId, err := decodeS3UploadId(encodedUploadId)
+	if err != nil {
+		return err
+	}
+	putClient := rio.NewClient(gw.upToken(key), "")
+	if err = rio.AbortParts(ctx, putClient, nil, gw.config.Bucket, key, true, uploadId.UploadId); err != nil {
+		return multipartError(err)
+	}
+	w.WriteHeader(204)
+	return nil
+}
@@ -0,0 +1,291 @@
+package atfuck
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testS3AccessKey = "s3-access-key"
+	testS3SecretKey = "s3-secret-key"
+)
+
+//testS3Escape escapes all the bytes but the unreserved ones like the aws sdks
+func testS3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+//testS3Sign signs the request like the aws sdks
+func testS3Sign(req *http.Request, secretKey string, body []byte, presignExpires int) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/us-east-1/s3/aws4_request"
+	credential := testS3AccessKey + "/" + scope
+
+	payloadHash := S3_UNSIGNED_PAYLOAD
+	signedHeaders := "host"
+	query := req.URL.Query()
+	if presignExpires > 0 {
+		query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+		query.Set("X-Amz-Credential", credential)
+		query.Set("X-Amz-Date", amzDate)
+		query.Set("X-Amz-Expires", fmt.Sprint(presignExpires))
+		query.Set("X-Amz-SignedHeaders", signedHeaders)
+	} else {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		req.Header.Set("X-Amz-Date", amzDate)
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		params = append(params, testS3Escape(key, true)+"="+testS3Escape(query.Get(key), true))
+	}
+	canonicalQuery := strings.Join(params, "&")
+	headers := "host:" + req.Host + "\n"
+	if presignExpires == 0 {
+		headers += "x-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	}
+	canonical := strings.Join([]string{req.Method, testS3Escape(req.URL.Path, false), canonicalQuery, headers, signedHeaders, payloadHash}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, item := range strings.Split(scope, "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(item))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if presignExpires > 0 {
+		req.URL.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	} else {
+		req.URL.RawQuery = canonicalQuery
+		req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s,SignedHeaders=%s,Signature=%s",
+			credential, signedHeaders, signature))
+	}
+}
+
+type testS3Client struct {
+	t         *testing.T
+	endpoint  string
+	secretKey string
+}
+
+func (c *testS3Client) do(method, path string, query url.Values, body []byte, header http.Header) (resp *http.Response, data []byte) {
+	req, err := http.NewRequest(method, c.endpoint+testS3Escape(path, false), bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.URL.RawQuery = query.Encode()
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	testS3Sign(req, c.secretKey, body, 0)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ = ioutil.ReadAll(resp.Body)
+	return
+}
+
+func (c *testS3Client) expect(status int, method, path string, query url.Values, body []byte, header http.Header) []byte {
+	resp, data := c.do(method, path, query, body, header)
+	if resp.StatusCode != status {
+		c.t.Fatalf("%s %s: expect status %d, got %d `%s`", method, path, status, resp.StatusCode, data)
+	}
+	return data
+}
+
+func TestS3Gateway(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	for _, key := range []string{"docs/a.txt", "docs/b.txt", "docs/sub/c.txt", "img/d.png", "top.txt"} {
+		srv.PutObject(fakeBucket, key, []byte("data of "+key), "text/plain")
+	}
+	gw, err := NewS3Gateway(mac, S3GatewayConfig{
+		Bucket:  fakeBucket,
+		Keys:    map[string]string{testS3AccessKey: testS3SecretKey},
+		TempDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(gw)
+	defer httpSrv.Close()
+	client := &testS3Client{t: t, endpoint: httpSrv.URL, secretKey: testS3SecretKey}
+	bucketPath := "/" + fakeBucket
+
+	//list with the delimiter and the continuation token
+	var listRet s3ListResult
+	data := client.expect(200, "GET", bucketPath, url.Values{"list-type": {"2"}, "delimiter": {"/"}}, nil, nil)
+	xml.Unmarshal(data, &listRet)
+	if len(listRet.Contents) != 1 || listRet.Contents[0].Key != "top.txt" || len(listRet.CommonPrefixes) != 2 ||
+		listRet.CommonPrefixes[0].Prefix != "docs/" || listRet.CommonPrefixes[1].Prefix != "img/" {
+		t.Fatalf("unexpected list result `%s`", data)
+	}
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {"docs/"}, "delimiter": {"/"}, "max-keys": {"1"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listRet = s3ListResult{}
+		xml.Unmarshal(client.expect(200, "GET", bucketPath, query, nil, nil), &listRet)
+		for _, object := range listRet.Contents {
+			names = append(names, object.Key)
+		}
+		for _, prefix := range listRet.CommonPrefixes {
+			names = append(names, prefix.Prefix)
+		}
+		if !listRet.IsTruncated {
+			break
+		}
+		token = listRet.NextContinuationToken
+	}
+	if strings.Join(names, ",") != "docs/a.txt,docs/b.txt,docs/sub/" {
+		t.Fatalf("unexpected paged list %v", names)
+	}
+
+	//put, get with range and head
+	key := "new dir/file+1.txt"
+	content := []byte("hello s3 gateway")
+	resp, _ := client.do("PUT", bucketPath+"/"+key, nil, content, http.Header{"Content-Type": {"text/x-test"}})
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") == "" {
+		t.Fatalf("put error, status %d", resp.StatusCode)
+	}
+	if stored, ok := srv.GetObject(fakeBucket, key); !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("unexpected stored object `%s`", stored)
+	}
+	resp, data = client.do("GET", bucketPath+"/"+key, nil, nil, http.Header{"Range": {"bytes=6-7"}})
+	if resp.StatusCode != 206 || string(data) != "s3" || resp.Header.Get("Content-Range") != "bytes 6-7/16" {
+		t.Fatalf("unexpected range get, status %d `%s`", resp.StatusCode, data)
+	}
+	resp, _ = client.do("HEAD", bucketPath+"/"+key, nil, nil, nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Length") != "16" || resp.Header.Get("Content-Type") != "text/x-test" {
+		t.Fatalf("unexpected head, status %d %v", resp.StatusCode, resp.Header)
+	}
+	data = client.expect(404, "GET", bucketPath+"/missing", nil, nil, nil)
+	if !strings.Contains(string(data), "<Code>NoSuchKey</Code>") {
+		t.Fatalf("expect NoSuchKey, got `%s`", data)
+	}
+	client.expect(404, "GET", "/other-bucket/a", nil, nil, nil)
+
+	//a body which does not match the signed hash
+	req, _ := http.NewRequest("PUT", httpSrv.URL+bucketPath+"/tampered", strings.NewReader("tampered"))
+	testS3Sign(req, testS3SecretKey, []byte("original"), 0)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("expect the tampered body rejected, got %d", resp.StatusCode)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "tampered"); ok {
+		t.Fatal("expect the tampered body not uploaded")
+	}
+
+	//multipart
+	var initRet s3InitiateResult
+	xml.Unmarshal(client.expect(200, "POST", bucketPath+"/big.bin", url.Values{"uploads": {""}}, nil,
+		http.Header{"Content-Type": {"application/x-big"}}), &initRet)
+	part1 := bytes.Repeat([]byte("a"), 1<<20)
+	part2 := []byte("tail")
+	complete := "<CompleteMultipartUpload>"
+	for i, part := range [][]byte{part1, part2} {
+		query := url.Values{"uploadId": {initRet.UploadId}, "partNumber": {fmt.Sprint(i + 1)}}
+		resp, _ = client.do("PUT", bucketPath+"/big.bin", query, part, nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("upload part error, status %d", resp.StatusCode)
+		}
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, resp.Header.Get("ETag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+	client.expect(200, "POST", bucketPath+"/big.bin", url.Values{"uploadId": {initRet.UploadId}}, []byte(complete), nil)
+	if stored, _ := srv.GetObject(fakeBucket, "big.bin"); len(stored) != len(part1)+len(part2) {
+		t.Fatalf("unexpected multipart object size %d", len(stored))
+	}
+	resp, _ = client.do("HEAD", bucketPath+"/big.bin", nil, nil, nil)
+	if resp.Header.Get("Content-Type") != "application/x-big" {
+		t.Fatalf("expect the mime type of the initiate request, got %s", resp.Header.Get("Content-Type"))
+	}
+	xml.Unmarshal(client.expect(200, "POST", bucketPath+"/abort.bin", url.Values{"uploads": {""}}, nil, nil), &initRet)
+	client.expect(204, "DELETE", bucketPath+"/abort.bin", url.Values{"uploadId": {initRet.UploadId}}, nil, nil)
+	client.expect(404, "PUT", bucketPath+"/abort.bin", url.Values{"uploadId": {initRet.UploadId}, "partNumber": {"1"}},
+		part2, nil)
+
+	//copy, delete and delete objects
+	client.expect(200, "PUT", bucketPath+"/copy.txt", nil, nil,
+		http.Header{"X-Amz-Copy-Source": {url.PathEscape(fakeBucket) + "/" + url.PathEscape(key)}})
+	if stored, _ := srv.GetObject(fakeBucket, "copy.txt"); !bytes.Equal(stored, content) {
+		t.Fatalf("unexpected copied object `%s`", stored)
+	}
+	//the other buckets of the account are not reachable by the gateway
+	srv.CreateBucket("other", false)
+	srv.PutObject("other", "secret.txt", []byte("secret"), "")
+	data = client.expect(403, "PUT", bucketPath+"/stolen.txt", nil, nil,
+		http.Header{"X-Amz-Copy-Source": {"other/secret.txt"}})
+	if !strings.Contains(string(data), "<Code>AccessDenied</Code>") {
+		t.Fatalf("expect AccessDenied, got `%s`", data)
+	}
+	client.expect(204, "DELETE", bucketPath+"/copy.txt", nil, nil, nil)
+	client.expect(204, "DELETE", bucketPath+"/copy.txt", nil, nil, nil)
+	deleteReq := "<Delete><Object><Key>docs/a.txt</Key></Object><Object><Key>docs/b.txt</Key></Object></Delete>"
+	var deleteRet s3DeleteResult
+	xml.Unmarshal(client.expect(200, "POST", bucketPath, url.Values{"delete": {""}}, []byte(deleteReq), nil), &deleteRet)
+	if len(deleteRet.Deleted) != 2 || len(deleteRet.Errors) != 0 {
+		t.Fatalf("unexpected delete result %+v", deleteRet)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "docs/a.txt"); ok {
+		t.Fatal("expect docs/a.txt deleted")
+	}
+
+	//a wrong secret key and a presigned url
+	wrong := &testS3Client{t: t, endpoint: httpSrv.URL, secretKey: "wrong"}
+	data = wrong.expect(403, "GET", bucketPath+"/top.txt", nil, nil, nil)
+	if !strings.Contains(string(data), "<Code>SignatureDoesNotMatch</Code>") {
+		t.Fatalf("expect SignatureDoesNotMatch, got `%s`", data)
+	}
+	req, _ = http.NewRequest("GET", httpSrv.URL+bucketPath+"/top.txt", nil)
+	testS3Sign(req, testS3SecretKey, nil, 300)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(data) != "data of top.txt" {
+		t.Fatalf("unexpected presigned get, status %d `%s`", resp.StatusCode, data)
+	}
+}
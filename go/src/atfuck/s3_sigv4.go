@@ -0,0 +1,381 @@
+package atfuck
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//the payload hashes of x-amz-content-sha256 besides the hex sha256 of the body
+const (
+	S3_UNSIGNED_PAYLOAD         = "UNSIGNED-PAYLOAD"
+	S3_STREAMING_PAYLOAD        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	S3_STREAMING_UNSIGNED_TRAIL = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	s3SignAlgorithm  = "AWS4-HMAC-SHA256"
+	s3AmzDateLayout  = "20060102T150405Z"
+	s3MaxClockSkew   = 15 * time.Minute
+	s3MaxPresignTime = 7 * 24 * time.Hour
+)
+
+var emptySha256 = hex.EncodeToString(sha256Sum(nil))
+
+type s3Error struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.msg
+}
+
+var (
+	errS3AccessDenied     = &s3Error{403, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey = &s3Error{403, "InvalidAccessKeyId", "The access key Id you provided does not exist in our records"}
+	errS3SignMismatch     = &s3Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errS3TimeSkewed       = &s3Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errS3Expired          = &s3Error{403, "AccessDenied", "Request has expired"}
+	errS3AuthHeader       = &s3Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errS3ContentSha256    = &s3Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errS3IncompleteBody   = &s3Error{400, "IncompleteBody", "The request body terminated unexpectedly"}
+)
+
+func sha256Sum(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+//s3Encode is the uri encoding of sigv4, all but the unreserved characters are encoded
+func s3Encode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+//s3Signature is the parsed credential of the authorization header or the presigned url
+type s3Signature struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+func (sig *s3Signature) scope() string {
+	return strings.Join([]string{sig.date, sig.region, sig.service, "aws4_request"}, "/")
+}
+
+func (sig *s3Signature) signingKey(secretKey string) []byte {
+	key := hmacSha256([]byte("AWS4"+secretKey), sig.date)
+	key = hmacSha256(key, sig.region)
+	key = hmacSha256(key, sig.service)
+	return hmacSha256(key, "aws4_request")
+}
+
+func parseS3Credential(credential string, sig *s3Signature) error {
+	items := strings.Split(credential, "/")
+	if len(items) != 5 || items[4] != "aws4_request" {
+		return errS3AuthHeader
+	}
+	sig.accessKey, sig.date, sig.region, sig.service = items[0], items[1], items[2], items[3]
+	return nil
+}
+
+//parseS3Signature reads the signature from the Authorization header or the X-Amz-* query of a presigned url
+func parseS3Signature(req *http.Request) (sig *s3Signature, err error) {
+	sig = &s3Signature{}
+	query := req.URL.Query()
+	var amzDate string
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, s3SignAlgorithm+" ") {
+			return nil, errS3AuthHeader
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, s3SignAlgorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, errS3AuthHeader
+			}
+			switch kv[0] {
+			case "Credential":
+				if err = parseS3Credential(kv[1], sig); err != nil {
+					return
+				}
+			case "SignedHeaders":
+				sig.signedHeaders = strings.Split(kv[1], ";")
+			case "Signature":
+				sig.signature = kv[1]
+			}
+		}
+		amzDate = req.Header.Get("X-Amz-Date")
+		sig.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			sig.payloadHash = emptySha256
+		}
+	} else if query.Get("X-Amz-Algorithm") == s3SignAlgorithm {
+		sig.presigned = true
+		if err = parseS3Credential(query.Get("X-Amz-Credential"), sig); err != nil {
+			return
+		}
+		sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		sig.signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		sig.payloadHash = S3_UNSIGNED_PAYLOAD
+	} else {
+		return nil, errS3AccessDenied
+	}
+
+	if sig.accessKey == "" || sig.signature == "" || len(sig.signedHeaders) == 0 {
+		return nil, errS3AuthHeader
+	}
+	if amzDate == "" {
+		amzDate = req.Header.Get("Date")
+	}
+	if sig.amzDate, err = time.Parse(s3AmzDateLayout, amzDate); err != nil {
+		if sig.amzDate, err = http.ParseTime(amzDate); err != nil {
+			return nil, errS3AuthHeader
+		}
+	}
+	return sig, nil
+}
+
+//s3CanonicalRequest is the canonical request of sigv4, the path of S3 is encoded only once
+func s3CanonicalRequest(req *http.Request, sig *s3Signature) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if !(sig.presigned && key == "X-Amz-Signature") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Encode(key, true)+"="+s3Encode(value, true))
+		}
+	}
+
+	headers := make([]string, 0, len(sig.signedHeaders))
+	for _, name := range sig.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = req.Host
+		case "content-length":
+			value = strconv.FormatInt(req.ContentLength, 10)
+			if vs := req.Header["Content-Length"]; len(vs) > 0 {
+				value = vs[0]
+			}
+		default:
+			values := make([]string, 0, 1)
+			for _, v := range req.Header[http.CanonicalHeaderKey(name)] {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		headers = append(headers, name+":"+value+"\n")
+	}
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		s3Encode(path, false),
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+//verifyS3Signature checks the signature with the secret key of the access key,
+//the body is not read, its hash is checked by newS3BodyReader
+func verifyS3Signature(req *http.Request, keys map[string]string, now time.Time) (sig *s3Signature, err error) {
+	if sig, err = parseS3Signature(req); err != nil {
+		return
+	}
+	secretKey, ok := keys[sig.accessKey]
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+	if sig.service != "s3" || sig.date != sig.amzDate.UTC().Format("20060102") {
+		return nil, errS3AuthHeader
+	}
+	if sig.presigned {
+		expires, pErr := strconv.ParseInt(req.URL.Query().Get("X-Amz-Expires"), 10, 64)
+		if pErr != nil || expires <= 0 || time.Duration(expires)*time.Second > s3MaxPresignTime {
+			return nil, errS3AuthHeader
+		}
+		if now.After(sig.amzDate.Add(time.Duration(expires) * time.Second)) {
+			return nil, errS3Expired
+		}
+	} else if now.Sub(sig.amzDate) > s3MaxClockSkew || sig.amzDate.Sub(now) > s3MaxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		sig.amzDate.UTC().Format(s3AmzDateLayout),
+		sig.scope(),
+		hex.EncodeToString(sha256Sum([]byte(s3CanonicalRequest(req, sig)))),
+	}, "\n")
+	signingKey := sig.signingKey(secretKey)
+	expect := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	if !hmac.Equal([]byte(expect), []byte(sig.signature)) {
+		return nil, errS3SignMismatch
+	}
+	return sig, nil
+}
+
+// ----------------------------------------------------------
+
+//s3BodyReader checks the sha256 of the body at EOF
+type s3BodyReader struct {
+	r      io.Reader
+	h      hash.Hash
+	expect string
+}
+
+func (b *s3BodyReader) Read(p []byte) (n int, err error) {
+	n, err = b.r.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.h.Sum(nil)) != b.expect {
+		err = errS3ContentSha256
+	}
+	return
+}
+
+//s3ChunkedReader decodes the aws-chunked body, `<HexSize>[;chunk-signature=<Sign>]\r\n<Data>\r\n`,
+//and checks the signature of each chunk, chained from the signature of the request
+type s3ChunkedReader struct {
+	r          *bufio.Reader
+	sig        *s3Signature
+	signingKey []byte
+	prevSign   string
+	signed     bool
+	chunk      []byte
+	done       bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (n int, err error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err = c.nextChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return
+}
+
+func (c *s3ChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errS3IncompleteBody
+	}
+	items := strings.SplitN(strings.TrimRight(line, "\r\n"), ";", 2)
+	size, err := strconv.ParseInt(items[0], 16, 64)
+	if err != nil || size < 0 || size > 1<<30 {
+		return errS3IncompleteBody
+	}
+	chunk := make([]byte, size)
+	if _, err = io.ReadFull(c.r, chunk); err != nil {
+		return errS3IncompleteBody
+	}
+
+	if c.signed {
+		if len(items) != 2 || !strings.HasPrefix(items[1], "chunk-signature=") {
+			return errS3SignMismatch
+		}
+		stringToSign := strings.Join([]string{
+			s3SignAlgorithm + "-PAYLOAD",
+			c.sig.amzDate.UTC().Format(s3AmzDateLayout),
+			c.sig.scope(),
+			c.prevSign,
+			emptySha256,
+			hex.EncodeToString(sha256Sum(chunk)),
+		}, "\n")
+		sign := hex.EncodeToString(hmacSha256(c.signingKey, stringToSign))
+		if sign != strings.TrimPrefix(items[1], "chunk-signature=") {
+			return errS3SignMismatch
+		}
+		c.prevSign = sign
+	}
+
+	if size == 0 {
+		//the trailers of the unsigned payload are not checked
+		c.done = true
+		return nil
+	}
+	if _, err = c.r.Discard(2); err != nil {
+		return errS3IncompleteBody
+	}
+	c.chunk = chunk
+	return nil
+}
+
+//newS3BodyReader returns the payload of the request, checked against the payload hash of the signature
+func newS3BodyReader(req *http.Request, sig *s3Signature, secretKey string) (r io.Reader, size int64, err error) {
+	size = req.ContentLength
+	switch sig.payloadHash {
+	case S3_UNSIGNED_PAYLOAD:
+		r = req.Body
+	case S3_STREAMING_PAYLOAD, S3_STREAMING_UNSIGNED_TRAIL:
+		decoded := req.Header.Get("X-Amz-Decoded-Content-Length")
+		if size, err = strconv.ParseInt(decoded, 10, 64); err != nil {
+			return nil, 0, &s3Error{411, "MissingContentLength", "You must provide the X-Amz-Decoded-Content-Length HTTP header"}
+		}
+		r = &s3ChunkedReader{
+			r:          bufio.NewReader(req.Body),
+			sig:        sig,
+			signingKey: sig.signingKey(secretKey),
+			prevSign:   sig.signature,
+			signed:     sig.payloadHash == S3_STREAMING_PAYLOAD,
+		}
+	default:
+		if len(sig.payloadHash) != sha256.Size*2 {
+			return nil, 0, errS3ContentSha256
+		}
+		r = &s3BodyReader{r: req.Body, h: sha256.New(), expect: sig.payloadHash}
+	}
+	if size < 0 {
+		return nil, 0, &s3Error{411, "MissingContentLength", "You must provide the Content-Length HTTP header"}
+	}
+	return
+}
@@ -0,0 +1,901 @@
+package atfuck
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+	"qiniu/rpc"
+)
+
+/*
+Shell is the interactive mode of atfuck, it keeps the current bucket and the current dir (a key prefix)
+like a file system:
+
+	/                       the buckets
+	/<bucket>/<dir>/<key>   the files, the dirs are split from the keys by `/`
+
+the paths of the commands are relative to the current dir, or absolute if started with `/`.
+The listings are cached for the completion until refreshed or changed by the shell.
+*/
+
+const (
+	SHELL_HISTORY_SIZE = 500
+	SHELL_LIST_LIMIT   = 1000
+	SHELL_BATCH_LIMIT  = 1000
+)
+
+var errShellExit = errors.New("exit")
+
+type shellCommand struct {
+	usage string
+	desc  string
+	run   func(s *Shell, args []string) error
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"help":    {"help", "Show the commands", (*Shell).help},
+		"pwd":     {"pwd", "Show the current bucket and dir", (*Shell).pwd},
+		"ls":      {"ls [-l] [<Path>]", "List the dirs and files, or the buckets at /", (*Shell).ls},
+		"cd":      {"cd [<Path>]", "Change the current dir, / by default", (*Shell).cd},
+		"stat":    {"stat <Path>...", "Show the info of the files", (*Shell).stat},
+		"get":     {"get <Path> [<LocalFile>]", "Download the file, to the current local dir by default", (*Shell).get},
+		"put":     {"put [-y] <LocalFile> [<Path>]", "Upload the local file, into the current dir by default", (*Shell).put},
+		"rm":      {"rm [-y] [-r] <Path>...", "Delete the files, or all the files under the dirs with -r", (*Shell).rm},
+		"mv":      {"mv [-y] <SrcPath> <DestPath>", "Move the file, into the dir if the dest ends with /", (*Shell).mv},
+		"cp":      {"cp [-y] <SrcPath> <DestPath>", "Copy the file, into the dir if the dest ends with /", (*Shell).cp},
+		"sign":    {"sign [-e <Seconds>] <Path>...", "Make the private download links, valid for an hour by default", (*Shell).sign},
+		"refresh": {"refresh", "Drop the cached listings", (*Shell).refresh},
+		"exit":    {"exit", "Leave the shell", (*Shell).exit},
+	}
+}
+
+//shellListing is a dir in bucket
+type shellListing struct {
+	dirs  []string
+	files []rsf.ListItem
+}
+
+type Shell struct {
+	mac    *digest.Mac
+	in     *bufio.Reader
+	out    io.Writer
+	editor *lineEditor
+
+	bucket string
+	//the current dir in bucket, ends with `/` unless empty
+	prefix string
+
+	zones    map[string]string
+	proxies  map[string]*bucketProxy
+	buckets  []string
+	listings map[string]*shellListing
+
+	history     []string
+	historyFile string
+}
+
+//NewShell reads the commands from in, the line is edited with the completion and the history if in is a terminal
+func NewShell(mac *digest.Mac, in io.Reader, out io.Writer) *Shell {
+	s := &Shell{
+		mac:      mac,
+		in:       bufio.NewReader(in),
+		out:      out,
+		zones:    make(map[string]string),
+		proxies:  make(map[string]*bucketProxy),
+		listings: make(map[string]*shellListing),
+	}
+	if f, ok := in.(*os.File); ok && isTerminal(f) {
+		s.editor = newLineEditor(f, s.in, out, s.Complete)
+		s.historyFile = filepath.Join(QShellRootPath, ".atfuck", "shell_history")
+		s.loadHistory()
+	}
+	return s
+}
+
+func (s *Shell) loadHistory() {
+	fp, err := os.Open(s.historyFile)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		s.history = append(s.history, scanner.Text())
+	}
+	if len(s.history) > SHELL_HISTORY_SIZE {
+		s.history = s.history[len(s.history)-SHELL_HISTORY_SIZE:]
+	}
+}
+
+func (s *Shell) addHistory(line string) {
+	if len(s.history) > 0 && s.history[len(s.history)-1] == line {
+		return
+	}
+	s.history = append(s.history, line)
+	if s.historyFile == "" {
+		return
+	}
+	if fp, err := os.OpenFile(s.historyFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+		fmt.Fprintln(fp, line)
+		fp.Close()
+	}
+}
+
+//Cwd is the current dir like /<bucket>/<dir>/
+func (s *Shell) Cwd() string {
+	if s.bucket == "" {
+		return "/"
+	}
+	return "/" + s.bucket + "/" + s.prefix
+}
+
+//Run executes the commands until the input ends or exit
+func (s *Shell) Run() error {
+	for {
+		var line string
+		var err error
+		if s.editor != nil {
+			line, err = s.editor.readLine(fmt.Sprintf("atfuck:%s> ", s.Cwd()), s.history)
+		} else {
+			line, err = s.in.ReadString('\n')
+			if err == io.EOF && line != "" {
+				err = nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if s.editor != nil {
+			s.addHistory(line)
+		}
+		if eErr := s.Exec(line); eErr == errShellExit {
+			return nil
+		} else if eErr != nil {
+			fmt.Fprintln(s.out, "Error:", eErr)
+		}
+	}
+}
+
+//Exec executes a command line
+func (s *Shell) Exec(line string) error {
+	args, err := splitShellArgs(line)
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	name := args[0]
+	if name == "quit" {
+		name = "exit"
+	}
+	cmd, ok := shellCommands[name]
+	if !ok {
+		return fmt.Errorf("unknown command `%s`, see help", args[0])
+	}
+	return cmd.run(s, args[1:])
+}
+
+//splitShellArgs splits the line by the spaces, the quoted parts and the escaped spaces are kept
+func splitShellArgs(line string) (args []string, err error) {
+	args, _, _, quote := scanShellArgs(line)
+	if quote != 0 {
+		return nil, errors.New("unclosed quote")
+	}
+	return
+}
+
+//scanShellArgs splits the line like splitShellArgs, with the offsets of the args in the line, whether the line
+//ends in the last arg and the quote left open at the end, so the last arg is completed as typed
+func scanShellArgs(line string) (args []string, starts []int, inArg bool, quote rune) {
+	var arg strings.Builder
+	escaped := false
+	begin := func(i int) {
+		if !inArg {
+			starts = append(starts, i)
+			inArg = true
+		}
+	}
+	for i, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			begin(i)
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			begin(i)
+			quote = c
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			begin(i)
+			arg.WriteRune(c)
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return
+}
+
+//quoteShellArg quotes the arg to type in the line, by the quote the arg is opened with,
+//or by escaping the special chars; the quote is closed if closed
+func quoteShellArg(arg string, quote rune, closed bool) string {
+	switch quote {
+	case '\'':
+		arg = "'" + strings.Replace(arg, "'", `'\''`, -1)
+	case '"':
+		arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg)
+	default:
+		return strings.NewReplacer(`\`, `\\`, " ", `\ `, "\t", "\\\t", "'", `\'`, `"`, `\"`).Replace(arg)
+	}
+	if closed {
+		arg += string(quote)
+	}
+	return arg
+}
+
+//parseShellFlags takes the leading flags of the args, the flags with values are named in withValue
+func parseShellFlags(args []string, withValue ...string) (flags map[string]string, rest []string, err error) {
+	flags = make(map[string]string)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		name := args[0]
+		args = args[1:]
+		if name == "--" {
+			break
+		}
+		flags[name] = ""
+		for _, v := range withValue {
+			if v == name {
+				if len(args) == 0 {
+					return nil, nil, fmt.Errorf("flag `%s` needs a value", name)
+				}
+				flags[name], args = args[0], args[1:]
+			}
+		}
+	}
+	return flags, args, nil
+}
+
+//resolve gets the bucket and the key of the path, the key of a dir ends with `/`
+func (s *Shell) resolve(p string) (bucket, key string) {
+	full := p
+	if !strings.HasPrefix(p, "/") {
+		full = s.Cwd() + p
+	}
+	var parts []string
+	for _, part := range strings.Split(full, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return
+	}
+	bucket, key = parts[0], strings.Join(parts[1:], "/")
+	if key != "" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..") || p == "." || p == "..") {
+		key += "/"
+	}
+	return
+}
+
+//resolveFile resolves the path of a file
+func (s *Shell) resolveFile(p string) (bucket, key string, err error) {
+	bucket, key = s.resolve(p)
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		err = fmt.Errorf("`%s` is not a file", p)
+	}
+	return
+}
+
+//useBucket sets the zone of the bucket for the following requests
+func (s *Shell) useBucket(bucket string) (err error) {
+	region, ok := s.zones[bucket]
+	if !ok {
+		bucketInfo, gErr := GetBucketInfo(s.mac, bucket)
+		if gErr != nil {
+			return gErr
+		}
+		region = bucketInfo.Region
+		s.zones[bucket] = region
+	}
+	SetZone(region)
+	return
+}
+
+//proxy gets the domain of the bucket to download the files
+func (s *Shell) proxy(bucket string) (proxy *bucketProxy, err error) {
+	if proxy, ok := s.proxies[bucket]; ok {
+		SetZone(s.zones[bucket])
+		return proxy, nil
+	}
+	if proxy, err = newBucketProxy(s.mac, bucket, "", "", ""); err == nil {
+		s.proxies[bucket] = proxy
+	}
+	return
+}
+
+func (s *Shell) client(bucket string) (client rs.Client, err error) {
+	if err = s.useBucket(bucket); err != nil {
+		return
+	}
+	client = rs.NewMac(s.mac)
+	client.Conn.Retry = rpc.DefaultRetryPolicy
+	return
+}
+
+//list lists the dir of the bucket, from the cache if listed before
+func (s *Shell) list(bucket, prefix string) (listing *shellListing, err error) {
+	cacheKey := bucket + "/" + prefix
+	if listing, ok := s.listings[cacheKey]; ok {
+		return listing, nil
+	}
+	if err = s.useBucket(bucket); err != nil {
+		return
+	}
+	listing = &shellListing{}
+	err = ListDirCtx(context.Background(), s.mac, bucket, prefix, SHELL_LIST_LIMIT, func(entries []rsf.ListItem, dirs []string) {
+		for _, entry := range entries {
+			if entry.Key != prefix {
+				listing.files = append(listing.files, entry)
+			}
+		}
+		for _, dir := range dirs {
+			listing.dirs = append(listing.dirs, dir[len(prefix):])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.listings[cacheKey] = listing
+	return
+}
+
+func (s *Shell) listBuckets() (buckets []string, err error) {
+	if s.buckets == nil {
+		if s.buckets, err = GetBuckets(s.mac); err != nil {
+			return
+		}
+		sort.Strings(s.buckets)
+	}
+	return s.buckets, nil
+}
+
+//invalidate drops the cached listings of the bucket after the files changed
+func (s *Shell) invalidate(bucket string) {
+	for cacheKey := range s.listings {
+		if strings.HasPrefix(cacheKey, bucket+"/") {
+			delete(s.listings, cacheKey)
+		}
+	}
+}
+
+//confirm asks the question, it is yes only if answered y or yes
+func (s *Shell) confirm(question string) bool {
+	fmt.Fprintf(s.out, "%s [y/N] ", question)
+	answer, _ := s.in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+//exists checks whether the file is in bucket
+func (s *Shell) exists(client rs.Client, bucket, key string) (bool, error) {
+	_, err := client.Stat(nil, bucket, key)
+	if err == nil {
+		return true, nil
+	}
+	if v, ok := err.(*rpc.ErrorInfo); ok && v.Code == 612 {
+		return false, nil
+	}
+	return false, err
+}
+
+// ----------------------------------------------------------
+
+func (s *Shell) help(args []string) error {
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(s.out, "\t%-36s%s\n", shellCommands[name].usage, shellCommands[name].desc)
+	}
+	return nil
+}
+
+func (s *Shell) pwd(args []string) error {
+	fmt.Fprintln(s.out, s.Cwd())
+	return nil
+}
+
+func (s *Shell) exit(args []string) error {
+	return errShellExit
+}
+
+func (s *Shell) refresh(args []string) error {
+	s.listings = make(map[string]*shellListing)
+	s.buckets = nil
+	return nil
+}
+
+func (s *Shell) cd(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: " + shellCommands["cd"].usage)
+	}
+	p := "/"
+	if len(args) == 1 {
+		p = args[0]
+	}
+	bucket, key := s.resolve(p)
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	if bucket != "" {
+		if err := s.useBucket(bucket); err != nil {
+			return err
+		}
+	}
+	s.bucket, s.prefix = bucket, key
+	return nil
+}
+
+func (s *Shell) ls(args []string) error {
+	flags, args, err := parseShellFlags(args)
+	if err != nil {
+		return err
+	}
+	_, long := flags["-l"]
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, p := range args {
+		bucket, key := s.resolve(p)
+		if bucket == "" {
+			buckets, lErr := s.listBuckets()
+			if lErr != nil {
+				return lErr
+			}
+			for _, name := range buckets {
+				fmt.Fprintf(s.out, "%s/\n", name)
+			}
+			continue
+		}
+		if key != "" && !strings.HasSuffix(key, "/") {
+			key += "/"
+		}
+		listing, lErr := s.list(bucket, key)
+		if lErr != nil {
+			return lErr
+		}
+		for _, dir := range listing.dirs {
+			if long {
+				fmt.Fprintf(s.out, "%12s  %-19s  %s\n", "-", "-", dir)
+			} else {
+				fmt.Fprintln(s.out, dir)
+			}
+		}
+		for _, file := range listing.files {
+			name := file.Key[len(key):]
+			if long {
+				putTime := time.Unix(0, file.PutTime*100).Format("2006-01-02 15:04:05")
+				fmt.Fprintf(s.out, "%12d  %s  %s\n", file.Fsize, putTime, name)
+			} else {
+				fmt.Fprintln(s.out, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Shell) stat(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["stat"].usage)
+	}
+	for _, p := range args {
+		bucket, key, err := s.resolveFile(p)
+		if err != nil {
+			return err
+		}
+		client, err := s.client(bucket)
+		if err != nil {
+			return err
+		}
+		entry, err := client.Stat(nil, bucket, key)
+		if err != nil {
+			return fmt.Errorf("stat `%s` error, %s", p, err)
+		}
+		fmt.Fprintf(s.out, "%-12s%s\n", "Bucket:", bucket)
+		fmt.Fprintf(s.out, "%-12s%s\n", "Key:", key)
+		fmt.Fprintf(s.out, "%-12s%s\n", "Hash:", entry.Hash)
+		fmt.Fprintf(s.out, "%-12s%d\n", "Fsize:", entry.Fsize)
+		fmt.Fprintf(s.out, "%-12s%s\n", "PutTime:", time.Unix(0, entry.PutTime*100).Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(s.out, "%-12s%s\n", "MimeType:", entry.MimeType)
+		fmt.Fprintf(s.out, "%-12s%d\n", "FileType:", entry.FileType)
+	}
+	return nil
+}
+
+func (s *Shell) get(args []string) (err error) {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: " + shellCommands["get"].usage)
+	}
+	bucket, key, err := s.resolveFile(args[0])
+	if err != nil {
+		return
+	}
+	localFile := path.Base(key)
+	if len(args) == 2 {
+		localFile = args[1]
+		if fi, sErr := os.Stat(localFile); sErr == nil && fi.IsDir() {
+			localFile = filepath.Join(localFile, path.Base(key))
+		}
+	}
+	if _, sErr := os.Stat(localFile); sErr == nil && !s.confirm(fmt.Sprintf("Overwrite local file `%s`?", localFile)) {
+		return
+	}
+	//the file is kept only if downloaded
+	tmpFile := localFile + ".tmp"
+	fp, err := os.Create(tmpFile)
+	if err != nil {
+		return
+	}
+	if _, err = s.proxy(bucket); err == nil {
+		err = CatFile(context.Background(), s.mac, bucket, key, fp)
+	}
+	if cErr := fp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, localFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return
+	}
+	fmt.Fprintf(s.out, "`%s` => `%s`\n", args[0], localFile)
+	return
+}
+
+func (s *Shell) put(args []string) (err error) {
+	flags, args, err := parseShellFlags(args)
+	if err != nil {
+		return
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: " + shellCommands["put"].usage)
+	}
+	localFile := args[0]
+	fi, err := os.Stat(localFile)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("`%s` is a dir, use qupload for the dirs", localFile)
+	}
+	target := filepath.Base(localFile)
+	if len(args) == 2 {
+		target = args[1]
+		if strings.HasSuffix(target, "/") {
+			target += filepath.Base(localFile)
+		}
+	}
+	bucket, key, err := s.resolveFile(target)
+	if err != nil {
+		return
+	}
+	client, err := s.client(bucket)
+	if err != nil {
+		return
+	}
+	if _, yes := flags["-y"]; !yes {
+		if exists, eErr := s.exists(client, bucket, key); eErr != nil {
+			return eErr
+		} else if exists && !s.confirm(fmt.Sprintf("Overwrite `%s` in bucket `%s`?", key, bucket)) {
+			return
+		}
+	}
+	//the domain is not needed to upload
+	proxy := &bucketProxy{bucket: bucket, mac: s.mac}
+	putRet, err := proxy.upload(context.Background(), key, localFile, fi.Size(), "")
+	if err != nil {
+		return
+	}
+	s.invalidate(bucket)
+	fmt.Fprintf(s.out, "`%s` => `%s`, hash %s\n", localFile, key, putRet.Hash)
+	return
+}
+
+func (s *Shell) rm(args []string) (err error) {
+	flags, args, err := parseShellFlags(args)
+	if err != nil {
+		return
+	}
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["rm"].usage)
+	}
+	_, recursive := flags["-r"]
+	var entries []rs.EntryPath
+	for _, p := range args {
+		bucket, key := s.resolve(p)
+		if bucket == "" || key == "" {
+			return fmt.Errorf("can not remove `%s`", p)
+		}
+		if !strings.HasSuffix(key, "/") {
+			entries = append(entries, rs.EntryPath{Bucket: bucket, Key: key})
+			continue
+		}
+		if !recursive {
+			return fmt.Errorf("`%s` is a dir, use -r to remove all the files under it", p)
+		}
+		if err = s.useBucket(bucket); err != nil {
+			return
+		}
+		client := rsf.New(s.mac)
+		client.Conn.Retry = listRetryPolicy
+		marker := ""
+		for {
+			items, markerOut, lErr := client.ListPrefixCtx(context.Background(), nil, bucket, key, marker, SHELL_LIST_LIMIT)
+			if lErr != nil && lErr != io.EOF {
+				return lErr
+			}
+			for _, item := range items {
+				entries = append(entries, rs.EntryPath{Bucket: bucket, Key: item.Key})
+			}
+			if lErr == io.EOF || markerOut == "" {
+				break
+			}
+			marker = markerOut
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(s.out, "No files to remove")
+		return
+	}
+	//the files are deleted bucket by bucket, in the order of the args
+	var buckets []string
+	groups := make(map[string][]rs.EntryPath)
+	for _, entry := range entries {
+		if _, ok := groups[entry.Bucket]; !ok {
+			buckets = append(buckets, entry.Bucket)
+		}
+		groups[entry.Bucket] = append(groups[entry.Bucket], entry)
+	}
+	if _, yes := flags["-y"]; !yes {
+		question := fmt.Sprintf("Delete `%s` in bucket `%s`?", entries[0].Key, entries[0].Bucket)
+		if len(buckets) > 1 {
+			question = fmt.Sprintf("Delete %d files in %d buckets, `%s:%s` and the others?", len(entries), len(buckets), entries[0].Bucket, entries[0].Key)
+		} else if len(entries) > 1 {
+			question = fmt.Sprintf("Delete %d files, `%s` and the others?", len(entries), entries[0].Key)
+		}
+		if !s.confirm(question) {
+			return
+		}
+	}
+
+	var failed int
+	for _, bucket := range buckets {
+		client, cErr := s.client(bucket)
+		if cErr != nil {
+			return cErr
+		}
+		group := groups[bucket]
+		for start := 0; start < len(group); start += SHELL_BATCH_LIMIT {
+			end := start + SHELL_BATCH_LIMIT
+			if end > len(group) {
+				end = len(group)
+			}
+			rets, bErr := BatchDelete(client, group[start:end])
+			s.invalidate(bucket)
+			if bErr != nil && len(rets) == 0 {
+				return bErr
+			}
+			for i, ret := range rets {
+				if ret.Code != 200 {
+					failed += 1
+					fmt.Fprintf(s.out, "Delete `%s:%s` error, %d %s\n", bucket, group[start+i].Key, ret.Code, ret.Data.Error)
+				}
+			}
+		}
+	}
+	fmt.Fprintf(s.out, "Deleted %d files\n", len(entries)-failed)
+	if failed > 0 {
+		err = fmt.Errorf("%d files not deleted", failed)
+	}
+	return
+}
+
+func (s *Shell) mv(args []string) error {
+	return s.moveOrCopy("mv", args)
+}
+
+func (s *Shell) cp(args []string) error {
+	return s.moveOrCopy("cp", args)
+}
+
+//moveOrCopy asks before moving the file or overwriting the dest
+func (s *Shell) moveOrCopy(name string, args []string) (err error) {
+	flags, args, err := parseShellFlags(args)
+	if err != nil {
+		return
+	}
+	if len(args) != 2 {
+		return errors.New("usage: " + shellCommands[name].usage)
+	}
+	srcBucket, srcKey, err := s.resolveFile(args[0])
+	if err != nil {
+		return
+	}
+	dest := args[1]
+	if strings.HasSuffix(dest, "/") || dest == "." || dest == ".." {
+		dest = strings.TrimSuffix(dest, "/") + "/" + path.Base(srcKey)
+	}
+	destBucket, destKey, err := s.resolveFile(dest)
+	if err != nil {
+		return
+	}
+	client, err := s.client(srcBucket)
+	if err != nil {
+		return
+	}
+	overwrite, err := s.exists(client, destBucket, destKey)
+	if err != nil {
+		return
+	}
+	if _, yes := flags["-y"]; !yes {
+		var question string
+		if name == "mv" {
+			question = fmt.Sprintf("Move `%s:%s` to `%s:%s`?", srcBucket, srcKey, destBucket, destKey)
+		}
+		if overwrite {
+			question = strings.TrimSpace(question + fmt.Sprintf(" Overwrite `%s:%s`?", destBucket, destKey))
+		}
+		if question != "" && !s.confirm(question) {
+			return
+		}
+	}
+	if name == "mv" {
+		err = client.Move(nil, srcBucket, srcKey, destBucket, destKey, overwrite)
+	} else {
+		err = client.Copy(nil, srcBucket, srcKey, destBucket, destKey, overwrite)
+	}
+	if err != nil {
+		return
+	}
+	s.invalidate(srcBucket)
+	s.invalidate(destBucket)
+	fmt.Fprintf(s.out, "`%s:%s` => `%s:%s`\n", srcBucket, srcKey, destBucket, destKey)
+	return
+}
+
+func (s *Shell) sign(args []string) (err error) {
+	flags, args, err := parseShellFlags(args, "-e")
+	if err != nil {
+		return
+	}
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["sign"].usage)
+	}
+	expires := int64(3600)
+	if v, ok := flags["-e"]; ok {
+		if expires, err = strconv.ParseInt(v, 10, 64); err != nil || expires <= 0 {
+			return fmt.Errorf("invalid seconds `%s`", v)
+		}
+	}
+	deadline := time.Now().Add(time.Duration(expires) * time.Second).Unix()
+	for _, p := range args {
+		bucket, key, rErr := s.resolveFile(p)
+		if rErr != nil {
+			return rErr
+		}
+		proxy, pErr := s.proxy(bucket)
+		if pErr != nil {
+			return pErr
+		}
+		publicUrl := fmt.Sprintf("http://%s/%s", proxy.domain, (&url.URL{Path: key}).EscapedPath())
+		fmt.Fprintln(s.out, PrivateUrl(s.mac, publicUrl, deadline))
+	}
+	return
+}
+
+// ----------------------------------------------------------
+
+//Complete gets the candidates to replace the last word of the line from the start offset, the command names
+//for the first word, or the dirs and files from the cached listings quoted like the word
+func (s *Shell) Complete(line string) (start int, candidates []string) {
+	args, starts, inArg, quote := scanShellArgs(line)
+	if !inArg {
+		args, starts = append(args, ""), append(starts, len(line))
+	}
+	word, start := args[len(args)-1], starts[len(starts)-1]
+	if len(args) == 1 {
+		for name := range shellCommands {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, name+" ")
+			}
+		}
+		sort.Strings(candidates)
+		return
+	}
+	if strings.HasPrefix(word, "-") {
+		return start, nil
+	}
+
+	dirPart, base := "", word
+	if idx := strings.LastIndex(word, "/"); idx >= 0 {
+		dirPart, base = word[:idx+1], word[idx+1:]
+	}
+	dir := dirPart
+	if dir == "" {
+		dir = "."
+	}
+	bucket, key := s.resolve(dir)
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	if bucket == "" {
+		buckets, err := s.listBuckets()
+		if err != nil {
+			return start, nil
+		}
+		for _, name := range buckets {
+			if strings.HasPrefix(name, base) {
+				candidates = append(candidates, quoteShellArg(dirPart+name+"/", quote, false))
+			}
+		}
+		return
+	}
+	listing, err := s.list(bucket, key)
+	if err != nil {
+		return start, nil
+	}
+	for _, name := range listing.dirs {
+		if strings.HasPrefix(name, base) {
+			candidates = append(candidates, quoteShellArg(dirPart+name, quote, false))
+		}
+	}
+	for _, file := range listing.files {
+		if name := file.Key[len(key):]; strings.HasPrefix(name, base) {
+			candidates = append(candidates, quoteShellArg(dirPart+name, quote, true)+" ")
+		}
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package atfuck
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srv.PutObject(fakeBucket, "keep/x.txt", []byte("x"), "")
+	srv.PutObject(fakeBucket, "docs/my file.txt", []byte("my file"), "")
+	srv.PutObject(fakeBucket, "notes..", []byte("notes"), "")
+	srv.CreateBucket("other", false)
+	srv.PutObject("other", "y.txt", []byte("y"), "")
+
+	localDir := t.TempDir()
+	localFile := filepath.Join(localDir, "a.txt")
+	if err := ioutil.WriteFile(localFile, []byte("hello shell"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outFile := filepath.Join(localDir, "out.txt")
+
+	script := strings.Join([]string{
+		"cd /test",
+		"put -y '" + localFile + "' docs/",
+		"cd docs",
+		"pwd",
+		"cp a.txt b.txt",
+		"mv a.txt ../c.txt",
+		"y",
+		"rm b.txt",
+		"n",
+		"stat b.txt",
+		"rm -r /test/keep/",
+		"y",
+		"cd ..",
+		"ls",
+		"sign c.txt",
+		"get c.txt '" + outFile + "'",
+		"stat notes..",
+		"ls /other/",
+		"rm notes.. /other/y.txt",
+		"y",
+		"ls /other/",
+		"unknown",
+		"exit",
+		"pwd",
+	}, "\n")
+	var out bytes.Buffer
+	shell := NewShell(mac, strings.NewReader(script), &out)
+	if err := shell.Run(); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	for _, expected := range []string{
+		"/test/docs/\n",
+		"`test:docs/a.txt` => `test:docs/b.txt`\n",
+		"Move `test:docs/a.txt` to `test:c.txt`? [y/N] `test:docs/a.txt` => `test:c.txt`\n",
+		"Delete `docs/b.txt` in bucket `test`? [y/N] ",
+		"Key:        docs/b.txt\n",
+		"Deleted 1 files\n",
+		"docs/\nc.txt\n",
+		"Key:        notes..\n",
+		"Delete 2 files in 2 buckets, `test:notes..` and the others? [y/N] ",
+		"Deleted 2 files\n",
+		"e=",
+		"&token=" + fakeAccessKey + ":",
+		"Error: unknown command `unknown`, see help\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expect `%s` in the output:\n%s", expected, output)
+		}
+	}
+	if strings.Count(output, "/test/docs/\n") != 1 {
+		t.Fatalf("expect the shell exited, got:\n%s", output)
+	}
+	if data, err := ioutil.ReadFile(outFile); err != nil || string(data) != "hello shell" {
+		t.Fatalf("unexpected downloaded file %q, %v", data, err)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "keep/x.txt"); ok {
+		t.Fatal("expect keep/x.txt removed")
+	}
+	if _, ok := srv.GetObject(fakeBucket, "docs/b.txt"); !ok {
+		t.Fatal("expect docs/b.txt kept")
+	}
+	if _, ok := srv.GetObject(fakeBucket, "notes.."); ok {
+		t.Fatal("expect notes.. removed")
+	}
+	//the listing of the other bucket is not from the cache after the files removed
+	if _, ok := srv.GetObject("other", "y.txt"); ok || strings.Count(output, "\ny.txt\n") != 1 {
+		t.Fatalf("expect other:y.txt removed and listed once, got:\n%s", output)
+	}
+
+	//the completion is from the listings after the changes, quoted like the word
+	for line, expected := range map[string]struct {
+		start      int
+		candidates []string
+	}{
+		"st":                {0, []string{"stat "}},
+		"ls /te":            {3, []string{"/test/"}},
+		"get d":             {4, []string{"docs/"}},
+		"get docs/":         {4, []string{"docs/b.txt ", `docs/my\ file.txt `}},
+		`get docs/my\ f`:    {4, []string{`docs/my\ file.txt `}},
+		`get "docs/my`:      {4, []string{`"docs/my file.txt" `}},
+		`get a.txt 'docs/m`: {10, []string{`'docs/my file.txt' `}},
+		"stat ../te":        {5, []string{"../test/"}},
+		"get x":             {4, nil},
+	} {
+		if start, got := shell.Complete(line); start != expected.start || !reflect.DeepEqual(got, expected.candidates) {
+			t.Fatalf("expect %q completed by %q from %d, got %q from %d", line, expected.candidates, expected.start, got, start)
+		}
+	}
+}
+
+func TestSplitShellArgs(t *testing.T) {
+	args, err := splitShellArgs(`put "my file.txt" dir\ 1/ 'a "b"'`)
+	if err != nil || !reflect.DeepEqual(args, []string{"put", "my file.txt", "dir 1/", `a "b"`}) {
+		t.Fatalf("unexpected args %q, %v", args, err)
+	}
+	if _, err = splitShellArgs(`get "a.txt`); err == nil {
+		t.Fatal("expect the unclosed quote")
+	}
+	//the quoted args are split back as is
+	for _, arg := range []string{"my file.txt", `a "b" c`, `it's`, `back\slash`} {
+		for _, quote := range []rune{0, '"', '\''} {
+			line := "get " + quoteShellArg(arg, quote, true)
+			if args, err = splitShellArgs(line); err != nil || !reflect.DeepEqual(args, []string{"get", arg}) {
+				t.Fatalf("unexpected args %q of `%s`, %v", args, line, err)
+			}
+		}
+	}
+}
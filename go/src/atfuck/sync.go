@@ -2,16 +2,21 @@ package atfuck
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"qiniu/rpc"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/astaxie/beego/logs"
@@ -28,6 +33,13 @@ const (
 	HTTP_TIMEOUT    = time.Second * 10
 )
 
+//a block is synced again on failure, with the interval doubled for each retry
+var syncRetryPolicy = &rpc.Backoff{
+	MaxRetries:  RETRY_MAX_TIMES,
+	Interval:    RETRY_INTERVAL,
+	MaxInterval: RETRY_INTERVAL * 10,
+}
+
 type PutRet struct {
 	Key      string `json:"key"`
 	Hash     string `json:"hash"`
@@ -41,8 +53,32 @@ type SyncProgress struct {
 	TotalSize int64           `json:"total_size"`
 }
 
+//syncMetricsJob shows the sync as a job of one file in the metrics, finish sets the result
+func syncMetricsJob(srcResUrl, bucket, key string, totalSize int64) (progress *Progress, finish func(err error)) {
+	var done, failed int64
+	progress = NewProgress("sync", 1, totalSize, func() ProgressCounts {
+		return ProgressCounts{Done: atomic.LoadInt64(&done), Failed: atomic.LoadInt64(&failed)}
+	})
+	RegisterMetricsJob(progress, func() int {
+		return 0
+	}, map[string]string{"src": srcResUrl, "bucket": bucket, "key": key})
+	finish = func(err error) {
+		if err != nil {
+			atomic.StoreInt64(&failed, 1)
+		} else {
+			atomic.StoreInt64(&done, 1)
+		}
+	}
+	return
+}
+
 func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutRet, err error) {
-	if exists, cErr := checkExists(mac, bucket, key); cErr != nil {
+	return SyncCtx(context.Background(), mac, srcResUrl, bucket, key, upHostIp)
+}
+
+//SyncCtx stops syncing when ctx is done, the synced blocks are kept in the progress file
+func SyncCtx(ctx context.Context, mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutRet, err error) {
+	if exists, cErr := checkExists(ctx, mac, bucket, key); cErr != nil {
 		err = cErr
 		return
 	} else if exists {
@@ -101,7 +137,7 @@ func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutR
 	}
 
 	//get total size
-	totalSize, hErr := getRemoteFileLength(srcResUrl)
+	totalSize, hErr := getRemoteFileLength(ctx, srcResUrl)
 	if hErr != nil {
 		err = hErr
 		return
@@ -116,6 +152,11 @@ func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutR
 		syncProgress.BlkCtxs = make([]rio.BlkputRet, 0)
 	}
 
+	jobProgress, finishJob := syncMetricsJob(srcResUrl, bucket, key, totalSize)
+	defer func() {
+		finishJob(err)
+	}()
+
 	//get total block count
 	totalBlkCnt := 0
 	if totalSize%BLOCK_SIZE == 0 {
@@ -146,30 +187,25 @@ func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutR
 
 		syncPercent := fmt.Sprintf("%.2f", float64(blkIndex+1)*100.0/float64(totalBlkCnt))
 		logs.Info("Syncing block %d [%s] ...", blkIndex, syncPercent)
-		blkCtx, pErr := rangeMkblkPipe(srcResUrl, totalSize, rangeStartOffset, BLOCK_SIZE, lastBlock, putClient)
-		if pErr != nil {
-			logs.Error(pErr.Error())
-			time.Sleep(RETRY_INTERVAL)
-
-			for retryTimes := 1; retryTimes <= RETRY_MAX_TIMES; retryTimes++ {
-				logs.Info("Retrying %d time range & mkblk block [%d]", retryTimes, blkIndex)
-				blkCtx, pErr = rangeMkblkPipe(srcResUrl, totalSize, rangeStartOffset, BLOCK_SIZE, lastBlock, putClient)
-				if pErr != nil {
-					logs.Error(pErr)
-					//wait a interval and retry
-					time.Sleep(RETRY_INTERVAL)
-					continue
-				} else {
-					break
-				}
+		var blkCtx rio.BlkputRet
+		pErr := rpc.WithRetry(ctx, syncRetryPolicy, func() (rErr error) {
+			blkCtx, rErr = rangeMkblkPipe(ctx, srcResUrl, totalSize, rangeStartOffset, BLOCK_SIZE, lastBlock, putClient)
+			if rErr != nil {
+				logs.Error("Range & mkblk block [%d] error, %s", blkIndex, rErr)
 			}
-		}
-
+			return
+		})
 		if pErr != nil {
-			err = errors.New("Max retry reached and range & mkblk still failed, check your network")
+			err = fmt.Errorf("Range & mkblk block [%d] failed, %s", blkIndex, pErr)
 			return
 		}
 
+		if lastBlock {
+			jobProgress.Transferred(totalSize - rangeStartOffset)
+		} else {
+			jobProgress.Transferred(BLOCK_SIZE)
+		}
+
 		//advance range offset
 		rangeStartOffset += BLOCK_SIZE
 
@@ -186,7 +222,7 @@ func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutR
 	putExtra := rio.PutExtra{
 		Progresses: syncProgress.BlkCtxs,
 	}
-	mkErr := rio.Mkfile(putClient, nil, &putRet, key, true, totalSize, &putExtra)
+	mkErr := rio.MkfileCtx(ctx, putClient, nil, &putRet, key, true, totalSize, &putExtra)
 	if mkErr != nil {
 		err = fmt.Errorf("Mkfile error, %s", mkErr.Error())
 		return
@@ -198,10 +234,145 @@ func Sync(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string) (putRet PutR
 	return
 }
 
-func rangeMkblkPipe(srcResUrl string, totalSize, rangeStartOffset, rangeBlockSize int64, lastBlock bool,
-	putClient rpc.Client) (putRet rio.BlkputRet, err error) {
-	//range get
-	dReq, dReqErr := http.NewRequest("GET", srcResUrl, nil)
+func SyncV2(mac *digest.Mac, srcResUrl, bucket, key, upHostIp string, partSize int64) (putRet PutRet, err error) {
+	return SyncV2Ctx(context.Background(), mac, srcResUrl, bucket, key, upHostIp, partSize)
+}
+
+//SyncV2Ctx syncs with the multipart upload (v2), the uploaded parts are kept in the progress file.
+//partSize is 4MB by default
+func SyncV2Ctx(ctx context.Context, mac *digest.Mac, srcResUrl, bucket, key, upHostIp string,
+	partSize int64) (putRet PutRet, err error) {
+	if partSize == 0 {
+		partSize = rio.DefaultPartSize
+	}
+	if partSize < rio.MinPartSize || partSize > rio.MaxPartSize {
+		err = rio.ErrInvalidPartSize
+		return
+	}
+
+	if exists, cErr := checkExists(ctx, mac, bucket, key); cErr != nil {
+		err = cErr
+		return
+	} else if exists {
+		err = errors.New("File with same key` already exists in bucket")
+		return
+	}
+
+	//get total size
+	totalSize, hErr := getRemoteFileLength(ctx, srcResUrl)
+	if hErr != nil {
+		err = hErr
+		return
+	}
+	totalPartCnt := rio.PartCount(totalSize, partSize)
+	if totalPartCnt > rio.MaxParts {
+		err = rio.ErrTooManyParts
+		return
+	}
+
+	jobProgress, finishJob := syncMetricsJob(srcResUrl, bucket, key, totalSize)
+	defer func() {
+		finishJob(err)
+	}()
+
+	//local storage path
+	syncId := Md5Hex(fmt.Sprintf("%s:%s:%s", srcResUrl, bucket, key))
+	storePath := filepath.Join(QShellRootPath, ".atfuck", "sync")
+	if mkdirErr := os.MkdirAll(storePath, 0775); mkdirErr != nil {
+		err = fmt.Errorf("Failed to mkdir `%s` due to `%s`", storePath, mkdirErr)
+		return
+	}
+	progressFile := filepath.Join(storePath, fmt.Sprintf("%s.v2.progress", syncId))
+
+	//create upload token
+	policy := rs.PutPolicy{Scope: bucket}
+	//token is valid for one year
+	policy.Expires = 3600 * 24 * 365
+	policy.ReturnBody = `{"key":"$(key)","hash":"$(etag)","fsize":$(fsize),"mimeType":"$(mimeType)"}`
+	uptoken := policy.Token(mac)
+	putClient := rio.NewClient(uptoken, upHostIp)
+
+	//try read old progress, which is out of date if the remote file length or the part size changed
+	syncProgress := rio.MultipartProgress{}
+	if progressData, rErr := ioutil.ReadFile(progressFile); rErr == nil {
+		json.Unmarshal(progressData, &syncProgress)
+	}
+	if syncProgress.UploadId == "" || syncProgress.Fsize != totalSize || syncProgress.PartSize != partSize ||
+		len(syncProgress.Parts) != totalPartCnt || time.Now().Add(time.Hour).Unix() > syncProgress.ExpireAt {
+		initRet, iErr := rio.InitParts(ctx, putClient, nil, bucket, key, true)
+		if iErr != nil {
+			err = fmt.Errorf("Init multipart upload error, %w", iErr)
+			return
+		}
+		syncProgress = rio.MultipartProgress{
+			UploadId: initRet.UploadId,
+			ExpireAt: initRet.ExpireAt,
+			PartSize: partSize,
+			Fsize:    totalSize,
+			Parts:    make([]rio.UploadPartInfo, totalPartCnt),
+		}
+	}
+
+	//range get and upload part
+	for partIndex := 0; partIndex < totalPartCnt; partIndex++ {
+		if syncProgress.Parts[partIndex].Etag != "" {
+			continue
+		}
+		rangeStartOffset := int64(partIndex) * partSize
+		lastPart := partIndex == totalPartCnt-1
+
+		syncPercent := fmt.Sprintf("%.2f", float64(partIndex+1)*100.0/float64(totalPartCnt))
+		logs.Info("Syncing part %d [%s] ...", partIndex+1, syncPercent)
+		var partRet rio.UploadPartRet
+		pErr := rpc.WithRetry(ctx, syncRetryPolicy, func() (rErr error) {
+			data, rErr := rangeGet(ctx, srcResUrl, totalSize, rangeStartOffset, partSize, lastPart)
+			if rErr == nil {
+				md5Sum := md5.Sum(data)
+				partRet, rErr = rio.UploadPart(ctx, putClient, nil, bucket, key, true, syncProgress.UploadId,
+					partIndex+1, hex.EncodeToString(md5Sum[:]), bytes.NewReader(data), int64(len(data)))
+			}
+			if rErr != nil {
+				logs.Error("Range & upload part [%d] error, %s", partIndex+1, rErr)
+			}
+			return
+		})
+		if pErr != nil {
+			if v, ok := pErr.(*rpc.ErrorInfo); ok && v.Code == rio.NoSuchUpload {
+				//the upload is expired, start over next time
+				os.Remove(progressFile)
+			}
+			err = fmt.Errorf("Range & upload part [%d] failed, %s", partIndex+1, pErr)
+			return
+		}
+
+		if lastPart {
+			jobProgress.Transferred(totalSize - rangeStartOffset)
+		} else {
+			jobProgress.Transferred(partSize)
+		}
+		syncProgress.Parts[partIndex] = rio.UploadPartInfo{Etag: partRet.Etag, PartNumber: partIndex + 1}
+		if rErr := recordProgress(progressFile, syncProgress); rErr != nil {
+			logs.Info(rErr.Error())
+		}
+	}
+
+	//complete the parts
+	cErr := rio.CompleteParts(ctx, putClient, nil, &putRet, bucket, key, true, syncProgress.UploadId, syncProgress.Parts, nil)
+	if cErr != nil {
+		err = fmt.Errorf("Complete parts error, %w", cErr)
+		return
+	}
+
+	//delete progress file
+	os.Remove(progressFile)
+
+	return
+}
+
+//rangeGet reads the range of the remote file, which is rangeBlockSize bytes except for the last block
+func rangeGet(ctx context.Context, srcResUrl string, totalSize, rangeStartOffset, rangeBlockSize int64,
+	lastBlock bool) (data []byte, err error) {
+	dReq, dReqErr := http.NewRequestWithContext(ctx, "GET", srcResUrl, nil)
 	if dReqErr != nil {
 		err = fmt.Errorf("New request error, %s", dReqErr.Error())
 		return
@@ -218,8 +389,7 @@ func rangeMkblkPipe(srcResUrl string, totalSize, rangeStartOffset, rangeBlockSiz
 	dReq.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", rangeStartOffset, rangeEndOffset))
 
 	//set client properties
-	client := http.DefaultClient
-	client.Timeout = time.Duration(HTTP_TIMEOUT)
+	client := &http.Client{Timeout: HTTP_TIMEOUT}
 	//client.Transport = &http.Transport{
 	//	Proxy: http.ProxyURL(proxyURL),
 	//}
@@ -273,15 +443,27 @@ func rangeMkblkPipe(srcResUrl string, totalSize, rangeStartOffset, rangeBlockSiz
 		return
 	}
 
+	data = buffer.Bytes()
+	return
+}
+
+func rangeMkblkPipe(ctx context.Context, srcResUrl string, totalSize, rangeStartOffset, rangeBlockSize int64, lastBlock bool,
+	putClient rpc.Client) (putRet rio.BlkputRet, err error) {
+	//range get
+	data, err := rangeGet(ctx, srcResUrl, totalSize, rangeStartOffset, rangeBlockSize, lastBlock)
+	if err != nil {
+		return
+	}
+
 	//mkblk
 	blkPutRet := rio.BlkputRet{}
-	blockSize := int(rangeSize)
-	blockDataReader := bytes.NewReader(buffer.Bytes())
-	blockDataSize := buffer.Len()
+	blockSize := len(data)
+	blockDataReader := bytes.NewReader(data)
+	blockDataSize := len(data)
 
-	mkErr := rio.Mkblock(putClient, nil, &blkPutRet, blockSize, blockDataReader, blockDataSize)
+	mkErr := rio.MkblockCtx(ctx, putClient, nil, &blkPutRet, blockSize, blockDataReader, blockDataSize)
 	if mkErr != nil {
-		err = fmt.Errorf("Mkblk error, %s", mkErr.Error())
+		err = fmt.Errorf("Mkblk error, %w", mkErr)
 		return
 	}
 
@@ -290,7 +472,7 @@ func rangeMkblkPipe(srcResUrl string, totalSize, rangeStartOffset, rangeBlockSiz
 	return
 }
 
-func recordProgress(progressFile string, syncProgress SyncProgress) (err error) {
+func recordProgress(progressFile string, syncProgress interface{}) (err error) {
 	fh, openErr := os.Create(progressFile)
 	if openErr != nil {
 		err = fmt.Errorf("Open progress file %s error, %s", progressFile, openErr.Error())
@@ -298,7 +480,7 @@ func recordProgress(progressFile string, syncProgress SyncProgress) (err error)
 	}
 	defer fh.Close()
 
-	jsonBytes, mErr := json.Marshal(&syncProgress)
+	jsonBytes, mErr := json.Marshal(syncProgress)
 	if mErr != nil {
 		err = fmt.Errorf("Marshal sync progress error, %s", mErr.Error())
 		return
@@ -312,8 +494,13 @@ func recordProgress(progressFile string, syncProgress SyncProgress) (err error)
 	return
 }
 
-func getRemoteFileLength(srcResUrl string) (totalSize int64, err error) {
-	resp, respErr := http.Head(srcResUrl)
+func getRemoteFileLength(ctx context.Context, srcResUrl string) (totalSize int64, err error) {
+	req, reqErr := http.NewRequestWithContext(ctx, "HEAD", srcResUrl, nil)
+	if reqErr != nil {
+		err = fmt.Errorf("New head request failed, %s", reqErr.Error())
+		return
+	}
+	resp, respErr := http.DefaultClient.Do(req)
 	if respErr != nil {
 		err = fmt.Errorf("New head request failed, %s", respErr.Error())
 		return
@@ -331,9 +518,9 @@ func getRemoteFileLength(srcResUrl string) (totalSize int64, err error) {
 	return
 }
 
-func checkExists(mac *digest.Mac, bucket, key string) (exists bool, err error) {
+func checkExists(ctx context.Context, mac *digest.Mac, bucket, key string) (exists bool, err error) {
 	client := rs.NewMac(mac)
-	entry, sErr := client.Stat(nil, bucket, key)
+	entry, sErr := client.StatCtx(ctx, nil, bucket, key)
 	if sErr != nil {
 		if v, ok := sErr.(*rpc.ErrorInfo); !ok {
 			err = fmt.Errorf("Check file exists error, %s", sErr.Error())
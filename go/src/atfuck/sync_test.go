@@ -0,0 +1,44 @@
+package atfuck
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"qiniu/api.v6/fakeserver"
+)
+
+func TestSyncToFakeServer(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	SetZone(fakeserver.Region)
+
+	data := make([]byte, 2*BLOCK_SIZE+1024)
+	rand.Read(data)
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "src.bin", time.Now(), bytes.NewReader(data))
+	}))
+	defer src.Close()
+
+	if _, err := Sync(mac, src.URL, fakeBucket, "sync.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+	putRet, err := SyncV2(mac, src.URL, fakeBucket, "sync_v2.bin", "", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if putRet.Key != "sync_v2.bin" || putRet.Fsize != int64(len(data)) {
+		t.Fatalf("unexpected put ret %+v", putRet)
+	}
+	for _, key := range []string{"sync.bin", "sync_v2.bin"} {
+		if remote, ok := srv.GetObject(fakeBucket, key); !ok || !bytes.Equal(remote, data) {
+			t.Fatalf("content of `%s` mismatched", key)
+		}
+	}
+
+	if _, err = SyncV2(mac, src.URL, fakeBucket, "sync_v2.bin", "", 0); err == nil {
+		t.Fatal("expect the existing file not overwritten")
+	}
+}
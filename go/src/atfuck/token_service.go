@@ -0,0 +1,306 @@
+package atfuck
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rs"
+)
+
+const (
+	DEFAULT_TOKEN_EXPIRES = 3600
+)
+
+//TokenPolicy is a template of the upload tokens, it is also the policy file of uptoken
+type TokenPolicy struct {
+	Bucket     string `json:"bucket"`
+	Prefix     string `json:"prefix,omitempty"`      //the keys must start with the prefix
+	InsertOnly bool   `json:"insert_only,omitempty"` //the files in bucket are not overwritten
+	DetectMime bool   `json:"detect_mime,omitempty"`
+	FsizeMin   int64  `json:"fsize_min,omitempty"`
+	FsizeLimit int64  `json:"fsize_limit,omitempty"`
+	MimeLimit  string `json:"mime_limit,omitempty"` //like image/*;video/mp4, or the forbidden types after `!`
+	Expires    int64  `json:"expires,omitempty"`    //the max seconds of the tokens, 3600 by default
+
+	ReturnBody         string `json:"return_body,omitempty"`
+	CallbackUrl        string `json:"callback_url,omitempty"`
+	CallbackBody       string `json:"callback_body,omitempty"`
+	PersistentOps      string `json:"persistent_ops,omitempty"`
+	PersistentPipeline string `json:"persistent_pipeline,omitempty"`
+}
+
+//PutPolicy makes the put policy of the key in the prefix, or of any key in the prefix if key is empty.
+//The expires is at most the Expires of the template, the Expires of the template if 0.
+func (p *TokenPolicy) PutPolicy(key string, expires int64) (policy rs.PutPolicy, err error) {
+	if p.Bucket == "" {
+		err = errors.New("no bucket in the policy")
+		return
+	}
+	maxExpires := p.Expires
+	if maxExpires <= 0 {
+		maxExpires = DEFAULT_TOKEN_EXPIRES
+	}
+	if expires == 0 {
+		expires = maxExpires
+	}
+	if expires < 0 || expires > maxExpires {
+		err = fmt.Errorf("expires %d out of the range 1-%d", expires, maxExpires)
+		return
+	}
+	if key != "" && !strings.HasPrefix(key, p.Prefix) {
+		err = fmt.Errorf("key `%s` not in the prefix `%s`", key, p.Prefix)
+		return
+	}
+
+	policy = rs.PutPolicy{
+		Scope:              p.Bucket,
+		Expires:            uint32(expires),
+		FsizeMin:           p.FsizeMin,
+		FsizeLimit:         p.FsizeLimit,
+		MimeLimit:          p.MimeLimit,
+		ReturnBody:         p.ReturnBody,
+		CallbackUrl:        p.CallbackUrl,
+		CallbackBody:       p.CallbackBody,
+		PersistentOps:      p.PersistentOps,
+		PersistentPipeline: p.PersistentPipeline,
+	}
+	if key != "" {
+		policy.Scope += ":" + key
+	} else if p.Prefix != "" {
+		policy.Scope += ":" + p.Prefix
+		policy.IsPrefixalScope = 1
+	}
+	if p.InsertOnly {
+		policy.InsertOnly = 1
+	}
+	if p.DetectMime {
+		policy.DetectMime = 1
+	}
+	return
+}
+
+//TokenClient is an app allowed to get the tokens by its api key
+type TokenClient struct {
+	ApiKey       string   `json:"api_key"`
+	Policies     []string `json:"policies,omitempty"`      //the names of the templates for the upload tokens
+	SignDomains  []string `json:"sign_domains,omitempty"`  //the domains of the download urls to sign
+	SignPrefixes []string `json:"sign_prefixes,omitempty"` //the keys of the download urls must start with one of them
+	SignExpires  int64    `json:"sign_expires,omitempty"`  //the max seconds of the signed urls, 3600 by default
+}
+
+//TokenServiceConfig is the config file of `serve tokens`
+type TokenServiceConfig struct {
+	Policies map[string]*TokenPolicy `json:"policies"`
+	Clients  map[string]*TokenClient `json:"clients"`
+}
+
+//TokenAuditEntry is a line of the audit log, for the tokens issued and the requests denied
+type TokenAuditEntry struct {
+	Time     string `json:"time"`
+	Client   string `json:"client,omitempty"`
+	Remote   string `json:"remote"`
+	Action   string `json:"action"`
+	Policy   string `json:"policy,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Url      string `json:"url,omitempty"`
+	Deadline int64  `json:"deadline,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//TokenService issues the upload tokens and signs the download urls for the clients, so that only the service
+//holds the secret key:
+//
+//	POST /uptoken  {"policy": <Name>, "key": <Key>, "expires": <Seconds>}  => {"token", "scope", "deadline"}
+//	POST /sign     {"url": <PublicUrl>, "expires": <Seconds>}              => {"url", "deadline"}
+//
+//the clients are authorized by `Authorization: Bearer <ApiKey>`, and only the urls without query of the keys in
+//their sign prefixes are signed
+type TokenService struct {
+	mac    *digest.Mac
+	config TokenServiceConfig
+
+	lock  sync.Mutex
+	audit io.Writer
+}
+
+func NewTokenService(mac *digest.Mac, config TokenServiceConfig, audit io.Writer) (s *TokenService, err error) {
+	for name, policy := range config.Policies {
+		if policy.Bucket == "" {
+			return nil, fmt.Errorf("no bucket in policy `%s`", name)
+		}
+	}
+	apiKeys := make(map[string]bool)
+	for name, client := range config.Clients {
+		if client.ApiKey == "" {
+			return nil, fmt.Errorf("no api key of client `%s`", name)
+		}
+		if apiKeys[client.ApiKey] {
+			return nil, fmt.Errorf("api key of client `%s` used by another client", name)
+		}
+		apiKeys[client.ApiKey] = true
+		for _, policy := range client.Policies {
+			if _, ok := config.Policies[policy]; !ok {
+				return nil, fmt.Errorf("no policy `%s` of client `%s`", policy, name)
+			}
+		}
+	}
+	if audit == nil {
+		audit = ioutil.Discard
+	}
+	s = &TokenService{mac: mac, config: config, audit: audit}
+	return
+}
+
+//client finds the client of the api key
+func (s *TokenService) client(req *http.Request) (name string, client *TokenClient) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return
+	}
+	apiKey := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for cName, c := range s.config.Clients {
+		if subtle.ConstantTimeCompare([]byte(c.ApiKey), apiKey) == 1 {
+			name, client = cName, c
+		}
+	}
+	return
+}
+
+func (s *TokenService) writeAudit(entry *TokenAuditEntry) {
+	entry.Time = time.Now().Format(time.RFC3339)
+	data, _ := json.Marshal(entry)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.audit.Write(append(data, '\n')); err != nil {
+		logs.Error("Write token audit log error,", err)
+	}
+}
+
+func writeTokenResponse(w http.ResponseWriter, status int, ret interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (s *TokenService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	entry := &TokenAuditEntry{Action: strings.TrimPrefix(req.URL.Path, "/")}
+	entry.Remote, _, _ = net.SplitHostPort(req.RemoteAddr)
+	if entry.Action != "uptoken" && entry.Action != "sign" {
+		writeTokenResponse(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	if req.Method != "POST" {
+		writeTokenResponse(w, 405, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	name, client := s.client(req)
+	entry.Client = name
+	var ret interface{}
+	status, err := 401, errors.New("bad api key")
+	if client != nil {
+		var args struct {
+			Policy  string `json:"policy"`
+			Key     string `json:"key"`
+			Url     string `json:"url"`
+			Expires int64  `json:"expires"`
+		}
+		if dErr := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(&args); dErr != nil {
+			status, err = 400, fmt.Errorf("bad request body, %s", dErr)
+		} else if entry.Action == "uptoken" {
+			entry.Policy = args.Policy
+			ret, status, err = s.upToken(client, args.Policy, args.Key, args.Expires, entry)
+		} else {
+			entry.Url = args.Url
+			ret, status, err = s.sign(client, args.Url, args.Expires, entry)
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		ret = map[string]string{"error": err.Error()}
+	}
+	s.writeAudit(entry)
+	writeTokenResponse(w, status, ret)
+}
+
+func (s *TokenService) upToken(client *TokenClient, policyName, key string, expires int64,
+	entry *TokenAuditEntry) (ret interface{}, status int, err error) {
+	allowed := false
+	for _, name := range client.Policies {
+		allowed = allowed || name == policyName
+	}
+	if !allowed {
+		return nil, 403, fmt.Errorf("policy `%s` not allowed", policyName)
+	}
+	policy, err := s.config.Policies[policyName].PutPolicy(key, expires)
+	if err != nil {
+		return nil, 400, err
+	}
+	entry.Scope = policy.Scope
+	entry.Deadline = time.Now().Unix() + int64(policy.Expires)
+	ret = map[string]interface{}{
+		"token":    policy.Token(s.mac),
+		"scope":    policy.Scope,
+		"deadline": entry.Deadline,
+	}
+	return ret, 200, nil
+}
+
+func (s *TokenService) sign(client *TokenClient, publicUrl string, expires int64,
+	entry *TokenAuditEntry) (ret interface{}, status int, err error) {
+	maxExpires := client.SignExpires
+	if maxExpires <= 0 {
+		maxExpires = DEFAULT_TOKEN_EXPIRES
+	}
+	if expires == 0 {
+		expires = maxExpires
+	}
+	if expires < 0 || expires > maxExpires {
+		return nil, 400, fmt.Errorf("expires %d out of the range 1-%d", expires, maxExpires)
+	}
+	uri, pErr := url.Parse(publicUrl)
+	if pErr != nil || uri.Scheme != "http" && uri.Scheme != "https" {
+		return nil, 400, fmt.Errorf("bad url `%s`", publicUrl)
+	}
+	allowed := false
+	for _, domain := range client.SignDomains {
+		allowed = allowed || strings.EqualFold(domain, uri.Host)
+	}
+	if !allowed {
+		return nil, 403, fmt.Errorf("domain `%s` not allowed", uri.Host)
+	}
+	//the queries like the fops and saveas are not signed, nor the paths out of the prefixes
+	if uri.RawQuery != "" || uri.ForceQuery || uri.Fragment != "" {
+		return nil, 403, errors.New("url with query not allowed")
+	}
+	key := strings.TrimPrefix(uri.Path, "/")
+	if key == "" || path.Clean("/"+key) != "/"+key {
+		return nil, 400, fmt.Errorf("bad key `%s`", key)
+	}
+	allowed = false
+	for _, prefix := range client.SignPrefixes {
+		allowed = allowed || strings.HasPrefix(key, prefix)
+	}
+	if !allowed {
+		return nil, 403, fmt.Errorf("key `%s` not allowed", key)
+	}
+	entry.Deadline = time.Now().Unix() + expires
+	ret = map[string]interface{}{
+		"url":      PrivateUrl(s.mac, publicUrl, entry.Deadline),
+		"deadline": entry.Deadline,
+	}
+	return ret, 200, nil
+}
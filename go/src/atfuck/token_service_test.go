@@ -0,0 +1,128 @@
+package atfuck
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"qiniu/api.v6/fakeserver"
+	fio "qiniu/api.v6/io"
+	"qiniu/rpc"
+)
+
+func TestTokenService(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	SetZone(fakeserver.Region)
+
+	config := TokenServiceConfig{
+		Policies: map[string]*TokenPolicy{
+			"avatars": {Bucket: fakeBucket, Prefix: "avatars/", FsizeLimit: 10, MimeLimit: "image/*", Expires: 600},
+		},
+		Clients: map[string]*TokenClient{
+			"webapp": {ApiKey: "webapp-key", Policies: []string{"avatars"},
+				SignDomains: []string{"cdn.example.com"}, SignPrefixes: []string{"avatars/", "public/"}},
+			"other": {ApiKey: "other-key"},
+		},
+	}
+	var audit bytes.Buffer
+	service, err := NewTokenService(mac, config, &audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	call := func(apiKey, path string, args map[string]interface{}, status int) map[string]interface{} {
+		t.Helper()
+		body, _ := json.Marshal(args)
+		req, _ := http.NewRequest("POST", server.URL+path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		resp, dErr := http.DefaultClient.Do(req)
+		if dErr != nil {
+			t.Fatal(dErr)
+		}
+		defer resp.Body.Close()
+		var ret map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&ret)
+		if resp.StatusCode != status {
+			t.Fatalf("expect %d of %s %v, got %d %v", status, path, args, resp.StatusCode, ret)
+		}
+		return ret
+	}
+	put := func(token, key string, data []byte, mimeType string) error {
+		extra := &fio.PutExtra{MimeType: mimeType}
+		return fio.Put2(rpc.NewClient(""), nil, nil, token, key, bytes.NewReader(data), int64(len(data)), extra)
+	}
+
+	//any key in the prefix
+	ret := call("webapp-key", "/uptoken", map[string]interface{}{"policy": "avatars"}, 200)
+	token, _ := ret["token"].(string)
+	if ret["scope"] != fakeBucket+":avatars/" {
+		t.Fatalf("unexpected uptoken %v", ret)
+	}
+	if err = put(token, "avatars/a.png", []byte("png"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key, mimeType string
+		data          []byte
+	}{
+		{"other/a.png", "image/png", []byte("png")},
+		{"avatars/b.txt", "text/plain", []byte("txt")},
+		{"avatars/c.png", "image/png", []byte("too large png")},
+	} {
+		if pErr := put(token, c.key, c.data, c.mimeType); pErr == nil {
+			t.Fatalf("expect `%s` rejected by the token", c.key)
+		}
+	}
+	//the token of a key
+	ret = call("webapp-key", "/uptoken", map[string]interface{}{"policy": "avatars", "key": "avatars/d.png", "expires": 60}, 200)
+	if ret["scope"] != fakeBucket+":avatars/d.png" {
+		t.Fatalf("unexpected uptoken %v", ret)
+	}
+	if _, ok := srv.GetObject(fakeBucket, "avatars/a.png"); !ok {
+		t.Fatal("expect avatars/a.png uploaded")
+	}
+
+	call("webapp-key", "/uptoken", map[string]interface{}{"policy": "avatars", "key": "other/d.png"}, 400)
+	call("webapp-key", "/uptoken", map[string]interface{}{"policy": "avatars", "expires": 601}, 400)
+	call("other-key", "/uptoken", map[string]interface{}{"policy": "avatars"}, 403)
+	call("bad-key", "/uptoken", map[string]interface{}{"policy": "avatars"}, 401)
+
+	ret = call("webapp-key", "/sign", map[string]interface{}{"url": "http://cdn.example.com/avatars/a.png"}, 200)
+	if signed, _ := ret["url"].(string); !strings.HasPrefix(signed, "http://cdn.example.com/avatars/a.png?e=") ||
+		!strings.Contains(signed, "&token="+fakeAccessKey+":") {
+		t.Fatalf("unexpected signed url %v", ret)
+	}
+	call("webapp-key", "/sign", map[string]interface{}{"url": "http://evil.example.com/avatars/a.png"}, 403)
+	call("webapp-key", "/sign", map[string]interface{}{"url": "http://cdn.example.com/secret/a.png"}, 403)
+	call("webapp-key", "/sign", map[string]interface{}{"url": "http://cdn.example.com/avatars/a.png?saveas/abc"}, 403)
+	call("webapp-key", "/sign", map[string]interface{}{"url": "http://cdn.example.com/avatars/../secret/a.png"}, 400)
+	call("other-key", "/sign", map[string]interface{}{"url": "http://cdn.example.com/avatars/a.png"}, 403)
+
+	//the tokens are not in the audit log
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 12 || strings.Contains(audit.String(), token) {
+		t.Fatalf("unexpected audit log:\n%s", audit.String())
+	}
+	var entry TokenAuditEntry
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Client != "webapp" || entry.Action != "uptoken" || entry.Policy != "avatars" ||
+		entry.Scope != fakeBucket+":avatars/" || entry.Deadline == 0 || entry.Error != "" {
+		t.Fatalf("unexpected audit entry %+v", entry)
+	}
+	var denied TokenAuditEntry
+	if err = json.Unmarshal([]byte(lines[5]), &denied); err != nil || denied.Client != "" || denied.Error != "bad api key" {
+		t.Fatalf("expect the denied request in audit, got %+v", denied)
+	}
+
+	config.Clients["bad"] = &TokenClient{ApiKey: "bad-key", Policies: []string{"missing"}}
+	if _, err = NewTokenService(mac, config, nil); err == nil {
+		t.Fatal("expect the missing policy")
+	}
+}
@@ -3,6 +3,8 @@ package atfuck
 import (
 	"bufio"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func GetFileLineCount(filePath string) (totalCount int64) {
@@ -18,3 +20,22 @@ func GetFileLineCount(filePath string) (totalCount int64) {
 	}
 	return
 }
+
+//GetFileBytes sums the sizes in the column of the tab separated lines
+func GetFileBytes(filePath string, sizeColumn int) (totalBytes int64) {
+	fp, openErr := os.Open(filePath)
+	if openErr != nil {
+		return
+	}
+	defer fp.Close()
+
+	bScanner := bufio.NewScanner(fp)
+	for bScanner.Scan() {
+		items := strings.Split(bScanner.Text(), "\t")
+		if len(items) > sizeColumn {
+			size, _ := strconv.ParseInt(items[sizeColumn], 10, 64)
+			totalBytes += size
+		}
+	}
+	return
+}
@@ -0,0 +1,745 @@
+package atfuck
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"qiniu/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+)
+
+const (
+	DEFAULT_WEBDAV_CACHE_TTL = 10 * time.Second
+
+	davBatchSize = 1000
+)
+
+var (
+	errDavNotFound = errors.New("not found")
+	errDavExists   = errors.New("already exists")
+)
+
+//WebDAVConfig is the config of the WebDAV server in front of a bucket
+type WebDAVConfig struct {
+	Bucket   string            //the bucket served as the root folder
+	Users    map[string]string //the users and passwords of basic auth, no auth if empty
+	ReadOnly bool              //reject the methods which change the bucket
+	CacheTTL time.Duration     //how long the folder listings are cached, 10s by default
+	Domain   string            //the domain to download the files, the first domain of the bucket by default
+	IoHost   string            //the io host to download the files, the io host of the zone by default
+	TempDir  string            //the dir to keep the uploading bodies
+}
+
+//WebDAVServer maps the key prefixes of a bucket to folders, a folder created by MKCOL is kept as an empty `<dir>/` file
+type WebDAVServer struct {
+	*bucketProxy
+	config WebDAVConfig
+
+	lock    sync.Mutex
+	listing map[string]*davListing
+}
+
+type davListing struct {
+	files   []rsf.ListItem
+	dirs    []string
+	expires time.Time
+}
+
+//davInfo is a file or a folder in the responses
+type davInfo struct {
+	href     string
+	dir      bool
+	size     int64
+	mimeType string
+	hash     string
+	putTime  int64
+}
+
+func NewWebDAVServer(mac *digest.Mac, config WebDAVConfig) (s *WebDAVServer, err error) {
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DEFAULT_WEBDAV_CACHE_TTL
+	}
+	proxy, err := newBucketProxy(mac, config.Bucket, config.Domain, config.IoHost, config.TempDir)
+	if err != nil {
+		return
+	}
+	s = &WebDAVServer{
+		bucketProxy: proxy,
+		config:      config,
+		listing:     make(map[string]*davListing),
+	}
+	return
+}
+
+func davIsWrite(method string) bool {
+	switch method {
+	case "PUT", "DELETE", "MKCOL", "MOVE", "COPY", "PROPPATCH", "LOCK", "UNLOCK":
+		return true
+	}
+	return false
+}
+
+//davStatus maps the errors of the storage to the http status
+func davStatus(err error) int {
+	if err == errDavNotFound {
+		return 404
+	}
+	if err == errDavExists {
+		return 412
+	}
+	var info *rpc.ErrorInfo
+	if errors.As(err, &info) {
+		switch info.Code {
+		case 612, 631:
+			return 404
+		case 614:
+			return 412
+		case 401, 403:
+			return 403
+		case 400:
+			return 400
+		}
+	}
+	return 500
+}
+
+func davHref(name string, dir bool) string {
+	href := (&url.URL{Path: "/" + name}).EscapedPath()
+	if dir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func (s *WebDAVServer) authorized(req *http.Request) bool {
+	if len(s.config.Users) == 0 {
+		return true
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	expect, ok := s.config.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expect), []byte(password)) == 1
+}
+
+func (s *WebDAVServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="atfuck"`)
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	if s.config.ReadOnly && davIsWrite(req.Method) {
+		http.Error(w, "Read only", 403)
+		return
+	}
+
+	ctx := req.Context()
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	var err error
+	switch req.Method {
+	case "OPTIONS":
+		s.options(w)
+	case "PROPFIND":
+		err = s.propfind(ctx, w, req, name)
+	case "PROPPATCH":
+		err = s.proppatch(w, req, name)
+	case "GET", "HEAD":
+		err = s.get(ctx, w, req, name)
+	case "PUT":
+		err = s.put(ctx, w, req, name)
+	case "MKCOL":
+		err = s.mkcol(ctx, w, req, name)
+	case "DELETE":
+		err = s.delete(ctx, w, name)
+	case "MOVE", "COPY":
+		err = s.moveOrCopy(ctx, w, req, name)
+	case "LOCK":
+		s.lockResource(w, req)
+	case "UNLOCK":
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+	if err != nil {
+		status := davStatus(err)
+		if status >= 500 {
+			logs.Error("WebDAV %s `%s` error, %s", req.Method, name, err)
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+func (s *WebDAVServer) options(w http.ResponseWriter) {
+	allow := "OPTIONS, PROPFIND, GET, HEAD"
+	if !s.config.ReadOnly {
+		allow += ", PUT, DELETE, MKCOL, MOVE, COPY, PROPPATCH, LOCK, UNLOCK"
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(200)
+}
+
+// ----------------------------------------------------------
+
+func (s *WebDAVServer) invalidate() {
+	s.lock.Lock()
+	s.listing = make(map[string]*davListing)
+	s.lock.Unlock()
+}
+
+//listDir lists the files and the sub folders of the folder by the `/` delimiter, the listing is cached for a while
+func (s *WebDAVServer) listDir(ctx context.Context, prefix string) (listing *davListing, err error) {
+	s.lock.Lock()
+	listing, ok := s.listing[prefix]
+	s.lock.Unlock()
+	if ok && time.Now().Before(listing.expires) {
+		return
+	}
+
+	listing = &davListing{}
+	err = ListDirCtx(ctx, s.mac, s.bucket, prefix, davBatchSize, func(entries []rsf.ListItem, dirs []string) {
+		for _, entry := range entries {
+			//not the folder itself
+			if entry.Key != prefix {
+				listing.files = append(listing.files, entry)
+			}
+		}
+		for _, dir := range dirs {
+			listing.dirs = append(listing.dirs, dir[len(prefix):])
+		}
+	})
+	if err != nil {
+		return
+	}
+	listing.expires = time.Now().Add(s.config.CacheTTL)
+	s.lock.Lock()
+	s.listing[prefix] = listing
+	s.lock.Unlock()
+	return
+}
+
+//listAll lists all the files under the prefix, including the files of the sub folders
+func (s *WebDAVServer) listAll(ctx context.Context, prefix string, fn func(entry rsf.ListItem)) error {
+	client := rsf.New(s.mac)
+	client.Conn.Retry = listRetryPolicy
+	marker := ""
+	for {
+		entries, markerOut, err := client.ListPrefixCtx(ctx, nil, s.bucket, prefix, marker, davBatchSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for _, entry := range entries {
+			fn(entry)
+		}
+		if err == io.EOF || markerOut == "" {
+			return nil
+		}
+		marker = markerOut
+	}
+}
+
+//dirExists checks whether any file is under the folder
+func (s *WebDAVServer) dirExists(ctx context.Context, prefix string) (bool, error) {
+	entries, _, err := rsf.New(s.mac).ListPrefixCtx(ctx, nil, s.bucket, prefix, "", 1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+//stat finds the file or the folder of the name
+func (s *WebDAVServer) stat(ctx context.Context, name string) (info davInfo, err error) {
+	if name == "" {
+		return davInfo{href: "/", dir: true}, nil
+	}
+	entry, err := s.client.Stat(nil, s.bucket, name)
+	if err == nil {
+		return davInfo{
+			href:     davHref(name, false),
+			size:     entry.Fsize,
+			mimeType: entry.MimeType,
+			hash:     entry.Hash,
+			putTime:  entry.PutTime,
+		}, nil
+	}
+	if davStatus(err) != 404 {
+		return
+	}
+	exists, err := s.dirExists(ctx, name+"/")
+	if err == nil && !exists {
+		err = errDavNotFound
+	}
+	return davInfo{href: davHref(name, true), dir: true}, err
+}
+
+// ----------------------------------------------------------
+
+func writeDavProp(buf *bytes.Buffer, info davInfo) {
+	buf.WriteString("<D:response><D:href>")
+	xml.EscapeText(buf, []byte(info.href))
+	buf.WriteString("</D:href><D:propstat><D:prop><D:displayname>")
+	xml.EscapeText(buf, []byte(path.Base(strings.TrimSuffix(info.href, "/"))))
+	buf.WriteString("</D:displayname>")
+	if info.dir {
+		buf.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		buf.WriteString("<D:resourcetype/>")
+		fmt.Fprintf(buf, "<D:getcontentlength>%d</D:getcontentlength>", info.size)
+		buf.WriteString("<D:getcontenttype>")
+		xml.EscapeText(buf, []byte(info.mimeType))
+		buf.WriteString("</D:getcontenttype>")
+		fmt.Fprintf(buf, "<D:getetag>\"%s\"</D:getetag>", info.hash)
+	}
+	if info.putTime > 0 {
+		fmt.Fprintf(buf, "<D:getlastmodified>%s</D:getlastmodified>",
+			time.Unix(0, info.putTime*100).UTC().Format(http.TimeFormat))
+	}
+	buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+func writeMultiStatus(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)+len(`<D:multistatus xmlns:D="DAV:"></D:multistatus>`)))
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<D:multistatus xmlns:D="DAV:">`)
+	w.Write(body)
+	io.WriteString(w, `</D:multistatus>`)
+}
+
+//propfind returns all the properties of the resource, an infinite depth is served as depth 1
+func (s *WebDAVServer) propfind(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	io.Copy(ioutil.Discard, io.LimitReader(req.Body, 1<<20))
+	info, err := s.stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeDavProp(&buf, info)
+	if info.dir && req.Header.Get("Depth") != "0" {
+		prefix := ""
+		if name != "" {
+			prefix = name + "/"
+		}
+		listing, lErr := s.listDir(ctx, prefix)
+		if lErr != nil {
+			return lErr
+		}
+		for _, dir := range listing.dirs {
+			writeDavProp(&buf, davInfo{href: davHref(prefix+dir, true), dir: true})
+		}
+		for _, entry := range listing.files {
+			writeDavProp(&buf, davInfo{
+				href:     davHref(entry.Key, false),
+				size:     entry.Fsize,
+				mimeType: entry.MimeType,
+				hash:     entry.Hash,
+				putTime:  entry.PutTime,
+			})
+		}
+	}
+	writeMultiStatus(w, buf.Bytes())
+	return nil
+}
+
+//proppatch accepts the dead properties like the windows file times without saving them
+func (s *WebDAVServer) proppatch(w http.ResponseWriter, req *http.Request, name string) error {
+	var props []xml.Name
+	decoder := xml.NewDecoder(io.LimitReader(req.Body, 1<<20))
+	var stack []xml.Name
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return nil
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) > 0 && stack[len(stack)-1].Local == "prop" {
+				props = append(props, t.Name)
+			}
+			stack = append(stack, t.Name)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<D:response><D:href>")
+	xml.EscapeText(&buf, []byte(davHref(name, false)))
+	buf.WriteString("</D:href><D:propstat><D:prop>")
+	for i, prop := range props {
+		fmt.Fprintf(&buf, `<ns%d:%s xmlns:ns%d="`, i, prop.Local, i)
+		xml.EscapeText(&buf, []byte(prop.Space))
+		buf.WriteString(`"/>`)
+	}
+	buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+	writeMultiStatus(w, buf.Bytes())
+	return nil
+}
+
+//lockResource returns a lock token without locking, so the clients like finder and explorer may write
+func (s *WebDAVServer) lockResource(w http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, io.LimitReader(req.Body, 1<<20))
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := "opaquelocktoken:" + hex.EncodeToString(b)
+	body := xml.Header + `<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>` +
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:depth>infinity</D:depth><D:timeout>Second-3600</D:timeout>` +
+		`<D:locktoken><D:href>` + token + `</D:href></D:locktoken>` +
+		`</D:activelock></D:lockdiscovery></D:prop>`
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(200)
+	io.WriteString(w, body)
+}
+
+// ----------------------------------------------------------
+
+func (s *WebDAVServer) get(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	info, err := s.stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.dir {
+		return s.index(ctx, w, req, name)
+	}
+	if req.Method == "HEAD" {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.size, 10))
+		w.Header().Set("Content-Type", info.mimeType)
+		w.Header().Set("ETag", `"`+info.hash+`"`)
+		w.Header().Set("Last-Modified", time.Unix(0, info.putTime*100).UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(200)
+		return nil
+	}
+
+	resp, err := s.download(ctx, name, req.Header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Range", "ETag", "Last-Modified", "Accept-Ranges"} {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, cErr := io.Copy(w, resp.Body); cErr != nil {
+		logs.Error("WebDAV get `%s` error, %s", name, cErr)
+	}
+	return nil
+}
+
+//index lists the folder as a html page for the browsers
+func (s *WebDAVServer) index(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	listing, err := s.listDir(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<html><head><title>%s</title></head><body><h1>/%s</h1><ul>\n",
+		html.EscapeString(s.bucket), html.EscapeString(prefix))
+	if name != "" {
+		buf.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, dir := range listing.dirs {
+		fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a></li>\n", davHref(prefix+dir, true), html.EscapeString(dir))
+	}
+	for _, entry := range listing.files {
+		fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a> %d</li>\n", davHref(entry.Key, false),
+			html.EscapeString(entry.Key[len(prefix):]), entry.Fsize)
+	}
+	buf.WriteString("</ul></body></html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(200)
+	if req.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+	return nil
+}
+
+func (s *WebDAVServer) put(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	if name == "" || strings.HasSuffix(req.URL.Path, "/") {
+		http.Error(w, "Method not allowed", 405)
+		return nil
+	}
+	tmpFile, size, err := s.spool(req.Body, req.ContentLength)
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return nil
+	}
+	defer os.Remove(tmpFile)
+
+	_, sErr := s.client.Stat(nil, s.bucket, name)
+	if _, err = s.upload(ctx, name, tmpFile, size, req.Header.Get("Content-Type")); err != nil {
+		return err
+	}
+	s.invalidate()
+	if sErr == nil {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+	return nil
+}
+
+//mkcol creates the folder as an empty file with the `/` suffix
+func (s *WebDAVServer) mkcol(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	if req.ContentLength > 0 {
+		http.Error(w, "Unsupported media type", 415)
+		return nil
+	}
+	if _, err := s.stat(ctx, name); err == nil {
+		http.Error(w, "Method not allowed", 405)
+		return nil
+	} else if davStatus(err) != 404 {
+		return err
+	}
+	if parent := path.Dir(name); parent != "." {
+		if _, err := s.stat(ctx, parent); err != nil {
+			if davStatus(err) == 404 {
+				http.Error(w, "Conflict", 409)
+				return nil
+			}
+			return err
+		}
+	}
+
+	tmpFile, _, err := s.spool(strings.NewReader(""), 0)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	if _, err = s.upload(ctx, name+"/", tmpFile, 0, ""); err != nil {
+		return err
+	}
+	s.invalidate()
+	w.WriteHeader(201)
+	return nil
+}
+
+//batchFailures collects the keys failed in the batch operations
+func (s *WebDAVServer) batchFailures(rets []BatchItemRet, keys []string, failures map[string]int) {
+	for i, ret := range rets {
+		if ret.Code != 200 && i < len(keys) {
+			failures[keys[i]] = davStatus(&rpc.ErrorInfo{Code: ret.Code, Err: ret.Data.Error})
+		}
+	}
+}
+
+func (s *WebDAVServer) writeFailures(w http.ResponseWriter, failures map[string]int) {
+	keys := make([]string, 0, len(failures))
+	for key := range failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString("<D:response><D:href>")
+		xml.EscapeText(&buf, []byte(davHref(key, false)))
+		fmt.Fprintf(&buf, "</D:href><D:status>HTTP/1.1 %d %s</D:status></D:response>",
+			failures[key], http.StatusText(failures[key]))
+	}
+	writeMultiStatus(w, buf.Bytes())
+}
+
+func (s *WebDAVServer) delete(ctx context.Context, w http.ResponseWriter, name string) error {
+	if name == "" {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	err := s.client.Delete(nil, s.bucket, name)
+	if err == nil {
+		s.invalidate()
+		w.WriteHeader(204)
+		return nil
+	}
+	if davStatus(err) != 404 {
+		return err
+	}
+
+	var keys []string
+	if err = s.listAll(ctx, name+"/", func(entry rsf.ListItem) {
+		keys = append(keys, entry.Key)
+	}); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errDavNotFound
+	}
+	defer s.invalidate()
+	failures := make(map[string]int)
+	if err = s.deleteKeys(keys, failures); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		s.writeFailures(w, failures)
+		return nil
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+//deleteKeys deletes the keys by batches, the keys failed to delete are added to the failures
+func (s *WebDAVServer) deleteKeys(keys []string, failures map[string]int) error {
+	for start := 0; start < len(keys); start += davBatchSize {
+		end := start + davBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		entries := make([]rs.EntryPath, 0, end-start)
+		for _, key := range keys[start:end] {
+			entries = append(entries, rs.EntryPath{Bucket: s.bucket, Key: key})
+		}
+		rets, bErr := BatchDelete(s.client, entries)
+		if len(rets) == 0 && bErr != nil {
+			return bErr
+		}
+		s.batchFailures(rets, keys[start:end], failures)
+	}
+	return nil
+}
+
+//davDestination gets the name of the Destination header, which is on this server
+func davDestination(req *http.Request) (name string, ok bool) {
+	dest, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || dest.Path == "" || (dest.Host != "" && dest.Host != req.Host) {
+		return
+	}
+	name = strings.TrimPrefix(path.Clean("/"+dest.Path), "/")
+	return name, name != ""
+}
+
+//moveOrCopy moves or copies the file, or all the files of the folder in batches
+func (s *WebDAVServer) moveOrCopy(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) error {
+	dest, ok := davDestination(req)
+	if !ok || name == "" {
+		http.Error(w, "Bad destination", 400)
+		return nil
+	}
+	if dest == name || strings.HasPrefix(dest, name+"/") {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	overwrite := req.Header.Get("Overwrite") != "F"
+	info, err := s.stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	destInfo, dErr := s.stat(ctx, dest)
+	existed := dErr == nil
+	if existed && !overwrite {
+		return errDavExists
+	}
+	move := req.Method == "MOVE"
+	defer s.invalidate()
+
+	//an overwritten dest is deleted first, so the stale files under it are not merged into the result
+	if existed && (destInfo.dir || info.dir) {
+		var destKeys []string
+		if destInfo.dir {
+			if err = s.listAll(ctx, dest+"/", func(entry rsf.ListItem) {
+				destKeys = append(destKeys, entry.Key)
+			}); err != nil {
+				return err
+			}
+		} else {
+			destKeys = []string{dest}
+		}
+		failures := make(map[string]int)
+		if err = s.deleteKeys(destKeys, failures); err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			s.writeFailures(w, failures)
+			return nil
+		}
+	}
+
+	if !info.dir {
+		if move {
+			err = s.client.Move(nil, s.bucket, name, s.bucket, dest, overwrite)
+		} else {
+			err = s.client.Copy(nil, s.bucket, name, s.bucket, dest, overwrite)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		var keys []string
+		if err = s.listAll(ctx, name+"/", func(entry rsf.ListItem) {
+			keys = append(keys, entry.Key)
+		}); err != nil {
+			return err
+		}
+		failures := make(map[string]int)
+		for start := 0; start < len(keys); start += davBatchSize {
+			end := start + davBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			var rets []BatchItemRet
+			var bErr error
+			if move {
+				entries := make([]MoveEntryPath, 0, end-start)
+				for _, key := range keys[start:end] {
+					entries = append(entries, MoveEntryPath{s.bucket, s.bucket, key, dest + key[len(name):]})
+				}
+				rets, bErr = BatchMove(s.client, entries, overwrite)
+			} else {
+				entries := make([]CopyEntryPath, 0, end-start)
+				for _, key := range keys[start:end] {
+					entries = append(entries, CopyEntryPath{s.bucket, s.bucket, key, dest + key[len(name):]})
+				}
+				rets, bErr = BatchCopy(s.client, entries, overwrite)
+			}
+			if len(rets) == 0 && bErr != nil {
+				return bErr
+			}
+			s.batchFailures(rets, keys[start:end], failures)
+		}
+		if len(failures) > 0 {
+			s.writeFailures(w, failures)
+			return nil
+		}
+	}
+	if existed {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package atfuck
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDavClient struct {
+	t        *testing.T
+	endpoint string
+	user     string
+	password string
+}
+
+func (c *testDavClient) do(method, path, body string, header map[string]string) (resp *http.Response, data string) {
+	req, err := http.NewRequest(method, c.endpoint+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func (c *testDavClient) expect(status int, method, path, body string, header map[string]string) string {
+	resp, data := c.do(method, path, body, header)
+	if resp.StatusCode != status {
+		c.t.Fatalf("%s %s: expect status %d, got %d `%s`", method, path, status, resp.StatusCode, data)
+	}
+	return data
+}
+
+func TestWebDAVServer(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	for _, key := range []string{"docs/a.txt", "docs/sub/b.txt", "top.txt"} {
+		srv.PutObject(fakeBucket, key, []byte("data of "+key), "text/plain")
+	}
+	dav, err := NewWebDAVServer(mac, WebDAVConfig{
+		Bucket:   fakeBucket,
+		Users:    map[string]string{"ops": "secret"},
+		CacheTTL: time.Hour,
+		TempDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(dav)
+	defer httpSrv.Close()
+
+	anonymous := &testDavClient{t: t, endpoint: httpSrv.URL}
+	anonymous.expect(401, "PROPFIND", "/", "", nil)
+	client := &testDavClient{t: t, endpoint: httpSrv.URL, user: "ops", password: "secret"}
+
+	//folders by the key prefixes
+	data := client.expect(207, "PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	for _, href := range []string{"<D:href>/</D:href>", "<D:href>/docs/</D:href>", "<D:href>/top.txt</D:href>"} {
+		if !strings.Contains(data, href) {
+			t.Fatalf("expect %s in `%s`", href, data)
+		}
+	}
+	if strings.Contains(data, "a.txt") {
+		t.Fatalf("expect depth 1 only, got `%s`", data)
+	}
+	data = client.expect(207, "PROPFIND", "/docs/sub/b.txt", "", map[string]string{"Depth": "0"})
+	if !strings.Contains(data, "<D:getcontentlength>22</D:getcontentlength>") {
+		t.Fatalf("unexpected file props `%s`", data)
+	}
+	client.expect(404, "PROPFIND", "/missing", "", nil)
+
+	//the listing is cached until changed by the server
+	client.expect(207, "PROPFIND", "/docs/", "", nil)
+	srv.PutObject(fakeBucket, "docs/outside.txt", []byte("outside"), "")
+	if data = client.expect(207, "PROPFIND", "/docs/", "", nil); strings.Contains(data, "outside.txt") {
+		t.Fatal("expect the cached listing")
+	}
+
+	//read and write
+	if data = client.expect(200, "GET", "/top.txt", "", nil); data != "data of top.txt" {
+		t.Fatalf("unexpected content `%s`", data)
+	}
+	resp, data := client.do("GET", "/top.txt", "", map[string]string{"Range": "bytes=0-3"})
+	if resp.StatusCode != 206 || data != "data" {
+		t.Fatalf("unexpected range get, status %d `%s`", resp.StatusCode, data)
+	}
+	client.expect(201, "PUT", "/docs/new%20file.txt", "new content", nil)
+	client.expect(204, "PUT", "/docs/new%20file.txt", "newer content", nil)
+	if stored, _ := srv.GetObject(fakeBucket, "docs/new file.txt"); string(stored) != "newer content" {
+		t.Fatalf("unexpected stored content `%s`", stored)
+	}
+	if data = client.expect(207, "PROPFIND", "/docs/", "", nil); !strings.Contains(data, "outside.txt") {
+		t.Fatal("expect the listing refreshed after a change")
+	}
+
+	//folders
+	client.expect(201, "MKCOL", "/empty", "", nil)
+	client.expect(405, "MKCOL", "/empty", "", nil)
+	client.expect(409, "MKCOL", "/missing/child", "", nil)
+	if data = client.expect(207, "PROPFIND", "/", "", nil); !strings.Contains(data, "<D:href>/empty/</D:href>") {
+		t.Fatalf("expect the new folder, got `%s`", data)
+	}
+	if data = client.expect(207, "PROPFIND", "/empty", "", map[string]string{"Depth": "1"}); strings.Count(data, "<D:response>") != 1 {
+		t.Fatalf("expect the folder marker hidden, got `%s`", data)
+	}
+
+	client.expect(201, "COPY", "/top.txt", "", map[string]string{"Destination": httpSrv.URL + "/empty/top.txt"})
+	client.expect(412, "COPY", "/top.txt", "", map[string]string{"Destination": "/empty/top.txt", "Overwrite": "F"})
+	client.expect(201, "MOVE", "/docs", "", map[string]string{"Destination": "/archive/docs"})
+	for key, expect := range map[string]bool{"docs/a.txt": false, "archive/docs/a.txt": true, "archive/docs/sub/b.txt": true,
+		"empty/top.txt": true, "top.txt": true} {
+		if _, ok := srv.GetObject(fakeBucket, key); ok != expect {
+			t.Fatalf("expect `%s` exists to be %v", key, expect)
+		}
+	}
+	//the files of an overwritten folder are deleted, not merged
+	srv.PutObject(fakeBucket, "backup/stale.txt", []byte("stale"), "")
+	client.expect(204, "COPY", "/archive/docs", "", map[string]string{"Destination": "/backup", "Overwrite": "T"})
+	for key, expect := range map[string]bool{"backup/stale.txt": false, "backup/a.txt": true, "backup/sub/b.txt": true,
+		"archive/docs/a.txt": true} {
+		if _, ok := srv.GetObject(fakeBucket, key); ok != expect {
+			t.Fatalf("expect `%s` exists to be %v after the overwrite", key, expect)
+		}
+	}
+	client.expect(204, "DELETE", "/archive", "", nil)
+	client.expect(404, "DELETE", "/archive", "", nil)
+	if _, ok := srv.GetObject(fakeBucket, "archive/docs/sub/b.txt"); ok {
+		t.Fatal("expect the folder deleted")
+	}
+
+	//the clients lock before writing
+	resp, _ = client.do("LOCK", "/top.txt", "", nil)
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Lock-Token"), "<opaquelocktoken:") {
+		t.Fatalf("unexpected lock, status %d", resp.StatusCode)
+	}
+}
+
+func TestWebDAVServerReadOnly(t *testing.T) {
+	srv, mac := startFakeServer(t)
+	srv.PutObject(fakeBucket, "a.txt", []byte("a"), "")
+	dav, err := NewWebDAVServer(mac, WebDAVConfig{Bucket: fakeBucket, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(dav)
+	defer httpSrv.Close()
+
+	client := &testDavClient{t: t, endpoint: httpSrv.URL}
+	client.expect(207, "PROPFIND", "/", "", nil)
+	client.expect(200, "GET", "/a.txt", "", nil)
+	client.expect(403, "PUT", "/b.txt", "b", nil)
+	client.expect(403, "DELETE", "/a.txt", "", nil)
+	client.expect(403, "MOVE", "/a.txt", "", map[string]string{"Destination": "/c.txt"})
+	if _, ok := srv.GetObject(fakeBucket, "a.txt"); !ok {
+		t.Fatal("expect nothing changed in read only mode")
+	}
+}
@@ -1,15 +1,47 @@
 package atfuck
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/astaxie/beego/logs"
 	"qiniu/api.v6/conf"
 )
 
 type ZoneConfig struct {
-	UpHost    string
-	RsHost    string
-	RsfHost   string
-	IovipHost string
-	ApiHost   string
+	UpHost    string `json:"up_host"`
+	RsHost    string `json:"rs_host"`
+	RsfHost   string `json:"rsf_host"`
+	IovipHost string `json:"iovip_host"`
+	ApiHost   string `json:"api_host"`
+}
+
+/*
+Hosts config file like:
+
+{
+	"bucket_rs_host"	:	"http://127.0.0.1:9400",
+	"bucket_api_host"	:	"http://127.0.0.1:9500",
+	"bucket_uc_host"	:	"http://127.0.0.1:9600",
+	"zones"			:	{
+		"fake"	:	{
+			"up_host"	:	"http://127.0.0.1:9100",
+			"rs_host"	:	"http://127.0.0.1:9400",
+			"rsf_host"	:	"http://127.0.0.1:9300",
+			"iovip_host"	:	"http://127.0.0.1:9200",
+			"api_host"	:	"http://127.0.0.1:9500"
+		}
+	}
+}
+*/
+type HostsConfig struct {
+	BucketRsHost  string                `json:"bucket_rs_host,omitempty"`
+	BucketApiHost string                `json:"bucket_api_host,omitempty"`
+	BucketUcHost  string                `json:"bucket_uc_host,omitempty"`
+	Zones         map[string]ZoneConfig `json:"zones,omitempty"`
 }
 
 const (
@@ -53,7 +85,20 @@ var ZoneNA0Config = ZoneConfig{
 	ApiHost:   "http://api-na0.qiniu.com",
 }
 
+//zones registered at runtime, like a private deployment or a local test server
+var customZoneConfigs = map[string]ZoneConfig{}
+
+//RegisterZone adds the hosts of a zone or replaces the hosts of a builtin zone
+func RegisterZone(zone string, zoneConfig ZoneConfig) {
+	customZoneConfigs[zone] = zoneConfig
+}
+
 func SetZone(zone string) {
+	if zoneConfig, ok := customZoneConfigs[zone]; ok {
+		SetZoneConfig(zoneConfig)
+		return
+	}
+
 	var zoneConfig ZoneConfig
 	switch zone {
 	case ZoneBC:
@@ -65,6 +110,11 @@ func SetZone(zone string) {
 	default:
 		zoneConfig = ZoneNBConfig
 	}
+	SetZoneConfig(zoneConfig)
+}
+
+//SetZoneConfig points the sdk at the hosts of the zone config
+func SetZoneConfig(zoneConfig ZoneConfig) {
 	conf.UP_HOST = zoneConfig.UpHost
 	conf.RS_HOST = zoneConfig.RsHost
 	conf.RSF_HOST = zoneConfig.RsfHost
@@ -77,7 +127,44 @@ func IsValidZone(zone string) (valid bool) {
 	case ZoneNB, ZoneBC, ZoneHN, ZoneNA0:
 		valid = true
 	default:
-		valid = false
+		_, valid = customZoneConfigs[zone]
 	}
 	return
 }
+
+//LoadHostsConfig applies the hosts config file `.atfuck/hosts.json` under QShellRootPath if it exists
+func LoadHostsConfig() (err error) {
+	hostsFname := filepath.Join(QShellRootPath, ".atfuck", "hosts.json")
+	hostsData, readErr := ioutil.ReadFile(hostsFname)
+	if readErr != nil {
+		if !os.IsNotExist(readErr) {
+			err = fmt.Errorf("Read hosts file error, %s", readErr)
+		}
+		return
+	}
+
+	var hostsConfig HostsConfig
+	if umErr := json.Unmarshal(hostsData, &hostsConfig); umErr != nil {
+		err = fmt.Errorf("Parse hosts file error, %s", umErr)
+		return
+	}
+	SetHostsConfig(hostsConfig)
+
+	logs.Debug("Load hosts from %s", hostsFname)
+	return
+}
+
+func SetHostsConfig(hostsConfig HostsConfig) {
+	if hostsConfig.BucketRsHost != "" {
+		BUCKET_RS_HOST = hostsConfig.BucketRsHost
+	}
+	if hostsConfig.BucketApiHost != "" {
+		BUCKET_API_HOST = hostsConfig.BucketApiHost
+	}
+	if hostsConfig.BucketUcHost != "" {
+		BUCKET_UC_HOST = hostsConfig.BucketUcHost
+	}
+	for zone, zoneConfig := range hostsConfig.Zones {
+		RegisterZone(zone, zoneConfig)
+	}
+}
@@ -2,8 +2,12 @@ package cli
 
 import (
 	"atfuck"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"runtime"
 
 	"github.com/astaxie/beego/logs"
 	"qiniu/api.v6/auth/digest"
@@ -71,3 +75,233 @@ func GetDomainsOfBucket(cmd string, params ...string) {
 func GetFileFromBucket(cmd string, params ...string) {
 
 }
+
+func accountMac() *digest.Mac {
+	account, gErr := atfuck.GetAccount()
+	if gErr != nil {
+		fmt.Println(gErr)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	return &digest.Mac{AccessKey: account.AccessKey, SecretKey: []byte(account.SecretKey)}
+}
+
+//setupBucket loads the account and sets the zone of the bucket
+func setupBucket(bucket string) *digest.Mac {
+	mac := accountMac()
+
+	//get bucket zone info
+	bucketInfo, gErr := atfuck.GetBucketInfo(mac, bucket)
+	if gErr != nil {
+		fmt.Println("Get bucket region info error,", gErr)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	atfuck.SetZone(bucketInfo.Region)
+	return mac
+}
+
+//confirm asks to input a random code for a dangerous operation
+func confirm() bool {
+	rcode := CreateRandString(6)
+	rcode2 := ""
+	if runtime.GOOS == "windows" {
+		fmt.Print(fmt.Sprintf("<DANGER> Input %s to confirm operation: ", rcode))
+	} else {
+		fmt.Print(fmt.Sprintf("\033[31m<DANGER>\033[0m Input \033[32m%s\033[0m to confirm operation: ", rcode))
+	}
+	fmt.Scanln(&rcode2)
+	return rcode == rcode2
+}
+
+func bucketExit(desc string, err error) {
+	if err != nil {
+		fmt.Println(desc+" error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+func MakeBucket(cmd string, params ...string) {
+	if len(params) == 2 {
+		bucket := params[0]
+		region := params[1]
+		err := atfuck.CreateBucket(accountMac(), bucket, region)
+		bucketExit("Create bucket", err)
+		fmt.Printf("Bucket `%s` created in region `%s`\n", bucket, region)
+	} else {
+		CmdHelp(cmd)
+	}
+}
+
+func RemoveBucket(cmd string, params ...string) {
+	var force bool
+	flagSet := flag.NewFlagSet("rmbucket", flag.ExitOnError)
+	flagSet.BoolVar(&force, "force", false, "force mode")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) == 1 {
+		bucket := cmdParams[0]
+		mac := setupBucket(bucket)
+
+		//only an empty bucket can be deleted
+		empty, err := atfuck.IsBucketEmpty(mac, bucket)
+		bucketExit("List bucket", err)
+		if !empty {
+			fmt.Printf("Bucket `%s` is not empty, delete the files first\n", bucket)
+			os.Exit(atfuck.STATUS_ERROR)
+		}
+
+		if !force && !confirm() {
+			fmt.Println("Task quit!")
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		bucketExit("Delete bucket", atfuck.DropBucket(mac, bucket))
+		fmt.Printf("Bucket `%s` deleted\n", bucket)
+	} else {
+		CmdHelp(cmd)
+	}
+}
+
+func SetBucketAcl(cmd string, params ...string) {
+	if len(params) == 2 && (params[1] == "public" || params[1] == "private") {
+		bucket := params[0]
+		err := atfuck.SetBucketPrivate(accountMac(), bucket, params[1] == "private")
+		bucketExit("Set bucket acl", err)
+	} else {
+		CmdHelp(cmd)
+	}
+}
+
+func SetBucketPage(cmd string, params ...string) {
+	var index string
+	var notFound string
+	flagSet := flag.NewFlagSet("bucketpage", flag.ExitOnError)
+	flagSet.StringVar(&index, "index", "", "serve index.html for the dirs, on or off")
+	flagSet.StringVar(&notFound, "404", "", "key of the file to serve for the missing files")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 || (index == "" && notFound == "") || (index != "" && index != "on" && index != "off") {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := cmdParams[0]
+	mac := setupBucket(bucket)
+	if index != "" {
+		bucketExit("Set index page", atfuck.SetIndexPage(mac, bucket, index == "on"))
+	}
+	if notFound != "" {
+		bucketExit("Set 404 page", atfuck.SetNotFoundPage(mac, bucket, notFound))
+	}
+}
+
+func SetAntiLeech(cmd string, params ...string) {
+	var allowEmptyReferer bool
+	flagSet := flag.NewFlagSet("antileech", flag.ExitOnError)
+	flagSet.BoolVar(&allowEmptyReferer, "allow-empty-referer", false, "allow the requests without referer")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) >= 2 {
+		bucket := cmdParams[0]
+		antiLeech := atfuck.AntiLeech{
+			Mode:              cmdParams[1],
+			Patterns:          cmdParams[2:],
+			AllowEmptyReferer: allowEmptyReferer,
+		}
+		bucketExit("Set anti leech", atfuck.SetAntiLeech(accountMac(), bucket, antiLeech))
+	} else {
+		CmdHelp(cmd)
+	}
+}
+
+func BucketRule(cmd string, params ...string) {
+	var rule atfuck.LifecycleRule
+	flagSet := flag.NewFlagSet("bucketrule", flag.ExitOnError)
+	flagSet.IntVar(&rule.DeleteAfterDays, "delete-after-days", 0, "delete the files some days after uploaded")
+	flagSet.IntVar(&rule.ToLineAfterDays, "to-line-after-days", 0, "transit the files to low frequency storage some days after uploaded")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) < 2 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := cmdParams[0]
+	mac := accountMac()
+	switch op := cmdParams[1]; {
+	case op == "list" && len(cmdParams) == 2:
+		rules, err := atfuck.GetLifecycleRules(mac, bucket)
+		bucketExit("Get lifecycle rules", err)
+		for _, rule := range rules {
+			fmt.Printf("%s\t%s\tdelete_after_days: %d\tto_line_after_days: %d\n",
+				rule.Name, rule.Prefix, rule.DeleteAfterDays, rule.ToLineAfterDays)
+		}
+	case (op == "add" || op == "update") && (len(cmdParams) == 3 || len(cmdParams) == 4):
+		rule.Name = cmdParams[2]
+		if len(cmdParams) == 4 {
+			rule.Prefix = cmdParams[3]
+		}
+		if op == "add" {
+			bucketExit("Add lifecycle rule", atfuck.AddLifecycleRule(mac, bucket, rule))
+		} else {
+			bucketExit("Update lifecycle rule", atfuck.UpdateLifecycleRule(mac, bucket, rule))
+		}
+	case op == "delete" && len(cmdParams) == 3:
+		bucketExit("Delete lifecycle rule", atfuck.DeleteLifecycleRule(mac, bucket, cmdParams[2]))
+	default:
+		CmdHelp(cmd)
+	}
+}
+
+func BucketConfig(cmd string, params ...string) {
+	var force bool
+	flagSet := flag.NewFlagSet("bucketconfig", flag.ExitOnError)
+	flagSet.BoolVar(&force, "force", false, "force mode")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	switch {
+	case len(cmdParams) >= 2 && len(cmdParams) <= 3 && cmdParams[0] == "export":
+		bucket := cmdParams[1]
+		config, err := atfuck.GetBucketConfig(accountMac(), bucket)
+		bucketExit("Get bucket config", err)
+		configData, _ := json.MarshalIndent(config, "", "\t")
+		if len(cmdParams) == 3 {
+			if wErr := ioutil.WriteFile(cmdParams[2], append(configData, '\n'), 0644); wErr != nil {
+				fmt.Println("Write bucket config file error,", wErr)
+				os.Exit(atfuck.STATUS_ERROR)
+			}
+		} else {
+			fmt.Println(string(configData))
+		}
+	case len(cmdParams) >= 2 && len(cmdParams) <= 3 && cmdParams[0] == "import":
+		configData, rErr := ioutil.ReadFile(cmdParams[1])
+		if rErr != nil {
+			fmt.Println("Read bucket config file error,", rErr)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		var config atfuck.BucketConfig
+		if uErr := json.Unmarshal(configData, &config); uErr != nil {
+			fmt.Println("Parse bucket config file error,", uErr)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		bucket := config.Bucket
+		if len(cmdParams) == 3 {
+			bucket = cmdParams[2]
+		}
+		if bucket == "" {
+			fmt.Println("No bucket specified in the config file")
+			os.Exit(atfuck.STATUS_HALT)
+		}
+
+		//the lifecycle rules not in the config are deleted
+		if !force && !confirm() {
+			fmt.Println("Task quit!")
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		bucketExit("Apply bucket config", atfuck.ApplyBucketConfig(accountMac(), bucket, config))
+		fmt.Printf("Bucket config of `%s` applied\n", bucket)
+	default:
+		CmdHelp(cmd)
+	}
+}
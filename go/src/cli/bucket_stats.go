@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"atfuck"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func BucketStats(cmd string, params ...string) {
+	var opts atfuck.BucketStatsOptions
+	var top int
+	var jsonOutput bool
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.IntVar(&opts.Depth, "depth", 1, "depth of the dirs, 0 to skip the dir stats")
+	flagSet.StringVar(&opts.Delimiter, "delimiter", "/", "delimiter of the dirs")
+	flagSet.StringVar(&opts.TimeUnit, "by-time", atfuck.STATS_BY_MONTH, "put time unit, day or month")
+	flagSet.BoolVar(&opts.Duplicates, "dups", false, "find the files with the same hash")
+	flagSet.IntVar(&top, "top", 20, "max rows of each table, 0 for all")
+	flagSet.BoolVar(&jsonOutput, "json", false, "print the stats as json")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 && len(cmdParams) != 2 {
+		CmdHelp(cmd)
+		return
+	}
+	if opts.TimeUnit != atfuck.STATS_BY_DAY && opts.TimeUnit != atfuck.STATS_BY_MONTH {
+		fmt.Printf("Invalid put time unit `%s`, should be day or month\n", opts.TimeUnit)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	bucket := cmdParams[0]
+	prefix := ""
+	if len(cmdParams) == 2 {
+		prefix = cmdParams[1]
+	}
+
+	stats, err := atfuck.GetBucketStats(context.Background(), accountMac(), bucket, prefix, opts)
+	bucketExit("Get bucket stats", err)
+
+	if jsonOutput {
+		data, _ := json.MarshalIndent(stats, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Bucket\t%s\n", stats.Bucket)
+	fmt.Fprintf(w, "Prefix\t%s\n", stats.Prefix)
+	fmt.Fprintf(w, "Files\t%d\n", stats.Total.Count)
+	fmt.Fprintf(w, "Size\t%s\n", FormatFsize(stats.Total.Bytes))
+	if opts.Depth > 0 {
+		printStatsTable(w, "Dir", stats.ByDir, top)
+	}
+	printStatsTable(w, "MimeType", stats.ByMime, top)
+	printStatsTable(w, "FileType", stats.ByFileType, top)
+	printStatsTable(w, "PutTime", stats.ByPutTime, 0)
+	if opts.Duplicates {
+		var wasted int64
+		for _, dup := range stats.Duplicates {
+			wasted += dup.Wasted()
+		}
+		fmt.Fprintf(w, "\nDuplicates\t%d\t%s wasted\n", len(stats.Duplicates), FormatFsize(wasted))
+		for i, dup := range stats.Duplicates {
+			if top > 0 && i >= top {
+				fmt.Fprintf(w, "...\t%d more\n", len(stats.Duplicates)-top)
+				break
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d copies\n", dup.Hash, FormatFsize(dup.Fsize), len(dup.Keys))
+			for _, key := range dup.Keys {
+				fmt.Fprintf(w, "\t%s\n", key)
+			}
+		}
+	}
+	w.Flush()
+}
+
+func printStatsTable(w *tabwriter.Writer, title string, items []atfuck.StatsItem, top int) {
+	fmt.Fprintf(w, "\n%s\tFiles\tSize\n", title)
+	for i, item := range items {
+		if top > 0 && i >= top {
+			fmt.Fprintf(w, "...\t%d more\t\n", len(items)-top)
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", item.Name, item.Count, FormatFsize(item.Bytes))
+	}
+}
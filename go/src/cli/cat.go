@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"atfuck"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func Cat(cmd string, params ...string) {
+	var outFile string
+	var byteRange string
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&outFile, "o", "", "local file to save, stdout by default")
+	flagSet.StringVar(&byteRange, "range", "", "bytes from start to end (inclusive) of the file, like 0-1023 or 1024-")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 2 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket, key := cmdParams[0], cmdParams[1]
+	offset, length, rErr := parseByteRange(byteRange)
+	if rErr != nil {
+		fmt.Fprintln(os.Stderr, rErr)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	var w io.Writer = os.Stdout
+	if outFile != "" {
+		fp, err := os.Create(outFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Create local file error,", err)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		defer fp.Close()
+		w = fp
+	}
+	if err := atfuck.CatFileRange(context.Background(), accountMac(), bucket, key, offset, length, w); err != nil {
+		fmt.Fprintln(os.Stderr, "Cat error,", err)
+		if outFile != "" {
+			os.Remove(outFile)
+		}
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+//parseByteRange parses <Start>-[<End>] to the offset and the length, which is -1 to the end
+func parseByteRange(byteRange string) (offset, length int64, err error) {
+	length = -1
+	if byteRange == "" {
+		return
+	}
+	items := strings.SplitN(byteRange, "-", 2)
+	if len(items) != 2 {
+		err = fmt.Errorf("Invalid range `%s`", byteRange)
+		return
+	}
+	if offset, err = strconv.ParseInt(items[0], 10, 64); err != nil || offset < 0 {
+		err = fmt.Errorf("Invalid range start `%s`", items[0])
+		return
+	}
+	if items[1] != "" {
+		end, pErr := strconv.ParseInt(items[1], 10, 64)
+		if pErr != nil || end < offset {
+			err = fmt.Errorf("Invalid range end `%s`", items[1])
+			return
+		}
+		length = end - offset + 1
+	}
+	return
+}
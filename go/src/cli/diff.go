@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"atfuck"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"qiniu/api.v6/auth/digest"
+)
+
+func Diff(cmd string, params ...string) {
+	var opts atfuck.DiffOptions
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&opts.StripPrefix, "strip", "", "prefix stripped from the src keys, the src bucket prefix by default")
+	flagSet.StringVar(&opts.AddPrefix, "add", "", "prefix added to the src keys, the dest bucket prefix by default")
+	flagSet.BoolVar(&opts.SizeOnly, "size-only", false, "compare the size only")
+	flagSet.StringVar(&opts.MissingFile, "missing", "diff_missing.txt", "result file of the files missing in dest")
+	flagSet.StringVar(&opts.ExtraFile, "extra", "diff_extra.txt", "result file of the files only in dest")
+	flagSet.StringVar(&opts.ChangedFile, "changed", "diff_changed.txt", "result file of the files changed")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 2 {
+		CmdHelp(cmd)
+		return
+	}
+	src, err := atfuck.ParseDiffLocation(cmdParams[0])
+	if err != nil {
+		fmt.Println("Invalid src,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	dest, err := atfuck.ParseDiffLocation(cmdParams[1])
+	if err != nil {
+		fmt.Println("Invalid dest,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	//the account is only needed to list the buckets
+	var mac *digest.Mac
+	if src.Bucket != "" || dest.Bucket != "" {
+		mac = accountMac()
+	}
+	result, err := atfuck.Diff(context.Background(), mac, src, dest, opts)
+	bucketExit("Diff", err)
+
+	fmt.Printf("Diff `%s` with `%s`\n", src, dest)
+	fmt.Printf("Compared: %d, Same: %d\n", result.Compared, result.Same)
+	fmt.Printf("Missing:  %d, see `%s`\n", result.Missing, opts.MissingFile)
+	fmt.Printf("Extra:    %d, see `%s`\n", result.Extra, opts.ExtraFile)
+	fmt.Printf("Changed:  %d, see `%s`\n", result.Changed, opts.ChangedFile)
+	if !result.Equal() {
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
@@ -2,9 +2,20 @@ package cli
 
 import (
 	"atfuck"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"qiniu/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiniu/api.v6/fop"
 )
 
 func Prefop(cmd string, params ...string) {
@@ -26,3 +37,377 @@ func Prefop(cmd string, params ...string) {
 		CmdHelp(cmd)
 	}
 }
+
+type pfopOptions struct {
+	pipeline  string
+	notifyUrl string
+	force     bool
+	jobFile   string
+}
+
+func (this *pfopOptions) flagSet(cmd string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&this.pipeline, "pipeline", "", "pipeline to run the fops")
+	flagSet.StringVar(&this.notifyUrl, "notify-url", "", "url to notify the result")
+	flagSet.BoolVar(&this.force, "force", false, "overwrite the existing result files")
+	flagSet.StringVar(&this.jobFile, "job-file", "", "file to record the persistent ids")
+	return flagSet
+}
+
+//parseInterspersed allows the flags to appear after the params
+func parseInterspersed(flagSet *flag.FlagSet, params []string) (args []string) {
+	for {
+		flagSet.Parse(params)
+		params = flagSet.Args()
+		if len(params) == 0 {
+			return
+		}
+		args = append(args, params[0])
+		params = params[1:]
+	}
+}
+
+func pfopError(err error) string {
+	if v, ok := err.(*rpc.ErrorInfo); ok {
+		return fmt.Sprintf("%d %s", v.Code, v.Err)
+	}
+	return err.Error()
+}
+
+func Pfop(cmd string, params ...string) {
+	if len(params) > 0 && params[0] == "wait" {
+		PfopWait(cmd, params[1:]...)
+		return
+	}
+
+	var opts pfopOptions
+	params = parseInterspersed(opts.flagSet(cmd), params)
+	if len(params) != 3 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := params[0]
+	key := params[1]
+	fops := params[2]
+	if opts.jobFile == "" {
+		opts.jobFile = atfuck.DefaultPfopJobFile()
+	}
+
+	mac := setupBucket(bucket)
+	persistentId, err := atfuck.Pfop(mac, bucket, key, fops, opts.pipeline, opts.notifyUrl, opts.force)
+	if err != nil {
+		fmt.Println("Pfop error,", pfopError(err))
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	fmt.Println(persistentId)
+
+	job := atfuck.PfopJob{PersistentId: persistentId, Bucket: bucket, Key: key, Fops: fops}
+	if aErr := atfuck.AppendPfopJobs(opts.jobFile, job); aErr != nil {
+		fmt.Println(aErr)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+func BatchPfop(cmd string, params ...string) {
+	var opts pfopOptions
+	params = parseInterspersed(opts.flagSet(cmd), params)
+	if len(params) != 3 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := params[0]
+	keyListFile := params[1]
+	fops := params[2]
+	if opts.jobFile == "" {
+		opts.jobFile = atfuck.DefaultPfopJobFile()
+	}
+
+	mac := setupBucket(bucket)
+	fp, err := os.Open(keyListFile)
+	if err != nil {
+		fmt.Println("Open key list file error", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	defer fp.Close()
+
+	failureCount := 0
+	scanner := bufio.NewScanner(fp)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		key := strings.Split(scanner.Text(), "\t")[0]
+		if key == "" {
+			continue
+		}
+		persistentId, pErr := atfuck.Pfop(mac, bucket, key, fops, opts.pipeline, opts.notifyUrl, opts.force)
+		if pErr != nil {
+			failureCount++
+			fmt.Println(key + "\t" + pfopError(pErr))
+			continue
+		}
+		fmt.Println(key + "\t" + persistentId)
+
+		//record each job once submitted, so that an interrupted batch can still be waited for
+		job := atfuck.PfopJob{PersistentId: persistentId, Bucket: bucket, Key: key, Fops: fops}
+		if aErr := atfuck.AppendPfopJobs(opts.jobFile, job); aErr != nil {
+			fmt.Println(aErr)
+			os.Exit(atfuck.STATUS_ERROR)
+		}
+	}
+
+	if failureCount > 0 {
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+func PfopWait(cmd string, params ...string) {
+	var jobFile string
+	var timeout time.Duration
+	flagSet := flag.NewFlagSet("pfop wait", flag.ExitOnError)
+	flagSet.StringVar(&jobFile, "job-file", "", "file of the persistent ids to wait for")
+	flagSet.DurationVar(&timeout, "timeout", 0, "max time to wait, no limit by default")
+	persistentIds := parseInterspersed(flagSet, params)
+
+	//wait for the jobs not finished in the job file if no ids specified
+	fromJobFile := len(persistentIds) == 0
+	if fromJobFile {
+		if jobFile == "" {
+			jobFile = atfuck.DefaultPfopJobFile()
+		}
+		jobs, lErr := atfuck.LoadPfopJobs(jobFile)
+		if lErr != nil {
+			fmt.Println(lErr)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		for _, job := range jobs {
+			if !job.Finished() {
+				persistentIds = append(persistentIds, job.PersistentId)
+			}
+		}
+	}
+	if len(persistentIds) == 0 {
+		fmt.Println("No pfop to wait for")
+		return
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	statuses := make(map[string]string)
+	failed, err := atfuck.WaitPfop(ctx, persistentIds, atfuck.PFOP_WAIT_INTERVAL, atfuck.PFOP_WAIT_MAX_INTERVAL,
+		func(persistentId string, fopRet *atfuck.FopRet, err error) {
+			statuses[persistentId] = atfuck.PFOP_JOB_FAILED
+			if err != nil {
+				fmt.Printf("Prefop `%s` error, %s\n", persistentId, pfopError(err))
+				return
+			}
+			if fopRet.Code == atfuck.FOP_SUCCESS {
+				statuses[persistentId] = atfuck.PFOP_JOB_SUCCEEDED
+			}
+			fmt.Println(fopRet.String())
+		})
+	if err != nil {
+		fmt.Printf("Wait pfop error, %s, %d not finished\n", err, len(failed))
+	}
+	//the finished jobs are skipped by the next wait
+	if fromJobFile && len(statuses) > 0 {
+		if fErr := atfuck.FinishPfopJobs(jobFile, statuses); fErr != nil {
+			fmt.Println(fErr)
+		}
+	}
+	fmt.Printf("Pfop total: %d, success: %d, failure: %d\n", len(persistentIds), len(persistentIds)-len(failed), len(failed))
+	if len(failed) > 0 {
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+//the builders of the fop command, the info fops return json
+var fopBuilders = map[string]func() fop.Fop{
+	"imageView":      func() fop.Fop { return &fop.ImageView{} },
+	"imageView2":     func() fop.Fop { return &fop.ImageView2{} },
+	"imageMogr2":     func() fop.Fop { return &fop.ImageMogr2{} },
+	"watermarkImage": func() fop.Fop { return &fop.WatermarkImage{} },
+	"watermarkText":  func() fop.Fop { return &fop.WatermarkText{} },
+	"vframe":         func() fop.Fop { return &fop.Vframe{} },
+	"avthumb":        func() fop.Fop { return &fop.Avthumb{} },
+	"avinfo":         func() fop.Fop { return &fop.Avinfo{} },
+	"imageInfo":      func() fop.Fop { return &fop.ImageInfo{} },
+	"exif":           func() fop.Fop { return &fop.Exif{} },
+}
+
+var infoFops = map[string]bool{
+	"avinfo":    true,
+	"imageInfo": true,
+	"exif":      true,
+}
+
+//setFopField sets the field of the builder by its name, ignoring case
+func setFopField(builder fop.Fop, name, value string) (err error) {
+	v := reflect.ValueOf(builder).Elem()
+	field := v.FieldByNameFunc(func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	})
+	if !field.IsValid() {
+		return fmt.Errorf("unknown param `%s` of %s", name, v.Type().Name())
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, pErr := strconv.Atoi(value)
+		if pErr != nil {
+			return fmt.Errorf("invalid int value `%s` of `%s`", value, name)
+		}
+		field.SetInt(int64(i))
+	case reflect.Float64:
+		f, pErr := strconv.ParseFloat(value, 64)
+		if pErr != nil {
+			return fmt.Errorf("invalid float value `%s` of `%s`", value, name)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, pErr := strconv.ParseBool(value)
+		if pErr != nil {
+			return fmt.Errorf("invalid bool value `%s` of `%s`", value, name)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported param `%s`", name)
+	}
+	return
+}
+
+//buildFops parses `<FopName> [<Param>=<Value>...] [| <FopName> ...]`,
+//and reports whether the last fop returns json info
+func buildFops(args []string) (fops []fop.Fop, info bool, err error) {
+	var builder fop.Fop
+	for _, arg := range args {
+		if arg == "|" {
+			builder = nil
+			continue
+		}
+		if builder == nil {
+			newBuilder, ok := fopBuilders[arg]
+			if !ok {
+				err = fmt.Errorf("unknown fop `%s`", arg)
+				return
+			}
+			builder = newBuilder()
+			fops = append(fops, builder)
+			info = infoFops[arg]
+			continue
+		}
+		items := strings.SplitN(arg, "=", 2)
+		if len(items) != 2 {
+			err = fmt.Errorf("invalid fop param `%s`, should be <Param>=<Value>", arg)
+			return
+		}
+		if err = setFopField(builder, items[0], items[1]); err != nil {
+			return
+		}
+	}
+	if len(fops) == 0 {
+		err = errors.New("no fop specified")
+	}
+	return
+}
+
+func parseSaveas(saveas string) fop.Saveas {
+	items := strings.SplitN(saveas, ":", 2)
+	if len(items) == 2 {
+		return fop.Saveas{Bucket: items[0], Key: items[1]}
+	}
+	return fop.Saveas{Bucket: items[0]}
+}
+
+func Fop(cmd string, params ...string) {
+	var opts pfopOptions
+	var saveas string
+	var persistent bool
+	flagSet := opts.flagSet(cmd)
+	flagSet.StringVar(&saveas, "saveas", "", "save the result as <Bucket>[:<Key>]")
+	flagSet.BoolVar(&persistent, "pfop", false, "submit as a persistent fop")
+
+	//the fop params after the key are not flags
+	flagSet.Parse(params)
+	params = flagSet.Args()
+	if len(params) < 3 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := params[0]
+	key := params[1]
+	fops, info, err := buildFops(params[2:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	mac := setupBucket(bucket)
+	if persistent {
+		if saveas != "" {
+			fops = append(fops, parseSaveas(saveas))
+		}
+		fopsStr := fop.Pipe(fops...)
+		persistentId, pErr := atfuck.Pfop(mac, bucket, key, fopsStr, opts.pipeline, opts.notifyUrl, opts.force)
+		if pErr != nil {
+			fmt.Println("Pfop error,", pfopError(pErr))
+			os.Exit(atfuck.STATUS_ERROR)
+		}
+		fmt.Println(persistentId)
+
+		if opts.jobFile == "" {
+			opts.jobFile = atfuck.DefaultPfopJobFile()
+		}
+		job := atfuck.PfopJob{PersistentId: persistentId, Bucket: bucket, Key: key, Fops: fopsStr}
+		if aErr := atfuck.AppendPfopJobs(opts.jobFile, job); aErr != nil {
+			fmt.Println(aErr)
+			os.Exit(atfuck.STATUS_ERROR)
+		}
+		return
+	}
+
+	domains, dErr := atfuck.GetDomainsOfBucket(mac, bucket)
+	if dErr != nil || len(domains) == 0 {
+		fmt.Println("Get domain of bucket error,", dErr)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	//the fop url is signed for the private buckets, before the saveas signs it again
+	fopUrl := fop.MakeRequest(fmt.Sprintf("http://%s/%s", domains[0], key), fops...)
+	fopUrl = atfuck.PrivateUrl(mac, fopUrl, time.Now().Add(time.Hour).Unix())
+
+	//the result is either saved, or printed if it is json info, otherwise print the url to get it
+	if saveas != "" {
+		dest := parseSaveas(saveas)
+		saveasUrl, sErr := atfuck.Saveas(mac, fopUrl, dest.Bucket, dest.Key)
+		if sErr != nil {
+			fmt.Println("Saveas error,", sErr)
+			os.Exit(atfuck.STATUS_ERROR)
+		}
+		fopUrl = saveasUrl
+	} else if !info {
+		fmt.Println(fopUrl)
+		return
+	}
+
+	resp, gErr := rpc.DefaultClient.Get(nil, fopUrl)
+	if gErr == nil && resp.StatusCode/100 != 2 {
+		gErr = rpc.ResponseError(resp)
+		resp.Body.Close()
+	}
+	if gErr != nil {
+		fmt.Println("Fop error,", pfopError(gErr))
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	defer resp.Body.Close()
+	body, rErr := ioutil.ReadAll(resp.Body)
+	if rErr != nil {
+		fmt.Println("Read fop result error,", rErr)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	fmt.Println(string(body))
+}
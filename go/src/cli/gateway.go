@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"atfuck"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+func Gateway(cmd string, params ...string) {
+	if len(params) > 0 && params[0] == "s3" {
+		GatewayS3(cmd, params[1:]...)
+		return
+	}
+	CmdHelp(cmd)
+}
+
+func GatewayS3(cmd string, params ...string) {
+	var config atfuck.S3GatewayConfig
+	var listen, keysFile string
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&listen, "listen", "127.0.0.1:9000", "address to listen")
+	flagSet.StringVar(&config.Region, "region", atfuck.S3_DEFAULT_REGION, "region reported to the S3 clients")
+	flagSet.StringVar(&keysFile, "keys", "", "json file of the S3 access keys and secret keys, the account keys by default")
+	flagSet.StringVar(&config.Domain, "domain", "", "domain to download the files, the first domain of the bucket by default")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 {
+		CmdHelp(cmd)
+		return
+	}
+	config.Bucket = cmdParams[0]
+
+	mac := accountMac()
+	if keysFile != "" {
+		data, err := ioutil.ReadFile(keysFile)
+		if err == nil {
+			err = json.Unmarshal(data, &config.Keys)
+		}
+		if err != nil {
+			fmt.Println("Load keys file error,", err)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+	} else {
+		config.Keys = map[string]string{mac.AccessKey: string(mac.SecretKey)}
+	}
+
+	gw, err := atfuck.NewS3Gateway(mac, config)
+	if err != nil {
+		fmt.Println("Start S3 gateway error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	fmt.Printf("Serving bucket `%s` as S3 on http://%s\n", config.Bucket, listen)
+	if err = http.ListenAndServe(listen, gw); err != nil {
+		fmt.Println("S3 gateway error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
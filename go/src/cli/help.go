@@ -9,10 +9,11 @@ import (
 var version = "v2.0.9"
 
 var optionDocs = map[string]string{
-	"-f": "Force batch operations",
-	"-d": "Show debug message",
-	"-v": "Show version",
-	"-h": "Show help",
+	"-f":                   "Force batch operations",
+	"-d":                   "Show debug message",
+	"-v":                   "Show version",
+	"-h":                   "Show help",
+	"-metrics-addr <Addr>": "Serve the prometheus metrics at /metrics and the job status at /status",
 }
 
 var cmds = []string{
@@ -20,12 +21,23 @@ var cmds = []string{
 	"zone",
 	"dircache",
 	"listbucket",
+	"du",
+	"bucketstats",
+	"diff",
+	"lifecycle",
+	"gateway",
+	"serve",
 	"prefop",
+	"pfop",
+	"batchpfop",
+	"fop",
 	"fput",
 	"rput",
 	"qupload",
 	"qupload2",
 	"qdownload",
+	"cat",
+	"shell",
 	"stat",
 	"delete",
 	"move",
@@ -42,9 +54,17 @@ var cmds = []string{
 	"batchrename",
 	"batchsign",
 	"privateurl",
+	"uptoken",
 	"saveas",
 	"reqid",
 	"buckets",
+	"mkbucket",
+	"rmbucket",
+	"bucketacl",
+	"bucketpage",
+	"antileech",
+	"bucketrule",
+	"bucketconfig",
 	"domains",
 	"qetag",
 	"m3u8delete",
@@ -67,20 +87,31 @@ var cmdDocs = map[string][]string{
 	"account":       {"atfuck account [<AccessKey> <SecretKey>] [<Zone>]", "Get/Set AccessKey and SecretKey and Zone"},
 	"zone":          {"atfuck zone [<Zone>]", "Switch the zone, [nb, bc, hn, na0]"},
 	"dircache":      {"atfuck dircache <DirCacheRootPath> <DirCacheResultFile>", "Cache the directory structure of a file path"},
+	"du":            {"atfuck du [-depth <Depth>] [-delimiter <Delimiter>] [-by-time <day|month>] [-dups] [-top <N>] [-json] <Bucket> [<Prefix>]", "Count the files and bytes of the bucket by dir, mime type, file type and put time, and find the duplicate files"},
+	"bucketstats":   {"atfuck bucketstats [-depth <Depth>] [-delimiter <Delimiter>] [-by-time <day|month>] [-dups] [-top <N>] [-json] <Bucket> [<Prefix>]", "Count the files and bytes of the bucket by dir, mime type, file type and put time, and find the duplicate files"},
+	"diff":          {"atfuck diff [-strip <Prefix>] [-add <Prefix>] [-size-only] [-missing <File>] [-extra <File>] [-changed <File>] <qiniu://Bucket/Prefix|list://ListFile|LocalDir> <qiniu://Bucket/Prefix|list://ListFile|LocalDir>", "Compare the files of two locations by size and qetag, and write the missing, extra and changed files for batchcopy and batchdelete"},
+	"lifecycle":     {"atfuck lifecycle [-dry-run] [-force] [-checkpoint <CheckpointFile>] [-actions <ActionFile>] [-report <ReportFile>] <Bucket> <PolicyFile> [<Prefix>]", "Transit the files to the low frequency storage or delete them by the age rules of the json policy file, and estimate the saving"},
+	"gateway":       {"atfuck gateway s3 [-listen <Address>] [-region <Region>] [-keys <KeysFile>] [-domain <Domain>] <Bucket>", "Serve the bucket by a subset of the S3 REST API with SigV4 signatures, the keys file is a json object of the access keys and secret keys"},
+	"serve":         {"atfuck serve webdav [-listen <Address>] [-read-only] [-users <UsersFile>] [-cache-ttl <Duration>] [-domain <Domain>] <Bucket>\r\n       atfuck serve tokens [-listen <Address>] [-audit <AuditFile>] <ConfigFile>", "Serve the bucket as a WebDAV folder, the key prefixes are the sub folders, the users file is a json object of the basic auth users and passwords. Or serve the upload tokens of the policy templates and the signed download urls to the clients by their api keys, with an audit log of the issued tokens"},
 	"listbucket":    {"atfuck listbucket [-marker <ListMarker>] <Bucket> [<Prefix>] <ListBucketResultFile>", "List all the files in the bucket by prefix"},
 	"alilistbucket": {"atfuck alilistbucket <DataCenter> <Bucket> <AccessKeyId> <AccesskeySecret> [Prefix] <ListBucketResultFile>", "List all the file in the bucket of aliyun oss by prefix"},
 	"prefop":        {"atfuck prefop <PersistentId>", "Query the pfop status"},
+	"pfop":          {"atfuck pfop <Bucket> <Key> <Fops> [--pipeline <Pipeline>] [--notify-url <NotifyUrl>] [--force] [--job-file <JobFile>]\r\n       atfuck pfop wait [--job-file <JobFile>] [--timeout <Timeout>] [<PersistentId>...]", "Submit the persistent fops of a file in bucket, or wait for the submitted ones to finish"},
+	"fop":           {"atfuck fop [--saveas <Bucket>[:<Key>]] [--pfop] [--pipeline <Pipeline>] [--notify-url <NotifyUrl>] [--force] <Bucket> <Key> <FopName> [<Param>=<Value>...] [| <FopName> ...]", "Process a file in bucket by the fop builders, like imageView2, imageMogr2, watermarkText, avinfo, vframe and avthumb"},
+	"batchpfop":     {"atfuck batchpfop <Bucket> <KeyListFile> <Fops> [--pipeline <Pipeline>] [--notify-url <NotifyUrl>] [--force] [--job-file <JobFile>]", "Batch submit the persistent fops of the files in bucket"},
 	"fput":          {"atfuck fput <Bucket> <Key> <LocalFile> [<Overwrite>] [<MimeType>] [<UpHost>] [<FileType>]", "Form upload a local file"},
-	"rput":          {"atfuck rput <Bucket> <Key> <LocalFile> [<Overwrite>] [<MimeType>] [<UpHost>] [<FileType>]", "Resumable upload a local file"},
+	"rput":          {"atfuck rput [-v2] [-part-size <PartSize>] <Bucket> <Key> <LocalFile> [<Overwrite>] [<MimeType>] [<UpHost>] [<FileType>]", "Resumable upload a local file, or stdin if the local file is -"},
 	"qupload":       {"atfuck qupload [<ThreadCount>] <LocalUploadConfig>", "Batch upload files to the qiniu bucket"},
 	"qupload2":      {"atfuck qupload2 [options]", "Batch upload files to the qiniu bucket"},
 	"qdownload":     {"atfuck qdownload [<ThreadCount>] <LocalDownloadConfig>", "Batch download files from the qiniu bucket"},
+	"cat":           {"atfuck cat [-o <LocalFile>] [-range <Start>-[<End>]] <Bucket> <Key>", "Print the file or the byte range of it in bucket to stdout, the broken download is resumed, and the file packed by qupload is read from its pack by the index"},
+	"shell":         {"atfuck shell", "Start an interactive shell on the buckets with the current bucket and dir, the commands are ls, cd, stat, get, put, rm, mv, cp, sign and refresh, the keys are completed by tab from the listings and the deletions and overwrites are confirmed"},
 	"stat":          {"atfuck stat <Bucket> <Key>", "Get the basic info of a remote file"},
 	"delete":        {"atfuck delete <Bucket> <Key>", "Delete a remote file in the bucket"},
 	"move":          {"atfuck move [-overwrite] <SrcBucket> <SrcKey> <DestBucket> [<DestKey>]", "Move/Rename a file and save in bucket"},
 	"copy":          {"atfuck copy [-overwrite] <SrcBucket> <SrcKey> <DestBucket> [<DestKey>]", "Make a copy of a file and save in bucket"},
 	"chgm":          {"atfuck chgm <Bucket> <Key> <NewMimeType>", "Change the mimeType of a file"},
-	"sync":          {"atfuck sync <SrcResUrl> <Bucket> <Key> [<UpHostIp>]", "Sync big file to qiniu bucket"},
+	"sync":          {"atfuck sync [-v2] [-part-size <PartSize>] <SrcResUrl> <Bucket> <Key> [<UpHostIp>]", "Sync big file to qiniu bucket"},
 	"fetch":         {"atfuck fetch <RemoteResourceUrl> <Bucket> [<Key>]", "Fetch a remote resource by url and save in bucket"},
 	"prefetch":      {"atfuck prefetch <Bucket> <Key>", "Fetch and update the file in bucket using mirror storage"},
 	"batchstat":     {"atfuck batchstat <Bucket> <KeyListFile>", "Batch stat files in bucket"},
@@ -102,11 +133,19 @@ var cmdDocs = map[string][]string{
 	"qetag":         {"atfuck qetag <LocalFilePath>", "Calculate the hash of local file using the algorithm of qiniu qetag"},
 	"unzip":         {"atfuck unzip <QiniuZipFilePath> [<UnzipToDir>]", "Unzip the archive file created by the qiniu mkzip API"},
 	"privateurl":    {"atfuck privateurl <PublicUrl> [<Deadline>]", "Create private resource access url"},
+	"uptoken":       {"atfuck uptoken [-key <Key>] [-e <Seconds>] <PolicyFile>", "Create an upload token from the policy file, the same json as the policies of `serve tokens`"},
 	"saveas":        {"atfuck saveas <PublicUrlWithFop> <SaveBucket> <SaveKey>", "Create a resource access url with fop and saveas"},
 	"reqid":         {"atfuck reqid <ReqIdToDecode>", "Decode a qiniu reqid"},
 	"m3u8delete":    {"atfuck m3u8delete <Bucket> <M3u8Key>", "Delete m3u8 playlist and the slices it references"},
 	"m3u8replace":   {"atfuck m3u8replace <Bucket> <M3u8Key> [<NewDomain>]", "Replace m3u8 domain in the playlist"},
 	"buckets":       {"atfuck buckets", "Get all buckets of the account"},
+	"mkbucket":      {"atfuck mkbucket <Bucket> <Region>", "Create a bucket in the region, like z0, z1, z2 or na0"},
+	"rmbucket":      {"atfuck rmbucket [-force] <Bucket>", "Delete an empty bucket"},
+	"bucketacl":     {"atfuck bucketacl <Bucket> <public|private>", "Set the bucket public or private"},
+	"bucketpage":    {"atfuck bucketpage [-index <on|off>] [-404 <Key>] <Bucket>", "Set the default index page and the 404 page of the bucket"},
+	"antileech":     {"atfuck antileech [-allow-empty-referer] <Bucket> <off|whitelist|blacklist> [<RefererPattern>...]", "Set the referer anti-leech of the bucket"},
+	"bucketrule":    {"atfuck bucketrule <Bucket> list\r\n       atfuck bucketrule [-delete-after-days <Days>] [-to-line-after-days <Days>] <Bucket> <add|update> <RuleName> [<Prefix>]\r\n       atfuck bucketrule <Bucket> delete <RuleName>", "Manage the lifecycle rules of the bucket"},
+	"bucketconfig":  {"atfuck bucketconfig export <Bucket> [<ConfigFile>]\r\n       atfuck bucketconfig import [-force] <ConfigFile> [<Bucket>]", "Export or import the config of a bucket as json"},
 	"domains":       {"atfuck domains <Bucket>", "Get all domains of the bucket"},
 	"cdnrefresh":    {"atfuck cdnrefresh <UrlListFile>", "Batch refresh the cdn cache by the url list file"},
 	"cdnprefetch":   {"atfuck cdnprefetch <UrlListFile>", "Batch prefetch the urls in the url list file"},
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"atfuck"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+)
+
+func Lifecycle(cmd string, params ...string) {
+	var opts atfuck.LifecycleOptions
+	var force bool
+	var reportFile string
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.BoolVar(&opts.DryRun, "dry-run", false, "report the files to transit or delete without changing them")
+	flagSet.BoolVar(&force, "force", false, "force mode")
+	flagSet.StringVar(&opts.CheckpointFile, "checkpoint", "", "checkpoint file, under the atfuck root by default")
+	flagSet.StringVar(&opts.ActionFile, "actions", "", "file to write the actions of the files")
+	flagSet.StringVar(&reportFile, "report", "", "file to write the report as json")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 2 && len(cmdParams) != 3 {
+		CmdHelp(cmd)
+		return
+	}
+	bucket := cmdParams[0]
+	policyFile := cmdParams[1]
+	prefix := ""
+	if len(cmdParams) == 3 {
+		prefix = cmdParams[2]
+	}
+
+	policy, err := atfuck.LoadLifecyclePolicy(policyFile)
+	if err != nil {
+		fmt.Println("Load lifecycle policy error,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	if opts.CheckpointFile == "" {
+		opts.CheckpointFile = atfuck.DefaultLifecycleCheckpoint(bucket, prefix)
+	}
+	if !opts.DryRun && !force && !confirm() {
+		fmt.Println("Task quit!")
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	report, err := atfuck.ApplyLifecycle(context.Background(), accountMac(), bucket, prefix, policy, opts)
+	printLifecycleReport(report)
+	if reportFile != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if wErr := ioutil.WriteFile(reportFile, data, 0644); wErr != nil {
+			fmt.Println("Write report file error,", wErr)
+		}
+	}
+	if err != nil {
+		fmt.Println("Lifecycle error,", err)
+		if !opts.DryRun {
+			fmt.Printf("Run the command again to continue from the checkpoint `%s`\n", opts.CheckpointFile)
+		}
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	if report.Failed > 0 {
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+func printLifecycleReport(report atfuck.LifecycleReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if report.DryRun {
+		fmt.Fprintln(w, "Dry run, nothing is changed")
+	}
+	fmt.Fprintf(w, "Scanned\t%d\n", report.Scanned)
+	fmt.Fprintf(w, "Failed\t%d\n", report.Failed)
+	fmt.Fprintf(w, "\nRule\tToLine\tToLineSize\tDeleted\tDeletedSize\tSaving/Month\n")
+	for _, rule := range report.Rules {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%.2f\n", rule.Name, rule.ToLine.Count, FormatFsize(rule.ToLine.Bytes),
+			rule.Deleted.Count, FormatFsize(rule.Deleted.Bytes), rule.Saving)
+	}
+	fmt.Fprintf(w, "\nEstimated saving per month\t%.2f\n", report.Saving)
+	w.Flush()
+}
@@ -2,12 +2,14 @@ package cli
 
 import (
 	"atfuck"
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"qiniu/rpc"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"qiniu/api.v6/auth/digest"
@@ -163,6 +165,14 @@ func FormPut(cmd string, params ...string) {
 }
 
 func ResumablePut(cmd string, params ...string) {
+	var v2 bool
+	var partSize int64
+	flagSet := flag.NewFlagSet("rput", flag.ExitOnError)
+	flagSet.BoolVar(&v2, "v2", false, "use multipart upload (v2)")
+	flagSet.Int64Var(&partSize, "part-size", 0, "part size of the multipart upload, default 4MB")
+	flagSet.Parse(params)
+
+	params = flagSet.Args()
 	if len(params) >= 3 && len(params) <= 7 {
 		bucket := params[0]
 		key := params[1]
@@ -203,12 +213,22 @@ func ResumablePut(cmd string, params ...string) {
 			os.Exit(atfuck.STATUS_ERROR)
 		}
 
-		fStat, statErr := os.Stat(localFile)
-		if statErr != nil {
-			fmt.Println("Local file error", statErr)
+		//- reads from stdin, the size is known after the upload
+		fromStdin := localFile == "-"
+		if fromStdin && v2 {
+			fmt.Println("Upload from stdin is not supported with -v2")
 			os.Exit(atfuck.STATUS_ERROR)
 		}
-		fsize := fStat.Size()
+		var fsize, lastModified int64
+		if !fromStdin {
+			fStat, statErr := os.Stat(localFile)
+			if statErr != nil {
+				fmt.Println("Local file error", statErr)
+				os.Exit(atfuck.STATUS_ERROR)
+			}
+			fsize = fStat.Size()
+			lastModified = fStat.ModTime().Unix()
+		}
 
 		//upload settings
 		mac := digest.Mac{account.AccessKey, []byte(account.SecretKey)}
@@ -225,7 +245,6 @@ func ResumablePut(cmd string, params ...string) {
 		} else {
 			conf.UP_HOST = upHost
 		}
-		rio.SetSettings(&upSettings)
 
 		//create uptoken
 		policy := rs.PutPolicy{}
@@ -238,19 +257,15 @@ func ResumablePut(cmd string, params ...string) {
 		policy.Expires = 7 * 24 * 3600
 		policy.ReturnBody = `{"key":"$(key)","hash":"$(etag)","fsize":$(fsize),"mimeType":"$(mimeType)"}`
 
-		putExtra := rio.PutExtra{}
-		if mimeType != "" {
-			putExtra.MimeType = mimeType
-		}
-
-		progressHandler := ProgressHandler{
-			rwLock:  &sync.RWMutex{},
-			fsize:   fsize,
-			offsets: make(map[int]int64, 0),
+		onProgress := func(p rio.BlockProgress) {
+			if p.Fsize < 0 {
+				fmt.Printf("\rProgress: %s", FormatFsize(p.Uploaded))
+			} else {
+				fmt.Printf("\rProgress: %.2f%%", float64(p.Uploaded)/float64(p.Fsize)*100)
+			}
+			os.Stdout.Sync()
 		}
 
-		putExtra.Notify = progressHandler.Notify
-		putExtra.NotifyErr = progressHandler.NotifyErr
 		uptoken := policy.Token(&mac)
 
 		//start to upload
@@ -259,7 +274,39 @@ func ResumablePut(cmd string, params ...string) {
 
 		putClient := rio.NewClient(uptoken, "")
 		fmt.Printf("Uploading %s => %s : %s ...\n", localFile, bucket, key)
-		err := rio.PutFile(putClient, nil, &putRet, key, localFile, &putExtra)
+		uploader := rio.NewUploader(&upSettings)
+		var err error
+		if v2 {
+			//the parts uploaded are kept in the progress file until the upload succeeds, so that the upload
+			//of the same version of the file is resumed by running rput again
+			progressDir := filepath.Join(atfuck.QShellRootPath, ".atfuck", "rput")
+			absFile, _ := filepath.Abs(localFile)
+			progressFile := filepath.Join(progressDir, atfuck.Md5Hex(fmt.Sprintf("%s:%s|%s|%d|%d",
+				bucket, key, absFile, fsize, lastModified))+".v2")
+			if mErr := os.MkdirAll(progressDir, 0755); mErr != nil {
+				fmt.Println("Create progress dir error,", mErr)
+				os.Exit(atfuck.STATUS_ERROR)
+			}
+			putExtra := rio.PutExtraV2{
+				MimeType:     mimeType,
+				PartSize:     partSize,
+				ProgressFile: progressFile,
+				OnProgress:   onProgress,
+			}
+			err = uploader.PutFileV2(context.Background(), putClient, nil, &putRet, bucket, key, localFile, &putExtra)
+		} else {
+			putExtra := rio.PutExtra{
+				MimeType:   mimeType,
+				OnProgress: onProgress,
+			}
+			if fromStdin {
+				err = uploader.PutStream(context.Background(), putClient, nil, &putRet, key, os.Stdin, &putExtra)
+				fsize = putRet.Fsize
+			} else {
+				err = uploader.PutFile(context.Background(), putClient, nil, &putRet, key, localFile, &putExtra)
+			}
+		}
+		uploader.Close()
 		fmt.Println()
 		if err != nil {
 			if v, ok := err.(*rpc.ErrorInfo); ok {
@@ -285,28 +332,3 @@ func ResumablePut(cmd string, params ...string) {
 		CmdHelp(cmd)
 	}
 }
-
-type ProgressHandler struct {
-	rwLock  *sync.RWMutex
-	offsets map[int]int64
-	fsize   int64
-}
-
-func (this *ProgressHandler) Notify(blkIdx int, blkSize int, ret *rio.BlkputRet) {
-	this.rwLock.Lock()
-	defer this.rwLock.Unlock()
-
-	this.offsets[blkIdx] = int64(ret.Offset)
-	var uploaded int64
-	for _, offset := range this.offsets {
-		uploaded += offset
-	}
-
-	percent := fmt.Sprintf("\rProgress: %.2f%%", float64(uploaded)/float64(this.fsize)*100)
-	fmt.Print(percent)
-	os.Stdout.Sync()
-}
-
-func (this *ProgressHandler) NotifyErr(blkIdx int, blkSize int, err error) {
-
-}
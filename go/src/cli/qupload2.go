@@ -37,6 +37,15 @@ func QiniuUpload2(cmd string, params ...string) {
 	var logRotate int
 	var watchDir bool
 	var fileType int
+	var resumableApiV2 bool
+	var resumableApiV2PartSize int64
+	var encryptKeyFile string
+	var packThreshold int64
+	var packSize int64
+	var dedup bool
+	var dedupRescan bool
+	var dedupHashLayout bool
+	var dedupHashPrefix string
 
 	flagSet.Int64Var(&threadCount, "thread-count", 0, "multiple thread count")
 	flagSet.StringVar(&srcDir, "src-dir", "", "src dir to upload")
@@ -63,6 +72,15 @@ func QiniuUpload2(cmd string, params ...string) {
 	flagSet.IntVar(&logRotate, "log-rotate", 1, "log rotate days")
 	flagSet.BoolVar(&watchDir, "watch", false, "watch dir changes after upload completes")
 	flagSet.IntVar(&fileType, "filetype", 0, "Select storage filetype")
+	flagSet.BoolVar(&resumableApiV2, "resumable-api-v2", false, "use multipart upload (v2) for the chunk upload")
+	flagSet.Int64Var(&resumableApiV2PartSize, "resumable-api-v2-part-size", 0, "part size of the multipart upload, default 4MB")
+	flagSet.StringVar(&encryptKeyFile, "encrypt-key-file", "", "master key file to encrypt the files before upload")
+	flagSet.Int64Var(&packThreshold, "pack-threshold", 0, "pack the files smaller than the threshold into tar objects")
+	flagSet.Int64Var(&packSize, "pack-size", 0, "target size of the tar objects, default 64MB")
+	flagSet.BoolVar(&dedup, "dedup", false, "copy in bucket instead of upload the file of the same hash")
+	flagSet.BoolVar(&dedupRescan, "dedup-rescan", false, "rebuild the dedup index from the bucket list")
+	flagSet.BoolVar(&dedupHashLayout, "dedup-hash-layout", false, "store the files by the hashes and write the manifest")
+	flagSet.StringVar(&dedupHashPrefix, "dedup-hash-prefix", atfuck.DEFAULT_DEDUP_HASH_PREFIX, "key prefix of the hash layout")
 
 	flagSet.Parse(params)
 
@@ -90,6 +108,16 @@ func QiniuUpload2(cmd string, params ...string) {
 		LogLevel:         logLevel,
 		LogRotate:        logRotate,
 		FileType:         fileType,
+
+		ResumableApiV2:         resumableApiV2,
+		ResumableApiV2PartSize: resumableApiV2PartSize,
+		EncryptKeyFile:         encryptKeyFile,
+		PackThreshold:          packThreshold,
+		PackSize:               packSize,
+		Dedup:                  dedup,
+		DedupRescan:            dedupRescan,
+		DedupHashLayout:        dedupHashLayout,
+		DedupHashPrefix:        dedupHashPrefix,
 	}
 
 	//check params
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"atfuck"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+func Serve(cmd string, params ...string) {
+	if len(params) > 0 && params[0] == "webdav" {
+		ServeWebDAV(cmd, params[1:]...)
+		return
+	}
+	if len(params) > 0 && params[0] == "tokens" {
+		ServeTokens(cmd, params[1:]...)
+		return
+	}
+	CmdHelp(cmd)
+}
+
+func ServeWebDAV(cmd string, params ...string) {
+	var config atfuck.WebDAVConfig
+	var listen, usersFile string
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&listen, "listen", "127.0.0.1:8080", "address to listen")
+	flagSet.BoolVar(&config.ReadOnly, "read-only", false, "reject the changes to the bucket")
+	flagSet.StringVar(&usersFile, "users", "", "json file of the basic auth users and passwords")
+	flagSet.DurationVar(&config.CacheTTL, "cache-ttl", atfuck.DEFAULT_WEBDAV_CACHE_TTL, "how long the folder listings are cached")
+	flagSet.StringVar(&config.Domain, "domain", "", "domain to download the files, the first domain of the bucket by default")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 {
+		CmdHelp(cmd)
+		return
+	}
+	config.Bucket = cmdParams[0]
+	if usersFile != "" {
+		data, err := ioutil.ReadFile(usersFile)
+		if err == nil {
+			err = json.Unmarshal(data, &config.Users)
+		}
+		if err != nil {
+			fmt.Println("Load users file error,", err)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+	}
+
+	server, err := atfuck.NewWebDAVServer(accountMac(), config)
+	if err != nil {
+		fmt.Println("Start WebDAV server error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+	if len(config.Users) == 0 {
+		fmt.Println("Warning: no users file, the WebDAV server is open to anyone who can reach it")
+	}
+	fmt.Printf("Serving bucket `%s` as WebDAV on http://%s\n", config.Bucket, listen)
+	if err = http.ListenAndServe(listen, server); err != nil {
+		fmt.Println("WebDAV server error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
+
+func ServeTokens(cmd string, params ...string) {
+	var listen, auditFile string
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&listen, "listen", "127.0.0.1:8090", "address to listen")
+	flagSet.StringVar(&auditFile, "audit", "", "file to append the audit log, stdout by default")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 {
+		CmdHelp(cmd)
+		return
+	}
+	var config atfuck.TokenServiceConfig
+	data, err := ioutil.ReadFile(cmdParams[0])
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		fmt.Println("Load token service config error,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	audit := os.Stdout
+	if auditFile != "" {
+		audit, err = os.OpenFile(auditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Println("Open audit log error,", err)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+		defer audit.Close()
+	}
+	service, err := atfuck.NewTokenService(accountMac(), config, audit)
+	if err != nil {
+		fmt.Println("Start token service error,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	fmt.Fprintf(os.Stderr, "Serving %d policies for %d clients on http://%s\n", len(config.Policies), len(config.Clients), listen)
+	if err = http.ListenAndServe(listen, service); err != nil {
+		fmt.Println("Token service error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
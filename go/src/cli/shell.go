@@ -0,0 +1,19 @@
+package cli
+
+import (
+	"atfuck"
+	"fmt"
+	"os"
+)
+
+func Shell(cmd string, params ...string) {
+	if len(params) != 0 {
+		CmdHelp(cmd)
+		return
+	}
+	shell := atfuck.NewShell(accountMac(), os.Stdin, os.Stdout)
+	if err := shell.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Shell error,", err)
+		os.Exit(atfuck.STATUS_ERROR)
+	}
+}
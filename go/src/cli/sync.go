@@ -2,6 +2,7 @@ package cli
 
 import (
 	"atfuck"
+	"flag"
 	"fmt"
 	"os"
 	"time"
@@ -11,6 +12,14 @@ import (
 )
 
 func Sync(cmd string, params ...string) {
+	var v2 bool
+	var partSize int64
+	flagSet := flag.NewFlagSet("sync", flag.ExitOnError)
+	flagSet.BoolVar(&v2, "v2", false, "use multipart upload (v2)")
+	flagSet.Int64Var(&partSize, "part-size", 0, "part size of the multipart upload, default 4MB")
+	flagSet.Parse(params)
+
+	params = flagSet.Args()
 	if len(params) == 3 || len(params) == 4 {
 		srcResUrl := params[0]
 		bucket := params[1]
@@ -42,7 +51,13 @@ func Sync(cmd string, params ...string) {
 
 		//sync
 		tStart := time.Now()
-		syncRet, sErr := atfuck.Sync(&mac, srcResUrl, bucket, key, upHostIp)
+		var syncRet atfuck.PutRet
+		var sErr error
+		if v2 {
+			syncRet, sErr = atfuck.SyncV2(&mac, srcResUrl, bucket, key, upHostIp, partSize)
+		} else {
+			syncRet, sErr = atfuck.Sync(&mac, srcResUrl, bucket, key, upHostIp)
+		}
 		if sErr != nil {
 			logs.Error(sErr)
 			os.Exit(atfuck.STATUS_ERROR)
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"atfuck"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func UpToken(cmd string, params ...string) {
+	var key string
+	var expires int64
+	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flagSet.StringVar(&key, "key", "", "key of the token, any key in the prefix of the policy by default")
+	flagSet.Int64Var(&expires, "e", 0, "seconds of the token valid, the expires of the policy by default")
+	flagSet.Parse(params)
+
+	cmdParams := flagSet.Args()
+	if len(cmdParams) != 1 {
+		CmdHelp(cmd)
+		return
+	}
+	var tokenPolicy atfuck.TokenPolicy
+	data, err := ioutil.ReadFile(cmdParams[0])
+	if err == nil {
+		err = json.Unmarshal(data, &tokenPolicy)
+	}
+	if err != nil {
+		fmt.Println("Load policy file error,", err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	policy, err := tokenPolicy.PutPolicy(key, expires)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+	fmt.Println(policy.Token(accountMac()))
+}
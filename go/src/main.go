@@ -14,12 +14,34 @@ import (
 )
 
 var supportedCmds = map[string]cli.CliFunc{
-	"acc":        cli.Account,
-	"d":          cli.QiniuDownload,
-	"qetag":      cli.Qetag,
-	"unzip":      cli.Unzip,
-	"privateurl": cli.PrivateUrl,
-	"saveas":     cli.Saveas,
+	"acc":          cli.Account,
+	"d":            cli.QiniuDownload,
+	"qetag":        cli.Qetag,
+	"unzip":        cli.Unzip,
+	"privateurl":   cli.PrivateUrl,
+	"saveas":       cli.Saveas,
+	"prefop":       cli.Prefop,
+	"pfop":         cli.Pfop,
+	"batchpfop":    cli.BatchPfop,
+	"fop":          cli.Fop,
+	"buckets":      cli.GetBuckets,
+	"domains":      cli.GetDomainsOfBucket,
+	"mkbucket":     cli.MakeBucket,
+	"rmbucket":     cli.RemoveBucket,
+	"bucketacl":    cli.SetBucketAcl,
+	"bucketpage":   cli.SetBucketPage,
+	"antileech":    cli.SetAntiLeech,
+	"bucketrule":   cli.BucketRule,
+	"bucketconfig": cli.BucketConfig,
+	"du":           cli.BucketStats,
+	"bucketstats":  cli.BucketStats,
+	"diff":         cli.Diff,
+	"lifecycle":    cli.Lifecycle,
+	"gateway":      cli.Gateway,
+	"serve":        cli.Serve,
+	"cat":          cli.Cat,
+	"shell":        cli.Shell,
+	"uptoken":      cli.UpToken,
 }
 
 func main() {
@@ -43,11 +65,13 @@ func main() {
 	var versionMode bool
 	var multiUserMode bool
 	var unzip bool
+	var metricsAddr string
 	flag.BoolVar(&debugMode, "d", false, "debug mode")
 	flag.BoolVar(&multiUserMode, "m", false, "multi user mode")
 	flag.BoolVar(&helpMode, "h", false, "show help")
 	flag.BoolVar(&versionMode, "v", false, "show version")
 	flag.BoolVar(&unzip, "unzip", false, "unzip the file to")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve the metrics and status of the jobs on the address")
 	flag.Parse()
 
 	if helpMode {
@@ -84,6 +108,20 @@ func main() {
 		atfuck.QShellRootPath = curUser.HomeDir
 	}
 
+	//load custom hosts, like a private deployment
+	if hErr := atfuck.LoadHostsConfig(); hErr != nil {
+		fmt.Println("Error:", hErr)
+		os.Exit(atfuck.STATUS_HALT)
+	}
+
+	//serve the metrics of the long running jobs
+	if metricsAddr != "" {
+		if _, mErr := atfuck.StartMetricsServer(metricsAddr); mErr != nil {
+			fmt.Println("Error: start metrics server error,", mErr)
+			os.Exit(atfuck.STATUS_HALT)
+		}
+	}
+
 	//set cmd and params
 	args := flag.Args()
 	cmd := args[0]
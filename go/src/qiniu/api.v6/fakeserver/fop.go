@@ -0,0 +1,157 @@
+package fakeserver
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ----------------------------------------------------------
+// 持久化处理（pfop）不真正执行：任务在第一次查询时处于等待状态，之后完成。
+// 名为 fail 的处理指令失败，其它指令成功，指定了 saveas 的把源文件保存为结果。
+
+const (
+	fopCodeSucceeded = 0
+	fopCodeWaiting   = 1
+	fopCodeFailed    = 3
+)
+
+// FailFop is the fop command which always fails, like "fail/1" or "fail|saveas/..."
+const FailFop = "fail"
+
+type pfopJob struct {
+	id       string
+	bucket   string
+	key      string
+	pipeline string
+	fops     []string
+	queries  int
+	ret      map[string]interface{}
+}
+
+type fopResultItem struct {
+	Cmd   string `json:"cmd"`
+	Code  int    `json:"code"`
+	Desc  string `json:"desc"`
+	Error string `json:"error,omitempty"`
+	Hash  string `json:"hash,omitempty"`
+	Key   string `json:"key,omitempty"`
+}
+
+// runFop makes the result of one fop, the caller holds the lock of the store
+func (s *Server) runFop(job *pfopJob, fop string) fopResultItem {
+	item := fopResultItem{Cmd: fop, Code: fopCodeSucceeded, Desc: "The fop was completed successfully"}
+	cmd := fop
+	saveEntry := ""
+	if idx := strings.Index(fop, "|saveas/"); idx >= 0 {
+		cmd, saveEntry = fop[:idx], fop[idx+len("|saveas/"):]
+	}
+	if strings.SplitN(cmd, "/", 2)[0] == FailFop {
+		item.Code, item.Desc, item.Error = fopCodeFailed, "The fop is failed", "fop failed"
+		return item
+	}
+
+	b, err := s.store.bucket(job.bucket)
+	if err != nil {
+		item.Code, item.Desc, item.Error = fopCodeFailed, "The fop is failed", err.Error()
+		return item
+	}
+	src, ok := b.objects[job.key]
+	if !ok {
+		item.Code, item.Desc, item.Error = fopCodeFailed, "The fop is failed", errNoSuchFile.Error()
+		return item
+	}
+	item.Hash = src.hash
+	if saveEntry != "" {
+		saveBucket, saveKey, dErr := decodeEntry(saveEntry)
+		if dErr != nil {
+			item.Code, item.Desc, item.Error = fopCodeFailed, "The fop is failed", "invalid saveas"
+			return item
+		}
+		dest, bErr := s.store.bucket(saveBucket)
+		if bErr != nil {
+			item.Code, item.Desc, item.Error = fopCodeFailed, "The fop is failed", bErr.Error()
+			return item
+		}
+		dest.objects[saveKey] = newObject(saveKey, src.data, src.mimeType)
+		item.Key = saveKey
+	}
+	return item
+}
+
+func (s *Server) prefop(job *pfopJob) map[string]interface{} {
+	ret := map[string]interface{}{
+		"id":          job.id,
+		"inputBucket": job.bucket,
+		"inputKey":    job.key,
+		"pipeline":    job.pipeline,
+	}
+	job.queries++
+	if job.queries == 1 {
+		ret["code"], ret["desc"] = fopCodeWaiting, "The fop is waiting for processing"
+		return ret
+	}
+	if job.ret != nil {
+		return job.ret
+	}
+
+	code, desc := fopCodeSucceeded, "The fop was completed successfully"
+	items := make([]fopResultItem, 0, len(job.fops))
+	for _, fop := range job.fops {
+		item := s.runFop(job, fop)
+		if item.Code != fopCodeSucceeded {
+			code, desc = fopCodeFailed, "The fop is failed"
+		}
+		items = append(items, item)
+	}
+	ret["code"], ret["desc"], ret["items"] = code, desc, items
+	job.ret = ret
+	return ret
+}
+
+// fopHandle serves the pfop submission and the prefop status query on the api host
+func (s *Server) fopHandle(mux *http.ServeMux) {
+	mux.HandleFunc("/pfop/", func(w http.ResponseWriter, req *http.Request) {
+		body, err := s.readMacRequest(req)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("bucket") == "" || form.Get("key") == "" || form.Get("fops") == "" {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		job := &pfopJob{
+			id:       "z0." + randomId(),
+			bucket:   form.Get("bucket"),
+			key:      form.Get("key"),
+			pipeline: form.Get("pipeline"),
+			fops:     strings.Split(form.Get("fops"), ";"),
+		}
+
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		b, err := s.store.bucket(job.bucket)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if _, ok := b.objects[job.key]; !ok {
+			s.writeError(w, errNoSuchFile)
+			return
+		}
+		s.store.pfops[job.id] = job
+		s.writeJSON(w, 200, map[string]string{"persistentId": job.id})
+	})
+	mux.HandleFunc("/status/get/prefop", func(w http.ResponseWriter, req *http.Request) {
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		job, ok := s.store.pfops[req.URL.Query().Get("id")]
+		if !ok {
+			s.writeError(w, &apiError{612, "no such persistent id"})
+			return
+		}
+		s.writeJSON(w, 200, s.prefop(job))
+	})
+}
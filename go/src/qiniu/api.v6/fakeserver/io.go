@@ -0,0 +1,60 @@
+package fakeserver
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkDownloadToken verifies a private download url "http://<Domain>/<Key>?e=<Deadline>&token=<AccessKey>:<Sign>",
+// the request reaches IoHost with the bucket domain in its Host header
+func (s *Server) checkDownloadToken(req *http.Request) error {
+	idx := strings.LastIndex(req.RequestURI, "&token=")
+	if idx < 0 {
+		return errBadToken
+	}
+	items := strings.SplitN(req.URL.Query().Get("token"), ":", 2)
+	if len(items) != 2 || items[0] != s.AccessKey {
+		return errBadToken
+	}
+	if !s.checkSign(items[1], []byte("http://"+req.Host+req.RequestURI[:idx])) {
+		return errBadToken
+	}
+	deadline, err := strconv.ParseInt(req.URL.Query().Get("e"), 10, 64)
+	if err != nil || deadline < time.Now().Unix() {
+		return errTokenExpired
+	}
+	return nil
+}
+
+func (s *Server) ioHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			s.writeError(w, &apiError{405, "method not allowed"})
+			return
+		}
+		bucketName, b, err := s.store.bucketOfDomain(req.Host)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if b.private || req.URL.Query().Get("token") != "" {
+			if err = s.checkDownloadToken(req); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		o, err := s.store.stat(bucketName, strings.TrimPrefix(req.URL.Path, "/"))
+		if err != nil {
+			s.writeError(w, &apiError{404, "Document not found"})
+			return
+		}
+		w.Header().Set("Content-Type", o.mimeType)
+		w.Header().Set("ETag", `"`+o.hash+`"`)
+		w.Header().Set("X-Reqid", s.newReqId())
+		http.ServeContent(w, req, "", time.Unix(0, o.putTime*100), bytes.NewReader(o.data))
+	})
+}
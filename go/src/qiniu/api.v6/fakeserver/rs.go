@@ -0,0 +1,240 @@
+package fakeserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"qiniu/api.v6/rsf"
+)
+
+// ----------------------------------------------------------
+
+type batchItemRet struct {
+	Code int         `json:"code"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// rsOp runs one rs operation like "/stat/<EncodedEntry>", it is shared by the single and batch requests
+func (s *Server) rsOp(op string) (ret interface{}, err error) {
+	items := strings.Split(strings.TrimPrefix(op, "/"), "/")
+	if len(items) < 2 {
+		return nil, errInvalidArgs
+	}
+	bucket, key, err := decodeEntry(items[1])
+	if err != nil {
+		return
+	}
+
+	switch items[0] {
+	case "stat":
+		o, sErr := s.store.stat(bucket, key)
+		if sErr != nil {
+			return nil, sErr
+		}
+		return o.entry(), nil
+	case "delete":
+		return nil, s.store.remove(bucket, key)
+	case "move", "copy":
+		if len(items) < 3 {
+			return nil, errInvalidArgs
+		}
+		destBucket, destKey, dErr := decodeEntry(items[2])
+		if dErr != nil {
+			return nil, dErr
+		}
+		force := len(items) >= 5 && items[3] == "force" && items[4] == "true"
+		return nil, s.store.copy(bucket, key, destBucket, destKey, force, items[0] == "move")
+	case "chgm":
+		if len(items) < 4 || items[2] != "mime" {
+			return nil, errInvalidArgs
+		}
+		mimeType, dErr := base64.URLEncoding.DecodeString(items[3])
+		if dErr != nil {
+			return nil, errInvalidArgs
+		}
+		return nil, s.store.changeMime(bucket, key, string(mimeType))
+	case "chtype":
+		if len(items) < 4 || items[2] != "type" {
+			return nil, errInvalidArgs
+		}
+		fileType, pErr := strconv.Atoi(items[3])
+		if pErr != nil || fileType < 0 || fileType > 1 {
+			return nil, errInvalidArgs
+		}
+		return nil, s.store.changeType(bucket, key, fileType)
+	}
+	return nil, errInvalidArgs
+}
+
+func (s *Server) rsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		ret, err := s.rsOp(req.URL.Path)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeJSON(w, 200, ret)
+	})
+	mux.HandleFunc("/batch", func(w http.ResponseWriter, req *http.Request) {
+		body, err := s.readMacRequest(req)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+
+		code := 200
+		rets := make([]batchItemRet, 0, len(form["op"]))
+		for _, op := range form["op"] {
+			ret, opErr := s.rsOp(op)
+			if opErr != nil {
+				e, ok := opErr.(*apiError)
+				if !ok {
+					e = &apiError{599, opErr.Error()}
+				}
+				rets = append(rets, batchItemRet{Code: e.code, Data: map[string]string{"error": e.msg}})
+				// partial failures of a batch are reported with 298
+				code = 298
+				continue
+			}
+			rets = append(rets, batchItemRet{Code: 200, Data: ret})
+		}
+		s.writeJSON(w, code, rets)
+	})
+	mux.HandleFunc("/bucket/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.store.mu.RLock()
+		b, err := s.store.bucket(strings.TrimPrefix(req.URL.Path, "/bucket/"))
+		s.store.mu.RUnlock()
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeJSON(w, 200, map[string]string{"region": b.region})
+	})
+	// /mkbucketv2/<EncodedBucket>/region/<Region>
+	mux.HandleFunc("/mkbucketv2/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		items := strings.Split(strings.TrimPrefix(req.URL.Path, "/mkbucketv2/"), "/")
+		name, dErr := base64.URLEncoding.DecodeString(items[0])
+		if dErr != nil || len(name) == 0 || (len(items) != 1 && (len(items) != 3 || items[1] != "region")) {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		region := Region
+		if len(items) == 3 {
+			region = items[2]
+		}
+
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		if _, ok := s.store.buckets[string(name)]; ok {
+			s.writeError(w, errBucketExists)
+			return
+		}
+		s.store.buckets[string(name)] = s.newBucket(string(name), region, false)
+		s.writeJSON(w, 200, nil)
+	})
+	mux.HandleFunc("/drop/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, "/drop/")
+
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		if _, err := s.store.bucket(name); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		delete(s.store.buckets, name)
+		s.writeJSON(w, 200, nil)
+	})
+	mux.HandleFunc("/buckets", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeJSON(w, 200, s.store.bucketNames())
+	})
+	return mux
+}
+
+// ----------------------------------------------------------
+
+func (s *Server) rsfHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.readMacRequest(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		query := req.URL.Query()
+		limit := 0
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			limit = n
+		}
+
+		items, commonPrefixes, marker, err := s.store.list(query.Get("bucket"), query.Get("prefix"),
+			query.Get("delimiter"), query.Get("marker"), limit)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeJSON(w, 200, rsf.ListRet{Marker: marker, Items: items, CommonPrefixes: commonPrefixes})
+	})
+	return mux
+}
+
+// ----------------------------------------------------------
+
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v6/domain/list", func(w http.ResponseWriter, req *http.Request) {
+		body, err := s.readMacRequest(req)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+
+		s.store.mu.RLock()
+		b, err := s.store.bucket(form.Get("tbl"))
+		s.store.mu.RUnlock()
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeJSON(w, 200, []string{b.domain})
+	})
+	s.fopHandle(mux)
+	return mux
+}
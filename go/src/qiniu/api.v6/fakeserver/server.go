@@ -0,0 +1,293 @@
+// Package fakeserver runs an in-process emulation of the storage APIs used by this project,
+// so that the sdk, atfuck and cli code can be tested offline.
+//
+// Every host (up, rs, rsf, io, api and uc) is a separate local listener on top of one in-memory
+// object store. Requests are authenticated with the access key and secret key of the server:
+//
+//	srv := fakeserver.New("ak", "sk")
+//	defer srv.Close()
+//	defer srv.Use()()
+//	srv.CreateBucket("test", false)
+package fakeserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"qiniu/api.v6/auth/digest"
+	"qiniu/api.v6/conf"
+	"qiniu/api.v6/rs"
+)
+
+// Region is the region of the buckets, unless created in another region by mkbucketv2
+const Region = "fake"
+
+type Server struct {
+	AccessKey string
+	SecretKey string
+
+	UpHost  string
+	RsHost  string
+	RsfHost string
+	IoHost  string
+	ApiHost string
+	UcHost  string
+
+	store   *store
+	reqId   int64
+	servers []*httptest.Server
+}
+
+func New(accessKey, secretKey string) *Server {
+	s := &Server{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		store:     newStore(),
+	}
+	s.UpHost = s.start(s.upHandler())
+	s.RsHost = s.start(s.rsHandler())
+	s.RsfHost = s.start(s.rsfHandler())
+	s.IoHost = s.start(s.ioHandler())
+	s.ApiHost = s.start(s.apiHandler())
+	s.UcHost = s.start(s.ucHandler())
+	return s
+}
+
+func (s *Server) start(h http.Handler) string {
+	srv := httptest.NewServer(h)
+	s.servers = append(s.servers, srv)
+	return srv.URL
+}
+
+func (s *Server) Close() {
+	for _, srv := range s.servers {
+		srv.Close()
+	}
+}
+
+func (s *Server) Mac() *digest.Mac {
+	return &digest.Mac{AccessKey: s.AccessKey, SecretKey: []byte(s.SecretKey)}
+}
+
+// Use points the hosts and the default keys of qiniu/api.v6/conf at the server,
+// the returned func restores the previous values
+func (s *Server) Use() (restore func()) {
+	up, rsHost, rsf, io, api := conf.UP_HOST, conf.RS_HOST, conf.RSF_HOST, conf.IO_HOST, conf.API_HOST
+	ak, sk := conf.ACCESS_KEY, conf.SECRET_KEY
+
+	conf.UP_HOST = s.UpHost
+	conf.RS_HOST = s.RsHost
+	conf.RSF_HOST = s.RsfHost
+	conf.IO_HOST = s.IoHost
+	conf.API_HOST = s.ApiHost
+	conf.ACCESS_KEY = s.AccessKey
+	conf.SECRET_KEY = s.SecretKey
+
+	return func() {
+		conf.UP_HOST, conf.RS_HOST, conf.RSF_HOST, conf.IO_HOST, conf.API_HOST = up, rsHost, rsf, io, api
+		conf.ACCESS_KEY, conf.SECRET_KEY = ak, sk
+	}
+}
+
+// FailParts makes the part uploads of the multipart uploads fail after n more parts are uploaded,
+// a negative n stops the failures
+func (s *Server) FailParts(n int) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.partsToFail = n
+}
+
+// PartsUploaded returns the number of the parts uploaded by the multipart uploads
+func (s *Server) PartsUploaded() int {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+	return s.store.partsUploaded
+}
+
+// ----------------------------------------------------------
+
+// CreateBucket adds an empty bucket, downloads from a private bucket require a signed url
+func (s *Server) CreateBucket(name string, private bool) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if _, ok := s.store.buckets[name]; ok {
+		return
+	}
+	s.store.buckets[name] = s.newBucket(name, Region, private)
+}
+
+func (s *Server) newBucket(name, region string, private bool) *bucket {
+	return &bucket{
+		private: private,
+		domain:  s.Domain(name),
+		objects: make(map[string]*object),
+		region:  region,
+	}
+}
+
+// Domain is the download domain of the bucket, requests to IoHost with this Host header read the bucket
+func (s *Server) Domain(bucket string) string {
+	return bucket + ".fake.clouddn.com"
+}
+
+// PutObject saves data under bucket:key, replacing an existing file, and returns its hash
+func (s *Server) PutObject(bucket, key string, data []byte, mimeType string) (hash string, err error) {
+	o := newObject(key, data, mimeType)
+	if err = s.store.put(bucket, key, o, true); err != nil {
+		return
+	}
+	return o.hash, nil
+}
+
+func (s *Server) GetObject(bucket, key string) (data []byte, ok bool) {
+	o, err := s.store.stat(bucket, key)
+	if err != nil {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// SetPutTime changes the put time of an existing file, for the tests of the files by age
+func (s *Server) SetPutTime(bucket, key string, putTime time.Time) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	b, err := s.store.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchFile
+	}
+	o1 := *o
+	o1.putTime = putTime.UnixNano() / 100
+	b.objects[key] = &o1
+	return nil
+}
+
+// ----------------------------------------------------------
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, ret interface{}) {
+	w.Header().Set("X-Reqid", s.newReqId())
+	if ret == nil {
+		w.WriteHeader(code)
+		return
+	}
+	data, err := json.Marshal(ret)
+	if err != nil {
+		code, data = 599, []byte(`{"error":"marshal response failed"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = &apiError{599, err.Error()}
+	}
+	s.writeJSON(w, e.code, map[string]string{"error": e.msg})
+}
+
+func (s *Server) newReqId() string {
+	return "fake" + strconv.FormatInt(atomic.AddInt64(&s.reqId, 1), 10)
+}
+
+func (s *Server) sign(data []byte) []byte {
+	h := hmac.New(sha1.New, []byte(s.SecretKey))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// checkSign compares a base64 hmac-sha1 of data, the padding may be omitted as in digest.Mac.Sign
+func (s *Server) checkSign(encodedSign string, data []byte) bool {
+	sign, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedSign, "="))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sign, s.sign(data))
+}
+
+// checkMac verifies the "QBox <AccessKey>:<Sign>" authorization of a management request,
+// the body is part of the signature for form requests
+func (s *Server) checkMac(req *http.Request, body []byte) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "QBox ") {
+		return errBadToken
+	}
+	items := strings.SplitN(strings.TrimPrefix(auth, "QBox "), ":", 2)
+	if len(items) != 2 || items[0] != s.AccessKey {
+		return errBadToken
+	}
+
+	data := req.URL.Path
+	if req.URL.RawQuery != "" {
+		data += "?" + req.URL.RawQuery
+	}
+	data += "\n"
+	if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		data += string(body)
+	}
+	if !s.checkSign(items[1], []byte(data)) {
+		return errBadToken
+	}
+	return nil
+}
+
+// readMacRequest reads the body of a management request and verifies its authorization
+func (s *Server) readMacRequest(req *http.Request) (body []byte, err error) {
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			return
+		}
+	}
+	err = s.checkMac(req, body)
+	return
+}
+
+// parseUpToken verifies an upload token "<AccessKey>:<Sign>:<EncodedPutPolicy>" and decodes its policy
+func (s *Server) parseUpToken(token string) (policy rs.PutPolicy, err error) {
+	items := strings.Split(token, ":")
+	if len(items) != 3 || items[0] != s.AccessKey || !s.checkSign(items[1], []byte(items[2])) {
+		err = errBadToken
+		return
+	}
+	data, dErr := base64.URLEncoding.DecodeString(items[2])
+	if dErr != nil || json.Unmarshal(data, &policy) != nil {
+		err = errBadToken
+		return
+	}
+	if int64(policy.Expires) < time.Now().Unix() {
+		err = errTokenExpired
+	}
+	return
+}
+
+// decodeEntry decodes the base64 "<Bucket>:<Key>" of an rs operation
+func decodeEntry(encoded string) (bucket, key string, err error) {
+	data, dErr := base64.URLEncoding.DecodeString(encoded)
+	if dErr != nil {
+		err = errInvalidArgs
+		return
+	}
+	items := strings.SplitN(string(data), ":", 2)
+	if len(items) != 2 {
+		err = errInvalidArgs
+		return
+	}
+	return items[0], items[1], nil
+}
@@ -0,0 +1,573 @@
+package fakeserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"qiniu/api.v6/auth/digest"
+	fio "qiniu/api.v6/io"
+	rio "qiniu/api.v6/resumable/io"
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+	"qiniu/rpc"
+)
+
+const testBucket = "test"
+
+func newTestServer(t *testing.T) *Server {
+	srv := New("ak", "sk")
+	restore := srv.Use()
+	t.Cleanup(func() {
+		restore()
+		srv.Close()
+	})
+	srv.CreateBucket(testBucket, false)
+	return srv
+}
+
+func randData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func TestFormUpload(t *testing.T) {
+	srv := newTestServer(t)
+	data := []byte("hello fake server")
+
+	policy := rs.PutPolicy{Scope: testBucket}
+	var ret struct {
+		fio.PutRet
+		X1 string `json:"x:1"`
+	}
+	extra := &fio.PutExtra{Params: map[string]string{"x:1": "1"}, Crc32: crc32.ChecksumIEEE(data), CheckCrc: 2}
+	err := fio.Put2(rpc.NewClient(""), nil, &ret, policy.Token(nil), "a.txt", bytes.NewReader(data), int64(len(data)), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Key != "a.txt" || ret.Hash != etag(data) || ret.X1 != "1" {
+		t.Fatalf("unexpected put ret %+v", ret)
+	}
+
+	entry, err := rs.NewMac(nil).Stat(nil, testBucket, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fsize != int64(len(data)) || entry.MimeType != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	// insert only without a key in the scope
+	other := []byte("other content")
+	err = fio.Put2(rpc.NewClient(""), nil, nil, policy.Token(nil), "a.txt", bytes.NewReader(other), int64(len(other)), nil)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 614 {
+		t.Fatalf("expect file exists, got %v", err)
+	}
+	policy.Scope = testBucket + ":a.txt"
+	err = fio.Put2(rpc.NewClient(""), nil, nil, policy.Token(nil), "a.txt", bytes.NewReader(other), int64(len(other)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.GetObject(testBucket, "a.txt"); !bytes.Equal(got, other) {
+		t.Fatal("overwrite failed")
+	}
+
+	// bad token
+	err = fio.Put2(rpc.NewClient(""), nil, nil, "ak:bad:token", "b.txt", bytes.NewReader(data), int64(len(data)), nil)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 401 {
+		t.Fatalf("expect bad token, got %v", err)
+	}
+}
+
+func TestPutPolicyLimits(t *testing.T) {
+	newTestServer(t)
+	put := func(policy rs.PutPolicy, key string, data []byte, mimeType string) error {
+		extra := &fio.PutExtra{MimeType: mimeType}
+		return fio.Put2(rpc.NewClient(""), nil, nil, policy.Token(nil), key, bytes.NewReader(data), int64(len(data)), extra)
+	}
+	expectCode := func(err error, code int) {
+		t.Helper()
+		if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != code {
+			t.Fatalf("expect %d, got %v", code, err)
+		}
+	}
+
+	prefixal := rs.PutPolicy{Scope: testBucket + ":avatars/", IsPrefixalScope: 1}
+	if err := put(prefixal, "avatars/a.png", []byte("png"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	// the prefixal scope may overwrite
+	if err := put(prefixal, "avatars/a.png", []byte("png2"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(put(prefixal, "other/a.png", []byte("png"), "image/png"), 403)
+
+	limited := rs.PutPolicy{Scope: testBucket, FsizeMin: 2, MimeLimit: "image/*;video/mp4"}
+	expectCode(put(limited, "b.png", []byte("b"), "image/png"), 403)
+	expectCode(put(limited, "b.txt", []byte("text"), "text/plain"), 403)
+	if err := put(limited, "b.mp4", []byte("mp4"), "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	limited.MimeLimit = "!image/*"
+	expectCode(put(limited, "c.png", []byte("png"), "image/png"), 403)
+	if err := put(limited, "c.txt", []byte("text"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	srv := newTestServer(t)
+	data := randData(blockSize + 300*1024)
+
+	policy := rs.PutPolicy{Scope: testBucket}
+	var ret rio.PutRet
+	extra := &rio.PutExtra{ChunkSize: 256 * 1024, MimeType: "video/mp4"}
+	err := rio.Put(rio.NewClient(policy.Token(nil), ""), nil, &ret, "big.mp4", bytes.NewReader(data), int64(len(data)), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Hash != etag(data) {
+		t.Fatalf("unexpected hash %s", ret.Hash)
+	}
+	got, ok := srv.GetObject(testBucket, "big.mp4")
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatal("uploaded data mismatched")
+	}
+	entry, err := rs.NewMac(nil).Stat(nil, testBucket, "big.mp4")
+	if err != nil || entry.MimeType != "video/mp4" {
+		t.Fatalf("unexpected entry %+v, %v", entry, err)
+	}
+}
+
+func TestUploader(t *testing.T) {
+	srv := newTestServer(t)
+	data := randData(3*blockSize + 1024)
+	policy := rs.PutPolicy{Scope: testBucket}
+	token := policy.Token(nil)
+
+	u := rio.NewUploader(&rio.Settings{Workers: 2, ChunkSize: 512 * 1024})
+	defer u.Close()
+
+	var mutex sync.Mutex
+	var last rio.BlockProgress
+	var ret rio.PutRet
+	extra := &rio.PutExtra{
+		Concurrency: 1,
+		OnProgress: func(p rio.BlockProgress) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if p.Err != nil || p.Uploaded < last.Uploaded {
+				t.Errorf("unexpected progress %+v", p)
+			}
+			last = p
+		},
+	}
+	err := u.Put(context.Background(), rio.NewClient(token, ""), nil, &ret, "big.bin", bytes.NewReader(data), int64(len(data)), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.GetObject(testBucket, "big.bin"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded data mismatched")
+	}
+	if last.Uploaded != int64(len(data)) || last.Fsize != int64(len(data)) {
+		t.Fatalf("unexpected last progress %+v", last)
+	}
+
+	// canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = u.Put(ctx, rio.NewClient(token, ""), nil, nil, "canceled.bin", bytes.NewReader(data), int64(len(data)), nil)
+	if err != context.Canceled {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if _, ok := srv.GetObject(testBucket, "canceled.bin"); ok {
+		t.Fatal("canceled upload saved")
+	}
+
+	// closed
+	u.Close()
+	err = u.Put(context.Background(), rio.NewClient(token, ""), nil, nil, "closed.bin", bytes.NewReader(data), int64(len(data)), nil)
+	if err != rio.ErrUploaderClosed {
+		t.Fatalf("expect uploader closed, got %v", err)
+	}
+}
+
+func TestUploaderStream(t *testing.T) {
+	srv := newTestServer(t)
+	policy := rs.PutPolicy{Scope: testBucket}
+	token := policy.Token(nil)
+
+	u := rio.NewUploader(&rio.Settings{Workers: 2, ChunkSize: 512 * 1024})
+	defer u.Close()
+
+	for _, size := range []int{2*blockSize + 777, blockSize, 0} {
+		data := randData(size)
+		// a pipe can be read only once, in small pieces
+		pr, pw := io.Pipe()
+		go func() {
+			for off := 0; off < len(data); off += 1000 {
+				end := off + 1000
+				if end > len(data) {
+					end = len(data)
+				}
+				pw.Write(data[off:end])
+			}
+			pw.Close()
+		}()
+
+		var last int64
+		var ret rio.PutRet
+		extra := &rio.PutExtra{
+			OnProgress: func(p rio.BlockProgress) {
+				if p.Err != nil || p.Fsize != -1 {
+					t.Errorf("unexpected progress %+v", p)
+				}
+				atomic.StoreInt64(&last, p.Uploaded)
+			},
+		}
+		key := fmt.Sprintf("stream-%d.bin", size)
+		if err := u.PutStream(context.Background(), rio.NewClient(token, ""), nil, &ret, key, pr, extra); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := srv.GetObject(testBucket, key); !ok || !bytes.Equal(got, data) || ret.Hash != etag(data) {
+			t.Fatalf("streamed data of size %d mismatched", size)
+		}
+		if size > 0 && atomic.LoadInt64(&last) != int64(size) {
+			t.Fatalf("expect %d bytes uploaded, got %d", size, last)
+		}
+	}
+
+	// the read error fails the upload
+	readErr := errors.New("broken pipe")
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(randData(blockSize + 1))
+		pw.CloseWithError(readErr)
+	}()
+	err := u.PutStream(context.Background(), rio.NewClient(token, ""), nil, nil, "broken.bin", pr, nil)
+	if err != readErr {
+		t.Fatalf("expect the read error, got %v", err)
+	}
+	if _, ok := srv.GetObject(testBucket, "broken.bin"); ok {
+		t.Fatal("broken upload saved")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := newTestServer(t)
+	data := randData(2*rio.MinPartSize + 1024)
+	policy := rs.PutPolicy{Scope: testBucket}
+	client := rio.NewClient(policy.Token(nil), "")
+	ctx := context.Background()
+
+	u := rio.NewUploader(&rio.Settings{Workers: 2})
+	defer u.Close()
+
+	// a failed part is kept in the progress file, and the upload is resumed with the same upload id
+	progressFile := filepath.Join(t.TempDir(), "progress")
+	extra := &rio.PutExtraV2{
+		PartSize:     rio.MinPartSize,
+		TryTimes:     1,
+		ProgressFile: progressFile,
+		Params:       map[string]string{"x:a": "1"},
+		MimeType:     "application/x-test",
+	}
+	broken := &failingReaderAt{ReaderAt: bytes.NewReader(data), failFrom: 2 * rio.MinPartSize}
+	err := u.PutV2(ctx, client, nil, nil, testBucket, "multi.bin", broken, int64(len(data)), extra)
+	if err != rio.ErrPutFailed {
+		t.Fatalf("expect put failed, got %v", err)
+	}
+	first, err := ioutil.ReadFile(progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uploaded int64
+	extra.OnProgress = func(p rio.BlockProgress) {
+		atomic.StoreInt64(&uploaded, p.Uploaded)
+	}
+	var ret rio.PutRet
+	err = u.PutV2(ctx, client, nil, &ret, testBucket, "multi.bin", bytes.NewReader(data), int64(len(data)), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.GetObject(testBucket, "multi.bin"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded data mismatched")
+	}
+	if ret.Key != "multi.bin" || ret.Hash != etag(data) || uploaded != int64(len(data)) {
+		t.Fatalf("unexpected put ret %+v, uploaded %d", ret, uploaded)
+	}
+	var saved rio.MultipartProgress
+	json.Unmarshal(first, &saved)
+	if saved.Parts[0].Etag == "" || saved.Parts[2].Etag != "" {
+		t.Fatalf("unexpected progress %+v", saved)
+	}
+	entry, _ := rs.NewMac(nil).Stat(nil, testBucket, "multi.bin")
+	if entry.MimeType != "application/x-test" {
+		t.Fatalf("unexpected mime type %s", entry.MimeType)
+	}
+
+	// the upload id is aborted on error
+	extra = &rio.PutExtraV2{PartSize: rio.MinPartSize, TryTimes: 1, ProgressFile: progressFile, AbortOnError: true}
+	err = u.PutV2(ctx, client, nil, nil, testBucket, "aborted.bin", broken, int64(len(data)), extra)
+	if err != rio.ErrPutFailed {
+		t.Fatalf("expect put failed, got %v", err)
+	}
+	if _, sErr := os.Stat(progressFile); !os.IsNotExist(sErr) {
+		t.Fatal("expect the progress file removed")
+	}
+	if len(srv.store.uploads) != 0 {
+		t.Fatal("expect the upload aborted")
+	}
+	_, err = rio.UploadPart(ctx, client, nil, testBucket, "multi.bin", true, saved.UploadId, 1, "", bytes.NewReader(data[:10]), 10)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != rio.NoSuchUpload {
+		t.Fatalf("expect no such upload, got %v", err)
+	}
+
+	// all the parts but the last one should be at least 1MB
+	initRet, err := rio.InitParts(ctx, client, nil, testBucket, "small.bin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []rio.UploadPartInfo
+	for i := 0; i < 2; i++ {
+		partRet, pErr := rio.UploadPart(ctx, client, nil, testBucket, "small.bin", true, initRet.UploadId, i+1, "", bytes.NewReader(data[:10]), 10)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		parts = append(parts, rio.UploadPartInfo{Etag: partRet.Etag, PartNumber: i + 1})
+	}
+	// the part is checked against its md5
+	_, err = rio.UploadPart(ctx, client, nil, testBucket, "small.bin", true, initRet.UploadId, 3, etag(data[:10]),
+		bytes.NewReader(data[:10]), 10)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 400 {
+		t.Fatalf("expect md5 mismatched, got %v", err)
+	}
+	err = rio.CompleteParts(ctx, client, nil, nil, testBucket, "small.bin", true, initRet.UploadId, parts, nil)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 400 {
+		t.Fatalf("expect invalid part, got %v", err)
+	}
+
+	if err = u.PutV2(ctx, client, nil, nil, testBucket, "x", bytes.NewReader(data), int64(len(data)),
+		&rio.PutExtraV2{PartSize: 1024}); err != rio.ErrInvalidPartSize {
+		t.Fatalf("expect invalid part size, got %v", err)
+	}
+}
+
+// failingReaderAt fails the reads beyond failFrom
+type failingReaderAt struct {
+	io.ReaderAt
+	failFrom int64
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.failFrom {
+		return 0, errors.New("read failed")
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestRsOperations(t *testing.T) {
+	srv := newTestServer(t)
+	srv.CreateBucket("other", false)
+	srv.PutObject(testBucket, "a", []byte("a"), "")
+	srv.PutObject(testBucket, "b", []byte("b"), "")
+	client := rs.NewMac(nil)
+
+	if err := client.Copy(nil, testBucket, "a", "other", "a", false); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Copy(nil, testBucket, "b", "other", "a", false)
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 614 {
+		t.Fatalf("expect file exists, got %v", err)
+	}
+	if err = client.Move(nil, testBucket, "b", "other", "a", true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.GetObject("other", "a"); string(got) != "b" {
+		t.Fatal("move with force failed")
+	}
+	if _, ok := srv.GetObject(testBucket, "b"); ok {
+		t.Fatal("moved file still exists")
+	}
+	if err = client.ChangeMime(nil, testBucket, "a", "text/x-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Delete(nil, "other", "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Stat(nil, "other", "a")
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 612 {
+		t.Fatalf("expect no such file, got %v", err)
+	}
+	_, err = client.Stat(nil, "nobucket", "a")
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 631 {
+		t.Fatalf("expect no such bucket, got %v", err)
+	}
+
+	type batchRet struct {
+		Code int `json:"code"`
+		Data struct {
+			rs.Entry
+			Error string `json:"error"`
+		} `json:"data"`
+	}
+	var rets []batchRet
+	err = client.Batch(nil, &rets, []string{rs.URIStat(testBucket, "a"), rs.URIStat(testBucket, "b")})
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 298 {
+		t.Fatalf("expect partial failure, got %v", err)
+	}
+	if len(rets) != 2 || rets[0].Code != 200 || rets[0].Data.MimeType != "text/x-a" || rets[1].Code != 612 || rets[1].Data.Error == "" {
+		t.Fatalf("unexpected batch ret %+v", rets)
+	}
+
+	// wrong secret key
+	bad := rs.NewMac(&digest.Mac{AccessKey: "ak", SecretKey: []byte("bad")})
+	_, err = bad.Stat(nil, testBucket, "a")
+	if e, ok := err.(*rpc.ErrorInfo); !ok || e.Code != 401 {
+		t.Fatalf("expect bad token, got %v", err)
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	srv := newTestServer(t)
+	for _, key := range []string{"dir/1", "dir/2", "dir/3", "dir/4", "dir/5", "other"} {
+		srv.PutObject(testBucket, key, []byte(key), "")
+	}
+
+	client := rsf.New(nil)
+	keys := []string{}
+	marker := ""
+	for {
+		items, markerOut, err := client.ListPrefix(nil, testBucket, "dir/", marker, 2)
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		marker = markerOut
+	}
+	if len(keys) != 5 || keys[0] != "dir/1" || keys[4] != "dir/5" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestListDelimiter(t *testing.T) {
+	srv := newTestServer(t)
+	for _, key := range []string{"a/1", "a/b/2", "a/c/3", "a/c/4", "a/d", "b/5"} {
+		srv.PutObject(testBucket, key, []byte(key), "")
+	}
+
+	client := rsf.New(nil)
+	names := []string{}
+	marker := ""
+	for {
+		items, prefixes, markerOut, err := client.ListDelimiterCtx(context.Background(), nil, testBucket, "a/", "/", marker, 2)
+		for _, item := range items {
+			names = append(names, item.Key)
+		}
+		names = append(names, prefixes...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		marker = markerOut
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a/1,a/b/,a/c/,a/d" {
+		t.Fatalf("unexpected names %v", names)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := newTestServer(t)
+	srv.CreateBucket("private", true)
+	data := []byte("0123456789")
+	srv.PutObject(testBucket, "f.txt", data, "")
+	srv.PutObject("private", "f.txt", data, "")
+
+	get := func(domain, rawUrl, rangeHeader string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", rawUrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = domain
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get(srv.Domain(testBucket), srv.IoHost+"/f.txt", "bytes=3-")
+	if resp.StatusCode != 206 || string(body) != "3456789" {
+		t.Fatalf("unexpected range response %d %s", resp.StatusCode, body)
+	}
+
+	resp, _ = get(srv.Domain("private"), srv.IoHost+"/f.txt", "")
+	if resp.StatusCode != 401 {
+		t.Fatalf("expect private bucket to require a token, got %d", resp.StatusCode)
+	}
+
+	baseUrl := rs.MakeBaseUrl(srv.Domain("private"), "f.txt")
+	privateUrl := rs.GetPolicy{}.MakeRequest(baseUrl, nil)
+	resp, body = get(srv.Domain("private"), srv.IoHost+privateUrl[len("http://"+srv.Domain("private")):], "")
+	if resp.StatusCode != 200 || !bytes.Equal(body, data) {
+		t.Fatalf("unexpected private download %d %s", resp.StatusCode, body)
+	}
+
+	resp, _ = get(srv.Domain("private"), srv.IoHost+"/f.txt?e=1&token=ak:bad", "")
+	if resp.StatusCode != 401 {
+		t.Fatalf("expect bad token, got %d", resp.StatusCode)
+	}
+}
+
+func TestBucketInfo(t *testing.T) {
+	srv := newTestServer(t)
+	client := rs.NewMac(nil)
+
+	var info struct {
+		Region string `json:"region"`
+	}
+	if err := client.Conn.Call(nil, &info, srv.RsHost+"/bucket/"+testBucket); err != nil {
+		t.Fatal(err)
+	}
+	if info.Region != Region {
+		t.Fatalf("unexpected region %s", info.Region)
+	}
+
+	var domains []string
+	err := client.Conn.CallWithForm(nil, &domains, srv.ApiHost+"/v6/domain/list", map[string][]string{"tbl": {testBucket}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0] != srv.Domain(testBucket) {
+		t.Fatalf("unexpected domains %v", domains)
+	}
+}
@@ -0,0 +1,400 @@
+package fakeserver
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"qiniu/api.v6/rs"
+	"qiniu/api.v6/rsf"
+)
+
+const (
+	blockBits = 22
+	blockSize = 1 << blockBits
+
+	defaultListLimit = 1000
+)
+
+// ----------------------------------------------------------
+
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+var (
+	errBadToken       = &apiError{401, "bad token"}
+	errTokenExpired   = &apiError{401, "token out of date"}
+	errKeyNotInScope  = &apiError{403, "key doesn't match with scope"}
+	errTooLarge       = &apiError{413, "file size exceeds fsizeLimit"}
+	errTooSmall       = &apiError{403, "file size is smaller than fsizeMin"}
+	errMimeLimited    = &apiError{403, "limited mimeType: this file type is forbidden to upload"}
+	errNoSuchFile     = &apiError{612, "no such file or directory"}
+	errFileExists     = &apiError{614, "file exists"}
+	errNoSuchBucket   = &apiError{631, "no such bucket"}
+	errInvalidCtx     = &apiError{701, "invalid ctx"}
+	errNoSuchDomain   = &apiError{404, "no such domain"}
+	errInvalidArgs    = &apiError{400, "invalid arguments"}
+	errSizeMismatched = &apiError{400, "file size mismatched"}
+	errNoSuchUpload   = &apiError{612, "no such upload"}
+	errInvalidPart    = &apiError{400, "invalid part"}
+	errBadDigest      = &apiError{400, "content md5 mismatched"}
+	errPartFailed     = &apiError{400, "part upload failed"}
+	errBucketExists   = &apiError{614, "the bucket already exists"}
+	errNoSuchRule     = &apiError{400, "no such rule"}
+	errRuleExists     = &apiError{400, "rule name already exists"}
+)
+
+// ----------------------------------------------------------
+
+type object struct {
+	data     []byte
+	hash     string
+	mimeType string
+	putTime  int64
+	fileType int
+	endUser  string
+}
+
+func (o *object) entry() rs.Entry {
+	return rs.Entry{
+		Hash:     o.hash,
+		Fsize:    int64(len(o.data)),
+		PutTime:  o.putTime,
+		MimeType: o.mimeType,
+		FileType: o.fileType,
+	}
+}
+
+func (o *object) listItem(key string) rsf.ListItem {
+	return rsf.ListItem{
+		Key:      key,
+		Hash:     o.hash,
+		Fsize:    int64(len(o.data)),
+		PutTime:  o.putTime,
+		MimeType: o.mimeType,
+		FileType: o.fileType,
+		EndUser:  o.endUser,
+	}
+}
+
+func newObject(key string, data []byte, mimeType string) *object {
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(path.Ext(key))
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+	}
+	return &object{
+		data:     data,
+		hash:     etag(data),
+		mimeType: mimeType,
+		putTime:  time.Now().UnixNano() / 100,
+	}
+}
+
+// etag computes the qetag of data, the same hash the storage returns for an upload
+func etag(data []byte) string {
+	var sum []byte
+	if len(data) <= blockSize {
+		h := sha1.Sum(data)
+		sum = append([]byte{0x16}, h[:]...)
+	} else {
+		blocks := make([]byte, 0, (len(data)+blockSize-1)/blockSize*sha1.Size)
+		for off := 0; off < len(data); off += blockSize {
+			end := off + blockSize
+			if end > len(data) {
+				end = len(data)
+			}
+			h := sha1.Sum(data[off:end])
+			blocks = append(blocks, h[:]...)
+		}
+		h := sha1.Sum(blocks)
+		sum = append([]byte{0x96}, h[:]...)
+	}
+	return base64.URLEncoding.EncodeToString(sum)
+}
+
+// ----------------------------------------------------------
+
+type bucket struct {
+	private bool
+	domain  string
+	objects map[string]*object
+
+	region        string
+	noIndexPage   bool
+	antiLeechMode int // 0 不限制，1 白名单，2 黑名单
+	referPatterns []string
+	noRefer       bool // 是否允许空 Referer
+	rules         []lifecycleRule
+}
+
+// lifecycleRule is a rule of deleting or transiting the files by prefix, managed by the uc host
+type lifecycleRule struct {
+	Name            string `json:"name"`
+	Prefix          string `json:"prefix"`
+	DeleteAfterDays int    `json:"delete_after_days"`
+	ToLineAfterDays int    `json:"to_line_after_days"`
+	Ctime           string `json:"ctime"`
+}
+
+// block is a resumable upload block between mkblk and mkfile
+type block struct {
+	size      int
+	data      []byte
+	expiredAt int64
+}
+
+// multipartUpload is a multipart upload between initiate and complete
+type multipartUpload struct {
+	bucket    string
+	key       string
+	hasKey    bool
+	parts     map[int]*object
+	expiredAt int64
+}
+
+// store keeps the buckets and in-progress uploads shared by all the hosts
+type store struct {
+	mu      sync.RWMutex
+	buckets map[string]*bucket
+	blocks  map[string]*block
+	uploads map[string]*multipartUpload
+	pfops   map[string]*pfopJob
+
+	partsUploaded int
+	partsToFail   int // the part uploads fail after this many more parts, never if negative
+}
+
+func newStore() *store {
+	return &store{
+		buckets: make(map[string]*bucket),
+		blocks:  make(map[string]*block),
+		uploads: make(map[string]*multipartUpload),
+		pfops:   make(map[string]*pfopJob),
+
+		partsToFail: -1,
+	}
+}
+
+func (s *store) bucket(name string) (*bucket, error) {
+	b, ok := s.buckets[name]
+	if !ok {
+		return nil, errNoSuchBucket
+	}
+	return b, nil
+}
+
+func (s *store) bucketNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *store) bucketOfDomain(domain string) (string, *bucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for name, b := range s.buckets {
+		if b.domain == domain {
+			return name, b, nil
+		}
+	}
+	return "", nil, errNoSuchDomain
+}
+
+func (s *store) stat(bucketName, key string) (*object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := b.objects[key]
+	if !ok {
+		return nil, errNoSuchFile
+	}
+	return o, nil
+}
+
+// put saves the object, an existing key is only replaced if overwrite is set or the content is the same
+func (s *store) put(bucketName, key string, o *object, overwrite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if old, ok := b.objects[key]; ok && !overwrite && old.hash != o.hash {
+		return errFileExists
+	}
+	b.objects[key] = o
+	return nil
+}
+
+func (s *store) remove(bucketName, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if _, ok := b.objects[key]; !ok {
+		return errNoSuchFile
+	}
+	delete(b.objects, key)
+	return nil
+}
+
+func (s *store) copy(srcBucket, srcKey, destBucket, destKey string, force, move bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, err := s.bucket(srcBucket)
+	if err != nil {
+		return err
+	}
+	dest, err := s.bucket(destBucket)
+	if err != nil {
+		return err
+	}
+	o, ok := src.objects[srcKey]
+	if !ok {
+		return errNoSuchFile
+	}
+	if srcBucket == destBucket && srcKey == destKey {
+		return nil
+	}
+	if _, ok := dest.objects[destKey]; ok && !force {
+		return errFileExists
+	}
+
+	o1 := *o
+	if !move {
+		o1.putTime = time.Now().UnixNano() / 100
+	}
+	dest.objects[destKey] = &o1
+	if move {
+		delete(src.objects, srcKey)
+	}
+	return nil
+}
+
+func (s *store) changeMime(bucketName, key, mimeType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchFile
+	}
+	o1 := *o
+	o1.mimeType = mimeType
+	b.objects[key] = &o1
+	return nil
+}
+
+func (s *store) changeType(bucketName, key string, fileType int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchFile
+	}
+	o1 := *o
+	o1.fileType = fileType
+	b.objects[key] = &o1
+	return nil
+}
+
+// list returns the keys after marker in lexical order, the marker is the base64 of the last listed name.
+// With a delimiter, the keys having it after the prefix are rolled up into their common prefixes, which
+// count against the limit like the keys.
+func (s *store) list(bucketName, prefix, delimiter, marker string,
+	limit int) (items []rsf.ListItem, commonPrefixes []string, markerOut string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return
+	}
+	after := ""
+	if marker != "" {
+		last, dErr := base64.URLEncoding.DecodeString(marker)
+		if dErr != nil {
+			err = errInvalidArgs
+			return
+		}
+		after = string(last)
+	}
+	if limit <= 0 || limit > defaultListLimit {
+		limit = defaultListLimit
+	}
+
+	names := make([]string, 0, len(b.objects))
+	rolledUp := make(map[string]bool)
+	for key := range b.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := key
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				name = key[:len(prefix)+idx+len(delimiter)]
+				if rolledUp[name] {
+					continue
+				}
+				rolledUp[name] = true
+			}
+		}
+		if marker == "" || name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) > limit {
+		names = names[:limit]
+		markerOut = base64.URLEncoding.EncodeToString([]byte(names[limit-1]))
+	}
+	items = make([]rsf.ListItem, 0, len(names))
+	for _, name := range names {
+		if rolledUp[name] {
+			commonPrefixes = append(commonPrefixes, name)
+		} else {
+			items = append(items, b.objects[name].listItem(name))
+		}
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package fakeserver
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------
+
+type bucketInfoRet struct {
+	Region        string   `json:"region"`
+	Private       int      `json:"private"`
+	NoIndexPage   int      `json:"no_index_page"`
+	AntiLeechMode int      `json:"anti_leech_mode"`
+	ReferWl       []string `json:"refer_wl"`
+	ReferBl       []string `json:"refer_bl"`
+	NoRefer       bool     `json:"no_refer"`
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ucHandler serves the bucket settings, the params are in the query or the form body
+func (s *Server) ucHandler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, f func(b *bucket, args url.Values) (interface{}, error)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+			body, err := s.readMacRequest(req)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			args := req.URL.Query()
+			if form, pErr := url.ParseQuery(string(body)); pErr == nil {
+				for k, v := range form {
+					args[k] = v
+				}
+			}
+
+			s.store.mu.Lock()
+			defer s.store.mu.Unlock()
+			b, err := s.store.bucket(args.Get("bucket"))
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			ret, err := f(b, args)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			s.writeJSON(w, 200, ret)
+		})
+	}
+
+	handle("/v2/bucketInfo", func(b *bucket, args url.Values) (interface{}, error) {
+		ret := bucketInfoRet{
+			Region:        b.region,
+			Private:       boolInt(b.private),
+			NoIndexPage:   boolInt(b.noIndexPage),
+			AntiLeechMode: b.antiLeechMode,
+			NoRefer:       b.noRefer,
+		}
+		switch b.antiLeechMode {
+		case 1:
+			ret.ReferWl = b.referPatterns
+		case 2:
+			ret.ReferBl = b.referPatterns
+		}
+		return ret, nil
+	})
+	handle("/private", func(b *bucket, args url.Values) (interface{}, error) {
+		b.private = args.Get("private") == "1"
+		return nil, nil
+	})
+	handle("/noIndexPage", func(b *bucket, args url.Values) (interface{}, error) {
+		b.noIndexPage = args.Get("noIndexPage") == "1"
+		return nil, nil
+	})
+	handle("/referAntiLeech", func(b *bucket, args url.Values) (interface{}, error) {
+		mode, err := strconv.Atoi(args.Get("mode"))
+		if err != nil || mode < 0 || mode > 2 {
+			return nil, errInvalidArgs
+		}
+		b.antiLeechMode = mode
+		b.noRefer = args.Get("norefer") == "1"
+		b.referPatterns = nil
+		if pattern := args.Get("pattern"); mode != 0 && pattern != "" {
+			b.referPatterns = strings.Split(pattern, ";")
+		}
+		return nil, nil
+	})
+
+	parseRule := func(args url.Values) (rule lifecycleRule, err error) {
+		rule = lifecycleRule{Name: args.Get("name"), Prefix: args.Get("prefix")}
+		if rule.Name == "" {
+			err = errInvalidArgs
+			return
+		}
+		for name, value := range map[string]*int{
+			"delete_after_days":  &rule.DeleteAfterDays,
+			"to_line_after_days": &rule.ToLineAfterDays,
+		} {
+			if days := args.Get(name); days != "" {
+				if *value, err = strconv.Atoi(days); err != nil || *value < 0 {
+					err = errInvalidArgs
+					return
+				}
+			}
+		}
+		if rule.DeleteAfterDays == 0 && rule.ToLineAfterDays == 0 {
+			err = errInvalidArgs
+		}
+		return
+	}
+	findRule := func(b *bucket, name string) int {
+		for i, rule := range b.rules {
+			if rule.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	handle("/rules/get", func(b *bucket, args url.Values) (interface{}, error) {
+		rules := b.rules
+		if rules == nil {
+			rules = []lifecycleRule{}
+		}
+		return rules, nil
+	})
+	handle("/rules/add", func(b *bucket, args url.Values) (interface{}, error) {
+		rule, err := parseRule(args)
+		if err != nil {
+			return nil, err
+		}
+		if findRule(b, rule.Name) >= 0 {
+			return nil, errRuleExists
+		}
+		rule.Ctime = time.Now().Format(time.RFC3339)
+		b.rules = append(b.rules, rule)
+		return nil, nil
+	})
+	handle("/rules/update", func(b *bucket, args url.Values) (interface{}, error) {
+		rule, err := parseRule(args)
+		if err != nil {
+			return nil, err
+		}
+		i := findRule(b, rule.Name)
+		if i < 0 {
+			return nil, errNoSuchRule
+		}
+		rule.Ctime = b.rules[i].Ctime
+		b.rules[i] = rule
+		return nil, nil
+	})
+	handle("/rules/delete", func(b *bucket, args url.Values) (interface{}, error) {
+		i := findRule(b, args.Get("name"))
+		if i < 0 {
+			return nil, errNoSuchRule
+		}
+		b.rules = append(b.rules[:i], b.rules[i+1:]...)
+		return nil, nil
+	})
+	return mux
+}
@@ -0,0 +1,518 @@
+package fakeserver
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiniu/api.v6/rs"
+)
+
+const blockExpires = 7 * 24 * time.Hour
+
+type blkputRet struct {
+	Ctx       string `json:"ctx"`
+	Checksum  string `json:"checksum"`
+	Crc32     uint32 `json:"crc32"`
+	Offset    uint32 `json:"offset"`
+	Host      string `json:"host"`
+	ExpiredAt int64  `json:"expired_at"`
+}
+
+// upload is one file received by the form upload or by mkfile
+type upload struct {
+	key      string
+	hasKey   bool
+	data     []byte
+	mimeType string
+	params   map[string]string
+}
+
+// save checks the upload against the put policy, stores it and writes the response of the upload
+func (s *Server) save(w http.ResponseWriter, policy rs.PutPolicy, up *upload) {
+	items := strings.SplitN(policy.Scope, ":", 2)
+	bucket := items[0]
+	scopeKey := ""
+	if len(items) == 2 {
+		scopeKey = items[1]
+	}
+	if !up.hasKey {
+		if scopeKey != "" {
+			up.key = scopeKey
+		} else {
+			up.key = etag(up.data)
+		}
+	}
+	if policy.IsPrefixalScope != 0 {
+		if !strings.HasPrefix(up.key, scopeKey) {
+			s.writeError(w, errKeyNotInScope)
+			return
+		}
+	} else if scopeKey != "" && up.key != scopeKey {
+		s.writeError(w, errKeyNotInScope)
+		return
+	}
+	if policy.FsizeLimit > 0 && int64(len(up.data)) > policy.FsizeLimit {
+		s.writeError(w, errTooLarge)
+		return
+	}
+	if int64(len(up.data)) < policy.FsizeMin {
+		s.writeError(w, errTooSmall)
+		return
+	}
+
+	o := newObject(up.key, up.data, up.mimeType)
+	if !mimeAllowed(policy.MimeLimit, o.mimeType) {
+		s.writeError(w, errMimeLimited)
+		return
+	}
+	o.fileType = policy.FileType
+	o.endUser = policy.EndUser
+	// like the real service, only a token with scope <Bucket>:<Key> may overwrite
+	overwrite := scopeKey != "" && policy.InsertOnly == 0
+	if err := s.store.put(bucket, up.key, o, overwrite); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if policy.ReturnBody != "" {
+		vars := map[string]string{
+			"bucket":   bucket,
+			"key":      up.key,
+			"hash":     o.hash,
+			"etag":     o.hash,
+			"fsize":    strconv.Itoa(len(up.data)),
+			"mimeType": o.mimeType,
+			"endUser":  o.endUser,
+		}
+		for k, v := range up.params {
+			vars[k] = v
+		}
+		body := policy.ReturnBody
+		for k, v := range vars {
+			// escape the value to be placed inside a JSON string
+			value, _ := json.Marshal(v)
+			body = strings.Replace(body, "$("+k+")", string(value[1:len(value)-1]), -1)
+		}
+		w.Header().Set("X-Reqid", s.newReqId())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+		return
+	}
+
+	ret := map[string]string{
+		"hash": o.hash,
+		"key":  up.key,
+	}
+	for k, v := range up.params {
+		ret[k] = v
+	}
+	s.writeJSON(w, 200, ret)
+}
+
+// mimeAllowed checks the mime type against the mimeLimit of the put policy, like "image/*;video/mp4",
+// or the forbidden types if started with "!"
+func mimeAllowed(mimeLimit, mimeType string) bool {
+	if mimeLimit == "" {
+		return true
+	}
+	forbidden := strings.HasPrefix(mimeLimit, "!")
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	for _, limit := range strings.Split(strings.TrimPrefix(mimeLimit, "!"), ";") {
+		limit = strings.TrimSpace(limit)
+		if limit == mimeType || strings.HasSuffix(limit, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(limit, "*")) {
+			return !forbidden
+		}
+	}
+	return forbidden
+}
+
+func (s *Server) upToken(req *http.Request) (policy rs.PutPolicy, err error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "UpToken ") {
+		err = errBadToken
+		return
+	}
+	return s.parseUpToken(strings.TrimPrefix(auth, "UpToken "))
+}
+
+// addBlock saves a snapshot of the block under a new ctx
+func (s *Server) addBlock(blk *block, chunk []byte) blkputRet {
+	ctx := randomId()
+
+	s.store.mu.Lock()
+	s.store.blocks[ctx] = blk
+	s.store.mu.Unlock()
+
+	return s.blockRet(ctx, blk, chunk)
+}
+
+func (s *Server) blockRet(ctx string, blk *block, chunk []byte) blkputRet {
+	sum := sha1.Sum(blk.data)
+	return blkputRet{
+		Ctx:       ctx,
+		Checksum:  base64.URLEncoding.EncodeToString(sum[:]),
+		Crc32:     crc32.ChecksumIEEE(chunk),
+		Offset:    uint32(len(blk.data)),
+		Host:      s.UpHost,
+		ExpiredAt: blk.expiredAt,
+	}
+}
+
+func (s *Server) upHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// form upload
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" || req.Method != "POST" {
+			s.writeError(w, &apiError{404, "not found"})
+			return
+		}
+		mr, err := req.MultipartReader()
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+
+		up := &upload{params: make(map[string]string)}
+		fields := make(map[string]string)
+		hasFile := false
+		for {
+			part, pErr := mr.NextPart()
+			if pErr == io.EOF {
+				break
+			}
+			if pErr != nil {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			data, rErr := ioutil.ReadAll(part)
+			if rErr != nil {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			name := part.FormName()
+			if name == "file" {
+				hasFile = true
+				up.data = data
+				up.mimeType = part.Header.Get("Content-Type")
+				continue
+			}
+			fields[name] = string(data)
+			if strings.HasPrefix(name, "x:") {
+				up.params[name] = string(data)
+			}
+		}
+		if !hasFile {
+			s.writeError(w, &apiError{400, "file is not specified in multipart"})
+			return
+		}
+		if crc, ok := fields["crc32"]; ok {
+			if crc != strconv.FormatUint(uint64(crc32.ChecksumIEEE(up.data)), 10) {
+				s.writeError(w, &apiError{406, "crc32 not match"})
+				return
+			}
+		}
+		up.key, up.hasKey = fields["key"]
+
+		policy, err := s.parseUpToken(fields["token"])
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.save(w, policy, up)
+	})
+
+	// POST /mkblk/<BlockSize>, the body is the first chunk of the block
+	mux.HandleFunc("/mkblk/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.upToken(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/mkblk/"))
+		if err != nil || size <= 0 || size > blockSize {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		chunk, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(size)+1))
+		if err != nil || len(chunk) > size {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		blk := &block{
+			size:      size,
+			data:      chunk,
+			expiredAt: time.Now().Add(blockExpires).Unix(),
+		}
+		s.writeJSON(w, 200, s.addBlock(blk, chunk))
+	})
+
+	// POST /bput/<Ctx>/<Offset>, the body is the next chunk of the block
+	mux.HandleFunc("/bput/", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := s.upToken(req); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		items := strings.Split(strings.TrimPrefix(req.URL.Path, "/bput/"), "/")
+		if len(items) != 2 {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		offset, err := strconv.Atoi(items[1])
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		chunk, err := ioutil.ReadAll(io.LimitReader(req.Body, blockSize+1))
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+
+		s.store.mu.RLock()
+		blk, ok := s.store.blocks[items[0]]
+		s.store.mu.RUnlock()
+		if !ok || blk.expiredAt < time.Now().Unix() || offset != len(blk.data) {
+			s.writeError(w, errInvalidCtx)
+			return
+		}
+		if len(blk.data)+len(chunk) > blk.size {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		// every bput returns a new ctx, the old one stays valid so that a chunk can be retried
+		next := &block{
+			size:      blk.size,
+			data:      append(blk.data[:len(blk.data):len(blk.data)], chunk...),
+			expiredAt: blk.expiredAt,
+		}
+		s.writeJSON(w, 200, s.addBlock(next, chunk))
+	})
+
+	// POST /mkfile/<Fsize>[/key/<EncodedKey>][/mimeType/<EncodedMimeType>][/x:<Name>/<EncodedValue>],
+	// the body is the comma separated ctx of the blocks
+	mux.HandleFunc("/mkfile/", func(w http.ResponseWriter, req *http.Request) {
+		policy, err := s.upToken(req)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		items := strings.Split(strings.TrimPrefix(req.URL.Path, "/mkfile/"), "/")
+		fsize, err := strconv.ParseInt(items[0], 10, 64)
+		if err != nil || len(items)%2 != 1 {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+
+		up := &upload{params: make(map[string]string)}
+		for i := 1; i < len(items); i += 2 {
+			value, dErr := base64.URLEncoding.DecodeString(items[i+1])
+			if dErr != nil {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			switch name := items[i]; {
+			case name == "key":
+				up.key, up.hasKey = string(value), true
+			case name == "mimeType":
+				up.mimeType = string(value)
+			case strings.HasPrefix(name, "x:"):
+				up.params[name] = string(value)
+			}
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<24))
+		if err != nil {
+			s.writeError(w, errInvalidArgs)
+			return
+		}
+		var ctxs []string
+		if len(body) > 0 {
+			ctxs = strings.Split(string(body), ",")
+		}
+
+		s.store.mu.Lock()
+		for i, ctx := range ctxs {
+			blk, ok := s.store.blocks[ctx]
+			if !ok {
+				s.store.mu.Unlock()
+				s.writeError(w, errInvalidCtx)
+				return
+			}
+			// every block but the last one is full, and all blocks are complete
+			if len(blk.data) != blk.size || (i < len(ctxs)-1 && blk.size != blockSize) {
+				s.store.mu.Unlock()
+				s.writeError(w, errSizeMismatched)
+				return
+			}
+			up.data = append(up.data, blk.data...)
+		}
+		if int64(len(up.data)) != fsize {
+			s.store.mu.Unlock()
+			s.writeError(w, errSizeMismatched)
+			return
+		}
+		for _, ctx := range ctxs {
+			delete(s.store.blocks, ctx)
+		}
+		s.store.mu.Unlock()
+
+		s.save(w, policy, up)
+	})
+	s.multipartHandle(mux)
+	return mux
+}
+
+// ----------------------------------------------------------
+
+type completePartsArgs struct {
+	Parts []struct {
+		Etag       string `json:"etag"`
+		PartNumber int    `json:"partNumber"`
+	} `json:"parts"`
+	Fname      string            `json:"fname"`
+	MimeType   string            `json:"mimeType"`
+	CustomVars map[string]string `json:"customVars"`
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// multipartHandle serves the multipart upload (v2) under
+// /buckets/<Bucket>/objects/<EncodedKey or ~>/uploads[/<UploadId>[/<PartNumber>]]
+func (s *Server) multipartHandle(mux *http.ServeMux) {
+	mux.HandleFunc("/buckets/", func(w http.ResponseWriter, req *http.Request) {
+		policy, err := s.upToken(req)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		items := strings.Split(strings.TrimPrefix(req.URL.Path, "/buckets/"), "/")
+		if len(items) < 4 || items[1] != "objects" || items[3] != "uploads" {
+			s.writeError(w, &apiError{404, "not found"})
+			return
+		}
+		bucket, key, hasKey := items[0], "", false
+		if items[2] != "~" {
+			value, dErr := base64.URLEncoding.DecodeString(items[2])
+			if dErr != nil {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			key, hasKey = string(value), true
+		}
+		if strings.SplitN(policy.Scope, ":", 2)[0] != bucket {
+			s.writeError(w, errKeyNotInScope)
+			return
+		}
+
+		// initiate
+		if len(items) == 4 {
+			if req.Method != "POST" {
+				s.writeError(w, &apiError{405, "method not allowed"})
+				return
+			}
+			uploadId := randomId()
+			expiredAt := time.Now().Add(blockExpires).Unix()
+			s.store.mu.Lock()
+			s.store.uploads[uploadId] = &multipartUpload{
+				bucket:    bucket,
+				key:       key,
+				hasKey:    hasKey,
+				parts:     make(map[int]*object),
+				expiredAt: expiredAt,
+			}
+			s.store.mu.Unlock()
+			s.writeJSON(w, 200, map[string]interface{}{"uploadId": uploadId, "expireAt": expiredAt})
+			return
+		}
+
+		s.store.mu.RLock()
+		up, ok := s.store.uploads[items[4]]
+		s.store.mu.RUnlock()
+		if !ok || up.bucket != bucket || up.key != key || up.hasKey != hasKey || up.expiredAt < time.Now().Unix() {
+			s.writeError(w, errNoSuchUpload)
+			return
+		}
+
+		switch {
+		case len(items) == 6 && req.Method == "PUT":
+			partNumber, pErr := strconv.Atoi(items[5])
+			if pErr != nil || partNumber < 1 || partNumber > 10000 {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			data, rErr := ioutil.ReadAll(io.LimitReader(req.Body, 1<<30+1))
+			if rErr != nil || len(data) > 1<<30 {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			sum := md5.Sum(data)
+			if partMd5 := req.Header.Get("Content-MD5"); partMd5 != "" && partMd5 != hex.EncodeToString(sum[:]) {
+				s.writeError(w, errBadDigest)
+				return
+			}
+			part := &object{data: data, hash: etag(data)}
+			s.store.mu.Lock()
+			if s.store.partsToFail == 0 {
+				s.store.mu.Unlock()
+				s.writeError(w, errPartFailed)
+				return
+			}
+			if s.store.partsToFail > 0 {
+				s.store.partsToFail--
+			}
+			s.store.partsUploaded++
+			up.parts[partNumber] = part
+			s.store.mu.Unlock()
+			s.writeJSON(w, 200, map[string]string{"etag": part.hash, "md5": hex.EncodeToString(sum[:])})
+		case len(items) == 5 && req.Method == "POST":
+			var args completePartsArgs
+			if dErr := json.NewDecoder(req.Body).Decode(&args); dErr != nil || len(args.Parts) == 0 {
+				s.writeError(w, errInvalidArgs)
+				return
+			}
+			file := &upload{key: key, hasKey: hasKey, mimeType: args.MimeType, params: make(map[string]string)}
+			for k, v := range args.CustomVars {
+				if strings.HasPrefix(k, "x:") {
+					file.params[k] = v
+				}
+			}
+			s.store.mu.Lock()
+			for i, p := range args.Parts {
+				part, ok := up.parts[p.PartNumber]
+				// the parts are in ascending order, and all but the last one are at least 1MB
+				if !ok || part.hash != p.Etag || (i > 0 && p.PartNumber <= args.Parts[i-1].PartNumber) ||
+					(i < len(args.Parts)-1 && len(part.data) < 1<<20) {
+					s.store.mu.Unlock()
+					s.writeError(w, errInvalidPart)
+					return
+				}
+				file.data = append(file.data, part.data...)
+			}
+			delete(s.store.uploads, items[4])
+			s.store.mu.Unlock()
+			s.save(w, policy, file)
+		case len(items) == 5 && req.Method == "DELETE":
+			s.store.mu.Lock()
+			delete(s.store.uploads, items[4])
+			s.store.mu.Unlock()
+			s.writeJSON(w, 200, nil)
+		default:
+			s.writeError(w, &apiError{405, "method not allowed"})
+		}
+	})
+}
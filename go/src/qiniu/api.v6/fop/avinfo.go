@@ -0,0 +1,74 @@
+package fop
+
+import (
+	"qiniu/rpc"
+)
+
+type AvinfoStream struct {
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecLongName string            `json:"codec_long_name"`
+	CodecType     string            `json:"codec_type"` // video, audio 等
+	Width         int               `json:"width,omitempty"`
+	Height        int               `json:"height,omitempty"`
+	PixFmt        string            `json:"pix_fmt,omitempty"`
+	SampleRate    string            `json:"sample_rate,omitempty"`
+	Channels      int               `json:"channels,omitempty"`
+	RFrameRate    string            `json:"r_frame_rate,omitempty"`
+	AvgFrameRate  string            `json:"avg_frame_rate,omitempty"`
+	StartTime     string            `json:"start_time,omitempty"`
+	Duration      string            `json:"duration,omitempty"`
+	BitRate       string            `json:"bit_rate,omitempty"`
+	NbFrames      string            `json:"nb_frames,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type AvinfoFormat struct {
+	NbStreams      int               `json:"nb_streams"`
+	FormatName     string            `json:"format_name"`
+	FormatLongName string            `json:"format_long_name"`
+	StartTime      string            `json:"start_time"`
+	Duration       string            `json:"duration"`
+	Size           string            `json:"size"`
+	BitRate        string            `json:"bit_rate"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+type AvinfoRet struct {
+	Streams []AvinfoStream `json:"streams"`
+	Format  AvinfoFormat   `json:"format"`
+}
+
+// Video returns the first video stream, nil if there is none
+func (this *AvinfoRet) Video() *AvinfoStream {
+	return this.stream("video")
+}
+
+// Audio returns the first audio stream, nil if there is none
+func (this *AvinfoRet) Audio() *AvinfoStream {
+	return this.stream("audio")
+}
+
+func (this *AvinfoRet) stream(codecType string) *AvinfoStream {
+	for i := range this.Streams {
+		if this.Streams[i].CodecType == codecType {
+			return &this.Streams[i]
+		}
+	}
+	return nil
+}
+
+type Avinfo struct{}
+
+func (this Avinfo) Fop() string {
+	return "avinfo"
+}
+
+func (this Avinfo) MakeRequest(url string) string {
+	return MakeRequest(url, this)
+}
+
+func (this Avinfo) Call(l rpc.Logger, url string) (ret AvinfoRet, err error) {
+	err = rpc.DefaultClient.Call(l, &ret, this.MakeRequest(url))
+	return
+}
@@ -0,0 +1,267 @@
+package fop
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------
+
+// Fop is a data processing command, like "imageView2/1/w/200".
+// The commands can be piped with "|", as the query of a download url or in PutPolicy.PersistentOps.
+type Fop interface {
+	Fop() string
+}
+
+// Pipe joins the commands with "|", the output of a command is the input of the next one
+func Pipe(fops ...Fop) string {
+	cmds := make([]string, 0, len(fops))
+	for _, fop := range fops {
+		cmds = append(cmds, fop.Fop())
+	}
+	return strings.Join(cmds, "|")
+}
+
+// MakeRequest returns the url processed by the piped commands
+func MakeRequest(url string, fops ...Fop) string {
+	return url + "?" + Pipe(fops...)
+}
+
+// PersistentOps joins the pipes with ";" for PutPolicy.PersistentOps and pfop,
+// each of them is a pipe of the commands made by Pipe
+func PersistentOps(pipes ...string) string {
+	return strings.Join(pipes, ";")
+}
+
+// EncodeParam is the URL-safe base64 of a text or url param, like the text of watermark
+func EncodeParam(param string) string {
+	return base64.URLEncoding.EncodeToString([]byte(param))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// cmdBuilder appends the "/<name>/<value>" params of a command
+type cmdBuilder struct {
+	cmd string
+}
+
+func (b *cmdBuilder) add(name, value string) {
+	b.cmd += "/" + name + "/" + value
+}
+
+func (b *cmdBuilder) addString(name, value string) {
+	if value != "" {
+		b.add(name, value)
+	}
+}
+
+func (b *cmdBuilder) addInt(name string, value int) {
+	if value != 0 {
+		b.add(name, strconv.Itoa(value))
+	}
+}
+
+func (b *cmdBuilder) addFloat(name string, value float64) {
+	if value != 0 {
+		b.add(name, formatFloat(value))
+	}
+}
+
+func (b *cmdBuilder) addBool(name string, value bool) {
+	if value {
+		b.add(name, "1")
+	}
+}
+
+func (b *cmdBuilder) addFlag(name string, value bool) {
+	if value {
+		b.cmd += "/" + name
+	}
+}
+
+// ----------------------------------------------------------
+
+// Saveas saves the result of the previous commands to the bucket.
+// In a download url the request needs to be signed, see atfuck.Saveas
+type Saveas struct {
+	Bucket string
+	Key    string // Key 为空表示由服务端生成
+}
+
+func (this Saveas) Fop() string {
+	entry := this.Bucket
+	if this.Key != "" {
+		entry += ":" + this.Key
+	}
+	return "saveas/" + EncodeParam(entry)
+}
+
+// ----------------------------------------------------------
+
+type ImageView2 struct {
+	Mode        int    // 缩略模式, 0-5
+	Width       int    // Width = 0 表示不限定宽度
+	Height      int    // Height = 0 表示不限定高度
+	Format      string // 可选。输出格式，如jpg, gif, png, webp等等
+	Interlace   bool   // 可选。是否渐进显示
+	Quality     int    // 可选。质量, 1-100
+	IgnoreError bool   // 可选。处理失败时返回原图
+}
+
+func (this ImageView2) Fop() string {
+	b := cmdBuilder{"imageView2/" + strconv.Itoa(this.Mode)}
+	b.addInt("w", this.Width)
+	b.addInt("h", this.Height)
+	b.addString("format", this.Format)
+	b.addBool("interlace", this.Interlace)
+	b.addInt("q", this.Quality)
+	b.addBool("ignore-error", this.IgnoreError)
+	return b.cmd
+}
+
+// ----------------------------------------------------------
+
+type ImageMogr2 struct {
+	AutoOrient bool   // 可选。根据原图EXIF信息自动旋正
+	Thumbnail  string // 可选。缩放参数，如 "300x", "!50p", "200x200>"
+	Strip      bool   // 可选。去除图片元信息
+	Gravity    string // 可选。裁剪锚点，如 NorthWest, Center
+	Crop       string // 可选。裁剪参数，如 "300x300", "!300x300a10a10"
+	Rotate     int    // 可选。旋转角度, 1-360
+	Format     string // 可选。输出格式
+	Blur       string // 可选。高斯模糊，如 "3x5" 表示半径3 方差5
+	Interlace  bool   // 可选。是否渐进显示
+	Quality    int    // 可选。质量, 1-100
+	Sharpen    int    // 可选。锐化程度
+}
+
+func (this ImageMogr2) Fop() string {
+	b := cmdBuilder{"imageMogr2"}
+	b.addFlag("auto-orient", this.AutoOrient)
+	b.addString("thumbnail", this.Thumbnail)
+	b.addFlag("strip", this.Strip)
+	b.addString("gravity", this.Gravity)
+	b.addString("crop", this.Crop)
+	b.addInt("rotate", this.Rotate)
+	b.addString("format", this.Format)
+	b.addString("blur", this.Blur)
+	b.addBool("interlace", this.Interlace)
+	b.addInt("quality", this.Quality)
+	b.addInt("sharpen", this.Sharpen)
+	return b.cmd
+}
+
+// ----------------------------------------------------------
+
+// WatermarkImage is the image watermark, watermark/1
+type WatermarkImage struct {
+	Image    string  // 水印图片的url
+	Dissolve int     // 可选。透明度, 1-100
+	Gravity  string  // 可选。水印位置，如 SouthEast
+	Dx       int     // 可选。横向边距
+	Dy       int     // 可选。纵向边距
+	Scale    float64 // 可选。水印图片相对原图短边的比例, 0-1
+}
+
+func (this WatermarkImage) Fop() string {
+	b := cmdBuilder{"watermark/1"}
+	b.add("image", EncodeParam(this.Image))
+	b.addInt("dissolve", this.Dissolve)
+	b.addString("gravity", this.Gravity)
+	b.addInt("dx", this.Dx)
+	b.addInt("dy", this.Dy)
+	b.addFloat("ws", this.Scale)
+	return b.cmd
+}
+
+// WatermarkText is the text watermark, watermark/2
+type WatermarkText struct {
+	Text     string // 水印文字
+	Font     string // 可选。字体名称
+	FontSize int    // 可选。字体大小，单位为缇
+	Fill     string // 可选。字体颜色，如 #FFFFFF
+	Dissolve int    // 可选。透明度, 1-100
+	Gravity  string // 可选。水印位置
+	Dx       int    // 可选。横向边距
+	Dy       int    // 可选。纵向边距
+}
+
+func (this WatermarkText) Fop() string {
+	b := cmdBuilder{"watermark/2"}
+	b.add("text", EncodeParam(this.Text))
+	if this.Font != "" {
+		b.add("font", EncodeParam(this.Font))
+	}
+	b.addInt("fontsize", this.FontSize)
+	if this.Fill != "" {
+		b.add("fill", EncodeParam(this.Fill))
+	}
+	b.addInt("dissolve", this.Dissolve)
+	b.addString("gravity", this.Gravity)
+	b.addInt("dx", this.Dx)
+	b.addInt("dy", this.Dy)
+	return b.cmd
+}
+
+// ----------------------------------------------------------
+
+type Vframe struct {
+	Format string  // 输出格式, jpg 或 png
+	Offset float64 // 截图的时间点，单位为秒
+	Width  int     // 可选。缩略图宽度
+	Height int     // 可选。缩略图高度
+	Rotate string  // 可选。旋转角度, 90, 180, 270 或 auto
+}
+
+func (this Vframe) Fop() string {
+	b := cmdBuilder{"vframe/" + this.Format}
+	b.add("offset", formatFloat(this.Offset))
+	b.addInt("w", this.Width)
+	b.addInt("h", this.Height)
+	b.addString("rotate", this.Rotate)
+	return b.cmd
+}
+
+// ----------------------------------------------------------
+
+type Avthumb struct {
+	Format          string  // 输出格式，如 mp4, flv, mp3, m3u8
+	Resolution      string  // 可选。分辨率，如 640x360
+	Autoscale       bool    // 可选。按原比例缩放到 Resolution 之内
+	Aspect          string  // 可选。宽高比，如 16:9
+	VideoBitRate    string  // 可选。视频码率，如 1m, 800k
+	VideoCodec      string  // 可选。视频编码，如 libx264
+	FrameRate       int     // 可选。帧率
+	AudioBitRate    string  // 可选。音频码率，如 128k
+	AudioCodec      string  // 可选。音频编码，如 libfaac
+	AudioSampleRate int     // 可选。音频采样率
+	AudioQuality    int     // 可选。音频质量, 0-9
+	Start           float64 // 可选。开始时间，单位为秒
+	Duration        float64 // 可选。时长，单位为秒
+	SegTime         int     // 可选。m3u8 的切片时长，单位为秒
+	StripMeta       bool    // 可选。去除元信息
+}
+
+func (this Avthumb) Fop() string {
+	b := cmdBuilder{"avthumb/" + this.Format}
+	b.addString("s", this.Resolution)
+	b.addBool("autoscale", this.Autoscale)
+	b.addString("aspect", this.Aspect)
+	b.addString("vb", this.VideoBitRate)
+	b.addString("vcodec", this.VideoCodec)
+	b.addInt("r", this.FrameRate)
+	b.addString("ab", this.AudioBitRate)
+	b.addString("acodec", this.AudioCodec)
+	b.addInt("ar", this.AudioSampleRate)
+	b.addInt("aq", this.AudioQuality)
+	b.addFloat("ss", this.Start)
+	b.addFloat("t", this.Duration)
+	b.addInt("segtime", this.SegTime)
+	b.addBool("stripmeta", this.StripMeta)
+	return b.cmd
+}
+
+// ----------------------------------------------------------
@@ -0,0 +1,50 @@
+package fop
+
+import (
+	"testing"
+
+	"qiniu/api.v6/rs"
+)
+
+func TestFopBuilders(t *testing.T) {
+	cases := []struct {
+		fop    Fop
+		expect string
+	}{
+		{ImageView2{Mode: 1, Width: 200, Height: 100, Format: "webp", Interlace: true, Quality: 75},
+			"imageView2/1/w/200/h/100/format/webp/interlace/1/q/75"},
+		{ImageMogr2{AutoOrient: true, Thumbnail: "!50p", Strip: true, Gravity: "Center", Crop: "300x300", Rotate: 90},
+			"imageMogr2/auto-orient/thumbnail/!50p/strip/gravity/Center/crop/300x300/rotate/90"},
+		{WatermarkText{Text: "七牛云存储", Font: "宋体", FontSize: 500, Fill: "#FFFFFF", Gravity: "SouthEast", Dx: 10, Dy: 10},
+			"watermark/2/text/5LiD54mb5LqR5a2Y5YKo/font/5a6L5L2T/fontsize/500/fill/I0ZGRkZGRg==/gravity/SouthEast/dx/10/dy/10"},
+		{WatermarkImage{Image: "http://www.b1.qiniudn.com/images/logo-2.png", Dissolve: 50, Scale: 0.2},
+			"watermark/1/image/aHR0cDovL3d3dy5iMS5xaW5pdWRuLmNvbS9pbWFnZXMvbG9nby0yLnBuZw==/dissolve/50/ws/0.2"},
+		{Vframe{Format: "jpg", Offset: 7.5, Width: 480, Height: 360}, "vframe/jpg/offset/7.5/w/480/h/360"},
+		{Vframe{Format: "png"}, "vframe/png/offset/0"},
+		{Avthumb{Format: "mp4", Resolution: "640x360", VideoBitRate: "1m", AudioBitRate: "128k", Start: 1.5, Duration: 30},
+			"avthumb/mp4/s/640x360/vb/1m/ab/128k/ss/1.5/t/30"},
+		{Avthumb{Format: "m3u8", SegTime: 10}, "avthumb/m3u8/segtime/10"},
+		{Avinfo{}, "avinfo"},
+		{Saveas{Bucket: "bucket", Key: "a/b.mp4"}, "saveas/YnVja2V0OmEvYi5tcDQ="},
+		{ImageView{Mode: 2, Width: 100}, "imageView/2/w/100"},
+	}
+	for _, c := range cases {
+		if got := c.fop.Fop(); got != c.expect {
+			t.Errorf("expect %s, got %s", c.expect, got)
+		}
+	}
+
+	url := MakeRequest("http://a.com/b.jpg", ImageMogr2{Thumbnail: "300x"}, WatermarkText{Text: "q"})
+	if url != "http://a.com/b.jpg?imageMogr2/thumbnail/300x|watermark/2/text/cQ==" {
+		t.Errorf("unexpected request %s", url)
+	}
+
+	policy := rs.PutPolicy{
+		PersistentOps: PersistentOps(
+			Pipe(Avthumb{Format: "mp4", Resolution: "640x360"}, Saveas{Bucket: "bucket", Key: "a.mp4"}),
+			Pipe(Vframe{Format: "jpg", Offset: 1})),
+	}
+	if policy.PersistentOps != "avthumb/mp4/s/640x360|saveas/YnVja2V0OmEubXA0;vframe/jpg/offset/1" {
+		t.Errorf("unexpected persistent ops %s", policy.PersistentOps)
+	}
+}
@@ -13,8 +13,12 @@ type ExifRet map[string]ExifValType
 
 type Exif struct{}
 
+func (this Exif) Fop() string {
+	return "exif"
+}
+
 func (this Exif) MakeRequest(url string) string {
-	return url + "?exif"
+	return MakeRequest(url, this)
 }
 
 func (this Exif) Call(l rpc.Logger, url string) (ret ExifRet, err error) {
@@ -13,8 +13,12 @@ type ImageInfoRet struct {
 
 type ImageInfo struct{}
 
+func (this ImageInfo) Fop() string {
+	return "imageInfo"
+}
+
 func (this ImageInfo) MakeRequest(url string) string {
-	return url + "?imageInfo"
+	return MakeRequest(url, this)
 }
 
 func (this ImageInfo) Call(l rpc.Logger, url string) (ret ImageInfoRet, err error) {
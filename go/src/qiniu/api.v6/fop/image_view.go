@@ -12,20 +12,24 @@ type ImageView struct {
 	Format  string // 输出格式，如jpg, gif, png, tif等等
 }
 
-func (this ImageView) MakeRequest(url string) string {
+func (this ImageView) Fop() string {
 
-	url += "?imageView/" + strconv.Itoa(this.Mode)
+	fop := "imageView/" + strconv.Itoa(this.Mode)
 	if this.Width > 0 {
-		url += "/w/" + strconv.Itoa(this.Width)
+		fop += "/w/" + strconv.Itoa(this.Width)
 	}
 	if this.Height > 0 {
-		url += "/h/" + strconv.Itoa(this.Height)
+		fop += "/h/" + strconv.Itoa(this.Height)
 	}
 	if this.Quality > 0 {
-		url += "/q/" + strconv.Itoa(this.Quality)
+		fop += "/q/" + strconv.Itoa(this.Quality)
 	}
 	if this.Format != "" {
-		url += "/format/" + this.Format
+		fop += "/format/" + this.Format
 	}
-	return url
+	return fop
+}
+
+func (this ImageView) MakeRequest(url string) string {
+	return MakeRequest(url, this)
 }
@@ -2,6 +2,7 @@ package io
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -37,7 +38,7 @@ type PutRet struct {
 
 // ----------------------------------------------------------
 
-func put(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, data io.Reader, size int64, extra *PutExtra) error {
+func put(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, data io.Reader, size int64, extra *PutExtra) error {
 
 	// CheckCrc == 1: 对于 Put 和 PutWithoutKey 等同于 CheckCrc == 2
 	if extra != nil {
@@ -47,28 +48,52 @@ func put(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKe
 			extra.CheckCrc = 2
 		}
 	}
-	return putWrite(c, l, ret, uptoken, key, hasKey, data, size, extra)
+	return putWrite(ctx, c, l, ret, uptoken, key, hasKey, data, size, extra)
 }
 
 func Put2(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, data io.Reader, size int64, extra *PutExtra) error {
-	return put(c, l, ret, uptoken, key, true, data, size, extra)
+	return put(context.Background(), c, l, ret, uptoken, key, true, data, size, extra)
 }
 
 func PutWithoutKey2(c rpc.Client, l rpc.Logger, ret interface{}, uptoken string, data io.Reader, size int64, extra *PutExtra) error {
-	return put(c, l, ret, uptoken, "", false, data, size, extra)
+	return put(context.Background(), c, l, ret, uptoken, "", false, data, size, extra)
+}
+
+func Put2Ctx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, data io.Reader, size int64, extra *PutExtra) error {
+
+	return put(ctx, c, l, ret, uptoken, key, true, data, size, extra)
+}
+
+func PutWithoutKey2Ctx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, uptoken string, data io.Reader, size int64, extra *PutExtra) error {
+
+	return put(ctx, c, l, ret, uptoken, "", false, data, size, extra)
 }
 
 // ----------------------------------------------------------
 
 func PutFile(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key, localFile string, extra *PutExtra) (err error) {
-	return putFile(c, l, ret, uptoken, key, true, localFile, extra)
+	return putFile(context.Background(), c, l, ret, uptoken, key, true, localFile, extra)
 }
 
 func PutFileWithoutKey(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, localFile string, extra *PutExtra) (err error) {
-	return putFile(c, l, ret, uptoken, "", false, localFile, extra)
+	return putFile(context.Background(), c, l, ret, uptoken, "", false, localFile, extra)
+}
+
+func PutFileCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key, localFile string, extra *PutExtra) (err error) {
+
+	return putFile(ctx, c, l, ret, uptoken, key, true, localFile, extra)
 }
 
-func putFile(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, localFile string, extra *PutExtra) (err error) {
+func PutFileWithoutKeyCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, uptoken, localFile string, extra *PutExtra) (err error) {
+
+	return putFile(ctx, c, l, ret, uptoken, "", false, localFile, extra)
+}
+
+func putFile(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, localFile string, extra *PutExtra) (err error) {
 
 	f, err := os.Open(localFile)
 	if err != nil {
@@ -89,12 +114,12 @@ func putFile(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, h
 		}
 	}
 
-	return putWrite(c, l, ret, uptoken, key, hasKey, f, fsize, extra)
+	return putWrite(ctx, c, l, ret, uptoken, key, hasKey, f, fsize, extra)
 }
 
 // ----------------------------------------------------------
 
-func putWrite(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, data io.Reader, size int64, extra *PutExtra) error {
+func putWrite(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string, hasKey bool, data io.Reader, size int64, extra *PutExtra) error {
 
 	var b bytes.Buffer
 	writer := multipart.NewWriter(&b)
@@ -108,11 +133,58 @@ func putWrite(c rpc.Client, l rpc.Logger, ret interface{}, uptoken, key string,
 	r := bytes.NewReader([]byte(lastLine))
 
 	bodyLen := int64(b.Len()) + size + int64(len(lastLine))
-	mr := io.MultiReader(&b, data, r)
+	var body io.Reader
+	if ra, ok := data.(io.ReaderAt); ok {
+		// the body can be rewound when the client retries
+		var base int64
+		if s, ok := data.(io.Seeker); ok {
+			if base, err = s.Seek(0, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		parts := multiReaderAt{
+			io.NewSectionReader(bytes.NewReader(b.Bytes()), 0, int64(b.Len())),
+			io.NewSectionReader(ra, base, size),
+			io.NewSectionReader(r, 0, r.Size()),
+		}
+		body = io.NewSectionReader(parts, 0, bodyLen)
+	} else {
+		body = io.MultiReader(&b, data, r)
+	}
 
 	contentType := writer.FormDataContentType()
 
-	return c.CallWith64(l, ret, UP_HOST, contentType, mr, bodyLen)
+	return c.CallWith64Ctx(ctx, l, ret, UP_HOST, contentType, body, bodyLen)
+}
+
+// multiReaderAt is the concatenation of the parts
+type multiReaderAt []*io.SectionReader
+
+func (m multiReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+
+	for _, part := range m {
+		if len(p) == 0 {
+			return
+		}
+		if off >= part.Size() {
+			off -= part.Size()
+			continue
+		}
+		nn, rErr := part.ReadAt(p, off)
+		n += nn
+		if rErr != nil && rErr != io.EOF {
+			return n, rErr
+		}
+		if rErr == io.EOF && off+int64(nn) < part.Size() {
+			return n, io.ErrUnexpectedEOF
+		}
+		p = p[nn:]
+		off = 0
+	}
+	if len(p) > 0 {
+		err = io.EOF
+	}
+	return
 }
 
 /*
@@ -0,0 +1,423 @@
+package io
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"qiniu/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	. "qiniu/api.v6/conf"
+)
+
+// ----------------------------------------------------------
+// 分片上传 v2：
+// 1. InitParts 创建上传，得到 uploadId
+// 2. UploadPart 上传各个分片（可以并行），得到分片的 etag
+// 3. CompleteParts 按分片序号提交所有分片的 etag，合成文件；或者 AbortParts 放弃上传
+
+const (
+	MinPartSize     = 1 << 20 // 除最后一个分片外，分片不小于 1MB
+	MaxPartSize     = 1 << 30
+	MaxParts        = 10000
+	DefaultPartSize = 4 << 20
+
+	NoSuchUpload = 612 // UP: uploadId 不存在或者已经过期
+)
+
+var ErrInvalidPartSize = errors.New("part size should be between 1MB and 1GB")
+var ErrTooManyParts = errors.New("too many parts, please use a larger part size")
+var ErrUnmatchedMd5 = errors.New("unmatched part md5")
+
+type InitPartsRet struct {
+	UploadId string `json:"uploadId"`
+	ExpireAt int64  `json:"expireAt"`
+}
+
+type UploadPartRet struct {
+	Etag string `json:"etag"`
+	Md5  string `json:"md5"`
+}
+
+type UploadPartInfo struct {
+	Etag       string `json:"etag"`
+	PartNumber int    `json:"partNumber"`
+}
+
+// MultipartProgress is saved in the progress file to resume the upload
+type MultipartProgress struct {
+	UploadId string           `json:"upload_id"`
+	ExpireAt int64            `json:"expire_at"`
+	PartSize int64            `json:"part_size"`
+	Fsize    int64            `json:"fsize"`
+	Parts    []UploadPartInfo `json:"parts"` // 第 i 个分片的上传结果，Etag 为空表示未上传
+}
+
+// @gist PutExtraV2
+type PutExtraV2 struct {
+	Params       map[string]string     // 可选。用户自定义参数，以"x:"开头 否则忽略
+	MimeType     string                // 可选。
+	PartSize     int64                 // 可选。分片大小，默认 4MB
+	TryTimes     int                   // 可选。每个分片的尝试次数
+	ProgressFile string                // 可选。分片级断点续传进度保存文件
+	Concurrency  int                   // 可选。本文件同时上传的分片数目，为 0 表示不限制
+	AbortOnError bool                  // 可选。上传失败时放弃 uploadId 并删除进度文件，被取消时除外
+	OnProgress   func(p BlockProgress) // 可选。进度提示，BlkIdx 为分片序号减一，每个分片完成或失败时调用
+}
+
+// @endgist
+
+// ----------------------------------------------------------
+
+func encodeKeyV2(key string, hasKey bool) string {
+	if !hasKey {
+		return "~"
+	}
+	return encode(key)
+}
+
+func uploadsURL(bucket, key string, hasKey bool) string {
+	return fmt.Sprintf("%s/buckets/%s/objects/%s/uploads", UP_HOST, url.PathEscape(bucket), encodeKeyV2(key, hasKey))
+}
+
+func InitParts(ctx context.Context,
+	c rpc.Client, l rpc.Logger, bucket, key string, hasKey bool) (ret InitPartsRet, err error) {
+
+	err = c.CallWithCtx(ctx, l, &ret, uploadsURL(bucket, key, hasKey), "application/octet-stream", nil, 0)
+	return
+}
+
+// UploadPart uploads the part numbered from 1, body should be an io.ReaderAt if the client retries.
+// The server checks the part against partMd5, the hex md5 of the body, unless it is empty.
+func UploadPart(ctx context.Context, c rpc.Client, l rpc.Logger, bucket, key string, hasKey bool,
+	uploadId string, partNumber int, partMd5 string, body io.Reader, size int64) (ret UploadPartRet, err error) {
+
+	url1 := uploadsURL(bucket, key, hasKey) + "/" + uploadId + "/" + strconv.Itoa(partNumber)
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if partMd5 != "" {
+		header.Set("Content-MD5", partMd5)
+	}
+	err = c.CallWithHeaderCtx(ctx, l, &ret, "PUT", url1, header, body, size)
+	return
+}
+
+// CompleteParts makes the file of the parts, which are ordered by the part number
+func CompleteParts(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key string, hasKey bool, uploadId string, parts []UploadPartInfo, extra *PutExtraV2) error {
+
+	if extra == nil {
+		extra = new(PutExtraV2)
+	}
+	body := map[string]interface{}{
+		"parts": parts,
+	}
+	if hasKey {
+		body["fname"] = key
+	}
+	if extra.MimeType != "" {
+		body["mimeType"] = extra.MimeType
+	}
+	if len(extra.Params) > 0 {
+		body["customVars"] = extra.Params
+	}
+	return c.CallWithJsonCtx(ctx, l, ret, uploadsURL(bucket, key, hasKey)+"/"+uploadId, body)
+}
+
+func AbortParts(ctx context.Context,
+	c rpc.Client, l rpc.Logger, bucket, key string, hasKey bool, uploadId string) error {
+
+	return c.CallWithMethodCtx(ctx, l, nil, "DELETE", uploadsURL(bucket, key, hasKey)+"/"+uploadId, "", nil, 0)
+}
+
+// ----------------------------------------------------------
+
+func PutV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key string, f io.ReaderAt, fsize int64, extra *PutExtraV2) error {
+
+	u := defaultUploader()
+	defer u.release()
+
+	return u.PutV2(ctx, c, l, ret, bucket, key, f, fsize, extra)
+}
+
+func PutFileV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key, localFile string, extra *PutExtraV2) error {
+
+	u := defaultUploader()
+	defer u.release()
+
+	return u.PutFileV2(ctx, c, l, ret, bucket, key, localFile, extra)
+}
+
+func (u *Uploader) PutV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key string, f io.ReaderAt, fsize int64, extra *PutExtraV2) error {
+
+	return u.putV2(ctx, c, l, ret, bucket, key, true, f, fsize, extra)
+}
+
+func (u *Uploader) PutWithoutKeyV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket string, f io.ReaderAt, fsize int64, extra *PutExtraV2) error {
+
+	return u.putV2(ctx, c, l, ret, bucket, "", false, f, fsize, extra)
+}
+
+func (u *Uploader) PutFileV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key, localFile string, extra *PutExtraV2) error {
+
+	return u.putFileV2(ctx, c, l, ret, bucket, key, true, localFile, extra)
+}
+
+func (u *Uploader) PutFileWithoutKeyV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, localFile string, extra *PutExtraV2) error {
+
+	return u.putFileV2(ctx, c, l, ret, bucket, "", false, localFile, extra)
+}
+
+// ----------------------------------------------------------
+
+// PartCount returns the number of the parts of the file, an empty file has one empty part
+func PartCount(fsize, partSize int64) int {
+	if fsize == 0 {
+		return 1
+	}
+	return int((fsize + partSize - 1) / partSize)
+}
+
+// loadMultipartProgress returns the progress saved for the same file and part size, which is not about to expire
+func loadMultipartProgress(progressFile string, fsize, partSize int64) *MultipartProgress {
+
+	data, err := ioutil.ReadFile(progressFile)
+	if err != nil {
+		return nil
+	}
+	var progress MultipartProgress
+	if err = json.Unmarshal(data, &progress); err != nil {
+		logs.Warning("resumable.PutV2 decode progress record error, %s", err)
+		return nil
+	}
+	if progress.UploadId == "" || progress.Fsize != fsize || progress.PartSize != partSize ||
+		len(progress.Parts) != PartCount(fsize, partSize) {
+		return nil
+	}
+	if time.Now().Add(time.Hour).Unix() > progress.ExpireAt {
+		return nil
+	}
+	return &progress
+}
+
+func partMd5(f io.ReaderAt, offset, size int64) (string, error) {
+
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (u *Uploader) putV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key string, hasKey bool, f io.ReaderAt, fsize int64, extra *PutExtraV2) (err error) {
+
+	if !u.acquire() {
+		return ErrUploaderClosed
+	}
+	defer u.release()
+
+	if extra == nil {
+		extra = new(PutExtraV2)
+	}
+	partSize := extra.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize || partSize > MaxPartSize {
+		return ErrInvalidPartSize
+	}
+	partCnt := PartCount(fsize, partSize)
+	if partCnt > MaxParts {
+		return ErrTooManyParts
+	}
+	tryTimes := extra.TryTimes
+	if tryTimes == 0 {
+		tryTimes = u.settings.TryTimes
+	}
+
+	var progress *MultipartProgress
+	if extra.ProgressFile != "" {
+		progress = loadMultipartProgress(extra.ProgressFile, fsize, partSize)
+	}
+	if progress == nil {
+		initRet, iErr := InitParts(ctx, c, l, bucket, key, hasKey)
+		if iErr != nil {
+			return iErr
+		}
+		progress = &MultipartProgress{
+			UploadId: initRet.UploadId,
+			ExpireAt: initRet.ExpireAt,
+			PartSize: partSize,
+			Fsize:    fsize,
+			Parts:    make([]UploadPartInfo, partCnt),
+		}
+		if extra.ProgressFile != "" {
+			writeProgressFile(extra.ProgressFile, progress)
+		}
+	}
+
+	defer func() {
+		if err != nil && extra.AbortOnError && ctx.Err() == nil {
+			if aErr := AbortParts(context.Background(), c, l, bucket, key, hasKey, progress.UploadId); aErr != nil {
+				logs.Warning("resumable.PutV2 abort upload `%s` error, %s", progress.UploadId, aErr)
+			}
+			if extra.ProgressFile != "" {
+				os.Remove(extra.ProgressFile)
+			}
+		}
+	}()
+
+	var uploaded int64
+	for i, part := range progress.Parts {
+		if part.Etag != "" {
+			uploaded += partSizeAt(i, partSize, fsize)
+		}
+	}
+	resumed := uploaded
+	notify := func(partIdx int, pErr error) {
+		if extra.OnProgress != nil {
+			size := partSizeAt(partIdx, partSize, fsize)
+			offset := size
+			if pErr != nil {
+				offset = 0
+			}
+			extra.OnProgress(BlockProgress{
+				BlkIdx:   partIdx,
+				BlkSize:  int(size),
+				Offset:   int(offset),
+				Uploaded: atomic.LoadInt64(&uploaded),
+				Resumed:  resumed,
+				Fsize:    fsize,
+				Err:      pErr,
+			})
+		}
+	}
+
+	var progressLock sync.Mutex
+	var nfails, expired int32
+
+	err = u.dispatch(ctx, partCnt, extra.Concurrency, func(partIdx int) {
+		if progress.Parts[partIdx].Etag != "" {
+			return
+		}
+		if ctx.Err() != nil {
+			notify(partIdx, ctx.Err())
+			atomic.AddInt32(&nfails, 1)
+			return
+		}
+		offset := int64(partIdx) * partSize
+		size := partSizeAt(partIdx, partSize, fsize)
+		md5Sum, pErr := partMd5(f, offset, size)
+		if pErr != nil {
+			notify(partIdx, pErr)
+			atomic.AddInt32(&nfails, 1)
+			return
+		}
+
+		var partRet UploadPartRet
+		for try := 1; ; try++ {
+			body := io.NewSectionReader(f, offset, size)
+			partRet, pErr = UploadPart(ctx, c, l, bucket, key, hasKey, progress.UploadId, partIdx+1, md5Sum, body, size)
+			if pErr == nil && partRet.Md5 != "" && partRet.Md5 != md5Sum {
+				pErr = ErrUnmatchedMd5
+			}
+			if pErr == nil {
+				break
+			}
+			if ei, ok := pErr.(*rpc.ErrorInfo); ok && ei.Code == NoSuchUpload {
+				atomic.AddInt32(&expired, 1)
+				break
+			}
+			if try >= tryTimes || ctx.Err() != nil {
+				break
+			}
+			logs.Warning("resumable.PutV2 part %d failed, %s, retrying ...", partIdx+1, pErr)
+			rpc.CountRetry()
+		}
+		if pErr != nil {
+			logs.Warning("resumable.PutV2 part", partIdx+1, "failed:", pErr)
+			atomic.AddInt32(&nfails, 1)
+			notify(partIdx, pErr)
+			return
+		}
+
+		progressLock.Lock()
+		progress.Parts[partIdx] = UploadPartInfo{Etag: partRet.Etag, PartNumber: partIdx + 1}
+		if extra.ProgressFile != "" {
+			writeProgressFile(extra.ProgressFile, progress)
+		}
+		progressLock.Unlock()
+		atomic.AddInt64(&uploaded, size)
+		notify(partIdx, nil)
+	})
+	if err != nil {
+		return
+	}
+	if expired != 0 {
+		// the upload id can not be used any more, start over next time
+		if extra.ProgressFile != "" {
+			os.Remove(extra.ProgressFile)
+		}
+		return ErrPutFailed
+	}
+	if nfails != 0 {
+		return ErrPutFailed
+	}
+
+	err = CompleteParts(ctx, c, l, ret, bucket, key, hasKey, progress.UploadId, progress.Parts, &PutExtraV2{
+		Params:   extra.Params,
+		MimeType: extra.MimeType,
+	})
+	if extra.ProgressFile != "" {
+		// the upload id is used up once completed
+		if ei, ok := err.(*rpc.ErrorInfo); err == nil || ok && ei.Code == NoSuchUpload {
+			os.Remove(extra.ProgressFile)
+		}
+	}
+	return
+}
+
+func partSizeAt(partIdx int, partSize, fsize int64) int64 {
+	offset := int64(partIdx) * partSize
+	if fsize-offset < partSize {
+		return fsize - offset
+	}
+	return partSize
+}
+
+func (u *Uploader) putFileV2(ctx context.Context, c rpc.Client, l rpc.Logger, ret interface{},
+	bucket, key string, hasKey bool, localFile string, extra *PutExtraV2) (err error) {
+
+	f, err := os.Open(localFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	return u.putV2(ctx, c, l, ret, bucket, key, hasKey, f, fi.Size(), extra)
+}
+
+// ----------------------------------------------------------
@@ -1,15 +1,11 @@
 package io
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"github.com/astaxie/beego/logs"
 	"io"
-	"io/ioutil"
-	"os"
 	"qiniu/rpc"
 	"sync"
-	"time"
 )
 
 // ----------------------------------------------------------
@@ -34,8 +30,13 @@ var settings = Settings{
 	TryTimes:  defaultTryTimes,
 }
 
+// SetSettings changes the settings of the package level Put functions,
+// the uploads already started keep the settings they started with
 func SetSettings(v *Settings) {
 
+	uploaderMutex.Lock()
+	defer uploaderMutex.Unlock()
+
 	settings = *v
 	if settings.Workers == 0 {
 		settings.Workers = defaultWorkers
@@ -49,24 +50,31 @@ func SetSettings(v *Settings) {
 	if settings.TryTimes == 0 {
 		settings.TryTimes = defaultTryTimes
 	}
+	// the workers of the previous uploader exit once it is unused
+	if uploader != nil {
+		uploader.closeWhenIdle()
+	}
+	uploader = nil
 }
 
 // ----------------------------------------------------------
 
-var tasks chan func()
+var uploader *Uploader
+var uploaderMutex sync.Mutex
 
-func worker(tasks chan func()) {
-	for {
-		task := <-tasks
-		task()
-	}
-}
+// defaultUploader returns the uploader of the package level Put functions acquired, so that SetSettings
+// can not close it before the put starts, the caller releases it after the put
+func defaultUploader() *Uploader {
 
-func initWorkers() {
-	tasks = make(chan func(), settings.TaskQsize)
-	for i := 0; i < settings.Workers; i++ {
-		go worker(tasks)
+	uploaderMutex.Lock()
+	defer uploaderMutex.Unlock()
+
+	if uploader == nil {
+		uploader = NewUploader(&settings)
 	}
+	//the uploader is not closed, SetSettings drops it when it is told to close
+	uploader.acquire()
+	return uploader
 }
 
 func notifyNil(blkIdx int, blkSize int, ret *BlkputRet) {}
@@ -108,10 +116,23 @@ type PutExtra struct {
 	ProgressFile string                                        //可选。块级断点续传进度保存文件
 	Notify       func(blkIdx int, blkSize int, ret *BlkputRet) // 可选。进度提示（注意多个block是并行传输的）
 	NotifyErr    func(blkIdx int, blkSize int, err error)
+	Concurrency  int                   // 可选。本文件同时上传的block数目，为 0 表示不限制
+	OnProgress   func(p BlockProgress) // 可选。进度提示，每个chunk上传完成或者block失败时调用
 }
 
 // @endgist
 
+// BlockProgress is the progress of a file after a chunk of one of its blocks is uploaded
+type BlockProgress struct {
+	BlkIdx   int   // block 序号
+	BlkSize  int   // block 大小
+	Offset   int   // block 已上传的字节数
+	Uploaded int64 // 文件已上传的字节数，包括 Resumed
+	Resumed  int64 // 从进度文件恢复、本次无需上传的字节数
+	Fsize    int64 // 文件大小
+	Err      error // 不为 nil 表示该 block 上传失败
+}
+
 type PutRet struct {
 	Hash string `json:"hash"` // 如果 uptoken 没有指定 ReturnBody，那么返回值是标准的 PutRet 结构
 	Key  string `json:"key"`
@@ -120,165 +141,71 @@ type PutRet struct {
 var ErrInvalidPutProgress = errors.New("invalid put progress")
 var ErrPutFailed = errors.New("resumable put failed")
 
-var once sync.Once
-
 // ----------------------------------------------------------
 
 func Put(c rpc.Client, l rpc.Logger, ret interface{}, key string, f io.ReaderAt, fsize int64, extra *PutExtra) error {
-	return put(c, l, ret, key, true, f, fsize, extra)
+	u := defaultUploader()
+	defer u.release()
+
+	return u.Put(context.Background(), c, l, ret, key, f, fsize, extra)
 }
 
 func PutWithoutKey(c rpc.Client, l rpc.Logger, ret interface{}, f io.ReaderAt, fsize int64, extra *PutExtra) error {
-	return put(c, l, ret, "", false, f, fsize, extra)
+	u := defaultUploader()
+	defer u.release()
+
+	return u.PutWithoutKey(context.Background(), c, l, ret, f, fsize, extra)
 }
 
 func PutFile(c rpc.Client, l rpc.Logger, ret interface{}, key, localFile string, extra *PutExtra) (err error) {
-	return putFile(c, l, ret, key, true, localFile, extra)
-}
+	u := defaultUploader()
+	defer u.release()
 
-func PutFileWithoutKey(c rpc.Client, l rpc.Logger, ret interface{}, localFile string, extra *PutExtra) (err error) {
-	return putFile(c, l, ret, "", false, localFile, extra)
+	return u.PutFile(context.Background(), c, l, ret, key, localFile, extra)
 }
 
-// ----------------------------------------------------------
+func PutFileWithoutKey(c rpc.Client, l rpc.Logger, ret interface{}, localFile string, extra *PutExtra) (err error) {
+	u := defaultUploader()
+	defer u.release()
 
-func put(c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, f io.ReaderAt, fsize int64, extra *PutExtra) error {
+	return u.PutFileWithoutKey(context.Background(), c, l, ret, localFile, extra)
+}
 
-	once.Do(initWorkers)
+// PutCtx is Put which stops when ctx is done, the blocks not yet uploaded fail with ctx.Err()
+func PutCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, f io.ReaderAt, fsize int64, extra *PutExtra) error {
 
-	blockCnt := BlockCount(fsize)
+	u := defaultUploader()
+	defer u.release()
 
-	if extra == nil {
-		extra = new(PutExtra)
-	}
+	return u.Put(ctx, c, l, ret, key, f, fsize, extra)
+}
 
-	//load the progress file
-	var progressWLock = sync.RWMutex{}
-
-	if extra.ProgressFile != "" {
-		progressRecord := ProgressRecord{}
-		if _, pStatErr := os.Stat(extra.ProgressFile); pStatErr == nil {
-			progressFp, openErr := os.Open(extra.ProgressFile)
-			if openErr == nil {
-				func() {
-					defer progressFp.Close()
-					decoder := json.NewDecoder(progressFp)
-					decodeErr := decoder.Decode(&progressRecord)
-					if decodeErr != nil {
-						logs.Warning("resumable.Put decode progess record error, %s", decodeErr)
-					}
-				}()
-			} else {
-				logs.Warning("resumable.Put open progress record error, %s", openErr)
-			}
-		}
-
-		//load in progresses
-		if progressRecord.Progresses != nil && len(progressRecord.Progresses) > 0 {
-			//check the expire date of the first progress
-			now := time.Now()
-			first := progressRecord.Progresses[0]
-			if now.Add(time.Hour*24).Unix() <= first.ExpiredAt {
-				//not expired, go ahead
-				extra.Progresses = progressRecord.Progresses
-			}
-		}
-	}
+func PutWithoutKeyCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, f io.ReaderAt, fsize int64, extra *PutExtra) error {
 
-	if extra.Progresses == nil {
-		extra.Progresses = make([]BlkputRet, blockCnt)
-	} else if len(extra.Progresses) != blockCnt {
-		return ErrInvalidPutProgress
-	}
+	u := defaultUploader()
+	defer u.release()
 
-	if extra.ChunkSize == 0 {
-		extra.ChunkSize = settings.ChunkSize
-	}
-	if extra.TryTimes == 0 {
-		extra.TryTimes = settings.TryTimes
-	}
-	if extra.Notify == nil {
-		extra.Notify = notifyNil
-	}
-	if extra.NotifyErr == nil {
-		extra.NotifyErr = notifyErrNil
-	}
+	return u.PutWithoutKey(ctx, c, l, ret, f, fsize, extra)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(blockCnt)
-
-	last := blockCnt - 1
-	blkSize := 1 << blockBits
-	nfails := 0
-
-	for i := 0; i < blockCnt; i++ {
-		blkIdx := i
-		blkSize1 := blkSize
-		if i == last {
-			offbase := int64(blkIdx) << blockBits
-			blkSize1 = int(fsize - offbase)
-		}
-		task := func() {
-			defer wg.Done()
-			tryTimes := extra.TryTimes
-		lzRetry:
-			err := ResumableBlockput(c, l, &extra.Progresses[blkIdx], f, blkIdx, blkSize1, extra)
-			if err != nil {
-				if tryTimes > 1 {
-					tryTimes--
-					logs.Warning("resumable.Put retrying ...")
-					goto lzRetry
-				}
-				logs.Warning("resumable.Put", blkIdx, "failed:", err)
-				extra.NotifyErr(blkIdx, blkSize1, err)
-				nfails++
-			} else {
-				//record block progress
-				if extra.ProgressFile != "" {
-					progressWLock.Lock()
-					func() {
-						defer progressWLock.Unlock()
-						progressRecord := ProgressRecord{
-							Progresses: extra.Progresses,
-						}
-						mData, mErr := json.Marshal(progressRecord)
-						if mErr == nil {
-							wErr := ioutil.WriteFile(extra.ProgressFile, mData, 0644)
-							if wErr != nil {
-								logs.Warning("resumable.Put record progress error, %s", wErr.Error)
-							}
-						} else {
-							logs.Warning("resumable.Put marshal progress record error, %s", mErr.Error)
-						}
-					}()
-				}
-			}
-		}
-		tasks <- task
-	}
+func PutFileCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key, localFile string, extra *PutExtra) (err error) {
 
-	wg.Wait()
-	if nfails != 0 {
-		return ErrPutFailed
-	}
+	u := defaultUploader()
+	defer u.release()
 
-	return Mkfile(c, l, ret, key, hasKey, fsize, extra)
+	return u.PutFile(ctx, c, l, ret, key, localFile, extra)
 }
 
-func putFile(c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, localFile string, extra *PutExtra) (err error) {
+func PutFileWithoutKeyCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, localFile string, extra *PutExtra) (err error) {
 
-	f, err := os.Open(localFile)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return
-	}
+	u := defaultUploader()
+	defer u.release()
 
-	return put(c, l, ret, key, hasKey, f, fi.Size(), extra)
+	return u.PutFileWithoutKey(ctx, c, l, ret, localFile, extra)
 }
 
 // ----------------------------------------------------------
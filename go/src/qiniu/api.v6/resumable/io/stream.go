@@ -0,0 +1,205 @@
+package io
+
+import (
+	"context"
+	"io"
+	"qiniu/rpc"
+	"sync"
+	"sync/atomic"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// ----------------------------------------------------------
+
+// blockReaderAt reads a block of a stream kept in memory at its offset in the stream
+type blockReaderAt struct {
+	data    []byte
+	offbase int64
+}
+
+func (b *blockReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+
+	off -= b.offbase
+	if off < 0 || off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, b.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// PutStream uploads the data read from r until EOF, such as stdin, which can not seek or tell its size first.
+// The blocks are uploaded as soon as they are read, at most extra.Concurrency of them at the same time
+// (the workers of the Uploader if 0), so only these blocks are kept in memory.
+// The Fsize of BlockProgress is -1, and the Progresses and ProgressFile of extra are not used.
+func (u *Uploader) PutStream(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, r io.Reader, extra *PutExtra) error {
+
+	return u.putStream(ctx, c, l, ret, key, true, r, extra)
+}
+
+func (u *Uploader) PutStreamWithoutKey(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, r io.Reader, extra *PutExtra) error {
+
+	return u.putStream(ctx, c, l, ret, "", false, r, extra)
+}
+
+func PutStreamCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, r io.Reader, extra *PutExtra) error {
+
+	return defaultUploader().PutStream(ctx, c, l, ret, key, r, extra)
+}
+
+func (u *Uploader) putStream(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, r io.Reader, extra *PutExtra) (err error) {
+
+	if !u.acquire() {
+		return ErrUploaderClosed
+	}
+	defer u.release()
+	u.startOnce.Do(u.start)
+
+	if extra == nil {
+		extra = new(PutExtra)
+	}
+	streamExtra := *extra
+	streamExtra.ProgressFile = ""
+	if streamExtra.ChunkSize == 0 {
+		streamExtra.ChunkSize = u.settings.ChunkSize
+	}
+	if streamExtra.TryTimes == 0 {
+		streamExtra.TryTimes = u.settings.TryTimes
+	}
+	if streamExtra.Notify == nil {
+		streamExtra.Notify = notifyNil
+	}
+	if streamExtra.NotifyErr == nil {
+		streamExtra.NotifyErr = notifyErrNil
+	}
+	concurrency := streamExtra.Concurrency
+	if concurrency <= 0 {
+		concurrency = u.settings.Workers
+	}
+	running := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	var progresses []*BlkputRet
+	var uploaded int64
+	var nfails int32
+	var fsize int64
+
+	blkSize := 1 << blockBits
+
+blocks:
+	for blkIdx := 0; atomic.LoadInt32(&nfails) == 0; blkIdx++ {
+		//wait for a free slot before reading the block, to bound the memory used
+		select {
+		case running <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break blocks
+		case <-u.quit:
+			err = ErrUploaderClosed
+			break blocks
+		}
+		data := make([]byte, blkSize)
+		n, rErr := io.ReadFull(r, data)
+		if rErr == io.EOF {
+			<-running
+			break
+		} else if rErr != nil && rErr != io.ErrUnexpectedEOF {
+			<-running
+			err = rErr
+			break
+		}
+		block := &blockReaderAt{data: data[:n], offbase: fsize}
+		fsize += int64(n)
+		prog := new(BlkputRet)
+		progresses = append(progresses, prog)
+
+		idx, size := blkIdx, n
+		run := func() {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			//the chunks of the block report to the tracker
+			var offset uint32
+			blkExtra := streamExtra
+			blkExtra.Notify = func(blkIdx int, blkSize int, ret *BlkputRet) {
+				total := atomic.AddInt64(&uploaded, int64(ret.Offset)-int64(offset))
+				offset = ret.Offset
+				streamExtra.Notify(blkIdx, blkSize, ret)
+				if streamExtra.OnProgress != nil {
+					streamExtra.OnProgress(BlockProgress{BlkIdx: blkIdx, BlkSize: blkSize, Offset: int(ret.Offset),
+						Uploaded: total, Fsize: -1})
+				}
+			}
+			tryTimes := streamExtra.TryTimes
+		lzRetry:
+			pErr := ResumableBlockputCtx(ctx, c, l, prog, block, idx, size, &blkExtra)
+			if pErr != nil {
+				if tryTimes > 1 && ctx.Err() == nil {
+					tryTimes--
+					logs.Warning("resumable.PutStream retrying ...")
+					rpc.CountRetry()
+					goto lzRetry
+				}
+				logs.Warning("resumable.PutStream", idx, "failed:", pErr)
+				streamExtra.NotifyErr(idx, size, pErr)
+				if streamExtra.OnProgress != nil {
+					streamExtra.OnProgress(BlockProgress{BlkIdx: idx, BlkSize: size, Offset: int(offset),
+						Uploaded: atomic.LoadInt64(&uploaded), Fsize: -1, Err: pErr})
+				}
+				atomic.AddInt32(&nfails, 1)
+			}
+		}
+		wg.Add(1)
+		select {
+		case u.tasks <- run:
+		case <-ctx.Done():
+			<-running
+			wg.Done()
+			err = ctx.Err()
+			break blocks
+		case <-u.quit:
+			<-running
+			wg.Done()
+			err = ErrUploaderClosed
+			break blocks
+		}
+		//the last block is not full
+		if rErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	//wait for the blocks uploading, or give up if the workers are stopped
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-u.quit:
+		return ErrUploaderClosed
+	}
+	if err != nil {
+		return
+	}
+	if nfails != 0 {
+		return ErrPutFailed
+	}
+
+	streamExtra.Progresses = make([]BlkputRet, len(progresses))
+	for i, prog := range progresses {
+		streamExtra.Progresses[i] = *prog
+	}
+	return MkfileCtx(ctx, c, l, ret, key, hasKey, fsize, &streamExtra)
+}
+
+// ----------------------------------------------------------
@@ -1,6 +1,8 @@
 package io
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -11,7 +13,6 @@ import (
 
 	"github.com/astaxie/beego/logs"
 	. "qiniu/api.v6/conf"
-	"qiniu/bytes"
 	"qiniu/rpc"
 )
 
@@ -49,7 +50,7 @@ func NewTransport(token string, transport http.RoundTripper) *Transport {
 
 func NewClientEx(token string, transport http.RoundTripper, bindRemoteIp string) rpc.Client {
 	t := NewTransport(token, transport)
-	return rpc.Client{&http.Client{Transport: t}, bindRemoteIp}
+	return rpc.Client{Client: &http.Client{Transport: t}, BindRemoteIp: bindRemoteIp}
 }
 
 func NewClient(token string, bindRemoteIp string) rpc.Client {
@@ -62,14 +63,26 @@ func NewClient(token string, bindRemoteIp string) rpc.Client {
 func Mkblock(
 	c rpc.Client, l rpc.Logger, ret *BlkputRet, blockSize int, body io.Reader, size int) error {
 
-	return c.CallWith(l, ret, UP_HOST+"/mkblk/"+strconv.Itoa(blockSize), "application/octet-stream", body, size)
+	return MkblockCtx(context.Background(), c, l, ret, blockSize, body, size)
+}
+
+func MkblockCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret *BlkputRet, blockSize int, body io.Reader, size int) error {
+
+	return c.CallWithCtx(ctx, l, ret, UP_HOST+"/mkblk/"+strconv.Itoa(blockSize), "application/octet-stream", body, size)
 }
 
 func Blockput(
 	c rpc.Client, l rpc.Logger, ret *BlkputRet, body io.Reader, size int) error {
 
+	return BlockputCtx(context.Background(), c, l, ret, body, size)
+}
+
+func BlockputCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret *BlkputRet, body io.Reader, size int) error {
+
 	url := ret.Host + "/bput/" + ret.Ctx + "/" + strconv.FormatUint(uint64(ret.Offset), 10)
-	return c.CallWith(l, ret, url, "application/octet-stream", body, size)
+	return c.CallWithCtx(ctx, l, ret, url, "application/octet-stream", body, size)
 }
 
 // ----------------------------------------------------------
@@ -77,7 +90,23 @@ func Blockput(
 func ResumableBlockput(
 	c rpc.Client, l rpc.Logger, ret *BlkputRet, f io.ReaderAt, blkIdx, blkSize int, extra *PutExtra) (err error) {
 
-	h := crc32.NewIEEE()
+	return ResumableBlockputCtx(context.Background(), c, l, ret, f, blkIdx, blkSize, extra)
+}
+
+// readChunk reads a chunk of the block into memory, so that the client can send it again when retrying
+func readChunk(f io.ReaderAt, offset int64, size int) (chunk []byte, crc uint32, err error) {
+
+	chunk = make([]byte, size)
+	if _, err = io.ReadFull(io.NewSectionReader(f, offset, int64(size)), chunk); err != nil {
+		return
+	}
+	crc = crc32.ChecksumIEEE(chunk)
+	return
+}
+
+func ResumableBlockputCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret *BlkputRet, f io.ReaderAt, blkIdx, blkSize int, extra *PutExtra) (err error) {
+
 	offbase := int64(blkIdx) << blockBits
 	chunkSize := extra.ChunkSize
 
@@ -91,14 +120,16 @@ func ResumableBlockput(
 			bodyLength = blkSize
 		}
 
-		body1 := io.NewSectionReader(f, offbase, int64(bodyLength))
-		body := io.TeeReader(body1, h)
+		chunk, crc, rErr := readChunk(f, offbase, bodyLength)
+		if rErr != nil {
+			return rErr
+		}
 
-		err = Mkblock(c, l, ret, blkSize, body, bodyLength)
+		err = MkblockCtx(ctx, c, l, ret, blkSize, bytes.NewReader(chunk), bodyLength)
 		if err != nil {
 			return
 		}
-		if ret.Crc32 != h.Sum32() || int(ret.Offset) != bodyLength {
+		if ret.Crc32 != crc || int(ret.Offset) != bodyLength {
 			err = ErrUnmatchedChecksum
 			return
 		}
@@ -113,16 +144,17 @@ func ResumableBlockput(
 			bodyLength = blkSize - int(ret.Offset)
 		}
 
+		chunk, crc, rErr := readChunk(f, offbase+int64(ret.Offset), bodyLength)
+		if rErr != nil {
+			return rErr
+		}
+
 		tryTimes := extra.TryTimes
 
 	lzRetry:
-		h.Reset()
-		body1 := io.NewSectionReader(f, offbase+int64(ret.Offset), int64(bodyLength))
-		body := io.TeeReader(body1, h)
-
-		err = Blockput(c, l, ret, body, bodyLength)
+		err = BlockputCtx(ctx, c, l, ret, bytes.NewReader(chunk), bodyLength)
 		if err == nil {
-			if ret.Crc32 == h.Sum32() {
+			if ret.Crc32 == crc {
 				extra.Notify(blkIdx, blkSize, ret)
 				continue
 			}
@@ -136,9 +168,10 @@ func ResumableBlockput(
 			}
 			logs.Warning("ResumableBlockput: bput failed -", err)
 		}
-		if tryTimes > 1 {
+		if tryTimes > 1 && ctx.Err() == nil {
 			tryTimes--
 			logs.Warning("ResumableBlockput retrying ...")
+			rpc.CountRetry()
 			goto lzRetry
 		}
 		break
@@ -151,6 +184,12 @@ func ResumableBlockput(
 func Mkfile(
 	c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, fsize int64, extra *PutExtra) (err error) {
 
+	return MkfileCtx(context.Background(), c, l, ret, key, hasKey, fsize, extra)
+}
+
+func MkfileCtx(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, fsize int64, extra *PutExtra) (err error) {
+
 	url := UP_HOST + "/mkfile/" + strconv.FormatInt(fsize, 10)
 
 	if extra.MimeType != "" {
@@ -172,7 +211,7 @@ func Mkfile(
 		buf = buf[:len(buf)-1]
 	}
 
-	return c.CallWith(l, ret, url, "application/octet-stream", bytes.NewReader(buf), len(buf))
+	return c.CallWithCtx(ctx, l, ret, url, "application/octet-stream", bytes.NewReader(buf), len(buf))
 }
 
 // ----------------------------------------------------------
@@ -0,0 +1,442 @@
+package io
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"qiniu/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// ----------------------------------------------------------
+
+var ErrUploaderClosed = errors.New("uploader closed")
+
+// Uploader uploads the blocks of the files with its own pool of workers,
+// the uploads of different Uploaders do not compete for the workers.
+type Uploader struct {
+	settings Settings
+	tasks    chan func()
+	quit     chan struct{}
+
+	startOnce sync.Once
+	closeOnce sync.Once
+
+	mutex     sync.Mutex
+	active    int
+	closeIdle bool
+}
+
+// NewUploader creates an Uploader, the zero values of v are replaced by the defaults.
+// The workers are started by the first upload.
+func NewUploader(v *Settings) *Uploader {
+
+	u := &Uploader{quit: make(chan struct{})}
+	if v != nil {
+		u.settings = *v
+	}
+	if u.settings.Workers <= 0 {
+		u.settings.Workers = defaultWorkers
+	}
+	if u.settings.TaskQsize <= 0 {
+		u.settings.TaskQsize = u.settings.Workers * 4
+	}
+	if u.settings.ChunkSize <= 0 {
+		u.settings.ChunkSize = defaultChunkSize
+	}
+	if u.settings.TryTimes <= 0 {
+		u.settings.TryTimes = defaultTryTimes
+	}
+	return u
+}
+
+func (u *Uploader) Settings() Settings {
+	return u.settings
+}
+
+// Close stops the workers, the uploads in progress fail with ErrUploaderClosed
+func (u *Uploader) Close() {
+	u.closeOnce.Do(func() {
+		close(u.quit)
+	})
+}
+
+func (u *Uploader) closeWhenIdle() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.active == 0 {
+		u.Close()
+		return
+	}
+	u.closeIdle = true
+}
+
+func (u *Uploader) acquire() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	select {
+	case <-u.quit:
+		return false
+	default:
+	}
+	u.active++
+	return true
+}
+
+func (u *Uploader) release() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.active--
+	if u.active == 0 && u.closeIdle {
+		u.Close()
+	}
+}
+
+func (u *Uploader) start() {
+	u.tasks = make(chan func(), u.settings.TaskQsize)
+	for i := 0; i < u.settings.Workers; i++ {
+		go u.worker()
+	}
+}
+
+func (u *Uploader) worker() {
+	for {
+		select {
+		case task := <-u.tasks:
+			task()
+		case <-u.quit:
+			return
+		}
+	}
+}
+
+// dispatch runs task(0), ..., task(count-1) on the workers, at most concurrency of them at the same time,
+// and waits for them. It returns ctx.Err() or ErrUploaderClosed if not all of the tasks are done.
+func (u *Uploader) dispatch(ctx context.Context, count, concurrency int, task func(idx int)) error {
+
+	u.startOnce.Do(u.start)
+	if concurrency <= 0 || concurrency > count {
+		concurrency = count
+	}
+	running := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+tasks:
+	for i := 0; i < count; i++ {
+		idx := i
+		run := func() {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			task(idx)
+		}
+
+		//wait for a free slot, then for a worker
+		select {
+		case running <- struct{}{}:
+		case <-ctx.Done():
+			break tasks
+		case <-u.quit:
+			break tasks
+		}
+		wg.Add(1)
+		select {
+		case u.tasks <- run:
+		case <-ctx.Done():
+			<-running
+			wg.Done()
+			break tasks
+		case <-u.quit:
+			<-running
+			wg.Done()
+			break tasks
+		}
+	}
+
+	//wait for the tasks running, or give up if the workers are stopped
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-u.quit:
+		return ErrUploaderClosed
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	select {
+	case <-u.quit:
+		return ErrUploaderClosed
+	default:
+	}
+	return nil
+}
+
+// ----------------------------------------------------------
+
+func (u *Uploader) Put(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, f io.ReaderAt, fsize int64, extra *PutExtra) error {
+
+	return u.put(ctx, c, l, ret, key, true, f, fsize, extra)
+}
+
+func (u *Uploader) PutWithoutKey(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, f io.ReaderAt, fsize int64, extra *PutExtra) error {
+
+	return u.put(ctx, c, l, ret, "", false, f, fsize, extra)
+}
+
+func (u *Uploader) PutFile(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key, localFile string, extra *PutExtra) (err error) {
+
+	return u.putFile(ctx, c, l, ret, key, true, localFile, extra)
+}
+
+func (u *Uploader) PutFileWithoutKey(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, localFile string, extra *PutExtra) (err error) {
+
+	return u.putFile(ctx, c, l, ret, "", false, localFile, extra)
+}
+
+// ----------------------------------------------------------
+
+// loadProgressFile returns the progresses saved in the progress file, nil if they are missing or about to expire
+func loadProgressFile(progressFile string) []BlkputRet {
+
+	progressRecord := ProgressRecord{}
+	if _, pStatErr := os.Stat(progressFile); pStatErr == nil {
+		progressFp, openErr := os.Open(progressFile)
+		if openErr == nil {
+			func() {
+				defer progressFp.Close()
+				decoder := json.NewDecoder(progressFp)
+				decodeErr := decoder.Decode(&progressRecord)
+				if decodeErr != nil {
+					logs.Warning("resumable.Put decode progess record error, %s", decodeErr)
+				}
+			}()
+		} else {
+			logs.Warning("resumable.Put open progress record error, %s", openErr)
+		}
+	}
+
+	//load in progresses
+	if progressRecord.Progresses != nil && len(progressRecord.Progresses) > 0 {
+		//check the expire date of the first progress
+		now := time.Now()
+		first := progressRecord.Progresses[0]
+		if now.Add(time.Hour*24).Unix() <= first.ExpiredAt {
+			//not expired, go ahead
+			return progressRecord.Progresses
+		}
+	}
+	return nil
+}
+
+func writeProgressFile(progressFile string, progressRecord interface{}) {
+
+	mData, mErr := json.Marshal(progressRecord)
+	if mErr == nil {
+		wErr := ioutil.WriteFile(progressFile, mData, 0644)
+		if wErr != nil {
+			logs.Warning("resumable.Put record progress error, %s", wErr)
+		}
+	} else {
+		logs.Warning("resumable.Put marshal progress record error, %s", mErr)
+	}
+}
+
+// progressTracker sums up the uploaded bytes of the blocks for BlockProgress
+type progressTracker struct {
+	extra    *PutExtra
+	fsize    int64
+	offsets  []uint32 // the offset of each block is only changed by the worker uploading the block
+	uploaded int64
+	resumed  int64
+}
+
+func newProgressTracker(extra *PutExtra, fsize int64) *progressTracker {
+
+	p := &progressTracker{
+		extra:   extra,
+		fsize:   fsize,
+		offsets: make([]uint32, len(extra.Progresses)),
+	}
+	for i, prog := range extra.Progresses {
+		p.offsets[i] = prog.Offset
+		p.uploaded += int64(prog.Offset)
+	}
+	p.resumed = p.uploaded
+	return p
+}
+
+func (p *progressTracker) notify(blkIdx int, blkSize int, ret *BlkputRet) {
+
+	uploaded := atomic.AddInt64(&p.uploaded, int64(ret.Offset)-int64(p.offsets[blkIdx]))
+	p.offsets[blkIdx] = ret.Offset
+	p.extra.Notify(blkIdx, blkSize, ret)
+	if p.extra.OnProgress != nil {
+		p.extra.OnProgress(BlockProgress{
+			BlkIdx:   blkIdx,
+			BlkSize:  blkSize,
+			Offset:   int(ret.Offset),
+			Uploaded: uploaded,
+			Resumed:  p.resumed,
+			Fsize:    p.fsize,
+		})
+	}
+}
+
+func (p *progressTracker) notifyErr(blkIdx int, blkSize int, err error) {
+
+	p.extra.NotifyErr(blkIdx, blkSize, err)
+	if p.extra.OnProgress != nil {
+		p.extra.OnProgress(BlockProgress{
+			BlkIdx:   blkIdx,
+			BlkSize:  blkSize,
+			Offset:   int(p.offsets[blkIdx]),
+			Uploaded: atomic.LoadInt64(&p.uploaded),
+			Resumed:  p.resumed,
+			Fsize:    p.fsize,
+			Err:      err,
+		})
+	}
+}
+
+// ----------------------------------------------------------
+
+func (u *Uploader) put(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, f io.ReaderAt, fsize int64, extra *PutExtra) error {
+
+	if !u.acquire() {
+		return ErrUploaderClosed
+	}
+	defer u.release()
+
+	blockCnt := BlockCount(fsize)
+
+	if extra == nil {
+		extra = new(PutExtra)
+	}
+
+	//load the progress file
+	var progressWLock = sync.RWMutex{}
+
+	if extra.ProgressFile != "" {
+		if progresses := loadProgressFile(extra.ProgressFile); progresses != nil {
+			extra.Progresses = progresses
+		}
+	}
+
+	if extra.Progresses == nil {
+		extra.Progresses = make([]BlkputRet, blockCnt)
+	} else if len(extra.Progresses) != blockCnt {
+		return ErrInvalidPutProgress
+	}
+
+	if extra.ChunkSize == 0 {
+		extra.ChunkSize = u.settings.ChunkSize
+	}
+	if extra.TryTimes == 0 {
+		extra.TryTimes = u.settings.TryTimes
+	}
+	if extra.Notify == nil {
+		extra.Notify = notifyNil
+	}
+	if extra.NotifyErr == nil {
+		extra.NotifyErr = notifyErrNil
+	}
+
+	//the blocks report to the tracker, which passes the progress on to extra
+	tracker := newProgressTracker(extra, fsize)
+	blkExtra := *extra
+	blkExtra.Notify = tracker.notify
+
+	last := blockCnt - 1
+	blkSize := 1 << blockBits
+	var nfails int32
+
+	err := u.dispatch(ctx, blockCnt, extra.Concurrency, func(blkIdx int) {
+		blkSize1 := blkSize
+		if blkIdx == last {
+			offbase := int64(blkIdx) << blockBits
+			blkSize1 = int(fsize - offbase)
+		}
+		if ctx.Err() != nil {
+			tracker.notifyErr(blkIdx, blkSize1, ctx.Err())
+			atomic.AddInt32(&nfails, 1)
+			return
+		}
+		//the block is uploaded with its own copy of the progress, extra.Progresses is shared by the workers
+		//and only changed under the lock
+		progressWLock.RLock()
+		progress := extra.Progresses[blkIdx]
+		progressWLock.RUnlock()
+		defer func() {
+			progressWLock.Lock()
+			defer progressWLock.Unlock()
+			extra.Progresses[blkIdx] = progress
+			if extra.ProgressFile != "" && progress.Offset == uint32(blkSize1) {
+				writeProgressFile(extra.ProgressFile, ProgressRecord{Progresses: extra.Progresses})
+			}
+		}()
+
+		tryTimes := extra.TryTimes
+	lzRetry:
+		err := ResumableBlockputCtx(ctx, c, l, &progress, f, blkIdx, blkSize1, &blkExtra)
+		if err != nil {
+			if tryTimes > 1 && ctx.Err() == nil {
+				tryTimes--
+				logs.Warning("resumable.Put retrying ...")
+				rpc.CountRetry()
+				goto lzRetry
+			}
+			logs.Warning("resumable.Put", blkIdx, "failed:", err)
+			tracker.notifyErr(blkIdx, blkSize1, err)
+			atomic.AddInt32(&nfails, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if nfails != 0 {
+		return ErrPutFailed
+	}
+
+	return MkfileCtx(ctx, c, l, ret, key, hasKey, fsize, extra)
+}
+
+func (u *Uploader) putFile(ctx context.Context,
+	c rpc.Client, l rpc.Logger, ret interface{}, key string, hasKey bool, localFile string, extra *PutExtra) (err error) {
+
+	f, err := os.Open(localFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	return u.put(ctx, c, l, ret, key, hasKey, f, fi.Size(), extra)
+}
+
+// ----------------------------------------------------------
@@ -1,6 +1,8 @@
 package rs
 
 import (
+	"context"
+
 	. "qiniu/api.v6/conf"
 	"qiniu/rpc"
 )
@@ -8,7 +10,11 @@ import (
 // ----------------------------------------------------------
 
 func (rs Client) Batch(l rpc.Logger, ret interface{}, op []string) (err error) {
-	return rs.Conn.CallWithForm(l, ret, RS_HOST+"/batch", map[string][]string{"op": op})
+	return rs.BatchCtx(context.Background(), l, ret, op)
+}
+
+func (rs Client) BatchCtx(ctx context.Context, l rpc.Logger, ret interface{}, op []string) (err error) {
+	return rs.Conn.CallWithFormCtx(ctx, l, ret, RS_HOST+"/batch", map[string][]string{"op": op})
 }
 
 // ----------------------------------------------------------
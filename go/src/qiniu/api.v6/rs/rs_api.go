@@ -1,6 +1,7 @@
 package rs
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
 
@@ -19,18 +20,18 @@ type Client struct {
 func NewMac(mac *digest.Mac) Client {
 	t := digest.NewTransport(mac, nil)
 	client := &http.Client{Transport: t}
-	return Client{rpc.Client{client, ""}}
+	return Client{rpc.Client{Client: client}}
 }
 
 func NewEx(t http.RoundTripper) Client {
 	client := &http.Client{Transport: t}
-	return Client{rpc.Client{client, ""}}
+	return Client{rpc.Client{Client: client}}
 }
 
 func NewMacEx(mac *digest.Mac, t http.RoundTripper, bindRemoteIp string) Client {
 	mt := digest.NewTransport(mac, t)
 	client := &http.Client{Transport: mt}
-	return Client{rpc.Client{client, bindRemoteIp}}
+	return Client{rpc.Client{Client: client, BindRemoteIp: bindRemoteIp}}
 }
 
 // ----------------------------------------------------------
@@ -48,24 +49,53 @@ type Entry struct {
 // @endgist
 
 func (rs Client) Stat(l rpc.Logger, bucket, key string) (entry Entry, err error) {
-	err = rs.Conn.Call(l, &entry, RS_HOST+URIStat(bucket, key))
+	return rs.StatCtx(context.Background(), l, bucket, key)
+}
+
+func (rs Client) StatCtx(ctx context.Context, l rpc.Logger, bucket, key string) (entry Entry, err error) {
+	err = rs.Conn.CallCtx(ctx, l, &entry, RS_HOST+URIStat(bucket, key))
 	return
 }
 
 func (rs Client) Delete(l rpc.Logger, bucket, key string) (err error) {
-	return rs.Conn.Call(l, nil, RS_HOST+URIDelete(bucket, key))
+	return rs.DeleteCtx(context.Background(), l, bucket, key)
+}
+
+func (rs Client) DeleteCtx(ctx context.Context, l rpc.Logger, bucket, key string) (err error) {
+	return rs.Conn.CallCtx(ctx, l, nil, RS_HOST+URIDelete(bucket, key))
 }
 
 func (rs Client) Move(l rpc.Logger, bucketSrc, keySrc, bucketDest, keyDest string, force bool) (err error) {
-	return rs.Conn.Call(l, nil, RS_HOST+URIMove(bucketSrc, keySrc, bucketDest, keyDest, force))
+	return rs.MoveCtx(context.Background(), l, bucketSrc, keySrc, bucketDest, keyDest, force)
+}
+
+func (rs Client) MoveCtx(ctx context.Context, l rpc.Logger, bucketSrc, keySrc, bucketDest, keyDest string, force bool) (err error) {
+	return rs.Conn.CallCtx(ctx, l, nil, RS_HOST+URIMove(bucketSrc, keySrc, bucketDest, keyDest, force))
 }
 
 func (rs Client) Copy(l rpc.Logger, bucketSrc, keySrc, bucketDest, keyDest string, force bool) (err error) {
-	return rs.Conn.Call(l, nil, RS_HOST+URICopy(bucketSrc, keySrc, bucketDest, keyDest, force))
+	return rs.CopyCtx(context.Background(), l, bucketSrc, keySrc, bucketDest, keyDest, force)
+}
+
+func (rs Client) CopyCtx(ctx context.Context, l rpc.Logger, bucketSrc, keySrc, bucketDest, keyDest string, force bool) (err error) {
+	return rs.Conn.CallCtx(ctx, l, nil, RS_HOST+URICopy(bucketSrc, keySrc, bucketDest, keyDest, force))
 }
 
 func (rs Client) ChangeMime(l rpc.Logger, bucket, key, mime string) (err error) {
-	return rs.Conn.Call(l, nil, RS_HOST+URIChangeMime(bucket, key, mime))
+	return rs.ChangeMimeCtx(context.Background(), l, bucket, key, mime)
+}
+
+func (rs Client) ChangeMimeCtx(ctx context.Context, l rpc.Logger, bucket, key, mime string) (err error) {
+	return rs.Conn.CallCtx(ctx, l, nil, RS_HOST+URIChangeMime(bucket, key, mime))
+}
+
+// ChangeType 修改文件的存储类型，0 表示普通存储，1 表示低频存储
+func (rs Client) ChangeType(l rpc.Logger, bucket, key string, fileType int) (err error) {
+	return rs.ChangeTypeCtx(context.Background(), l, bucket, key, fileType)
+}
+
+func (rs Client) ChangeTypeCtx(ctx context.Context, l rpc.Logger, bucket, key string, fileType int) (err error) {
+	return rs.Conn.CallCtx(ctx, l, nil, RS_HOST+URIChangeType(bucket, key, fileType))
 }
 
 func encodeURI(uri string) string {
@@ -92,6 +122,10 @@ func URIChangeMime(bucket, key, mime string) string {
 	return fmt.Sprintf("/chgm/%s/mime/%s", encodeURI(bucket+":"+key), encodeURI(mime))
 }
 
+func URIChangeType(bucket, key string, fileType int) string {
+	return fmt.Sprintf("/chtype/%s/type/%d", encodeURI(bucket+":"+key), fileType)
+}
+
 func URIPrefetch(bucket, key string) string {
 	return fmt.Sprintf("/prefetch/%s", encodeURI(bucket+":"+key))
 }
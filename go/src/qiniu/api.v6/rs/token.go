@@ -47,6 +47,9 @@ type PutPolicy struct {
 	InsertOnly          uint16 `json:"exclusive,omitempty"`  // 若非0, 即使Scope为 Bucket:Key 的形式也是insert only
 	DetectMime          uint16 `json:"detectMime,omitempty"` // 若非0, 则服务端根据内容自动确定 MimeType
 	FsizeLimit          int64  `json:"fsizeLimit,omitempty"`
+	IsPrefixalScope     int    `json:"isPrefixalScope,omitempty"` // 若为1, Scope为 Bucket:KeyPrefix 的形式时允许上传该前缀的任意Key
+	FsizeMin            int64  `json:"fsizeMin,omitempty"`        // 文件大小的下限
+	MimeLimit           string `json:"mimeLimit,omitempty"`       // 允许的MimeType, 如 image/*;video/mp4, 以!开头则为禁止的MimeType
 	SaveKey             string `json:"saveKey,omitempty"`
 	CallbackUrl         string `json:"callbackUrl,omitempty"`
 	CallbackBody        string `json:"callbackBody,omitempty"`
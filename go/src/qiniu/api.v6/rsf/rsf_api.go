@@ -1,6 +1,7 @@
 package rsf
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -25,8 +26,9 @@ type ListItem struct {
 }
 
 type ListRet struct {
-	Marker string     `json:"marker"`
-	Items  []ListItem `json:"items"`
+	Marker         string     `json:"marker"`
+	Items          []ListItem `json:"items"`
+	CommonPrefixes []string   `json:"commonPrefixes,omitempty"`
 }
 
 // ----------------------------------------------------------
@@ -38,18 +40,18 @@ type Client struct {
 func New(mac *digest.Mac) Client {
 	t := digest.NewTransport(mac, nil)
 	client := &http.Client{Transport: t}
-	return Client{rpc.Client{client, ""}}
+	return Client{rpc.Client{Client: client}}
 }
 
 func NewEx(t http.RoundTripper) Client {
 	client := &http.Client{Transport: t}
-	return Client{rpc.Client{client, ""}}
+	return Client{rpc.Client{Client: client}}
 }
 
 func NewMacEx(mac *digest.Mac, t http.RoundTripper, bindRemoteIp string) Client {
 	mt := digest.NewTransport(mac, t)
 	client := &http.Client{Transport: mt}
-	return Client{rpc.Client{client, bindRemoteIp}}
+	return Client{rpc.Client{Client: client, BindRemoteIp: bindRemoteIp}}
 }
 
 // ----------------------------------------------------------
@@ -57,32 +59,49 @@ func NewMacEx(mac *digest.Mac, t http.RoundTripper, bindRemoteIp string) Client
 // 2. 无论 err 值如何，均应该先看 entries 是否有内容
 // 3. 如果后续没有更多数据，err 返回 EOF，markerOut 返回 ""（但不通过该特征来判断是否结束）
 func (rsf Client) ListPrefix(l rpc.Logger, bucket, prefix, marker string, limit int) (entries []ListItem, markerOut string, err error) {
+	return rsf.ListPrefixCtx(context.Background(), l, bucket, prefix, marker, limit)
+}
+
+func (rsf Client) ListPrefixCtx(ctx context.Context,
+	l rpc.Logger, bucket, prefix, marker string, limit int) (entries []ListItem, markerOut string, err error) {
+
+	entries, _, markerOut, err = rsf.ListDelimiterCtx(ctx, l, bucket, prefix, "", marker, limit)
+	return
+}
+
+// 指定 delimiter 时，prefix 之后含有 delimiter 的文件不在 entries 中，而是合并为 commonPrefixes 返回，
+// 如 delimiter = "/" 时只列举一级目录；limit 同时限制 entries 与 commonPrefixes 的总数
+func (rsf Client) ListDelimiterCtx(ctx context.Context, l rpc.Logger, bucket, prefix, delimiter, marker string,
+	limit int) (entries []ListItem, commonPrefixes []string, markerOut string, err error) {
 
 	if bucket == "" {
 		err = errors.New("bucket could not be nil")
 		return
 	}
 
-	URL := makeListURL(bucket, prefix, marker, limit)
+	URL := makeListURL(bucket, prefix, delimiter, marker, limit)
 	listRet := ListRet{}
-	err = rsf.Conn.Call(l, &listRet, URL)
+	err = rsf.Conn.CallCtx(ctx, l, &listRet, URL)
 
 	if err != nil {
 		return
 	}
 	if listRet.Marker == "" {
-		return listRet.Items, "", io.EOF
+		return listRet.Items, listRet.CommonPrefixes, "", io.EOF
 	}
-	return listRet.Items, listRet.Marker, err
+	return listRet.Items, listRet.CommonPrefixes, listRet.Marker, err
 }
 
-func makeListURL(bucket, prefix, marker string, limit int) string {
+func makeListURL(bucket, prefix, delimiter, marker string, limit int) string {
 
 	query := make(url.Values)
 	query.Add("bucket", bucket)
 	if prefix != "" {
 		query.Add("prefix", prefix)
 	}
+	if delimiter != "" {
+		query.Add("delimiter", delimiter)
+	}
 	if marker != "" {
 		query.Add("marker", marker)
 	}
@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------
+
+// RetryPolicy decides whether a request is sent again.
+// attempt is the number of the attempts already made (starting from 1),
+// resp and err are the result of the last attempt.
+// It returns the delay before the next attempt, and false to give up.
+type RetryPolicy interface {
+	Retry(attempt int, resp *http.Response, err error) (delay time.Duration, retry bool)
+}
+
+// Backoff retries the retryable errors with an exponential delay
+type Backoff struct {
+	MaxRetries  int           // 最多重试次数
+	Interval    time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	MaxInterval time.Duration // 可选。等待时间的上限，为 0 表示不限制
+}
+
+var DefaultRetryPolicy = &Backoff{
+	MaxRetries:  3,
+	Interval:    time.Second,
+	MaxInterval: 30 * time.Second,
+}
+
+func (b *Backoff) Retry(attempt int, resp *http.Response, err error) (delay time.Duration, retry bool) {
+
+	if attempt > b.MaxRetries || !ShouldRetry(resp, err) {
+		return
+	}
+	delay = b.Interval
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if b.MaxInterval > 0 && delay >= b.MaxInterval {
+			delay = b.MaxInterval
+			break
+		}
+	}
+	return delay, true
+}
+
+// --------------------------------------------------------------------
+
+// IsRetryableCode reports whether a request failed with the code may succeed if sent again.
+// 571/573/579 are the server side callback and frequency limit errors of qiniu.
+func IsRetryableCode(code int) bool {
+	switch code {
+	case 571, 573, 579:
+		return true
+	}
+	return code/100 == 5
+}
+
+// ShouldRetry reports whether the result of a request is a network error or a retryable status code
+func ShouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp != nil && IsRetryableCode(resp.StatusCode)
+}
+
+// --------------------------------------------------------------------
+
+var retryCount int64
+
+// CountRetry counts a request sent again, the callers retrying by themselves should call it too
+func CountRetry() {
+	atomic.AddInt64(&retryCount, 1)
+}
+
+// RetryCount returns the requests sent again since the start of the process
+func RetryCount() int64 {
+	return atomic.LoadInt64(&retryCount)
+}
+
+// --------------------------------------------------------------------
+
+// rewinder makes a request body readable again from its start for retries,
+// it works for the bodies which implement io.ReaderAt, like *os.File and *io.SectionReader
+func rewinder(body io.Reader, bodyLength int64) func() (io.ReadCloser, error) {
+
+	ra, ok := body.(io.ReaderAt)
+	if !ok || bodyLength < 0 {
+		return nil
+	}
+	var base int64
+	if s, ok := body.(io.Seeker); ok {
+		offset, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil
+		}
+		base = offset
+	}
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(ra, base, bodyLength)), nil
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithRetry calls f until it succeeds or the policy gives up.
+// An error of f which is an *ErrorInfo is judged by its code, the others are taken as network errors.
+func WithRetry(ctx context.Context, policy RetryPolicy, f func() error) (err error) {
+
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || ctx.Err() != nil {
+			return
+		}
+		var resp *http.Response
+		var callErr = err
+		var ei *ErrorInfo
+		if errors.As(err, &ei) {
+			resp, callErr = &http.Response{StatusCode: ei.Code}, nil
+		}
+		delay, retry := policy.Retry(attempt, resp, callErr)
+		if !retry {
+			return
+		}
+		CountRetry()
+		if sErr := sleepCtx(ctx, delay); sErr != nil {
+			return sErr
+		}
+	}
+}
+
+// --------------------------------------------------------------------
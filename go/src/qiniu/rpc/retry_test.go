@@ -0,0 +1,142 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{MaxRetries: 4, Interval: time.Second, MaxInterval: 3 * time.Second}
+	resp := &http.Response{StatusCode: 503}
+
+	expects := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, expect := range expects {
+		delay, retry := b.Retry(i+1, resp, nil)
+		if !retry || delay != expect {
+			t.Fatalf("attempt %d: expect %v, got %v %v", i+1, expect, delay, retry)
+		}
+	}
+	if _, retry := b.Retry(5, resp, nil); retry {
+		t.Fatal("expect to give up after MaxRetries")
+	}
+
+	for code, expect := range map[int]bool{200: false, 401: false, 612: false, 500: true, 503: true, 571: true, 573: true, 579: true} {
+		if _, retry := b.Retry(1, &http.Response{StatusCode: code}, nil); retry != expect {
+			t.Fatalf("code %d: expect retry %v", code, expect)
+		}
+	}
+	if _, retry := b.Retry(1, nil, errors.New("connection reset")); !retry {
+		t.Fatal("expect to retry network errors")
+	}
+	if _, retry := b.Retry(1, nil, context.Canceled); retry {
+		t.Fatal("expect not to retry a canceled request")
+	}
+}
+
+func TestRetryRewindsBody(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"body":"` + string(body) + `"}`))
+	}))
+	defer srv.Close()
+
+	fpath := filepath.Join(t.TempDir(), "body")
+	if err := ioutil.WriteFile(fpath, []byte("--hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the body starts from the current offset of the file
+	f.Seek(2, io.SeekStart)
+
+	c := Client{Client: http.DefaultClient, Retry: &Backoff{MaxRetries: 3}}
+	var ret struct {
+		Body string `json:"body"`
+	}
+	if err = c.CallWith(nil, &ret, srv.URL, "application/octet-stream", f, 5); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&calls) != 3 || ret.Body != "hello" {
+		t.Fatalf("unexpected calls %d, body %s", atomic.LoadInt32(&calls), ret.Body)
+	}
+
+	// a body which can not be rewound is sent once
+	atomic.StoreInt32(&calls, 0)
+	err = c.CallWith(nil, nil, srv.URL, "application/octet-stream", ioutil.NopCloser(strings.NewReader("hello")), 5)
+	if e, ok := err.(*ErrorInfo); !ok || e.Code != 503 || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expect one failed call, got %d %v", atomic.LoadInt32(&calls), err)
+	}
+}
+
+func TestContextAndTimeout(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	// every attempt times out and is retried
+	c := Client{Client: http.DefaultClient, Timeout: 20 * time.Millisecond, Retry: &Backoff{MaxRetries: 2}}
+	err := c.Call(nil, nil, srv.URL)
+	if err == nil || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expect 3 timed out calls, got %d %v", atomic.LoadInt32(&calls), err)
+	}
+
+	// a canceled call is not retried
+	atomic.StoreInt32(&calls, 0)
+	c.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = c.CallCtx(ctx, nil, nil, srv.URL)
+	if !errors.Is(err, context.DeadlineExceeded) || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expect the call to stop with ctx, got %d %v", atomic.LoadInt32(&calls), err)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	policy := &Backoff{MaxRetries: 5}
+
+	calls := 0
+	err := WithRetry(context.Background(), policy, func() error {
+		calls++
+		if calls < 3 {
+			return &ErrorInfo{Code: 579}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expect success after 3 calls, got %d %v", calls, err)
+	}
+
+	calls = 0
+	err = WithRetry(context.Background(), policy, func() error {
+		calls++
+		return &ErrorInfo{Code: 612}
+	})
+	if e, ok := err.(*ErrorInfo); !ok || e.Code != 612 || calls != 1 {
+		t.Fatalf("expect no retry for 612, got %d %v", calls, err)
+	}
+}
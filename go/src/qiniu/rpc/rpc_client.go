@@ -2,12 +2,15 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 var UserAgent = "Golang qiniu/rpc package"
@@ -17,16 +20,18 @@ var UserAgent = "Golang qiniu/rpc package"
 type Client struct {
 	*http.Client
 	BindRemoteIp string
+	Timeout      time.Duration // 可选。单次请求的超时时间，为 0 表示不限制
+	Retry        RetryPolicy   // 可选。重试策略，为 nil 表示不重试
 }
 
-var DefaultClient = Client{http.DefaultClient, ""}
+var DefaultClient = Client{Client: http.DefaultClient}
 
 func NewClient(bindRemoteIp string) Client {
-	return Client{http.DefaultClient, bindRemoteIp}
+	return Client{Client: http.DefaultClient, BindRemoteIp: bindRemoteIp}
 }
 
 func NewClientEx(t http.RoundTripper, bindRemoteIp string) Client {
-	return Client{&http.Client{Transport: t}, bindRemoteIp}
+	return Client{Client: &http.Client{Transport: t}, BindRemoteIp: bindRemoteIp}
 }
 
 // --------------------------------------------------------------------
@@ -39,56 +44,112 @@ type Logger interface {
 // --------------------------------------------------------------------
 
 func (r Client) Get(l Logger, url string) (resp *http.Response, err error) {
+	return r.GetCtx(context.Background(), l, url)
+}
+
+func (r Client) GetCtx(ctx context.Context, l Logger, url string) (resp *http.Response, err error) {
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
-	return r.Do(l, req)
+	return r.DoCtx(ctx, l, req)
 }
 
 func (r Client) PostWith(
 	l Logger, url1 string, bodyType string, body io.Reader, bodyLength int) (resp *http.Response, err error) {
 
-	req, err := http.NewRequest("POST", url1, body)
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", bodyType)
-	req.ContentLength = int64(bodyLength)
-	return r.Do(l, req)
+	return r.PostWith64Ctx(context.Background(), l, url1, bodyType, body, int64(bodyLength))
 }
 
 func (r Client) PostWith64(
 	l Logger, url1 string, bodyType string, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
 
-	req, err := http.NewRequest("POST", url1, body)
+	return r.PostWith64Ctx(context.Background(), l, url1, bodyType, body, bodyLength)
+}
+
+func (r Client) PostWithCtx(ctx context.Context,
+	l Logger, url1 string, bodyType string, body io.Reader, bodyLength int) (resp *http.Response, err error) {
+
+	return r.PostWith64Ctx(ctx, l, url1, bodyType, body, int64(bodyLength))
+}
+
+func (r Client) PostWith64Ctx(ctx context.Context,
+	l Logger, url1 string, bodyType string, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
+
+	return r.RequestWithCtx(ctx, l, "POST", url1, bodyType, body, bodyLength)
+}
+
+// RequestWithCtx sends a request of any method with the body
+func (r Client) RequestWithCtx(ctx context.Context,
+	l Logger, method, url1 string, bodyType string, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
+
+	header := http.Header{}
+	if bodyType != "" {
+		header.Set("Content-Type", bodyType)
+	}
+	return r.RequestWithHeaderCtx(ctx, l, method, url1, header, body, bodyLength)
+}
+
+// RequestWithHeaderCtx sends the request with the header, like the Content-Type and the Content-MD5 of the body
+func (r Client) RequestWithHeaderCtx(ctx context.Context,
+	l Logger, method, url1 string, header http.Header, body io.Reader, bodyLength int64) (resp *http.Response, err error) {
+
+	req, err := http.NewRequest(method, url1, body)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", bodyType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.ContentLength = bodyLength
-	return r.Do(l, req)
+	if req.GetBody == nil && body != nil {
+		// send a rewindable copy, the transport closes the body it is given
+		if getBody := rewinder(body, bodyLength); getBody != nil {
+			req.GetBody = getBody
+			req.Body, _ = getBody()
+		}
+	}
+	return r.DoCtx(ctx, l, req)
 }
 
 func (r Client) PostWithForm(
 	l Logger, url1 string, data map[string][]string) (resp *http.Response, err error) {
 
+	return r.PostWithFormCtx(context.Background(), l, url1, data)
+}
+
+func (r Client) PostWithFormCtx(ctx context.Context,
+	l Logger, url1 string, data map[string][]string) (resp *http.Response, err error) {
+
 	msg := url.Values(data).Encode()
-	return r.PostWith(l, url1, "application/x-www-form-urlencoded", strings.NewReader(msg), len(msg))
+	return r.PostWithCtx(ctx, l, url1, "application/x-www-form-urlencoded", strings.NewReader(msg), len(msg))
 }
 
 func (r Client) PostWithJson(
 	l Logger, url1 string, data interface{}) (resp *http.Response, err error) {
 
+	return r.PostWithJsonCtx(context.Background(), l, url1, data)
+}
+
+func (r Client) PostWithJsonCtx(ctx context.Context,
+	l Logger, url1 string, data interface{}) (resp *http.Response, err error) {
+
 	msg, err := json.Marshal(data)
 	if err != nil {
 		return
 	}
-	return r.PostWith(l, url1, "application/json", bytes.NewReader(msg), len(msg))
+	return r.PostWithCtx(ctx, l, url1, "application/json", bytes.NewReader(msg), len(msg))
 }
 
 func (r Client) Do(l Logger, req *http.Request) (resp *http.Response, err error) {
+	return r.DoCtx(context.Background(), l, req)
+}
+
+// DoCtx sends the request, it stops waiting when ctx is done.
+// If r.Retry is set, the request is sent again as long as the policy allows it,
+// a request with a body is only retried when its body can be rewound (req.GetBody).
+func (r Client) DoCtx(ctx context.Context, l Logger, req *http.Request) (resp *http.Response, err error) {
 	//check bind remote ip
 	if r.BindRemoteIp != "" {
 		oldReqUrl := req.URL.String()
@@ -106,7 +167,35 @@ func (r Client) Do(l Logger, req *http.Request) (resp *http.Response, err error)
 	}
 
 	req.Header.Set("User-Agent", UserAgent)
-	resp, err = r.Client.Do(req)
+
+	for attempt := 1; ; attempt++ {
+		resp, err = r.do(ctx, req)
+		if r.Retry == nil || ctx.Err() != nil {
+			break
+		}
+		if req.Body != nil && req.GetBody == nil {
+			break
+		}
+		delay, retry := r.Retry.Retry(attempt, resp, err)
+		if !retry {
+			break
+		}
+		CountRetry()
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err = sleepCtx(ctx, delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, bErr := req.GetBody()
+			if bErr != nil {
+				return nil, bErr
+			}
+			req.Body = body
+		}
+	}
 	if err != nil {
 		return
 	}
@@ -120,6 +209,34 @@ func (r Client) Do(l Logger, req *http.Request) (resp *http.Response, err error)
 	return
 }
 
+// do sends the request once, the timeout of the client ends when the response body is closed
+func (r Client) do(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+
+	if r.Timeout <= 0 {
+		return r.Client.Do(req.WithContext(ctx))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	resp, err = r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 // --------------------------------------------------------------------
 
 type ErrorInfo struct {
@@ -178,8 +295,13 @@ func callRet(l Logger, ret interface{}, resp *http.Response) (err error) {
 }
 
 func (r Client) CallWithForm(l Logger, ret interface{}, url1 string, param map[string][]string) (err error) {
+	return r.CallWithFormCtx(context.Background(), l, ret, url1, param)
+}
+
+func (r Client) CallWithFormCtx(ctx context.Context,
+	l Logger, ret interface{}, url1 string, param map[string][]string) (err error) {
 
-	resp, err := r.PostWithForm(l, url1, param)
+	resp, err := r.PostWithFormCtx(ctx, l, url1, param)
 	if err != nil {
 		return err
 	}
@@ -187,8 +309,13 @@ func (r Client) CallWithForm(l Logger, ret interface{}, url1 string, param map[s
 }
 
 func (r Client) CallWithJson(l Logger, ret interface{}, url1 string, param interface{}) (err error) {
+	return r.CallWithJsonCtx(context.Background(), l, ret, url1, param)
+}
+
+func (r Client) CallWithJsonCtx(ctx context.Context,
+	l Logger, ret interface{}, url1 string, param interface{}) (err error) {
 
-	resp, err := r.PostWithJson(l, url1, param)
+	resp, err := r.PostWithJsonCtx(ctx, l, url1, param)
 	if err != nil {
 		return err
 	}
@@ -198,17 +325,45 @@ func (r Client) CallWithJson(l Logger, ret interface{}, url1 string, param inter
 func (r Client) CallWith(
 	l Logger, ret interface{}, url1 string, bodyType string, body io.Reader, bodyLength int) (err error) {
 
-	resp, err := r.PostWith(l, url1, bodyType, body, bodyLength)
+	return r.CallWith64Ctx(context.Background(), l, ret, url1, bodyType, body, int64(bodyLength))
+}
+
+func (r Client) CallWith64(
+	l Logger, ret interface{}, url1 string, bodyType string, body io.Reader, bodyLength int64) (err error) {
+
+	return r.CallWith64Ctx(context.Background(), l, ret, url1, bodyType, body, bodyLength)
+}
+
+func (r Client) CallWithCtx(ctx context.Context,
+	l Logger, ret interface{}, url1 string, bodyType string, body io.Reader, bodyLength int) (err error) {
+
+	return r.CallWith64Ctx(ctx, l, ret, url1, bodyType, body, int64(bodyLength))
+}
+
+func (r Client) CallWith64Ctx(ctx context.Context,
+	l Logger, ret interface{}, url1 string, bodyType string, body io.Reader, bodyLength int64) (err error) {
+
+	resp, err := r.PostWith64Ctx(ctx, l, url1, bodyType, body, bodyLength)
 	if err != nil {
 		return err
 	}
 	return callRet(l, ret, resp)
 }
 
-func (r Client) CallWith64(
-	l Logger, ret interface{}, url1 string, bodyType string, body io.Reader, bodyLength int64) (err error) {
+func (r Client) CallWithMethodCtx(ctx context.Context,
+	l Logger, ret interface{}, method, url1 string, bodyType string, body io.Reader, bodyLength int64) (err error) {
 
-	resp, err := r.PostWith64(l, url1, bodyType, body, bodyLength)
+	resp, err := r.RequestWithCtx(ctx, l, method, url1, bodyType, body, bodyLength)
+	if err != nil {
+		return err
+	}
+	return callRet(l, ret, resp)
+}
+
+func (r Client) CallWithHeaderCtx(ctx context.Context,
+	l Logger, ret interface{}, method, url1 string, header http.Header, body io.Reader, bodyLength int64) (err error) {
+
+	resp, err := r.RequestWithHeaderCtx(ctx, l, method, url1, header, body, bodyLength)
 	if err != nil {
 		return err
 	}
@@ -218,7 +373,13 @@ func (r Client) CallWith64(
 func (r Client) Call(
 	l Logger, ret interface{}, url1 string) (err error) {
 
-	resp, err := r.PostWith(l, url1, "application/x-www-form-urlencoded", nil, 0)
+	return r.CallCtx(context.Background(), l, ret, url1)
+}
+
+func (r Client) CallCtx(ctx context.Context,
+	l Logger, ret interface{}, url1 string) (err error) {
+
+	resp, err := r.PostWithCtx(ctx, l, url1, "application/x-www-form-urlencoded", nil, 0)
 	if err != nil {
 		return err
 	}